@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultAliveWindow is how recent a task's last event must be for `alive`
+// to call it alive when --within isn't given: three heartbeat intervals, so
+// that one late or lost heartbeat isn't mistaken for a hang.
+const DefaultAliveWindow = 3 * HeartbeatInterval
+
+// parseAliveArgs parses `alive` arguments of the form:
+//
+//	--task-name NAME [--within DURATION]
+func parseAliveArgs(args []string) (string, time.Duration, error) {
+	var taskName string
+	within := DefaultAliveWindow
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--task-name":
+			if i+1 >= len(args) {
+				return "", 0, fmt.Errorf("--task-name requires an argument")
+			}
+			taskName = args[i+1]
+			i++
+		case "--within":
+			if i+1 >= len(args) {
+				return "", 0, fmt.Errorf("--within requires an argument")
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d <= 0 {
+				return "", 0, fmt.Errorf("invalid --within %q: must be a positive duration such as 15s or 1m", args[i+1])
+			}
+			within = d
+			i++
+		default:
+			return "", 0, fmt.Errorf("unexpected argument %q\nUsage: bgx alive --task-name NAME [--within DURATION]", args[i])
+		}
+	}
+	if taskName == "" {
+		return "", 0, fmt.Errorf("--task-name is required")
+	}
+	return taskName, within, nil
+}
+
+// runAlive is a liveness probe for health checks: it exits 0 if the task is
+// running and recorded an event within the window, and 1 if it has exited,
+// hasn't started its command, or has gone quiet. It prints one line saying
+// which. A task forked with --no-heartbeat records nothing while it runs
+// quietly, so for it only the exit event counts.
+func runAlive(args []string) (int, error) {
+	taskName, within, err := parseAliveArgs(args)
+	if err != nil {
+		return 1, err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return 1, err
+	}
+	defer db.Close()
+
+	exists, err := taskExists(db, taskName)
+	if err != nil {
+		return 1, fmt.Errorf("failed to look up task: %w", err)
+	}
+	if !exists {
+		return 1, fmt.Errorf("task %q not found (BGX_DB=%s)", taskName, getDBPath())
+	}
+
+	// The summary's queries walk back from the newest event, so this stays
+	// cheap however long the task's log is.
+	s, err := readTaskSummary(db, taskName)
+	if err != nil {
+		return 1, fmt.Errorf("failed to read task %q: %w", taskName, err)
+	}
+	quiet := time.Since(s.LastEventTime).Round(time.Second)
+	// A --heartbeat-adaptive task says when to expect its next heartbeat,
+	// which may be well past the usual interval.
+	window := stallTimeout(within, s.HeartbeatInterval)
+	switch {
+	case !s.Started:
+		fmt.Printf("%s: not alive: its command hasn't started\n", taskName)
+	case s.Exited:
+		fmt.Printf("%s: not alive: exited (code %d)\n", taskName, s.ExitCode)
+	case s.NoHeartbeat:
+		fmt.Printf("%s: alive: no exit recorded (forked with --no-heartbeat, so a hang can't be seen)\n", taskName)
+		return 0, nil
+	case quiet > window && window != within:
+		fmt.Printf("%s: not alive: no events for %s (no heartbeat within %s: adaptive interval)\n", taskName, quiet, window)
+	case quiet > window:
+		fmt.Printf("%s: not alive: no events for %s (--within %s)\n", taskName, quiet, window)
+	default:
+		fmt.Printf("%s: alive: last event %s ago\n", taskName, quiet)
+		return 0, nil
+	}
+	return 1, nil
+}
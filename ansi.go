@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+)
+
+// ansiStripper removes ANSI escape sequences from a stream of output for
+// --strip-ansi: CSI sequences such as colors and cursor movement
+// ("\x1b[1;31m"), OSC and other string sequences such as window titles and
+// hyperlinks ("\x1b]0;title\x07"), and two-byte escapes ("\x1b7"). It keeps
+// its state between calls, so a sequence split across two events of the
+// same stream is still removed whole.
+//
+// A newline always survives: it ends an unterminated sequence rather than
+// being swallowed by it, so a stray ESC can't eat the rest of the output.
+type ansiStripper struct {
+	state  ansiState
+	params []byte // of the CSI sequence in progress
+}
+
+type ansiState int
+
+const (
+	ansiText     ansiState = iota // plain output
+	ansiEscape                    // after ESC
+	ansiCSI                       // after ESC [, up to a final byte
+	ansiString                    // after ESC ] (or P, X, ^, _), up to BEL or ST
+	ansiStringST                  // after an ESC inside a string sequence
+	ansiNF                        // after ESC and intermediate bytes, up to a final byte
+)
+
+// strip returns s without the escape sequences in it, or in progress at its
+// start or end.
+func (a *ansiStripper) strip(s string) string {
+	if a.state == ansiText && !strings.ContainsRune(s, '\x1b') {
+		return s
+	}
+	var b strings.Builder
+	a.scan(s, func(text string) { b.WriteString(text) }, nil)
+	return b.String()
+}
+
+// scan splits s into the text between escape sequences, passed to text in
+// order, and the parameters of each complete SGR sequence ("\x1b[1;31m"
+// gives "1;31"), passed to sgr if it is non-nil. Every other sequence is
+// dropped.
+func (a *ansiStripper) scan(s string, text func(string), sgr func(params string)) {
+	start := 0 // of the plain text not yet passed on
+	flush := func(end int) {
+		if end > start {
+			text(s[start:end])
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if a.state == ansiText {
+			if c == '\x1b' {
+				flush(i)
+				a.state = ansiEscape
+			}
+			continue
+		}
+		start = i + 1
+		if c == '\n' {
+			a.state = ansiText
+			start = i // the newline is text
+			continue
+		}
+		switch a.state {
+		case ansiEscape:
+			switch {
+			case c == '[':
+				a.state = ansiCSI
+				a.params = a.params[:0]
+			case c == ']' || c == 'P' || c == 'X' || c == '^' || c == '_':
+				a.state = ansiString
+			case c >= 0x20 && c <= 0x2f:
+				a.state = ansiNF
+			case c >= 0x30 && c <= 0x7e:
+				a.state = ansiText
+			case c == '\x1b':
+				// A repeated ESC starts over.
+			default:
+				a.state = ansiText
+				start = i
+			}
+		case ansiCSI, ansiNF:
+			switch {
+			case c >= 0x40 && c <= 0x7e && a.state == ansiCSI:
+				a.state = ansiText
+				if c == 'm' && sgr != nil {
+					sgr(string(a.params))
+				}
+			case c >= 0x30 && c <= 0x7e && a.state == ansiNF:
+				a.state = ansiText
+			case c >= 0x20 && c <= 0x3f:
+				// parameter and intermediate bytes
+				if a.state == ansiCSI {
+					a.params = append(a.params, c)
+				}
+			default:
+				a.state = ansiText
+				start = i
+			}
+		case ansiString:
+			switch c {
+			case '\x07':
+				a.state = ansiText
+			case '\x1b':
+				a.state = ansiStringST
+			}
+		case ansiStringST:
+			if c == '\\' {
+				a.state = ansiText
+			} else if c != '\x1b' {
+				a.state = ansiString
+			}
+		}
+	}
+	if a.state == ansiText {
+		flush(len(s))
+	}
+}
+
+// ansiHTML converts a stream of output to HTML for `export --format html`:
+// text is escaped, SGR sequences (colors, bold and the like) become styled
+// spans, and every other escape sequence is removed. Like ansiStripper, it
+// keeps its state between calls, so a color set on one line carries on to
+// the next until it is reset.
+type ansiHTML struct {
+	scanner ansiStripper
+	style   sgrStyle
+}
+
+// convert returns s as HTML.
+func (h *ansiHTML) convert(s string) string {
+	var b strings.Builder
+	h.scanner.scan(s, func(text string) {
+		if css := h.style.css(); css != "" {
+			fmt.Fprintf(&b, `<span style="%s">%s</span>`, css, html.EscapeString(text))
+		} else {
+			b.WriteString(html.EscapeString(text))
+		}
+	}, h.style.apply)
+	return b.String()
+}
+
+// sgrStyle is the text style that SGR sequences have set. fg and bg are CSS
+// colors ("": the default).
+type sgrStyle struct {
+	fg, bg                       string
+	bold, dim, italic, underline bool
+}
+
+// ansiPalette holds the 16 standard terminal colors, as xterm shows them.
+var ansiPalette = [16]string{
+	"#000000", "#cd0000", "#00cd00", "#cdcd00", "#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+	"#7f7f7f", "#ff0000", "#00ff00", "#ffff00", "#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+}
+
+// apply updates the style for the parameters of an SGR sequence, such as
+// "1;31" or "38;5;208". Codes it doesn't know are ignored.
+func (st *sgrStyle) apply(params string) {
+	codes := strings.Split(params, ";")
+	for i := 0; i < len(codes); i++ {
+		n, _ := strconv.Atoi(codes[i]) // an empty code means 0
+		switch {
+		case n == 0:
+			*st = sgrStyle{}
+		case n == 1:
+			st.bold = true
+		case n == 2:
+			st.dim = true
+		case n == 3:
+			st.italic = true
+		case n == 4:
+			st.underline = true
+		case n == 22:
+			st.bold, st.dim = false, false
+		case n == 23:
+			st.italic = false
+		case n == 24:
+			st.underline = false
+		case n >= 30 && n <= 37:
+			st.fg = ansiPalette[n-30]
+		case n >= 90 && n <= 97:
+			st.fg = ansiPalette[n-90+8]
+		case n == 39:
+			st.fg = ""
+		case n >= 40 && n <= 47:
+			st.bg = ansiPalette[n-40]
+		case n >= 100 && n <= 107:
+			st.bg = ansiPalette[n-100+8]
+		case n == 49:
+			st.bg = ""
+		case n == 38 || n == 48:
+			color, used := extendedColor(codes[i+1:])
+			i += used
+			if n == 38 {
+				st.fg = color
+			} else {
+				st.bg = color
+			}
+		}
+	}
+}
+
+// extendedColor decodes the arguments of a 38 or 48 SGR code: "5;N" for one
+// of 256 colors, or "2;R;G;B". It returns the CSS color ("" if malformed)
+// and how many of codes it used.
+func extendedColor(codes []string) (string, int) {
+	arg := func(i int) int {
+		if i >= len(codes) {
+			return -1
+		}
+		n, err := strconv.Atoi(codes[i])
+		if err != nil || n > 255 {
+			return -1
+		}
+		return n
+	}
+	switch arg(0) {
+	case 5:
+		n := arg(1)
+		switch {
+		case n < 0:
+			return "", min(len(codes), 2)
+		case n < 16:
+			return ansiPalette[n], 2
+		case n < 232:
+			n -= 16
+			level := func(v int) int {
+				if v == 0 {
+					return 0
+				}
+				return 55 + 40*v
+			}
+			return fmt.Sprintf("#%02x%02x%02x", level(n/36), level(n/6%6), level(n%6)), 2
+		default:
+			gray := 8 + 10*(n-232)
+			return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray), 2
+		}
+	case 2:
+		r, g, b := arg(1), arg(2), arg(3)
+		if r < 0 || g < 0 || b < 0 {
+			return "", min(len(codes), 4)
+		}
+		return fmt.Sprintf("#%02x%02x%02x", r, g, b), 4
+	}
+	return "", min(len(codes), 1)
+}
+
+// css renders the style as an inline CSS declaration list, or "" for the
+// default style.
+func (st sgrStyle) css() string {
+	var decls []string
+	if st.fg != "" {
+		decls = append(decls, "color:"+st.fg)
+	}
+	if st.bg != "" {
+		decls = append(decls, "background:"+st.bg)
+	}
+	if st.bold {
+		decls = append(decls, "font-weight:bold")
+	}
+	if st.dim {
+		decls = append(decls, "opacity:0.7")
+	}
+	if st.italic {
+		decls = append(decls, "font-style:italic")
+	}
+	if st.underline {
+		decls = append(decls, "text-decoration:underline")
+	}
+	return strings.Join(decls, ";")
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+// TestANSIStripper verifies escape sequences are removed however the output
+// is split between calls, while text, newlines and UTF-8 are kept.
+func TestANSIStripper(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"plain\n", "plain\n"},
+		{"\x1b[1;31merror\x1b[0m: failed\n", "error: failed\n"},
+		{"\x1b[2K\x1b[1Gprogress 50%\r\n", "progress 50%\r\n"},
+		{"\x1b]0;title\x07text\n", "text\n"},
+		{"\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\\n", "link\n"},
+		{"\x1b7saved\x1b8\x1b(B\n", "saved\n"},
+		{"héllo \x1b[32m✓\x1b[m\n", "héllo ✓\n"},
+		{"stray \x1b[\nnext\n", "stray \nnext\n"},
+		{"\x1b]unterminated\nkept\n", "\nkept\n"},
+	} {
+		var whole ansiStripper
+		if got := whole.strip(tc.in); got != tc.want {
+			t.Errorf("strip(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+		for cut := 1; cut < len(tc.in); cut++ {
+			var split ansiStripper
+			if got := split.strip(tc.in[:cut]) + split.strip(tc.in[cut:]); got != tc.want {
+				t.Errorf("strip(%q) split at %d = %q, want %q", tc.in, cut, got, tc.want)
+			}
+		}
+	}
+}
+
+// TestANSIHTML verifies SGR sequences become inline styles that carry over
+// between calls until reset, that text is escaped, and that other sequences
+// are dropped.
+func TestANSIHTML(t *testing.T) {
+	var h ansiHTML
+	for _, tc := range []struct{ in, want string }{
+		{"a<b> & c\n", "a&lt;b&gt; &amp; c\n"},
+		{"\x1b[1;32mok", `<span style="color:#00cd00;font-weight:bold">ok</span>`},
+		{" still\n", `<span style="color:#00cd00;font-weight:bold"> still` + "\n</span>"},
+		{"\x1b[22m\x1b[2Kgreen\x1b[m plain", `<span style="color:#00cd00">green</span> plain`},
+		{"\x1b[38;5;208mx\x1b[48;2;1;2;3my\x1b[0m", `<span style="color:#ff8700">x</span><span style="color:#ff8700;background:#010203">y</span>`},
+		{"\x1b[38;5;244;4mz\x1b[0m", `<span style="color:#808080;text-decoration:underline">z</span>`},
+	} {
+		if got := h.convert(tc.in); got != tc.want {
+			t.Errorf("convert(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+)
+
+// recordAccess adds an access event to a task's log for --audit, saying who
+// ran which bgx command against it, such as "join by alice". It goes through
+// the database like every other write, so it can't corrupt a log the daemon
+// is still writing; it simply lands between two of the daemon's events.
+func recordAccess(db *sql.DB, taskName, action string) error {
+	if err := insertEvent(db, taskName, Event{
+		Type: EventTypeAccess,
+		Time: time.Now(),
+		Data: fmt.Sprintf("%s by %s", action, currentUser()),
+	}); err != nil {
+		return fmt.Errorf("failed to record access event: %w", err)
+	}
+	return nil
+}
+
+// currentUser names the user running bgx: $USER if set, else the account
+// the process runs as, else "unknown".
+func currentUser() string {
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return "unknown"
+}
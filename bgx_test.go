@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	_ "modernc.org/sqlite"
 )
@@ -35,7 +44,7 @@ func readEvents(t *testing.T, dbPath, taskName string) []Event {
 	defer db.Close()
 
 	rows, err := db.Query(
-		"SELECT type, data, code, cpu_seconds, mem_bytes FROM events WHERE task = ? ORDER BY id", taskName)
+		"SELECT type, data, code, cpu_seconds, mem_bytes, read_bytes, write_bytes, mem_metric, uid, gid, interval_seconds FROM events WHERE task = ? ORDER BY id", taskName)
 	if err != nil {
 		t.Fatalf("Failed to query events: %v", err)
 	}
@@ -44,7 +53,7 @@ func readEvents(t *testing.T, dbPath, taskName string) []Event {
 	var events []Event
 	for rows.Next() {
 		var e Event
-		if err := rows.Scan(&e.Type, &e.Data, &e.Code, &e.CPUSeconds, &e.MemBytes); err != nil {
+		if err := rows.Scan(&e.Type, &e.Data, &e.Code, &e.CPUSeconds, &e.MemBytes, &e.ReadBytes, &e.WriteBytes, &e.MemMetric, &e.UID, &e.GID, &e.IntervalSeconds); err != nil {
 			t.Fatalf("Failed to scan event: %v", err)
 		}
 		events = append(events, e)
@@ -52,6 +61,25 @@ func readEvents(t *testing.T, dbPath, taskName string) []Event {
 	return events
 }
 
+// seedTask records a task with the given events directly in the test
+// database, for fixtures whose timestamps are fixed rather than live.
+func seedTask(t *testing.T, taskName string, events ...Event) {
+	t.Helper()
+	db, err := openDB()
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	if err := registerTask(db, taskName); err != nil {
+		t.Fatalf("Failed to register %s: %v", taskName, err)
+	}
+	for _, e := range events {
+		if err := insertEvent(db, taskName, e); err != nil {
+			t.Fatalf("Failed to insert %s event: %v", e.Type, err)
+		}
+	}
+}
+
 func TestNamedTaskMode(t *testing.T) {
 	setupDB(t)
 	taskName := "test_task"
@@ -232,14 +260,36 @@ func TestNonExistentTask(t *testing.T) {
 }
 
 func TestFailedCommand(t *testing.T) {
-	setupDB(t)
+	dbPath := setupDB(t)
 	taskName := "failed_command"
 
-	// A command that cannot start should surface a clear error via join,
-	// not hang until the heartbeat timeout.
-	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "this-command-does-not-exist")
+	// A command that doesn't exist is refused before the name is claimed or
+	// a daemon log created.
+	for _, sub := range []string{"fork", "exec"} {
+		output, err := exec.Command(bgxPath, sub, "--task-name", taskName, "--", "this-command-does-not-exist").CombinedOutput()
+		if err == nil || !strings.Contains(string(output), "command not found") {
+			t.Errorf("%s of a missing command = %v, %s; want a command not found error", sub, err, output)
+		}
+		if strings.Contains(string(output), "Started task") {
+			t.Errorf("%s should not have started the task, got: %s", sub, output)
+		}
+	}
+	if output, err := exec.Command(bgxPath, "status", "--task-name", taskName).CombinedOutput(); err == nil {
+		t.Errorf("The name should not have been claimed, status says: %s", output)
+	}
+	if _, err := os.Stat(filepath.Join(dbPath+"-daemon", taskName+".log")); !os.IsNotExist(err) {
+		t.Errorf("No daemon log should be created, stat: %v", err)
+	}
+
+	// A command that is found but cannot start should surface a clear error
+	// via join, not hang until the heartbeat timeout.
+	bogus := filepath.Join(t.TempDir(), "not-a-program")
+	if err := os.WriteFile(bogus, []byte{0, 1, 2, 3}, 0755); err != nil {
+		t.Fatal(err)
+	}
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", bogus)
 	if err := forkCmd.Run(); err != nil {
-		t.Fatalf("Fork (parent) should succeed even if the command is invalid: %v", err)
+		t.Fatalf("Fork (parent) should succeed even if the command can't start: %v", err)
 	}
 
 	start := time.Now()
@@ -351,6 +401,448 @@ func TestLongOutputLine(t *testing.T) {
 	}
 }
 
+// TestMaxEventBytes verifies that a line longer than --max-event-bytes is
+// recorded as several events that join reassembles exactly.
+func TestMaxEventBytes(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "chunked"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--max-event-bytes", "1000", "--", "sh", "-c",
+		"head -c 2500 /dev/zero | tr '\\0' 'x'; echo; echo short")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	var stdout strings.Builder
+	joinCmd := exec.Command(bgxPath, "join", "--task-name", taskName)
+	joinCmd.Stdout = &stdout
+	if err := joinCmd.Run(); err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	if want := strings.Repeat("x", 2500) + "\nshort\n"; stdout.String() != want {
+		t.Errorf("Join should reassemble the output exactly, got %d bytes: %.40q...", stdout.Len(), stdout.String())
+	}
+
+	var sizes []int
+	for _, e := range readEvents(t, dbPath, taskName) {
+		if e.Type == EventTypeStdout {
+			sizes = append(sizes, len(e.Data))
+		}
+	}
+	if fmt.Sprint(sizes) != "[1000 1000 501 6]" {
+		t.Errorf("stdout event sizes = %v, want [1000 1000 501 6]", sizes)
+	}
+}
+
+// TestMaxEventBytesUTF8 verifies a line split into several events is split
+// between characters, so that each event is valid UTF-8 on its own.
+func TestMaxEventBytesUTF8(t *testing.T) {
+	dbPath := setupDB(t)
+	line := strings.Repeat("€", 700) + "\n" // 3 bytes each, so 1000 would split one
+	if output, err := exec.Command(bgxPath, "exec", "--task-name", "euros", "--max-event-bytes", "1000", "--", "printf", "%s", line).CombinedOutput(); err != nil {
+		t.Fatalf("Exec failed: %v, output: %s", err, output)
+	}
+	joined, err := exec.Command(bgxPath, "join", "--task-name", "euros").Output()
+	if err != nil || string(joined) != line {
+		t.Errorf("Join should reassemble the output exactly, got %v, %d bytes", err, len(joined))
+	}
+	var sizes []int
+	for _, e := range readEvents(t, dbPath, "euros") {
+		if e.Type == EventTypeStdout {
+			sizes = append(sizes, len(e.Data))
+			if !utf8.ValidString(e.Data) || len(e.Data) > 1000 {
+				t.Errorf("stdout event of %d bytes isn't valid UTF-8 of at most 1000 bytes", len(e.Data))
+			}
+		}
+	}
+	if len(sizes) != 3 {
+		t.Errorf("stdout event sizes = %v, want 3 events", sizes)
+	}
+}
+
+// TestForkDelimiter verifies --delimiter records one event per NUL-terminated
+// record, and that join replays them unchanged.
+func TestForkDelimiter(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "nul"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--delimiter", `\0`, "--", "sh", "-c",
+		`printf '{"a":1}\0{"b":"x\\ny"}\0'`)
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	stdout, err := exec.Command(bgxPath, "join", "--task-name", taskName).Output()
+	if err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	want := `{"a":1}` + "\x00" + `{"b":"x\ny"}` + "\x00"
+	if string(stdout) != want {
+		t.Errorf("Join = %q, want %q", stdout, want)
+	}
+
+	var records []string
+	for _, e := range readEvents(t, dbPath, taskName) {
+		if e.Type == EventTypeStdout {
+			var v map[string]any
+			if err := json.Unmarshal([]byte(strings.TrimSuffix(e.Data, "\x00")), &v); err != nil {
+				t.Errorf("stdout event %q is not one NDJSON record: %v", e.Data, err)
+			}
+			records = append(records, e.Data)
+		}
+	}
+	if len(records) != 2 {
+		t.Errorf("Expected one stdout event per record, got %q", records)
+	}
+
+	output, err := exec.Command(bgxPath, "fork", "--task-name", "bad", "--delimiter", "ab", "--", "true").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "--delimiter") {
+		t.Errorf("A multi-byte --delimiter should be rejected, got: %s", output)
+	}
+}
+
+// TestMaxEvents verifies a task is killed once it reaches --max-events, with a
+// limit-exceeded event before its exit event that join reports.
+func TestMaxEvents(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "runaway"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--max-events", "50", "--", "yes")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	var stdout, stderr strings.Builder
+	joinCmd := exec.Command(bgxPath, "join", "--task-name", taskName)
+	joinCmd.Stdout = &stdout
+	joinCmd.Stderr = &stderr
+	if got := exitCodeOf(t, joinCmd.Run()); got == 0 {
+		t.Errorf("Join should fail for a killed task, got exit code 0")
+	}
+	if want := strings.Repeat("y\n", 50); stdout.String() != want {
+		t.Errorf("Join should replay exactly 50 lines, got %d bytes", stdout.Len())
+	}
+	if !strings.Contains(stderr.String(), "--max-events 50") {
+		t.Errorf("Join should report the limit, got stderr: %q", stderr.String())
+	}
+
+	var types []string
+	for _, e := range readEvents(t, dbPath, taskName) {
+		types = append(types, e.Type)
+	}
+	if n := len(types); n < 2 || types[n-2] != EventTypeLimitExceeded || types[n-1] != EventTypeExit {
+		t.Errorf("Log should end with limit-exceeded then exit, got %v", types)
+	}
+}
+
+// TestMaxTotalBytes verifies output stops being recorded at
+// --max-total-bytes, with a truncated event that join reports, while the
+// command runs to completion and its exit is recorded.
+func TestMaxTotalBytes(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "verbose"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--max-total-bytes", "1001", "--", "sh", "-c", "yes | head -n 5000")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	var stdout, stderr strings.Builder
+	joinCmd := exec.Command(bgxPath, "join", "--task-name", taskName)
+	joinCmd.Stdout = &stdout
+	joinCmd.Stderr = &stderr
+	if got := exitCodeOf(t, joinCmd.Run()); got != 0 {
+		t.Errorf("Join should return the command's exit code 0, got %d (stderr: %q)", got, stderr.String())
+	}
+	if want := strings.Repeat("y\n", 500); stdout.String() != want {
+		t.Errorf("Join should replay exactly 500 lines (1000 bytes), got %d bytes", stdout.Len())
+	}
+	if !strings.Contains(stderr.String(), "after 1000 bytes (--max-total-bytes 1001)") {
+		t.Errorf("Join should report the truncation, got stderr: %q", stderr.String())
+	}
+
+	var types []string
+	for _, e := range readEvents(t, dbPath, taskName) {
+		if e.Type != EventTypeHeartbeat {
+			types = append(types, e.Type)
+		}
+	}
+	if n := len(types); n != 503 || types[n-2] != EventTypeTruncated || types[n-1] != EventTypeExit {
+		t.Errorf("Log should be start, 500 lines, truncated and exit, got %d events ending %v", n, types[max(0, n-3):])
+	}
+
+	status, err := exec.Command(bgxPath, "status", "--task-name", taskName, "--json").Output()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if !strings.Contains(string(status), `"stdout_bytes":10000,`) {
+		t.Errorf("Exit event should count all 10000 bytes written, got status: %s", status)
+	}
+}
+
+// TestIdleTimeout verifies a task that stops writing output is killed once
+// --idle-timeout passes, with an idle-timeout event before its exit event.
+func TestIdleTimeout(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "hung"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--idle-timeout", "500ms", "--", "sh", "-c", "echo working; exec sleep 30")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	start := time.Now()
+	var stdout, stderr strings.Builder
+	joinCmd := exec.Command(bgxPath, "join", "--task-name", taskName)
+	joinCmd.Stdout = &stdout
+	joinCmd.Stderr = &stderr
+	if got := exitCodeOf(t, joinCmd.Run()); got == 0 {
+		t.Errorf("Join should fail for a killed task, got exit code 0")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Task should be killed soon after going idle, took %s", elapsed)
+	}
+	if stdout.String() != "working\n" {
+		t.Errorf("stdout = %q, want the output before it went idle", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "--idle-timeout") {
+		t.Errorf("Join should report the idle timeout, got stderr: %q", stderr.String())
+	}
+
+	var types []string
+	for _, e := range readEvents(t, dbPath, taskName) {
+		types = append(types, e.Type)
+	}
+	if n := len(types); n < 2 || types[n-2] != EventTypeIdleTimeout || types[n-1] != EventTypeExit {
+		t.Errorf("Log should end with idle-timeout then exit, got %v", types)
+	}
+}
+
+// TestCoalesceWindow verifies --coalesce-window records a burst of tiny
+// writes as a few events per stream, which join replays as written.
+func TestCoalesceWindow(t *testing.T) {
+	dbPath := setupDB(t)
+	script := `for i in $(seq 1 200); do echo $i; echo e$i >&2; done`
+
+	var want string
+	for _, task := range []struct {
+		name string
+		args []string
+	}{
+		{"plain", nil},
+		{"coalesced", []string{"--coalesce-window", "500ms"}},
+	} {
+		args := append(append([]string{"fork", "--task-name", task.name}, task.args...), "--", "sh", "-c", script)
+		if output, err := exec.Command(bgxPath, args...).CombinedOutput(); err != nil {
+			t.Fatalf("Fork failed: %v, output: %s", err, output)
+		}
+		stdout, err := exec.Command(bgxPath, "join", "--task-name", task.name).Output()
+		if err != nil {
+			t.Fatalf("Join of %s failed: %v", task.name, err)
+		}
+		if task.name == "plain" {
+			want = string(stdout)
+			continue
+		}
+		if string(stdout) != want {
+			t.Errorf("Coalesced stdout differs:\n%s\nwant:\n%s", stdout, want)
+		}
+	}
+
+	counts := map[string]map[string]int{}
+	for _, task := range []string{"plain", "coalesced"} {
+		counts[task] = map[string]int{}
+		for _, e := range readEvents(t, dbPath, task) {
+			counts[task][e.Type]++
+			if task == "coalesced" && e.Type == EventTypeStdout && strings.Contains(e.Data, "e") {
+				t.Errorf("stderr leaked into a stdout event: %q", e.Data)
+			}
+		}
+	}
+	for _, stream := range []string{EventTypeStdout, EventTypeStderr} {
+		if counts["plain"][stream] != 200 || counts["coalesced"][stream] > 20 {
+			t.Errorf("%s events: %d plain, %d coalesced; want 200 and at most 20", stream, counts["plain"][stream], counts["coalesced"][stream])
+		}
+	}
+}
+
+// TestWaitFile verifies fork --wait-file returns only once the command has
+// created the file, recording a ready event after the start event, and fails
+// for a command that exits without creating it or takes too long.
+func TestWaitFile(t *testing.T) {
+	dbPath := setupDB(t)
+	readyFile := filepath.Join(t.TempDir(), "ready")
+
+	start := time.Now()
+	output, err := exec.Command(bgxPath, "fork", "--task-name", "server", "--wait-file", readyFile, "--",
+		"sh", "-c", "sleep 1; touch "+readyFile+"; exec sleep 30").CombinedOutput()
+	defer exec.Command(bgxPath, "kill", "--task-name", "server").Run()
+	if err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Fork returned after %s, before the file was created", elapsed)
+	}
+	if _, err := os.Stat(readyFile); err != nil {
+		t.Errorf("Fork returned but the file doesn't exist: %v", err)
+	}
+	if !strings.Contains(string(output), "Task 'server' is ready") {
+		t.Errorf("Fork should say the task is ready, got: %s", output)
+	}
+	var types []string
+	for _, e := range readEvents(t, dbPath, "server") {
+		types = append(types, e.Type)
+		if e.Type == EventTypeReady && e.Data != readyFile {
+			t.Errorf("Ready event data = %q, want %q", e.Data, readyFile)
+		}
+	}
+	if i := slices.Index(types, EventTypeReady); i < 0 || slices.Index(types, EventTypeStart) > i {
+		t.Errorf("Log should have a ready event after the start event, got %v", types)
+	}
+
+	output, err = exec.Command(bgxPath, "fork", "--task-name", "crashed", "--wait-file", readyFile+".never", "--", "sh", "-c", "exit 3").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "exited with code 3 before") {
+		t.Errorf("Fork of a command that exits first should fail, got %v: %s", err, output)
+	}
+
+	output, err = exec.Command(bgxPath, "fork", "--task-name", "slow", "--wait-file", readyFile+".never", "--wait-timeout", "500ms", "--", "sleep", "30").CombinedOutput()
+	defer exec.Command(bgxPath, "kill", "--task-name", "slow").Run()
+	if err == nil || !strings.Contains(string(output), "did not appear within 500ms") {
+		t.Errorf("Fork should time out waiting for the file, got %v: %s", err, output)
+	}
+
+	output, err = exec.Command(bgxPath, "fork", "--task-name", "bad", "--wait-timeout", "1s", "--", "true").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "--wait-timeout requires --wait-file") {
+		t.Errorf("--wait-timeout without --wait-file should be rejected, got %v: %s", err, output)
+	}
+}
+
+// TestKillDrainsOutput verifies a task the daemon kills keeps the output it
+// wrote before dying, and still gets an exit event promptly when a child
+// process it left behind holds its output pipes open.
+func TestKillDrainsOutput(t *testing.T) {
+	setupDB(t)
+	taskName := "orphaned"
+
+	// The shell is killed, but its sleep child keeps stdout/stderr open.
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--idle-timeout", "500ms", "--", "sh", "-c",
+		"echo first; echo last >&2; sleep 30; true")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	start := time.Now()
+	var stdout, stderr strings.Builder
+	joinCmd := exec.Command(bgxPath, "join", "--task-name", taskName)
+	joinCmd.Stdout = &stdout
+	joinCmd.Stderr = &stderr
+	if got := exitCodeOf(t, joinCmd.Run()); got == 0 {
+		t.Errorf("Join should fail for a killed task, got exit code 0")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Exit should be recorded within the drain window, took %s", elapsed)
+	}
+	if stdout.String() != "first\n" || !strings.HasPrefix(stderr.String(), "last\n") {
+		t.Errorf("The lines before the kill should be kept, got stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+// TestJoinRejectsOversizedEvent verifies join refuses to load an event over
+// its --max-event-bytes limit rather than buffering it.
+func TestJoinRejectsOversizedEvent(t *testing.T) {
+	setupDB(t)
+	seedTask(t, "hostile",
+		Event{Type: EventTypeStart, Time: time.Now(), PID: 1, Command: []string{"true"}},
+		Event{Type: EventTypeStdout, Time: time.Now(), Data: strings.Repeat("x", MaxEventBytes+1)},
+		Event{Type: EventTypeExit, Time: time.Now()},
+	)
+
+	output, err := exec.Command(bgxPath, "join", "--task-name", "hostile").CombinedOutput()
+	if got := exitCodeOf(t, err); got != 1 {
+		t.Errorf("Expected exit code 1, got %d", got)
+	}
+	if !strings.Contains(string(output), "more than --max-event-bytes") {
+		t.Errorf("Expected an explanation, got %.200s", output)
+	}
+	if strings.Contains(string(output), "xxxx") {
+		t.Error("The oversized event should not be replayed")
+	}
+
+	output, err = exec.Command(bgxPath, "join", "--task-name", "hostile", "--max-event-bytes", "0").Output()
+	if err != nil {
+		t.Fatalf("Join with no limit failed: %v", err)
+	}
+	if len(output) != MaxEventBytes+1 {
+		t.Errorf("Join with no limit should replay the event, got %d bytes", len(output))
+	}
+}
+
+// TestNoOutputAfterExit is a stress test for the daemon's shutdown ordering:
+// across many tasks writing to both streams up to the moment they exit, the
+// exit event is always the last one recorded and join replays every line.
+func TestNoOutputAfterExit(t *testing.T) {
+	dbPath := setupDB(t)
+	const tasks, lines = 10, 300
+
+	script := fmt.Sprintf("i=0; while [ $i -lt %d ]; do echo out$i; echo err$i >&2; i=$((i+1)); done", lines)
+	for i := 0; i < tasks; i++ {
+		name := fmt.Sprintf("burst_%d", i)
+		if output, err := exec.Command(bgxPath, "fork", "--task-name", name, "--", "sh", "-c", script).CombinedOutput(); err != nil {
+			t.Fatalf("Fork %s failed: %v, output: %s", name, err, output)
+		}
+	}
+
+	for i := 0; i < tasks; i++ {
+		name := fmt.Sprintf("burst_%d", i)
+		var stdout, stderr strings.Builder
+		joinCmd := exec.Command(bgxPath, "join", "--task-name", name)
+		joinCmd.Stdout, joinCmd.Stderr = &stdout, &stderr
+		if err := joinCmd.Run(); err != nil {
+			t.Fatalf("Join %s failed: %v", name, err)
+		}
+		if got := strings.Count(stdout.String(), "\n"); got != lines {
+			t.Errorf("%s: expected %d stdout lines, got %d", name, lines, got)
+		}
+		if got := strings.Count(stderr.String(), "\n"); got != lines {
+			t.Errorf("%s: expected %d stderr lines, got %d", name, lines, got)
+		}
+		events := readEvents(t, dbPath, name)
+		if last := events[len(events)-1]; last.Type != EventTypeExit {
+			t.Errorf("%s: last event is %s, want exit", name, last.Type)
+		}
+	}
+}
+
+// TestJoinLinger verifies --linger replays output recorded after the exit
+// event, which join otherwise stops at.
+func TestJoinLinger(t *testing.T) {
+	setupDB(t)
+	now := time.Now()
+	seedTask(t, "late",
+		Event{Type: EventTypeStart, Time: now, PID: 1, Command: []string{"true"}},
+		Event{Type: EventTypeStdout, Time: now, Data: "before\n"},
+		Event{Type: EventTypeExit, Time: now, Code: 4},
+		Event{Type: EventTypeStdout, Time: now, Data: "after\n"},
+	)
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "before\n"},
+		{[]string{"--linger", "300ms"}, "before\nafter\n"},
+	} {
+		var stdout strings.Builder
+		joinCmd := exec.Command(bgxPath, append([]string{"join", "--task-name", "late"}, tt.args...)...)
+		joinCmd.Stdout = &stdout
+		if got := exitCodeOf(t, joinCmd.Run()); got != 4 {
+			t.Errorf("join %v: expected exit code 4, got %d", tt.args, got)
+		}
+		if stdout.String() != tt.want {
+			t.Errorf("join %v: expected %q, got %q", tt.args, tt.want, stdout.String())
+		}
+	}
+}
+
 // TestNoTrailingNewline verifies output without a final newline is preserved
 // exactly (ReadString returns the trailing partial line on EOF).
 func TestNoTrailingNewline(t *testing.T) {
@@ -457,6 +949,58 @@ func TestMultiJoinFailurePropagates(t *testing.T) {
 	}
 }
 
+// TestMultiJoinSummary verifies a join of tasks finishing at different
+// times waits for all of them and ends with a table of how each ended, and
+// that --timeout gives up on a task still running, exiting with 124.
+func TestMultiJoinSummary(t *testing.T) {
+	setupDB(t)
+
+	for name, script := range map[string]string{
+		"fast":  "echo fast done",
+		"slow":  "sleep 1; echo slow done; exit 3",
+		"stuck": "sleep 10",
+	} {
+		if output, err := exec.Command(bgxPath, "fork", "--task-name", name, "--", "sh", "-c", script).CombinedOutput(); err != nil {
+			t.Fatalf("Fork %s failed: %v, output: %s", name, err, output)
+		}
+	}
+	defer exec.Command(bgxPath, "kill", "--task-name", "stuck").Run()
+
+	var stdout, stderr strings.Builder
+	joinCmd := exec.Command(bgxPath, "join", "--task-name", "fast", "--task-name", "slow", "--summary")
+	joinCmd.Stdout = &stdout
+	joinCmd.Stderr = &stderr
+	if got := exitCodeOf(t, joinCmd.Run()); got != 3 {
+		t.Errorf("Join should exit with the slow task's code 3, got %d", got)
+	}
+	if !strings.Contains(stdout.String(), "[fast] fast done") || !strings.Contains(stdout.String(), "[slow] slow done") {
+		t.Errorf("Join should replay both tasks' output, got: %q", stdout.String())
+	}
+	table := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if len(table) != 3 || !strings.HasPrefix(table[0], "TASK") ||
+		!regexp.MustCompile(`^fast +0 +\S+ +stdout 1 line `).MatchString(table[1]) ||
+		!regexp.MustCompile(`^slow +3 +1\.\d+s +stdout 1 line `).MatchString(table[2]) {
+		t.Errorf("Summary should be a table with a row per task, got:\n%s", stderr.String())
+	}
+
+	stdout.Reset()
+	stderr.Reset()
+	start := time.Now()
+	joinCmd = exec.Command(bgxPath, "join", "--task-name", "fast", "--task-name", "stuck", "--summary", "--timeout", "500ms")
+	joinCmd.Stdout = &stdout
+	joinCmd.Stderr = &stderr
+	if got := exitCodeOf(t, joinCmd.Run()); got != WaitTimeoutExitCode {
+		t.Errorf("Join should exit with %d for a task still running, got %d", WaitTimeoutExitCode, got)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Join should give up after --timeout, took %v", elapsed)
+	}
+	if !strings.Contains(stderr.String(), `gave up on task "stuck", still running after --timeout 500ms`) ||
+		!regexp.MustCompile(`(?m)^stuck +- +\S+ +still running$`).MatchString(stderr.String()) {
+		t.Errorf("Join should report the task given up on, got stderr:\n%s", stderr.String())
+	}
+}
+
 func TestJoinGroup(t *testing.T) {
 	setupDB(t)
 
@@ -516,6 +1060,69 @@ func TestJoinTimestamps(t *testing.T) {
 	}
 }
 
+// TestJoinTagLines verifies --tag-lines tags every line with its event's id
+// and stream, as --output json reports them, and that --tag-format changes
+// the separator.
+func TestJoinTagLines(t *testing.T) {
+	setupDB(t)
+	taskName := "tagged"
+	base := time.Now()
+	seedTask(t, taskName,
+		Event{Type: EventTypeStart, Time: base, PID: 1, Command: []string{"build"}},
+		Event{Type: EventTypeStdout, Time: base, Data: "compiling\n"},
+		Event{Type: EventTypeStderr, Time: base, Data: "warning: x\n"},
+		Event{Type: EventTypeStdout, Time: base, Data: "a\nb\n"},
+		Event{Type: EventTypeExit, Time: base, Code: 0},
+	)
+
+	out, err := exec.Command(bgxPath, "join", "--task-name", taskName, "--output", "json", "--fields", "id,type,data").Output()
+	if err != nil {
+		t.Fatalf("Join --output json failed: %v", err)
+	}
+	type tagged struct{ id, stream, line string }
+	var lines []tagged
+	for _, record := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		var e struct {
+			ID         int64
+			Type, Data string
+		}
+		if err := json.Unmarshal([]byte(record), &e); err != nil {
+			t.Fatalf("Bad record %q: %v", record, err)
+		}
+		stream := map[string]string{"stdout": "O", "stderr": "E"}[e.Type]
+		for _, line := range strings.Split(strings.TrimSuffix(e.Data, "\n"), "\n") {
+			if stream != "" {
+				lines = append(lines, tagged{strconv.FormatInt(e.ID, 10), stream, line})
+			}
+		}
+	}
+
+	for _, sep := range []string{":", " | "} {
+		flags := []string{"join", "--task-name", taskName, "--tag-lines"}
+		if sep != ":" {
+			flags = append(flags, "--tag-format", sep)
+		}
+		var want, got strings.Builder
+		for _, l := range lines {
+			want.WriteString(l.id + sep + l.stream + sep + l.line + "\n")
+		}
+		joinCmd := exec.Command(bgxPath, flags...)
+		joinCmd.Stdout = &got
+		joinCmd.Stderr = &got
+		if err := joinCmd.Run(); err != nil {
+			t.Fatalf("%v failed: %v\n%s", flags, err, got.String())
+		}
+		if len(lines) != 4 || got.String() != want.String() {
+			t.Errorf("%v output:\n%s\nwant:\n%s", flags, got.String(), want.String())
+		}
+	}
+
+	out, err = exec.Command(bgxPath, "join", "--task-name", taskName, "--tag-format", "-").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "--tag-format requires --tag-lines") {
+		t.Errorf("--tag-format without --tag-lines: %v, %s", err, out)
+	}
+}
+
 // TestExecForeground verifies `bgx exec` runs the command in the foreground,
 // mirrors its output to the terminal, records the lifecycle to the database,
 // and exits with the command's exit code.
@@ -624,12 +1231,3325 @@ func TestExecDuplicateName(t *testing.T) {
 	}
 }
 
+// TestOverwriteIfExited verifies --overwrite-if-exited reuses the name of a
+// task that has exited, replacing its log, and refuses one still running.
+func TestOverwriteIfExited(t *testing.T) {
+	dbPath := setupDB(t)
+
+	if output, err := exec.Command(bgxPath, "exec", "--task-name", "nightly", "--", "echo", "first run").CombinedOutput(); err != nil {
+		t.Fatalf("First exec failed: %v, output: %s", err, output)
+	}
+	output, err := exec.Command(bgxPath, "fork", "--task-name", "nightly", "--overwrite-if-exited", "--", "sh", "-c", "echo second run; exit 2").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Fork over an exited task failed: %v, output: %s", err, output)
+	}
+	output, _ = exec.Command(bgxPath, "join", "--task-name", "nightly").CombinedOutput()
+	if string(output) != "second run\n" {
+		t.Errorf("Join should replay only the new run, got %q", output)
+	}
+	var types []string
+	for _, e := range readEvents(t, dbPath, "nightly") {
+		types = append(types, e.Type)
+	}
+	if n := strings.Count(strings.Join(types, " "), EventTypeStart); n != 1 {
+		t.Errorf("The log should hold one run, got %v", types)
+	}
+
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", "server", "--", "sleep", "30").CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	defer exec.Command(bgxPath, "kill", "--task-name", "server").Run()
+	output, err = exec.Command(bgxPath, "fork", "--task-name", "server", "--overwrite-if-exited", "--", "true").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "hasn't exited") {
+		t.Errorf("Fork over a running task should be refused, got %v: %s", err, output)
+	}
+	if got, _ := exec.Command(bgxPath, "status", "--task-name", "server").Output(); !strings.Contains(string(got), "sleep 30") {
+		t.Errorf("The running task should be untouched, status:\n%s", got)
+	}
+}
+
+// TestForkSync verifies the --sync flag is accepted and forwarded to the
+// daemon, which records the task as usual.
+func TestForkSync(t *testing.T) {
+	setupDB(t)
+	taskName := "synced"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--sync", "--", "sh", "-c", "echo durable; exit 2")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	joinCmd := exec.Command(bgxPath, "join", "--task-name", taskName)
+	output, err := joinCmd.CombinedOutput()
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	if exitCode != 2 {
+		t.Errorf("Expected exit code 2, got %d", exitCode)
+	}
+	if !strings.Contains(string(output), "durable") {
+		t.Errorf("Expected 'durable' in output, got: %s", output)
+	}
+}
+
+// collectSink accepts one connection on ln and returns the NDJSON events the
+// daemon streams to it, read until the exit event (or the connection closes).
+func collectSink(t *testing.T, ln net.Listener) <-chan []sinkEvent {
+	t.Helper()
+	ch := make(chan []sinkEvent, 1)
+	go func() {
+		var events []sinkEvent
+		defer func() { ch <- events }()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			var e sinkEvent
+			if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+				t.Errorf("Sink received invalid NDJSON %q: %v", sc.Text(), err)
+				return
+			}
+			events = append(events, e)
+			if e.Type == EventTypeExit {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func TestForkSink(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			setupDB(t)
+			taskName := "sink_" + network
+
+			var ln net.Listener
+			var err error
+			var sinkURL string
+			if network == "tcp" {
+				ln, err = net.Listen("tcp", "127.0.0.1:0")
+				sinkURL = "tcp://" + ln.Addr().String()
+			} else {
+				path := filepath.Join(t.TempDir(), "sink.sock")
+				ln, err = net.Listen("unix", path)
+				sinkURL = "unix://" + path
+			}
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			defer ln.Close()
+			received := collectSink(t, ln)
+
+			forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--sink", sinkURL, "--", "sh", "-c", "echo streamed; exit 3")
+			if output, err := forkCmd.CombinedOutput(); err != nil {
+				t.Fatalf("Fork failed: %v, output: %s", err, output)
+			}
+
+			var events []sinkEvent
+			select {
+			case events = <-received:
+			case <-time.After(10 * time.Second):
+				t.Fatal("Timed out waiting for sink events")
+			}
+			if len(events) < 3 {
+				t.Fatalf("Expected start, stdout and exit events, got: %+v", events)
+			}
+			if events[0].Type != EventTypeStart || events[0].Task != taskName {
+				t.Errorf("First sink event should be %s's start, got: %+v", taskName, events[0])
+			}
+			if events[1].Type != EventTypeStdout || events[1].Data != "streamed\n" {
+				t.Errorf("Expected stdout 'streamed', got: %+v", events[1])
+			}
+			last := events[len(events)-1]
+			if last.Type != EventTypeExit || last.Code != 3 {
+				t.Errorf("Last sink event should be exit with code 3, got: %+v", last)
+			}
+
+			// The database still holds the full record for join.
+			joinCmd := exec.Command(bgxPath, "join", "--task-name", taskName)
+			output, _ := joinCmd.CombinedOutput()
+			if !strings.Contains(string(output), "streamed") {
+				t.Errorf("Expected 'streamed' in join output, got: %s", output)
+			}
+		})
+	}
+}
+
+// TestSinkFanOut verifies every repeated --sink, a file among them, receives
+// the same events in the same order.
+func TestSinkFanOut(t *testing.T) {
+	setupDB(t)
+	dir := t.TempDir()
+	var received []<-chan []sinkEvent
+	args := []string{"fork", "--task-name", "fanout"}
+	file := filepath.Join(dir, "events.ndjson")
+	args = append(args, "--sink", "file://"+file)
+	for _, name := range []string{"a.sock", "b.sock"} {
+		ln, err := net.Listen("unix", filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer ln.Close()
+		received = append(received, collectSink(t, ln))
+		args = append(args, "--sink", "unix://"+filepath.Join(dir, name))
+	}
+	args = append(args, "--", "sh", "-c", "echo one; echo two >&2; exit 1")
+	if output, err := exec.Command(bgxPath, args...).CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	var streams [][]byte
+	for _, ch := range received {
+		select {
+		case events := <-ch:
+			var b []byte
+			for _, e := range events {
+				line, _ := json.Marshal(e)
+				b = append(append(b, line...), '\n')
+			}
+			streams = append(streams, b)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for sink events")
+		}
+	}
+	// The file is written before the sockets, so it is complete by now.
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("File sink wasn't written: %v", err)
+	}
+	if !bytes.HasSuffix(bytes.TrimSpace(data), []byte(`"code":1}`)) {
+		t.Errorf("File sink should end with the exit event, got:\n%s", data)
+	}
+	for i, b := range streams {
+		if !bytes.Equal(b, data) {
+			t.Errorf("Socket sink %d received:\n%s\nwant the same as the file:\n%s", i, b, data)
+		}
+	}
+
+	output, err := exec.Command(bgxPath, "fork", "--task-name", "bad", "--sink", "file://relative.ndjson", "--", "true").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "expected file:///PATH") {
+		t.Errorf("A file sink without an absolute path should be rejected, got %v: %s", err, output)
+	}
+}
+
+// TestSinkUnreachable verifies that a collector that is down doesn't affect
+// the task: events still land in the database and the exit code is kept.
+func TestSinkUnreachable(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "sink_down"
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close() // nothing listens here now
+
+	execCmd := exec.Command(bgxPath, "exec", "--task-name", taskName, "--sink", "tcp://"+addr, "--", "sh", "-c", "echo still-recorded; exit 6")
+	var stderr strings.Builder
+	execCmd.Stderr = &stderr
+	err = execCmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 6 {
+		t.Fatalf("Expected exec to exit 6, got: %v", err)
+	}
+	if !strings.Contains(stderr.String(), "failed to connect to sink") {
+		t.Errorf("Expected a sink connection warning, got: %s", stderr.String())
+	}
+	if n := strings.Count(stderr.String(), "sink"); n != 1 {
+		t.Errorf("Expected the warning once, got %d mentions: %s", n, stderr.String())
+	}
+
+	events := readEvents(t, dbPath, taskName)
+	if len(events) == 0 || events[len(events)-1].Type != EventTypeExit {
+		t.Errorf("Expected the run to be recorded despite the sink, got: %+v", events)
+	}
+	// The problem is recorded in the log too, once.
+	var problems []string
+	for _, e := range events {
+		if e.Type == EventTypeError {
+			problems = append(problems, e.Data)
+		}
+	}
+	if len(problems) != 1 || !strings.Contains(problems[0], "failed to connect to sink tcp://"+addr) {
+		t.Errorf("Expected one error event about the sink, got: %q", problems)
+	}
+}
+
+// TestSinkNotReading verifies a collector that accepts the connection but
+// never reads doesn't hold up the task: once the socket's buffers are full,
+// events reach only the database, and the task runs and exits as usual.
+func TestSinkNotReading(t *testing.T) {
+	dbPath := setupDB(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c) // and never read from it
+		}
+	}()
+
+	start := time.Now()
+	execCmd := exec.Command(bgxPath, "exec", "--task-name", "unread", "--sink", "tcp://"+ln.Addr().String(), "--",
+		"sh", "-c", `head -c 50000000 /dev/zero | tr '\0' a | fold -w 1000; exit 4`)
+	var stderr strings.Builder
+	execCmd.Stderr = &stderr
+	if code := exitCodeOf(t, execCmd.Run()); code != 4 {
+		t.Fatalf("Expected exec to exit 4, got %d: %s", code, stderr.String())
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("exec took %v with a collector that doesn't read", elapsed)
+	}
+	if !strings.Contains(stderr.String(), "events behind") && !strings.Contains(stderr.String(), "i/o timeout") {
+		t.Errorf("Expected a warning that the sink fell behind or timed out, got: %s", stderr.String())
+	}
+	events := readEvents(t, dbPath, "unread")
+	if n := len(events); n < 50002 || events[n-1].Type != EventTypeExit {
+		t.Errorf("Expected all 50000 lines recorded, then the exit, got %d events", n)
+	}
+}
+
+// TestDaemonLog verifies that problems the detached daemon reports (here, an
+// unreachable sink) are kept in its log and surfaced by status and doctor,
+// while a daemon with nothing to report leaves no log behind.
+func TestDaemonLog(t *testing.T) {
+	dbPath := setupDB(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	for _, args := range [][]string{
+		{"--task-name", "troubled", "--sink", "tcp://" + addr},
+		{"--task-name", "fine"},
+	} {
+		forkArgs := append(append([]string{"fork"}, args...), "--", "true")
+		if output, err := exec.Command(bgxPath, forkArgs...).CombinedOutput(); err != nil {
+			t.Fatalf("Fork failed: %v, output: %s", err, output)
+		}
+		if err := exec.Command(bgxPath, append([]string{"join"}, args[:2]...)...).Run(); err != nil {
+			t.Fatalf("Join failed: %v", err)
+		}
+	}
+
+	output, err := exec.Command(bgxPath, "status", "--task-name", "troubled").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Status failed: %v, output: %s", err, output)
+	}
+	if !strings.Contains(string(output), "The daemon reported problems") || !strings.Contains(string(output), "failed to connect to sink") {
+		t.Errorf("Status should show the daemon's sink warning, got:\n%s", output)
+	}
+
+	output, _ = exec.Command(bgxPath, "doctor").CombinedOutput()
+	if !strings.Contains(string(output), "[warn] daemon logs") || !strings.Contains(string(output), "troubled") || strings.Contains(string(output), "fine") {
+		t.Errorf("Doctor should point at the troubled task only, got:\n%s", output)
+	}
+
+	// The clean daemon removes its empty log just after recording the exit.
+	cleanLog := filepath.Join(dbPath+"-daemon", "fine.log")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(cleanLog); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to be removed", cleanLog)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestInvalidSink(t *testing.T) {
+	setupDB(t)
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", "bad_sink", "--sink", "http://example.com", "--", "true")
+	output, err := forkCmd.CombinedOutput()
+	if err == nil {
+		t.Error("Fork should reject an unsupported sink scheme")
+	}
+	if !strings.Contains(string(output), "tcp://, unix:// or file://") {
+		t.Errorf("Error should list the supported schemes, got: %s", output)
+	}
+}
+
+// TestNoHeartbeat verifies --no-heartbeat suppresses heartbeat events, records
+// the choice in the start event, and still lets join see the task through.
+func TestNoHeartbeat(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping heartbeat-interval test in short mode")
+	}
+	dbPath := setupDB(t)
+	taskName := "no_heartbeat"
+
+	// Outlive one HeartbeatInterval so a heartbeat would have been written.
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--no-heartbeat", "--", "sh", "-c", "sleep 6; echo quiet")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	joinCmd := exec.Command(bgxPath, "join", "--task-name", taskName)
+	output, err := joinCmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Join failed: %v, output: %s", err, output)
+	}
+	if !strings.Contains(string(output), "quiet") {
+		t.Errorf("Expected 'quiet' in output, got: %s", output)
+	}
+
+	for _, e := range readEvents(t, dbPath, taskName) {
+		if e.Type == EventTypeHeartbeat {
+			t.Errorf("Expected no heartbeat events, got: %+v", e)
+		}
+	}
+
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	var noHeartbeat bool
+	if err := db.QueryRow("SELECT no_heartbeat FROM events WHERE task = ? AND type = ?", taskName, EventTypeStart).Scan(&noHeartbeat); err != nil {
+		t.Fatalf("Failed to read start event: %v", err)
+	}
+	if !noHeartbeat {
+		t.Error("Start event should record that heartbeats are disabled")
+	}
+}
+
+// TestStatusDuration verifies status reports the recorded duration for both a
+// finished task (start to exit) and one whose daemon died (start to its last
+// heartbeat), independent of the clock at the time status runs.
+func TestStatusDuration(t *testing.T) {
+	setupDB(t)
+	t0 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	seedTask(t, "finished",
+		Event{Type: EventTypeStart, Time: t0, PID: 100, Command: []string{"make", "build"}},
+		Event{Type: EventTypeHeartbeat, Time: t0.Add(5 * time.Second), CPUSeconds: 0.5, MemBytes: 3 << 20},
+		Event{Type: EventTypeExit, Time: t0.Add(42500 * time.Millisecond), Code: 3, CPUSeconds: 1.25, PeakMemBytes: 3 << 20},
+	)
+	// Memory grows then shrinks; the peak, not the latest sample, is shown.
+	seedTask(t, "dead",
+		Event{Type: EventTypeStart, Time: t0, PID: 200, Command: []string{"sleep", "1000"}},
+		Event{Type: EventTypeHeartbeat, Time: t0.Add(5 * time.Second), CPUSeconds: 0.1, MemBytes: 2 << 20},
+		Event{Type: EventTypeHeartbeat, Time: t0.Add(10 * time.Second), CPUSeconds: 0.2, MemBytes: 1 << 20},
+	)
+
+	for _, tt := range []struct {
+		task  string
+		wants []string
+	}{
+		{"finished", []string{"exited (code 3)", "make build", "Duration:  42.5s", "Peak mem:  3.0 MiB", "CPU time:  1.25s"}},
+		{"dead", []string{"stalled", "sleep 1000", "Duration:  10s", "Peak mem:  2.0 MiB", "CPU time:  0.20s"}},
+	} {
+		output, err := exec.Command(bgxPath, "status", "--task-name", tt.task).CombinedOutput()
+		if err != nil {
+			t.Fatalf("Status %s failed: %v, output: %s", tt.task, err, output)
+		}
+		for _, want := range tt.wants {
+			if !strings.Contains(string(output), want) {
+				t.Errorf("Status %s: expected %q, got:\n%s", tt.task, want, output)
+			}
+		}
+	}
+}
+
+// TestExitPeakMemory verifies the exit event records the highest memory any
+// heartbeat sampled and the task's total CPU time.
+func TestExitPeakMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping heartbeat-interval test in short mode")
+	}
+	dbPath := setupDB(t)
+	taskName := "peak"
+
+	// The shell holds ~32 MB in a variable past the first heartbeat, then
+	// drops it before a final stretch of heartbeats.
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "sh", "-c",
+		`x=$(head -c 32000000 /dev/zero | tr '\0' a); sleep 6; x=; sleep 1`)
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	if got := exitCodeOf(t, exec.Command(bgxPath, "join", "--task-name", taskName).Run()); got != 0 {
+		t.Fatalf("Expected exit code 0, got %d", got)
+	}
+
+	var maxHeartbeatMem int64
+	var lastHeartbeatCPU float64
+	for _, e := range readEvents(t, dbPath, taskName) {
+		if e.Type == EventTypeHeartbeat {
+			maxHeartbeatMem = max(maxHeartbeatMem, e.MemBytes)
+			lastHeartbeatCPU = e.CPUSeconds
+		}
+	}
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	var peak int64
+	var cpu float64
+	if err := db.QueryRow("SELECT peak_mem_bytes, cpu_seconds FROM events WHERE task = ? AND type = ?", taskName, EventTypeExit).Scan(&peak, &cpu); err != nil {
+		t.Fatalf("Failed to read exit event: %v", err)
+	}
+	if peak < 32000000 || peak != maxHeartbeatMem {
+		t.Errorf("peak_mem_bytes = %d, want the highest heartbeat sample %d (at least 32 MB)", peak, maxHeartbeatMem)
+	}
+	if cpu < lastHeartbeatCPU {
+		t.Errorf("Exit cpu_seconds %v should be at least the last heartbeat's %v", cpu, lastHeartbeatCPU)
+	}
+}
+
+// TestIOStats verifies --io-stats records the command's storage writes in
+// heartbeats, and carries the last sample into the exit event and status.
+func TestIOStats(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping heartbeat-interval test in short mode")
+	}
+	dbPath := setupDB(t)
+	taskName := "writer"
+
+	// printf is a shell builtin, so the writes are the shell's own rather
+	// than a child's, and they are counted in the shell's /proc/<pid>/io.
+	out := filepath.Join(t.TempDir(), "out")
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--io-stats", "--", "sh", "-c",
+		`x=$(head -c 8000000 /dev/zero | tr '\0' a); printf %s "$x" > "$0"; sleep 6`, out)
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	if got := exitCodeOf(t, exec.Command(bgxPath, "join", "--task-name", taskName).Run()); got != 0 {
+		t.Fatalf("Expected exit code 0, got %d", got)
+	}
+
+	var heartbeatWrites, exitWrites int64
+	for _, e := range readEvents(t, dbPath, taskName) {
+		switch e.Type {
+		case EventTypeHeartbeat:
+			heartbeatWrites = max(heartbeatWrites, e.WriteBytes)
+		case EventTypeExit:
+			exitWrites = e.WriteBytes
+		}
+	}
+	if heartbeatWrites < 8000000 {
+		t.Errorf("Heartbeat write_bytes = %d, want at least the 8 MB written", heartbeatWrites)
+	}
+	if exitWrites != heartbeatWrites {
+		t.Errorf("Exit write_bytes = %d, want the last heartbeat's %d", exitWrites, heartbeatWrites)
+	}
+
+	status, err := exec.Command(bgxPath, "status", "--task-name", taskName).Output()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if !strings.Contains(string(status), "MiB written") {
+		t.Errorf("Status should show the I/O, got:\n%s", status)
+	}
+}
+
+// TestMemMetric verifies --mem-metric pss is recorded in the start event,
+// that heartbeats then carry a memory sample, and that status labels it.
+func TestMemMetric(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping heartbeat-interval test in short mode")
+	}
+	if _, err := os.Stat("/proc/self/smaps_rollup"); err != nil {
+		t.Skipf("PSS unavailable: %v", err)
+	}
+	dbPath := setupDB(t)
+	taskName := "pss"
+
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", "bad", "--mem-metric", "uss", "--", "true").CombinedOutput(); err == nil {
+		t.Errorf("--mem-metric uss should be rejected, got: %s", output)
+	}
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--mem-metric", "pss", "--", "sleep", "6")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	if got := exitCodeOf(t, exec.Command(bgxPath, "join", "--task-name", taskName).Run()); got != 0 {
+		t.Fatalf("Expected exit code 0, got %d", got)
+	}
+
+	var metric string
+	var heartbeatMem int64
+	for _, e := range readEvents(t, dbPath, taskName) {
+		switch e.Type {
+		case EventTypeStart:
+			metric = e.MemMetric
+		case EventTypeHeartbeat:
+			heartbeatMem = max(heartbeatMem, e.MemBytes)
+		}
+	}
+	if metric != MemMetricPSS {
+		t.Errorf("Start event mem_metric = %q, want %q", metric, MemMetricPSS)
+	}
+	if heartbeatMem <= 0 {
+		t.Errorf("Heartbeats should sample PSS, got mem_bytes %d", heartbeatMem)
+	}
+
+	status, err := exec.Command(bgxPath, "status", "--task-name", taskName).Output()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if !strings.Contains(string(status), "(PSS)") {
+		t.Errorf("Status should label the memory as PSS, got:\n%s", status)
+	}
+	statusJSON, err := exec.Command(bgxPath, "status", "--task-name", taskName, "--json").Output()
+	if err != nil {
+		t.Fatalf("Status --json failed: %v", err)
+	}
+	if !strings.Contains(string(statusJSON), `"mem_metric":"pss"`) {
+		t.Errorf("Status --json should report mem_metric pss, got %s", statusJSON)
+	}
+}
+
+// TestNoProcStats verifies --no-proc-stats keeps heartbeats but leaves
+// their CPU and memory unsampled, without error events, and that status says
+// why the figures are missing.
+func TestNoProcStats(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping heartbeat-interval test in short mode")
+	}
+	dbPath := setupDB(t)
+	taskName := "unsampled"
+
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", "bad", "--no-proc-stats", "--io-stats", "--", "true").CombinedOutput(); err == nil {
+		t.Errorf("--no-proc-stats with --io-stats should be rejected, got: %s", output)
+	}
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--no-proc-stats", "--", "sleep", "6")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	// Check once the start event is in.
+	var status []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		var err error
+		if status, err = exec.Command(bgxPath, "status", "--task-name", taskName).Output(); err != nil {
+			t.Fatalf("Status failed: %v", err)
+		}
+		if strings.Contains(string(status), "State:     running") {
+			break
+		}
+	}
+	if strings.Count(string(status), "not sampled (--no-proc-stats)") != 2 {
+		t.Errorf("Status should say memory and CPU time aren't sampled, got:\n%s", status)
+	}
+	if got := exitCodeOf(t, exec.Command(bgxPath, "join", "--task-name", taskName).Run()); got != 0 {
+		t.Fatalf("Expected exit code 0, got %d", got)
+	}
+
+	var heartbeats int
+	for _, e := range readEvents(t, dbPath, taskName) {
+		switch e.Type {
+		case EventTypeHeartbeat:
+			heartbeats++
+			if e.CPUSeconds != 0 || e.MemBytes != 0 {
+				t.Errorf("Heartbeat should carry no samples, got cpu_seconds %v, mem_bytes %d", e.CPUSeconds, e.MemBytes)
+			}
+		case EventTypeError:
+			t.Errorf("Unexpected error event: %s", e.Data)
+		}
+	}
+	if heartbeats == 0 {
+		t.Errorf("Heartbeats should still be recorded to mark liveness")
+	}
+
+	statusJSON, err := exec.Command(bgxPath, "status", "--task-name", taskName, "--json").Output()
+	if err != nil {
+		t.Fatalf("Status --json failed: %v", err)
+	}
+	if !strings.Contains(string(statusJSON), `"no_proc_stats":true`) {
+		t.Errorf("Status --json should report no_proc_stats, got %s", statusJSON)
+	}
+}
+
+// TestHeartbeatTouch verifies --heartbeat-touch records no heartbeat events,
+// yet keeps join from giving up on a quiet task while its heartbeat file is
+// touched, and that one whose file goes stale is given up on and reported
+// stalled.
+func TestHeartbeatTouch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping heartbeat-interval test in short mode")
+	}
+	dbPath := setupDB(t)
+	taskName := "touched"
+
+	// Quiet for longer than join's timeout, but touched every 5s.
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--heartbeat-touch", "--", "sh", "-c", "sleep 7; echo done")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	output, err := exec.Command(bgxPath, "join", "--task-name", taskName, "--heartbeat-timeout", "6s").CombinedOutput()
+	if err != nil || string(output) != "done\n" {
+		t.Fatalf("Join should wait out the quiet task, got %v: %s", err, output)
+	}
+	for _, e := range readEvents(t, dbPath, taskName) {
+		if e.Type == EventTypeHeartbeat || e.Type == EventTypeError {
+			t.Errorf("Unexpected %s event: %s", e.Type, e.Data)
+		}
+	}
+	if _, err := os.Stat(heartbeatFilePath(taskName)); !os.IsNotExist(err) {
+		t.Errorf("The heartbeat file should be removed once the task exits, got %v", err)
+	}
+
+	// A daemon that died leaves its heartbeat file behind, untouched.
+	stale := time.Now().Add(-time.Minute)
+	seedTask(t, "stale", Event{Type: EventTypeStart, Time: stale, PID: 1, Command: []string{"sleep"}, NoHeartbeat: true, HeartbeatTouch: true})
+	if err := touchHeartbeatFile("stale"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(heartbeatFilePath("stale"), stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	output, err = exec.Command(bgxPath, "join", "--task-name", "stale", "--heartbeat-timeout", "1s").CombinedOutput()
+	if exitCodeOf(t, err) != 1 || !strings.Contains(string(output), "heartbeat timeout") {
+		t.Errorf("Join should give up on a stale task, got %v: %s", err, output)
+	}
+	status, err := exec.Command(bgxPath, "status", "--task-name", "stale").Output()
+	if err != nil || !strings.Contains(string(status), "stalled") {
+		t.Errorf("Status should report the task stalled, got %v:\n%s", err, status)
+	}
+}
+
+// TestExitRusage verifies the exit event carries the kernel's accounting of
+// a CPU-bound command, which status reports in preference to the samples.
+func TestExitRusage(t *testing.T) {
+	setupDB(t)
+	taskName := "spin"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--no-heartbeat", "--", "sh", "-c",
+		`i=0; while [ $i -lt 300000 ]; do i=$((i+1)); done`)
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	if got := exitCodeOf(t, exec.Command(bgxPath, "join", "--task-name", taskName).Run()); got != 0 {
+		t.Fatalf("Expected exit code 0, got %d", got)
+	}
+
+	output, err := exec.Command(bgxPath, "status", "--task-name", taskName, "--json").Output()
+	if err != nil {
+		t.Fatalf("Status --json failed: %v", err)
+	}
+	var status struct {
+		CPUSeconds    float64 `json:"cpu_seconds"`
+		UserSeconds   float64 `json:"user_seconds"`
+		SystemSeconds float64 `json:"system_seconds"`
+		MaxRSSBytes   int64   `json:"max_rss_bytes"`
+		PeakMemBytes  int64   `json:"peak_mem_bytes"`
+	}
+	if err := json.Unmarshal(output, &status); err != nil {
+		t.Fatalf("Status --json is not valid JSON: %v\n%s", err, output)
+	}
+	if status.UserSeconds <= 0 || status.MaxRSSBytes <= 0 {
+		t.Errorf("Exit event should carry user time and max RSS, got %s", output)
+	}
+	if diff := status.CPUSeconds - status.UserSeconds - status.SystemSeconds; diff < -1e-6 || diff > 1e-6 {
+		t.Errorf("cpu_seconds should be user plus system time, got %s", output)
+	}
+	if status.PeakMemBytes != status.MaxRSSBytes {
+		t.Errorf("Peak memory should be the kernel's max RSS without heartbeats, got %s", output)
+	}
+
+	text, err := exec.Command(bgxPath, "status", "--task-name", taskName).Output()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if !regexp.MustCompile(`CPU time: +[\d.]+s \(user [\d.]+s, system [\d.]+s\)`).Match(text) {
+		t.Errorf("Status should split the CPU time, got:\n%s", text)
+	}
+}
+
+// TestPauseResume verifies pause stops a task's process and resume continues
+// it, with status following each transition, and that pausing twice,
+// resuming a task that isn't paused, or pausing one that has exited fail.
+func TestPauseResume(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "pausable"
+
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "sleep", "30").CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	defer exec.Command(bgxPath, "kill", "--task-name", taskName, "--signal", "KILL").Run()
+	state := func() string {
+		t.Helper()
+		output, err := exec.Command(bgxPath, "status", "--task-name", taskName).Output()
+		if err != nil {
+			t.Fatalf("Status failed: %v", err)
+		}
+		m := regexp.MustCompile(`State: +(.*)`).FindSubmatch(output)
+		if m == nil {
+			t.Fatalf("Status has no state:\n%s", output)
+		}
+		return string(m[1])
+	}
+	for deadline := time.Now().Add(5 * time.Second); state() != "running" && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+	}
+	// The process's own state, where /proc shows it: T for stopped.
+	var pid int
+	for _, e := range readEvents(t, dbPath, taskName) {
+		if e.Type == EventTypeStart {
+			pid = e.PID
+		}
+	}
+	procState := func() string {
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			return ""
+		}
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		return fields[0]
+	}
+
+	run := func(command string, wantErr string) {
+		t.Helper()
+		output, err := exec.Command(bgxPath, command, "--task-name", taskName).CombinedOutput()
+		switch {
+		case wantErr == "" && err != nil:
+			t.Fatalf("%s failed: %v, output: %s", command, err, output)
+		case wantErr != "" && (err == nil || !strings.Contains(string(output), wantErr)):
+			t.Errorf("%s should fail with %q, got %v: %s", command, wantErr, err, output)
+		}
+	}
+	run("pause", "")
+	if got := state(); got != "paused" {
+		t.Errorf("State after pause = %q, want paused", got)
+	}
+	if got := procState(); got != "" && got != "T" {
+		t.Errorf("Process state after pause = %q, want T (stopped)", got)
+	}
+	run("pause", "already paused")
+
+	run("resume", "")
+	if got := state(); got != "running" {
+		t.Errorf("State after resume = %q, want running", got)
+	}
+	if got := procState(); got == "T" {
+		t.Errorf("Process should run again after resume, state %q", got)
+	}
+	run("resume", "isn't paused")
+
+	run("pause", "")
+	if output, err := exec.Command(bgxPath, "stop", "--task-name", taskName, "--timeout", "5s").CombinedOutput(); err != nil || !strings.Contains(string(output), "stopped (exit code 143)") {
+		t.Errorf("Stop should end a paused task with TERM, got %v: %s", err, output)
+	}
+	run("resume", "already exited")
+
+	var types []string
+	for _, e := range readEvents(t, dbPath, taskName) {
+		switch e.Type {
+		case EventTypePause, EventTypeResume, EventTypeKill, EventTypeExit:
+			types = append(types, e.Type)
+		}
+	}
+	if want := []string{"pause", "resume", "pause", "kill", "resume", "exit"}; !slices.Equal(types, want) {
+		t.Errorf("Events = %v, want %v", types, want)
+	}
+}
+
+// TestForkUser verifies --user and --group run the command as that user and
+// group, recorded in the start event, and that unknown names are refused
+// before a task is created.
+func TestForkUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Switching users needs root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("No nobody user: %v", err)
+	}
+	dbPath := setupDB(t)
+
+	output, err := exec.Command(bgxPath, "exec", "--task-name", "unprivileged", "--user", "nobody", "--", "sh", "-c", "id -u; id -g; id -G").Output()
+	if err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	want := fmt.Sprintf("%s\n%s\n%s\n", nobody.Uid, nobody.Gid, nobody.Gid)
+	if string(output) != want {
+		t.Errorf("Command ran as %q, want uid, gid and groups %q", output, want)
+	}
+	events := readEvents(t, dbPath, "unprivileged")
+	if e := events[0]; e.UID == nil || e.GID == nil || fmt.Sprint(*e.UID) != nobody.Uid || fmt.Sprint(*e.GID) != nobody.Gid {
+		t.Errorf("Start event should record uid %s and gid %s, got %v, %v", nobody.Uid, nobody.Gid, e.UID, e.GID)
+	}
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", "grouped", "--user", "nobody", "--group", "0", "--", "id", "-g")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	output, err = exec.Command(bgxPath, "join", "--task-name", "grouped").Output()
+	if err != nil || string(output) != "0\n" {
+		t.Errorf("Join of --group 0 = %q, %v; want gid 0", output, err)
+	}
+
+	for _, args := range [][]string{{"--user", "no-such-user-bgx"}, {"--group", "no-such-group-bgx"}} {
+		cmd := exec.Command(bgxPath, append(append([]string{"fork", "--task-name", "unknown"}, args...), "--", "true")...)
+		if output, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(output), args[1]) {
+			t.Errorf("fork %q should fail naming it, got %v: %s", args, err, output)
+		}
+	}
+	if output, _ := exec.Command(bgxPath, "status", "--task-name", "unknown").CombinedOutput(); !strings.Contains(string(output), "not found") {
+		t.Errorf("A refused fork should not create the task, got: %s", output)
+	}
+}
+
+// TestStripANSI verifies --strip-ansi records colored output as plain text,
+// on both streams, while exec still mirrors the colors.
+func TestStripANSI(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "colored"
+
+	cmd := exec.Command(bgxPath, "exec", "--task-name", taskName, "--strip-ansi", "--", "sh", "-c",
+		`printf '\033[1;32mok\033[0m all good\n'; printf '\033[31merror\033[m\n' >&2; printf '\033[2K\n'`)
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	if !strings.Contains(string(output), "\x1b[1;32m") {
+		t.Errorf("Exec should mirror the output as written, got %q", output)
+	}
+
+	var data []string
+	for _, e := range readEvents(t, dbPath, taskName) {
+		if e.Type == EventTypeStdout || e.Type == EventTypeStderr {
+			if strings.Contains(e.Data, "\x1b") {
+				t.Errorf("%s event %q still has an escape code", e.Type, e.Data)
+			}
+			data = append(data, e.Data)
+		}
+	}
+	slices.Sort(data)
+	if want := []string{"\n", "error\n", "ok all good\n"}; !slices.Equal(data, want) {
+		t.Errorf("Recorded output = %q, want %q", data, want)
+	}
+}
+
+// TestExport verifies export writes a transcript with the task's header and
+// its output, by stream or merged in recorded order, as text without escape
+// codes or as HTML with them turned into styles.
+func TestExport(t *testing.T) {
+	setupDB(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	seedTask(t, "report",
+		Event{Type: EventTypeStart, Time: start, PID: 1, Command: []string{"make", "test"}},
+		Event{Type: EventTypeStdout, Time: start, Data: "one\n"},
+		Event{Type: EventTypeStderr, Time: start, Data: "\x1b[31mtwo\x1b[0m\n"},
+		Event{Type: EventTypeHeartbeat, Time: start},
+		Event{Type: EventTypeStdout, Time: start, Data: "<three>\n"},
+		Event{Type: EventTypeExit, Time: start.Add(90 * time.Second), Code: 3},
+	)
+	export := func(args ...string) string {
+		t.Helper()
+		output, err := exec.Command(bgxPath, append([]string{"export", "--task-name", "report"}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("export %q failed: %v", args, err)
+		}
+		return string(output)
+	}
+
+	text := export()
+	for _, want := range []string{"Task:      report\n", "Command:   make test\n", "Exit code: 3\n", "Duration:  1m30s\n"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Transcript should contain %q, got:\n%s", want, text)
+		}
+	}
+	if _, body, _ := strings.Cut(text, "\n\n"); body != "--- stdout ---\none\n<three>\n\n--- stderr ---\ntwo\n" {
+		t.Errorf("Transcript output = %q, want stdout then stderr without escape codes", body)
+	}
+	if _, body, _ := strings.Cut(export("--merge"), "\n\n"); body != "--- output ---\none\ntwo\n<three>\n" {
+		t.Errorf("Merged transcript output = %q, want the recorded order", body)
+	}
+
+	page := export("--format", "html", "--merge")
+	for _, want := range []string{"<!DOCTYPE html>", "<td>make test</td>", `<span class="stderr"><span style="color:#cd0000">two</span>`, "&lt;three&gt;"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("HTML transcript should contain %q, got:\n%s", want, page)
+		}
+	}
+
+	if output, err := exec.Command(bgxPath, "export", "--task-name", "report", "--format", "pdf").CombinedOutput(); err == nil {
+		t.Errorf("--format pdf should be rejected, got: %s", output)
+	}
+}
+
+// TestHeartbeatAdaptive verifies --heartbeat-adaptive records fewer
+// heartbeats for an idle task than the fixed interval would, each announcing
+// a longer wait, and that join still sees the task through.
+func TestHeartbeatAdaptive(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping heartbeat-interval test in short mode")
+	}
+	dbPath := setupDB(t)
+	taskName := "idle"
+
+	// At the fixed interval, 16 seconds would give three heartbeats.
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--heartbeat-adaptive", "--", "sleep", "16")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	if got := exitCodeOf(t, exec.Command(bgxPath, "join", "--task-name", taskName).Run()); got != 0 {
+		t.Fatalf("Expected exit code 0, got %d", got)
+	}
+
+	var intervals []float64
+	for _, e := range readEvents(t, dbPath, taskName) {
+		if e.Type == EventTypeHeartbeat {
+			intervals = append(intervals, e.IntervalSeconds)
+		}
+	}
+	if want := []float64{10, 20}; !slices.Equal(intervals, want) {
+		t.Errorf("Heartbeats announced intervals %v, want %v (after 5s and 15s)", intervals, want)
+	}
+}
+
+// TestExitReason verifies the exit event says in words how the command
+// ended, reporting a command killed by SIGSEGV with exit code 139, and that
+// status and join show it.
+func TestExitReason(t *testing.T) {
+	setupDB(t)
+
+	// The shell kills itself, as a crashing program would be.
+	cmd := exec.Command(bgxPath, "exec", "--task-name", "crash", "--", "sh", "-c", "ulimit -c 0; kill -SEGV $$")
+	if got := exitCodeOf(t, cmd.Run()); got != 139 {
+		t.Errorf("Exec of a segfaulting command should exit 139, got %d", got)
+	}
+	if got := exitCodeOf(t, exec.Command(bgxPath, "exec", "--task-name", "fine", "--", "true").Run()); got != 0 {
+		t.Fatalf("Exec of true should exit 0, got %d", got)
+	}
+
+	for task, want := range map[string]string{"crash": "segfault (SIGSEGV)", "fine": "exited normally"} {
+		output, err := exec.Command(bgxPath, "status", "--task-name", task).Output()
+		if err != nil || !strings.Contains(string(output), "Reason:    "+want+"\n") {
+			t.Errorf("Status of %s should give the reason %q, got %v:\n%s", task, want, err, output)
+		}
+	}
+	statusJSON, err := exec.Command(bgxPath, "status", "--task-name", "crash", "--json").Output()
+	if err != nil || !strings.Contains(string(statusJSON), `"exit_code":139,"exit_reason":"segfault (SIGSEGV)","exit_signal":"SIGSEGV"`) {
+		t.Errorf("Status --json should give the exit reason and signal, got %v: %s", err, statusJSON)
+	}
+
+	join := exec.Command(bgxPath, "join", "--task-name", "crash")
+	var stderr strings.Builder
+	join.Stderr = &stderr
+	if got := exitCodeOf(t, join.Run()); got != 139 {
+		t.Errorf("Join should exit 139, got %d", got)
+	}
+	if want := "bgx: task ended: segfault (SIGSEGV), exit code 139\n"; stderr.String() != want {
+		t.Errorf("Join stderr = %q, want %q", stderr.String(), want)
+	}
+	join = exec.Command(bgxPath, "join", "--task-name", "fine")
+	stderr.Reset()
+	join.Stderr = &stderr
+	if err := join.Run(); err != nil || stderr.String() != "" {
+		t.Errorf("Join of a normal exit = %v, stderr %q; want no message", err, stderr.String())
+	}
+}
+
+// TestOOMKillReason verifies that a task the OOM killer kills is reported as
+// such rather than as an ordinary SIGKILL. It runs bgx in a memory cgroup of
+// its own with a small limit, so it needs a writable cgroup filesystem, as
+// root in most containers has; elsewhere it is skipped.
+func TestOOMKillReason(t *testing.T) {
+	setupDB(t)
+	cgroup := limitedMemoryCgroup(t, 64<<20)
+
+	// The shell moves itself into the cgroup before bgx starts, so bgx's
+	// daemon and the command share it; the command grows a shell variable
+	// well past the limit.
+	script := fmt.Sprintf(`echo $$ > %s/cgroup.procs && exec %s exec --task-name hog -- sh -c 'x=$(head -c 512000000 /dev/zero | tr "\\0" a)'`, cgroup, bgxPath)
+	if got := exitCodeOf(t, exec.Command("sh", "-c", script).Run()); got != 137 {
+		t.Fatalf("Exec of a command over its memory limit should exit 137, got %d", got)
+	}
+	output, err := exec.Command(bgxPath, "status", "--task-name", "hog", "--json").Output()
+	if err != nil || !strings.Contains(string(output), `"exit_code":137,"exit_reason":"oom-killed (SIGKILL)","exit_signal":"SIGKILL"`) {
+		t.Errorf("Status --json should blame the OOM killer, got %v: %s", err, output)
+	}
+}
+
+// TestOOMKillReasonBgxKill verifies a task that bgx kill sends SIGKILL isn't
+// blamed on the OOM killer, even though another process in its memory
+// cgroup was OOM-killed while it ran.
+func TestOOMKillReasonBgxKill(t *testing.T) {
+	setupDB(t)
+	cgroup := limitedMemoryCgroup(t, 64<<20)
+
+	script := fmt.Sprintf(`echo $$ > %s/cgroup.procs && %s fork --task-name victim -- sleep 60 && (x=$(head -c 512000000 /dev/zero | tr "\0" a))`, cgroup, bgxPath)
+	if output, err := exec.Command("sh", "-c", script).CombinedOutput(); exitCodeOf(t, err) != 137 {
+		t.Fatalf("The hog beside the task should be OOM-killed, got %v: %s", err, output)
+	}
+	if output, err := exec.Command(bgxPath, "kill", "--task-name", "victim", "--signal", "KILL").CombinedOutput(); err != nil {
+		t.Fatalf("Kill failed: %v, output: %s", err, output)
+	}
+	exec.Command(bgxPath, "wait", "--task-name", "victim").Run()
+	output, err := exec.Command(bgxPath, "status", "--task-name", "victim", "--json").Output()
+	if err != nil || !strings.Contains(string(output), `"exit_reason":"killed (SIGKILL)"`) {
+		t.Errorf("Status --json should not blame the OOM killer for bgx kill, got %v: %s", err, output)
+	}
+}
+
+// limitedMemoryCgroup creates a memory cgroup under the test's own, limited
+// to limit bytes (swap included, where that can be set), and removes it when
+// the test ends. It skips the test if there is no cgroup it can create.
+func limitedMemoryCgroup(t *testing.T, limit int64) string {
+	t.Helper()
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		t.Skipf("No cgroups: %v", err)
+	}
+	var dir string
+	var files []string
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		switch {
+		case len(parts) != 3:
+		case slices.Contains(strings.Split(parts[1], ","), "memory"):
+			dir, files = "/sys/fs/cgroup/memory"+parts[2], []string{"memory.limit_in_bytes", "memory.memsw.limit_in_bytes"}
+		case parts[0] == "0" && dir == "":
+			dir, files = "/sys/fs/cgroup"+parts[2], []string{"memory.max", "memory.swap.max"}
+		}
+	}
+	if dir == "" {
+		t.Skip("No memory cgroup")
+	}
+	dir = filepath.Join(dir, fmt.Sprintf("bgx-test-%d", os.Getpid()))
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Skipf("Can't create a memory cgroup: %v", err)
+	}
+	t.Cleanup(func() {
+		// The cgroup can only be removed once its processes have exited.
+		for range 50 {
+			if os.Remove(dir) == nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Errorf("Failed to remove cgroup %s", dir)
+	})
+	value := []byte(strconv.FormatInt(limit, 10))
+	if err := os.WriteFile(filepath.Join(dir, files[0]), value, 0o644); err != nil {
+		t.Skipf("Can't limit a memory cgroup: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, files[1]), value, 0o644) // without swap accounting, there is no such file
+	return dir
+}
+
+// TestOutputCounters verifies the exit event counts the bytes and lines the
+// command wrote to each stream, including an unterminated last line, and
+// that status --json and join --summary report them.
+func TestOutputCounters(t *testing.T) {
+	setupDB(t)
+	taskName := "counted"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "sh", "-c",
+		`printf 'a\nbb\nccc'; printf 'oops\n' >&2`)
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	join := exec.Command(bgxPath, "join", "--task-name", taskName, "--summary")
+	var stderr strings.Builder
+	join.Stderr = &stderr
+	if err := join.Run(); err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	if !strings.Contains(stderr.String(), "bgx: counted exited with code 0 after ") ||
+		!strings.HasSuffix(stderr.String(), ": stdout 3 lines (8 B), stderr 1 line (5 B)\n") {
+		t.Errorf("join --summary stderr = %q, want the task's output, then its summary", stderr.String())
+	}
+
+	out, err := exec.Command(bgxPath, "status", "--task-name", taskName, "--json").Output()
+	if err != nil {
+		t.Fatalf("Status --json failed: %v", err)
+	}
+	var got struct {
+		Task        string `json:"task"`
+		Exited      bool   `json:"exited"`
+		ExitCode    *int   `json:"exit_code"`
+		StdoutBytes int64  `json:"stdout_bytes"`
+		StderrBytes int64  `json:"stderr_bytes"`
+		StdoutLines int64  `json:"stdout_lines"`
+		StderrLines int64  `json:"stderr_lines"`
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("Status --json printed %q: %v", out, err)
+	}
+	if got.Task != taskName || !got.Exited || got.ExitCode == nil || *got.ExitCode != 0 {
+		t.Errorf("status --json = %s, want the exited task with code 0", out)
+	}
+	if got.StdoutBytes != 8 || got.StdoutLines != 3 || got.StderrBytes != 5 || got.StderrLines != 1 {
+		t.Errorf("status --json counters = %s, want 8 B in 3 lines on stdout and 5 B in 1 line on stderr", out)
+	}
+
+	status, err := exec.Command(bgxPath, "status", "--task-name", taskName).Output()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if !strings.Contains(string(status), "Output:    stdout 3 lines (8 B), stderr 1 line (5 B)\n") {
+		t.Errorf("Status should show the output counters, got:\n%s", status)
+	}
+}
+
+// TestAlive verifies the liveness probe passes a running task and fails a
+// stalled or exited one, that --within widens the window, and that the
+// window stretched for an adaptive heartbeat is reported as such.
+func TestAlive(t *testing.T) {
+	setupDB(t)
+	now := time.Now()
+	seedTask(t, "stalled",
+		Event{Type: EventTypeStart, Time: now.Add(-5 * time.Minute), PID: 1, Command: []string{"server"}},
+		Event{Type: EventTypeHeartbeat, Time: now.Add(-time.Minute)},
+	)
+	// Its last heartbeat announced the next in a minute: 15s+55s from then.
+	seedTask(t, "adaptive",
+		Event{Type: EventTypeStart, Time: now.Add(-5 * time.Minute), PID: 1, Command: []string{"server"}},
+		Event{Type: EventTypeHeartbeat, Time: now.Add(-2 * time.Minute), IntervalSeconds: 60},
+	)
+	seedTask(t, "finished",
+		Event{Type: EventTypeStart, Time: now.Add(-time.Minute), PID: 1, Command: []string{"true"}},
+		Event{Type: EventTypeExit, Time: now.Add(-time.Second), Code: 0},
+	)
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", "running", "--", "sleep", "10").CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	defer exec.Command(bgxPath, "kill", "--task-name", "running").Run()
+	// Probe once the start event is in.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if out, _ := exec.Command(bgxPath, "status", "--task-name", "running").Output(); strings.Contains(string(out), "State:     running") {
+			break
+		}
+	}
+
+	for _, tc := range []struct {
+		args []string
+		code int
+		want string
+	}{
+		{[]string{"--task-name", "running"}, 0, "running: alive: last event"},
+		{[]string{"--task-name", "stalled"}, 1, "stalled: not alive: no events for 1m0s (--within 15s)"},
+		{[]string{"--task-name", "stalled", "--within", "2m"}, 0, "stalled: alive"},
+		{[]string{"--task-name", "adaptive"}, 1, "adaptive: not alive: no events for 2m0s (no heartbeat within 1m10s: adaptive interval)"},
+		{[]string{"--task-name", "finished"}, 1, "finished: not alive: exited (code 0)"},
+	} {
+		out, err := exec.Command(bgxPath, append([]string{"alive"}, tc.args...)...).Output()
+		if got := exitCodeOf(t, err); got != tc.code || !strings.HasPrefix(string(out), tc.want) {
+			t.Errorf("alive %q = %q, exit %d; want %q, exit %d", tc.args, out, got, tc.want, tc.code)
+		}
+	}
+
+	output, err := exec.Command(bgxPath, "alive", "--task-name", "missing").CombinedOutput()
+	if exitCodeOf(t, err) != 1 || !strings.Contains(string(output), `task "missing" not found`) {
+		t.Errorf("alive of a missing task = %q; want a not found error", output)
+	}
+}
+
+func TestStatusNonExistentTask(t *testing.T) {
+	setupDB(t)
+
+	output, err := exec.Command(bgxPath, "status", "--task-name", "nonexistent").CombinedOutput()
+	if err == nil {
+		t.Error("Status should fail for a non-existent task")
+	}
+	if !strings.Contains(string(output), "not found") {
+		t.Errorf("Error should mention task not found, got: %s", output)
+	}
+}
+
+func TestWait(t *testing.T) {
+	setupDB(t)
+	taskName := "waited"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "sh", "-c", "echo 'not replayed'; sleep 1; exit 3")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	waitCmd := exec.Command(bgxPath, "wait", "--task-name", taskName, "--timeout", "20s")
+	output, err := waitCmd.CombinedOutput()
+	if got := exitCodeOf(t, err); got != 3 {
+		t.Errorf("Expected the task's exit code 3, got %d, output: %s", got, output)
+	}
+	if strings.Contains(string(output), "not replayed") {
+		t.Errorf("wait should not replay output, got: %s", output)
+	}
+}
+
+func TestWaitTimeoutReturn(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "slow"
+
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "sleep", "3").CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	waitCmd := exec.Command(bgxPath, "wait", "--task-name", taskName, "--timeout", "500ms")
+	output, err := waitCmd.CombinedOutput()
+	if got := exitCodeOf(t, err); got != WaitTimeoutExitCode {
+		t.Errorf("Expected exit code %d, got %d, output: %s", WaitTimeoutExitCode, got, output)
+	}
+	if !strings.Contains(string(output), "did not exit within 500ms") {
+		t.Errorf("Expected a timeout message, got: %s", output)
+	}
+
+	// The task was left alone and still exits normally.
+	if got := exitCodeOf(t, exec.Command(bgxPath, "join", "--task-name", taskName).Run()); got != 0 {
+		t.Errorf("Task should exit 0 on its own, got %d", got)
+	}
+	for _, e := range readEvents(t, dbPath, taskName) {
+		if e.Type == EventTypeKill {
+			t.Error("--on-timeout return should not kill the task")
+		}
+	}
+}
+
+func TestWaitTimeoutKill(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "hung"
+
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "sleep", "30").CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	start := time.Now()
+	waitCmd := exec.Command(bgxPath, "wait", "--task-name", taskName, "--timeout", "500ms", "--on-timeout", "kill")
+	output, err := waitCmd.CombinedOutput()
+	if got := exitCodeOf(t, err); got != WaitTimeoutExitCode {
+		t.Errorf("Expected exit code %d, got %d, output: %s", WaitTimeoutExitCode, got, output)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("wait took %v; the task should have been killed promptly", elapsed)
+	}
+
+	events := readEvents(t, dbPath, taskName)
+	var types []string
+	for _, e := range events {
+		if e.Type != EventTypeHeartbeat {
+			types = append(types, e.Type)
+		}
+	}
+	if got, want := strings.Join(types, ","), "start,kill,exit"; got != want {
+		t.Errorf("Recorded event types = %s, want %s", got, want)
+	}
+	for _, e := range events {
+		if e.Type == EventTypeKill && !strings.Contains(e.Data, "timed out after 500ms") {
+			t.Errorf("Kill event should give the reason, got: %q", e.Data)
+		}
+		if e.Type == EventTypeExit && e.Code == 0 {
+			t.Error("A killed task should not record a successful exit")
+		}
+	}
+}
+
+// TestEnvDefaults verifies BGX_TIMEOUT and BGX_NO_HEARTBEAT apply where their
+// flags aren't given, that the flags (--timeout 0 and --heartbeat among them)
+// override them, and that a malformed value fails with an error naming the
+// variable.
+func TestEnvDefaults(t *testing.T) {
+	dbPath := setupDB(t)
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", "slow", "--", "sleep", "30").CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	t.Cleanup(func() { exec.Command(bgxPath, "kill", "--task-name", "slow", "--signal", "KILL").Run() })
+
+	run := func(env string, args ...string) (string, int, time.Duration) {
+		t.Helper()
+		cmd := exec.Command(bgxPath, args...)
+		cmd.Env = append(os.Environ(), env)
+		start := time.Now()
+		output, err := cmd.CombinedOutput()
+		return string(output), exitCodeOf(t, err), time.Since(start)
+	}
+	for _, command := range []string{"wait", "join"} {
+		if _, code, elapsed := run("BGX_TIMEOUT=300ms", command, "--task-name", "slow"); code != WaitTimeoutExitCode || elapsed > 10*time.Second {
+			t.Errorf("%s with BGX_TIMEOUT=300ms = code %d after %v, want %d promptly", command, code, elapsed, WaitTimeoutExitCode)
+		}
+		if output, code, elapsed := run("BGX_TIMEOUT=1h", command, "--task-name", "slow", "--timeout", "300ms"); code != WaitTimeoutExitCode || elapsed > 10*time.Second {
+			t.Errorf("%s --timeout 300ms with BGX_TIMEOUT=1h = code %d after %v, want the flag to win: %s", command, code, elapsed, output)
+		}
+		if output, code, _ := run("BGX_TIMEOUT=soon", command, "--task-name", "slow"); code != 1 || !strings.Contains(output, `invalid BGX_TIMEOUT="soon"`) {
+			t.Errorf("%s with BGX_TIMEOUT=soon = code %d, %q; want an error naming the variable", command, code, output)
+		}
+		// --timeout 0 turns the default off: the task outlasts it.
+		short := "short-" + command
+		if output, err := exec.Command(bgxPath, "fork", "--task-name", short, "--", "sh", "-c", "sleep 1; exit 3").CombinedOutput(); err != nil {
+			t.Fatalf("Fork failed: %v, output: %s", err, output)
+		}
+		if output, code, _ := run("BGX_TIMEOUT=300ms", command, "--task-name", short, "--timeout", "0"); code != 3 {
+			t.Errorf("%s --timeout 0 with BGX_TIMEOUT=300ms = code %d, want the task's 3: %s", command, code, output)
+		}
+	}
+
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	for task, args := range map[string][]string{
+		"default":   nil,
+		"adaptive":  {"--heartbeat-adaptive"},
+		"heartbeat": {"--heartbeat"},
+		"last-wins": {"--heartbeat", "--no-heartbeat"},
+	} {
+		// fork, so that the daemon's reading of its options is covered too.
+		fork := append([]string{"fork", "--task-name", task}, args...)
+		if output, code, _ := run("BGX_NO_HEARTBEAT=1", append(fork, "--", "true")...); code != 0 {
+			t.Fatalf("Fork with BGX_NO_HEARTBEAT=1 failed with code %d: %s", code, output)
+		}
+		if output, err := exec.Command(bgxPath, "wait", "--task-name", task).CombinedOutput(); err != nil {
+			t.Fatalf("Wait failed: %v, output: %s", err, output)
+		}
+		var noHeartbeat bool
+		if err := db.QueryRow("SELECT no_heartbeat FROM events WHERE task = ? AND type = ?", task, EventTypeStart).Scan(&noHeartbeat); err != nil {
+			t.Fatalf("Failed to read start event: %v", err)
+		}
+		if want := task == "default" || task == "last-wins"; noHeartbeat != want {
+			t.Errorf("Start event of %s (%q) with BGX_NO_HEARTBEAT=1 has no_heartbeat %v, want %v", task, args, noHeartbeat, want)
+		}
+	}
+	if output, code, _ := run("BGX_NO_HEARTBEAT=maybe", "exec", "--task-name", "bad", "--", "true"); code != 1 || !strings.Contains(output, `invalid BGX_NO_HEARTBEAT="maybe"`) {
+		t.Errorf("Exec with BGX_NO_HEARTBEAT=maybe = code %d, %q; want an error naming the variable", code, output)
+	}
+}
+
+func TestWaitOnTimeoutRequiresTimeout(t *testing.T) {
+	setupDB(t)
+
+	output, err := exec.Command(bgxPath, "wait", "--task-name", "x", "--on-timeout", "kill").CombinedOutput()
+	if err == nil {
+		t.Error("wait --on-timeout without --timeout should fail")
+	}
+	if !strings.Contains(string(output), "requires --timeout") {
+		t.Errorf("Expected an explanation, got: %s", output)
+	}
+}
+
+// TestResultFile verifies join and wait --result-file write a task's outcome
+// as JSON: its exit code and duration as recorded, and whether --timeout gave
+// up on it, as an array when joining several tasks.
+func TestResultFile(t *testing.T) {
+	setupDB(t)
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	seedTask(t, "built",
+		Event{Type: EventTypeStart, Time: start, PID: 4242, Command: []string{"make"}},
+		Event{Type: EventTypeStdout, Time: start.Add(time.Second), Data: "ok\n"},
+		Event{Type: EventTypeExit, Time: start.Add(2500 * time.Millisecond), Code: 3, ExitReason: "exited with code 3"})
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", "slow", "--", "sleep", "30").CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	t.Cleanup(func() { exec.Command(bgxPath, "kill", "--task-name", "slow", "--signal", "KILL").Run() })
+
+	type result struct {
+		Task            string  `json:"task"`
+		StartTime       string  `json:"start_time"`
+		DurationSeconds float64 `json:"duration_seconds"`
+		Exited          bool    `json:"exited"`
+		ExitCode        *int    `json:"exit_code"`
+		TimedOut        bool    `json:"timed_out"`
+	}
+	read := func(path string, v any) {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read the result file: %v", err)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("Result file holds %s: %v", data, err)
+		}
+	}
+	dir := t.TempDir()
+
+	for _, command := range []string{"join", "wait"} {
+		path := filepath.Join(dir, command+".json")
+		if got := exitCodeOf(t, exec.Command(bgxPath, command, "--task-name", "built", "--result-file", path).Run()); got != 3 {
+			t.Errorf("%s should exit with the task's code 3, got %d", command, got)
+		}
+		var got result
+		read(path, &got)
+		if got.Task != "built" || got.StartTime != "2026-01-02T03:04:05Z" || got.DurationSeconds != 2.5 ||
+			!got.Exited || got.ExitCode == nil || *got.ExitCode != 3 || got.TimedOut {
+			t.Errorf("%s --result-file = %+v, want built's exit code 3 after 2.5s", command, got)
+		}
+	}
+
+	// The file is replaced, not appended to.
+	path := filepath.Join(dir, "wait.json")
+	if got := exitCodeOf(t, exec.Command(bgxPath, "wait", "--task-name", "slow", "--timeout", "300ms", "--result-file", path).Run()); got != WaitTimeoutExitCode {
+		t.Errorf("wait --timeout should exit %d, got %d", WaitTimeoutExitCode, got)
+	}
+	var got result
+	read(path, &got)
+	if got.Task != "slow" || got.Exited || got.ExitCode != nil || !got.TimedOut {
+		t.Errorf("wait --timeout --result-file = %+v, want slow timed out and still running", got)
+	}
+
+	path = filepath.Join(dir, "several.json")
+	join := exec.Command(bgxPath, "join", "--task-name", "built", "--task-name", "slow", "--timeout", "300ms", "--result-file", path)
+	if got := exitCodeOf(t, join.Run()); got != 3 {
+		t.Errorf("join of both should exit with built's code 3, got %d", got)
+	}
+	var several []result
+	read(path, &several)
+	if len(several) != 2 || several[0].Task != "built" || several[0].TimedOut || several[1].Task != "slow" || !several[1].TimedOut {
+		t.Errorf("join --result-file of two tasks = %+v, want built, then slow timed out", several)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Errorf("Result files dir has %d entries, want 3 and no temporary files left behind", len(entries))
+	}
+
+	output, err := exec.Command(bgxPath, "join", "--task-name", "built", "--host", "example", "--result-file", path).CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "--result-file can't be used with --host") {
+		t.Errorf("join --host --result-file = %v, want it refused, got: %s", err, output)
+	}
+}
+
+// TestKill verifies bgx kill delivers the named signal to a running task and
+// records who sent it, and refuses a task that has already exited.
+func TestKill(t *testing.T) {
+	dbPath := setupDB(t)
+	t.Setenv("USER", "alice")
+	taskName := "trapper"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "sh", "-c",
+		`trap 'echo got USR1; exit 7' USR1; echo ready; while :; do sleep 0.1; done`)
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	// Only signal once the trap is set.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events := readEvents(t, dbPath, taskName)
+		if len(events) > 0 && events[len(events)-1].Type == EventTypeStdout {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The task never printed ready")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if output, err := exec.Command(bgxPath, "kill", "--task-name", taskName, "--signal", "SIGUSR1", "--audit").CombinedOutput(); err != nil {
+		t.Fatalf("Kill failed: %v, output: %s", err, output)
+	}
+	stdout, err := exec.Command(bgxPath, "join", "--task-name", taskName).Output()
+	if got := exitCodeOf(t, err); got != 7 || string(stdout) != "ready\ngot USR1\n" {
+		t.Errorf("Join = %q, exit %d; want the trap's output and exit code 7", stdout, got)
+	}
+	var types []string
+	for _, e := range readEvents(t, dbPath, taskName) {
+		switch e.Type {
+		case EventTypeAccess, EventTypeKill:
+			types = append(types, e.Type+": "+e.Data)
+		}
+	}
+	if got, want := strings.Join(types, "; "), "access: kill by alice; kill: bgx kill (signal: user defined signal 1)"; got != want {
+		t.Errorf("Recorded %q, want %q", got, want)
+	}
+
+	output, err := exec.Command(bgxPath, "kill", "--task-name", taskName).CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "already exited (code 7)") {
+		t.Errorf("Killing an exited task = %v, %s; want an error", err, output)
+	}
+	output, err = exec.Command(bgxPath, "kill", "--task-name", taskName, "--signal", "BOGUS").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), `unknown --signal "BOGUS"`) {
+		t.Errorf("kill --signal BOGUS = %v, %s; want an error", err, output)
+	}
+}
+
+// TestForkSign verifies that a signed task verifies cleanly and that editing,
+// deleting, or inserting an event afterwards is caught, as is stripping every
+// event's HMAC.
+func TestForkSign(t *testing.T) {
+	dbPath := setupDB(t)
+	t.Setenv(SignKeyEnv, "s3cret")
+	taskName := "signed"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--sign", "--", "sh", "-c",
+		`echo one; echo two; echo "key=[$BGX_SIGN_KEY]"; exit 2`)
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	joinOutput, err := exec.Command(bgxPath, "join", "--task-name", taskName).CombinedOutput()
+	if got := exitCodeOf(t, err); got != 2 {
+		t.Fatalf("Expected exit code 2, got %d, output: %s", got, joinOutput)
+	}
+	if !strings.Contains(string(joinOutput), "key=[]") {
+		t.Errorf("The signing key should not be passed to the task, got: %s", joinOutput)
+	}
+
+	verify := func() (int, string) {
+		t.Helper()
+		output, err := exec.Command(bgxPath, "verify", "--task-name", taskName).CombinedOutput()
+		return exitCodeOf(t, err), string(output)
+	}
+	if code, output := verify(); code != 0 || !strings.Contains(output, "Verified 5 signed events") {
+		t.Fatalf("Untouched log should verify, got exit %d: %s", code, output)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	tamper := func(query string) {
+		t.Helper()
+		if _, err := db.Exec(query, taskName); err != nil {
+			t.Fatalf("Failed to tamper with the log: %v", err)
+		}
+	}
+
+	tamper("UPDATE events SET data = 'uno' || char(10) WHERE task = ? AND data = 'one' || char(10)")
+	if code, output := verify(); code != 1 || !strings.Contains(output, "(stdout) failed verification") {
+		t.Errorf("An edited event should fail verification, got exit %d: %s", code, output)
+	}
+	tamper("UPDATE events SET data = 'one' || char(10) WHERE task = ? AND data = 'uno' || char(10)")
+
+	tamper("DELETE FROM events WHERE task = ? AND data = 'two' || char(10)")
+	if code, output := verify(); code != 1 || !strings.Contains(output, "failed verification") {
+		t.Errorf("A deleted event should fail verification, got exit %d: %s", code, output)
+	}
+
+	tamper("UPDATE events SET hmac = '' WHERE task = ?")
+	if code, output := verify(); code != 1 || !strings.Contains(output, "forked with --sign, but none of its events are signed") {
+		t.Errorf("A log stripped of its HMACs should fail verification, got exit %d: %s", code, output)
+	}
+}
+
+// TestForkDetachLogLevel verifies how much fork prints at each
+// --detach-log-level, on success and on failure, and that every level
+// records the same task log.
+func TestForkDetachLogLevel(t *testing.T) {
+	setupDB(t)
+	fork := func(taskName, level string) (string, int) {
+		t.Helper()
+		output, err := exec.Command(bgxPath, "fork", "--task-name", taskName, "--detach-log-level", level, "--", "echo", "hello").CombinedOutput()
+		return string(output), exitCodeOf(t, err)
+	}
+	for _, tc := range []struct {
+		level              string
+		started            int // lines printed by a fork that succeeds
+		startedFirstPrefix string
+		reportsErrors      bool
+	}{
+		{"silent", 0, "", false},
+		{"error", 0, "", true},
+		{"info", 2, "Started task", true},
+		{"debug", 6, "bgx: daemon: ", true},
+	} {
+		output, code := fork(tc.level, tc.level)
+		lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+		if output == "" {
+			lines = nil
+		}
+		if code != 0 || len(lines) != tc.started || tc.started > 0 && !strings.HasPrefix(lines[0], tc.startedFirstPrefix) {
+			t.Errorf("fork --detach-log-level %s = exit %d, %d lines, want exit 0 and %d lines starting with %q:\n%s", tc.level, code, len(lines), tc.started, tc.startedFirstPrefix, output)
+		}
+		if tc.level == "debug" {
+			for _, want := range []string{" --task-name debug -- echo hello\n", "BGX_DAEMON_MODE=1", "-daemon/debug.log\n", "bgx: daemon pid: "} {
+				if !strings.Contains(output, want) {
+					t.Errorf("fork --detach-log-level debug should print %q, got:\n%s", want, output)
+				}
+			}
+		}
+
+		joinOutput, err := exec.Command(bgxPath, "join", "--task-name", tc.level, "--output", "json", "--fields", "type,data").Output()
+		if err != nil {
+			t.Fatalf("Join of %s failed: %v", tc.level, err)
+		}
+		if want := `{"type":"start"}` + "\n" + `{"type":"stdout","data":"hello\n"}` + "\n" + `{"type":"exit"}` + "\n"; string(joinOutput) != want {
+			t.Errorf("Task forked with --detach-log-level %s recorded:\n%s\nwant:\n%s", tc.level, joinOutput, want)
+		}
+
+		// The name is taken now, so forking it again fails.
+		output, code = fork(tc.level, tc.level)
+		if reported := strings.HasPrefix(output, "Error: ") && strings.Contains(output, "already exists"); code != 1 || reported != tc.reportsErrors || !reported && output != "" {
+			t.Errorf("failing fork --detach-log-level %s = exit %d, %q; want exit 1, and the error printed: %v", tc.level, code, output, tc.reportsErrors)
+		}
+	}
+
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", "x", "--detach-log-level", "loud", "--", "true").CombinedOutput(); err == nil || !strings.Contains(string(output), `invalid --detach-log-level "loud"`) {
+		t.Errorf("fork --detach-log-level loud should be rejected, got %v: %s", err, output)
+	}
+	if output, err := exec.Command(bgxPath, "exec", "--task-name", "x", "--detach-log-level", "debug", "--", "true").CombinedOutput(); err == nil || !strings.Contains(string(output), "only applies to fork") {
+		t.Errorf("exec --detach-log-level should be rejected, got %v: %s", err, output)
+	}
+}
+
+// TestForkSignPauseResume verifies that the unsigned pause and resume events
+// bgx pause and resume add don't fail verification of a signed task.
+func TestForkSignPauseResume(t *testing.T) {
+	setupDB(t)
+	t.Setenv(SignKeyEnv, "s3cret")
+	taskName := "signed-paused"
+
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", taskName, "--sign", "--", "sleep", "30").CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	defer exec.Command(bgxPath, "kill", "--task-name", taskName, "--signal", "KILL").Run()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		output, err := exec.Command(bgxPath, "pause", "--task-name", taskName).CombinedOutput()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Pause failed: %v, output: %s", err, output)
+		}
+	}
+	if output, err := exec.Command(bgxPath, "resume", "--task-name", taskName).CombinedOutput(); err != nil {
+		t.Fatalf("Resume failed: %v, output: %s", err, output)
+	}
+	output, err := exec.Command(bgxPath, "verify", "--task-name", taskName).CombinedOutput()
+	if code := exitCodeOf(t, err); code != 0 || !strings.Contains(string(output), "Verified") {
+		t.Errorf("A paused and resumed signed task should verify, got exit %d: %s", code, output)
+	}
+}
+
+func TestVerifyUnsignedTask(t *testing.T) {
+	setupDB(t)
+	seedTask(t, "plain",
+		Event{Type: EventTypeStart, Time: time.Now(), PID: 1, Command: []string{"true"}},
+		Event{Type: EventTypeExit, Time: time.Now()},
+	)
+
+	output, err := exec.Command(bgxPath, "verify", "--task-name", "plain").CombinedOutput()
+	if got := exitCodeOf(t, err); got != 0 {
+		t.Errorf("An unsigned task should verify trivially, got exit %d: %s", got, output)
+	}
+	if !strings.Contains(string(output), "not signed") {
+		t.Errorf("Expected a note that the task is not signed, got: %s", output)
+	}
+}
+
+func TestForkSignRequiresKey(t *testing.T) {
+	setupDB(t)
+	t.Setenv(SignKeyEnv, "")
+
+	output, err := exec.Command(bgxPath, "fork", "--task-name", "x", "--sign", "--", "true").CombinedOutput()
+	if err == nil {
+		t.Error("Fork --sign without a key should fail")
+	}
+	if !strings.Contains(string(output), SignKeyEnv) {
+		t.Errorf("Error should mention %s, got: %s", SignKeyEnv, output)
+	}
+}
+
+// TestForkInheritFD passes the write end of a pipe to a forked task. It is fd
+// 4 in `bgx fork` (after a placeholder at fd 3) and, as the first inherited
+// descriptor, arrives in the task as fd 3.
+func TestForkInheritFD(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "inherits"
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	placeholder, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer placeholder.Close()
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--inherit-fd", "4", "--", "sh", "-c", "echo 'via fd 3' >&3")
+	forkCmd.ExtraFiles = []*os.File{placeholder, w}
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	w.Close()
+
+	r.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read from the inherited pipe: %v", err)
+	}
+	if line != "via fd 3\n" {
+		t.Errorf("Expected the task to write to fd 3, got %q", line)
+	}
+
+	if got := exitCodeOf(t, exec.Command(bgxPath, "join", "--task-name", taskName).Run()); got != 0 {
+		t.Errorf("Expected exit code 0, got %d", got)
+	}
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	var fds string
+	if err := db.QueryRow("SELECT inherit_fds FROM events WHERE task = ? AND type = ?", taskName, EventTypeStart).Scan(&fds); err != nil {
+		t.Fatalf("Failed to read start event: %v", err)
+	}
+	if fds != "4" {
+		t.Errorf("Start event should record inherit_fds=4, got %q", fds)
+	}
+}
+
+func TestForkInheritClosedFD(t *testing.T) {
+	setupDB(t)
+
+	output, err := exec.Command(bgxPath, "fork", "--task-name", "x", "--inherit-fd", "9", "--", "true").CombinedOutput()
+	if err == nil {
+		t.Error("Fork should reject a descriptor that isn't open")
+	}
+	if !strings.Contains(string(output), "--inherit-fd 9 is not an open file descriptor") {
+		t.Errorf("Expected an explanation, got: %s", output)
+	}
+	if strings.Contains(string(output), "Started task") {
+		t.Errorf("The task should not have been started, got: %s", output)
+	}
+}
+
+// TestForkCaptureFD verifies output to a --capture-fd descriptor is recorded
+// as fd events, which join replays only with --fd, and that a descriptor
+// below a captured one is left closed in the task.
+func TestForkCaptureFD(t *testing.T) {
+	setupDB(t)
+	taskName := "captures"
+
+	script := `echo out; echo progress >&3; echo five >&5; echo err >&2; { echo x >&4; } 2>/dev/null || echo 'fd 4 closed'`
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--capture-fd", "3", "--capture-fd", "5", "--", "sh", "-c", script)
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	join := func(args ...string) (string, string) {
+		t.Helper()
+		cmd := exec.Command(bgxPath, append([]string{"join", "--task-name", taskName}, args...)...)
+		var stdout, stderr strings.Builder
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("Join %q failed: %v, stderr: %s", args, err, stderr.String())
+		}
+		return stdout.String(), stderr.String()
+	}
+	stdout, stderr := join()
+	if stdout != "out\nfd 4 closed\n" || stderr != "err\n" {
+		t.Errorf("Join = %q, %q; want only stdout and stderr", stdout, stderr)
+	}
+	// Each descriptor is read on its own, so only the order within one is
+	// kept.
+	stdout, stderr = join("--fd", "3", "--fd", "5")
+	lines := strings.SplitAfter(stderr, "\n")
+	slices.Sort(lines)
+	if stdout != "out\nfd 4 closed\n" || strings.Join(lines, "") != "[fd 3] progress\n[fd 5] five\nerr\n" {
+		t.Errorf("Join --fd 3 --fd 5 = %q, %q; want the captured lines labeled on stderr", stdout, stderr)
+	}
+	stdout, _ = join("--output", "logfmt", "--fields", "type,fd,data")
+	if !strings.Contains(stdout, "type=fd fd=3 data=") || !strings.Contains(stdout, "type=fd fd=5 data=") || strings.Contains(stdout, "type=stdout fd=") {
+		t.Errorf("Structured join should carry fd on fd events only, got:\n%s", stdout)
+	}
+
+	output, err := exec.Command(bgxPath, "fork", "--task-name", "clash", "--inherit-fd", "7", "--capture-fd", "3", "--", "true").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "--capture-fd 3 is taken by --inherit-fd") {
+		t.Errorf("Fork should reject a captured descriptor that an inherited one fills, got %v: %s", err, output)
+	}
+}
+
+// TestStatusPeek verifies status --peek shows the last lines of output, each
+// attributed to its stream, counting each line of a multi-line event.
+func TestStatusPeek(t *testing.T) {
+	setupDB(t)
+	now := time.Now()
+	seedTask(t, "build",
+		Event{Type: EventTypeStart, Time: now, PID: 1, Command: []string{"make"}},
+		Event{Type: EventTypeStdout, Time: now, Data: "first\n"},
+		Event{Type: EventTypeStdout, Time: now, Data: "second\n"},
+		Event{Type: EventTypeStderr, Time: now, Data: "warning\n"},
+		Event{Type: EventTypeHeartbeat, Time: now},
+		Event{Type: EventTypeStdout, Time: now, Data: "third\nfourth\n"},
+		Event{Type: EventTypeExit, Time: now, Code: 0},
+	)
+	seedTask(t, "quiet", Event{Type: EventTypeStart, Time: now, PID: 2, Command: []string{"true"}})
+
+	output, err := exec.Command(bgxPath, "status", "--task-name", "build", "--peek", "3").CombinedOutput()
+	if err != nil {
+		t.Fatalf("status --peek failed: %v, output: %s", err, output)
+	}
+	want := "Last 3 lines of output:\n  stderr | warning\n  stdout | third\n  stdout | fourth\n"
+	if !strings.HasSuffix(string(output), want) {
+		t.Errorf("status --peek 3 should end with:\n%s\ngot:\n%s", want, output)
+	}
+
+	output, err = exec.Command(bgxPath, "status", "--task-name", "build", "--peek", "2", "--json").Output()
+	if err != nil {
+		t.Fatalf("status --peek --json failed: %v", err)
+	}
+	var status struct {
+		RecentOutput []struct{ Stream, Data string } `json:"recent_output"`
+	}
+	if err := json.Unmarshal(output, &status); err != nil {
+		t.Fatalf("Invalid JSON %s: %v", output, err)
+	}
+	if got := fmt.Sprint(status.RecentOutput); got != "[{stdout third} {stdout fourth}]" {
+		t.Errorf("recent_output = %s, want the last two stdout lines", got)
+	}
+
+	output, _ = exec.Command(bgxPath, "status", "--task-name", "quiet", "--peek", "5").CombinedOutput()
+	if !strings.Contains(string(output), "No output recorded yet.") {
+		t.Errorf("status --peek of a silent task should say so, got:\n%s", output)
+	}
+}
+
+func TestTop(t *testing.T) {
+	setupDB(t)
+	now := time.Now()
+
+	seedTask(t, "web",
+		Event{Type: EventTypeStart, Time: now.Add(-time.Minute), PID: 11, Command: []string{"server"}},
+		Event{Type: EventTypeHeartbeat, Time: now.Add(-time.Second), CPUSeconds: 1.5, MemBytes: 3 << 20},
+	)
+	seedTask(t, "worker",
+		Event{Type: EventTypeStart, Time: now.Add(-time.Minute), PID: 12, Command: []string{"worker"}},
+		Event{Type: EventTypeHeartbeat, Time: now.Add(-2 * time.Second), CPUSeconds: 2, MemBytes: 1 << 20},
+	)
+	seedTask(t, "done",
+		Event{Type: EventTypeStart, Time: now.Add(-time.Minute), PID: 13, Command: []string{"true"}},
+		Event{Type: EventTypeExit, Time: now.Add(-time.Second), CPUSeconds: 100},
+	)
+	seedTask(t, "ghost",
+		Event{Type: EventTypeStart, Time: now.Add(-time.Hour), PID: 14, Command: []string{"sleep"}},
+		Event{Type: EventTypeHeartbeat, Time: now.Add(-time.Hour), CPUSeconds: 50, MemBytes: 50 << 20},
+	)
+
+	output, err := exec.Command(bgxPath, "top").CombinedOutput()
+	if err != nil {
+		t.Fatalf("top failed: %v, output: %s", err, output)
+	}
+	fields := map[string][]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		f := strings.Fields(line)
+		fields[f[0]] = f
+	}
+	if _, ok := fields["done"]; ok {
+		t.Errorf("Exited tasks should not be listed, got:\n%s", output)
+	}
+	if got := strings.Join(fields["web"], " "); got != "web running 11 1.50s 3.0 MiB" {
+		t.Errorf("Unexpected row for web: %q", got)
+	}
+	if got := fields["ghost"]; len(got) < 2 || got[1] != "stalled" {
+		t.Errorf("ghost should be listed as stalled, got %q", got)
+	}
+	// Totals cover the running tasks only, not the stalled or exited ones.
+	if got := strings.Join(fields["TOTAL"], " "); got != "TOTAL 2 running 3.50s 4.0 MiB" {
+		t.Errorf("Unexpected totals: %q\n%s", got, output)
+	}
+}
+
+// TestTopSort verifies each --sort key, and --reverse, orders top's rows.
+func TestTopSort(t *testing.T) {
+	setupDB(t)
+	now := time.Now()
+	seedTask(t, "bravo",
+		Event{Type: EventTypeStart, Time: now.Add(-3 * time.Minute), PID: 11, Command: []string{"a"}},
+		Event{Type: EventTypeHeartbeat, Time: now.Add(-time.Second), CPUSeconds: 5, MemBytes: 1 << 20},
+	)
+	seedTask(t, "alpha",
+		Event{Type: EventTypeStart, Time: now.Add(-time.Minute), PID: 12, Command: []string{"b"}},
+		Event{Type: EventTypeHeartbeat, Time: now.Add(-time.Second), CPUSeconds: 1, MemBytes: 9 << 20},
+	)
+	seedTask(t, "charlie",
+		Event{Type: EventTypeStart, Time: now.Add(-time.Hour), PID: 13, Command: []string{"c"}},
+		Event{Type: EventTypeHeartbeat, Time: now.Add(-time.Hour), CPUSeconds: 3, MemBytes: 4 << 20},
+	)
+	seedTask(t, "delta") // registered, not started
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "delta alpha bravo charlie"},
+		{[]string{"--sort", "start"}, "delta alpha bravo charlie"},
+		{[]string{"--sort", "start", "--reverse"}, "charlie bravo alpha delta"},
+		{[]string{"--sort", "name"}, "alpha bravo charlie delta"},
+		{[]string{"--sort", "cpu"}, "bravo charlie alpha delta"},
+		{[]string{"--sort", "mem"}, "alpha charlie bravo delta"},
+		{[]string{"--sort", "status"}, "bravo alpha delta charlie"},
+		{[]string{"--sort", "status", "--reverse"}, "charlie delta alpha bravo"},
+	} {
+		output, err := exec.Command(bgxPath, append([]string{"top"}, tt.args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("top %v failed: %v, output: %s", tt.args, err, output)
+		}
+		var names []string
+		for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+			if name := strings.Fields(line)[0]; name != "TASK" && name != "TOTAL" {
+				names = append(names, name)
+			}
+		}
+		if got := strings.Join(names, " "); got != tt.want {
+			t.Errorf("top %v listed %s, want %s", tt.args, got, tt.want)
+		}
+	}
+
+	output, err := exec.Command(bgxPath, "top", "--sort", "pid").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "invalid --sort") {
+		t.Errorf("An unknown --sort key should be rejected, got %v: %s", err, output)
+	}
+}
+
+// TestKillProcessGroup verifies kill and stop reach the processes a forked
+// command started: a shell's background child holds the output pipes, and
+// the task's exit is only recorded once it has gone too.
+func TestKillProcessGroup(t *testing.T) {
+	setupDB(t)
+	for _, command := range [][]string{
+		{"kill", "--task-name", "kill"},
+		{"stop", "--task-name", "stop", "--timeout", "20s"},
+	} {
+		taskName := command[2]
+		if output, err := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "sh", "-c", "sleep 60 & wait").CombinedOutput(); err != nil {
+			t.Fatalf("Fork failed: %v, output: %s", err, output)
+		}
+		t.Cleanup(func() { exec.Command(bgxPath, "kill", "--task-name", taskName, "--signal", "KILL").Run() })
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if status, _ := exec.Command(bgxPath, "status", "--task-name", taskName).Output(); !strings.Contains(string(status), "starting") {
+				break
+			}
+		}
+		time.Sleep(200 * time.Millisecond) // for the shell to start sleep
+
+		start := time.Now()
+		if output, err := exec.Command(bgxPath, command...).CombinedOutput(); err != nil {
+			t.Fatalf("%s failed: %v, output: %s", command[0], err, output)
+		}
+		output, err := exec.Command(bgxPath, "wait", "--task-name", taskName, "--timeout", "10s").CombinedOutput()
+		if code := exitCodeOf(t, err); code != 143 {
+			t.Errorf("wait after %s = code %d after %v, want 143 (SIGTERM) promptly: %s", command[0], code, time.Since(start), output)
+		}
+	}
+}
+
+// TestPauseProcessGroup verifies pause stops the processes a forked command
+// started along with it, and resume continues them.
+func TestPauseProcessGroup(t *testing.T) {
+	setupDB(t)
+	out := filepath.Join(t.TempDir(), "out")
+	script := fmt.Sprintf("while :; do date >> %s; sleep 0.1; done & wait", out)
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", "looper", "--", "sh", "-c", script).CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	t.Cleanup(func() { exec.Command(bgxPath, "kill", "--task-name", "looper", "--signal", "KILL").Run() })
+	lines := func() int {
+		data, _ := os.ReadFile(out)
+		return bytes.Count(data, []byte("\n"))
+	}
+	for deadline := time.Now().Add(5 * time.Second); lines() < 3 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if output, err := exec.Command(bgxPath, "pause", "--task-name", "looper").CombinedOutput(); err != nil {
+		t.Fatalf("Pause failed: %v, output: %s", err, output)
+	}
+	time.Sleep(200 * time.Millisecond) // for a write already under way
+	before := lines()
+	time.Sleep(500 * time.Millisecond)
+	if after := lines(); after != before {
+		t.Errorf("The command's background child kept writing while paused: %d lines, then %d", before, after)
+	}
+
+	if output, err := exec.Command(bgxPath, "resume", "--task-name", "looper").CombinedOutput(); err != nil {
+		t.Fatalf("Resume failed: %v, output: %s", err, output)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if after := lines(); after <= before {
+		t.Errorf("The command's background child should write again after resume, still %d lines", after)
+	}
+}
+
+// TestSignalStalled verifies kill, pause, resume and stop leave alone the
+// process a stalled task's start event names: the daemon is gone, and the pid
+// may have been reused by an unrelated process, as it is here.
+func TestSignalStalled(t *testing.T) {
+	dbPath := setupDB(t)
+	unrelated := exec.Command("sleep", "60")
+	if err := unrelated.Start(); err != nil {
+		t.Fatalf("Failed to start sleep: %v", err)
+	}
+	defer unrelated.Process.Kill()
+	exited := make(chan struct{})
+	go func() { unrelated.Wait(); close(exited) }()
+	seedTask(t, "abandoned", Event{Type: EventTypeStart, Time: time.Now().Add(-time.Hour), PID: unrelated.Process.Pid, Command: []string{"sleep", "60"}})
+
+	for _, args := range [][]string{
+		{"kill", "--task-name", "abandoned", "--signal", "KILL"},
+		{"pause", "--task-name", "abandoned"},
+		{"resume", "--task-name", "abandoned"},
+	} {
+		output, err := exec.Command(bgxPath, args...).CombinedOutput()
+		if code := exitCodeOf(t, err); code != 1 || !strings.Contains(string(output), `task "abandoned": stalled (no events for 1h0m0s), daemon gone; not signalled`) {
+			t.Errorf("%s of a stalled task = exit %d, %s", args[0], code, output)
+		}
+	}
+	for _, args := range [][]string{{"--task-name", "abandoned"}, {"--all"}} {
+		output, err := exec.Command(bgxPath, append([]string{"stop", "--timeout", "1s"}, args...)...).CombinedOutput()
+		if code := exitCodeOf(t, err); code != 1 || !strings.Contains(string(output), "abandoned: not stopped: stalled (no events for 1h0m0s), daemon gone; not signalled") {
+			t.Errorf("stop %q of a stalled task = exit %d, %s", args, code, output)
+		}
+	}
+	select {
+	case <-exited:
+		t.Error("The process that reused a stalled task's pid was signalled")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if events := readEvents(t, dbPath, "abandoned"); len(events) != 1 {
+		t.Errorf("Nothing should be recorded for a stalled task, got %d events", len(events))
+	}
+}
+
+// TestStopAll verifies stop --all shuts every running task down at once,
+// killing one that ignores the terminate signal, and leaves out a task that
+// had already exited.
+func TestStopAll(t *testing.T) {
+	setupDB(t)
+	for name, script := range map[string]string{
+		"sleeper1": "exec sleep 60",
+		"sleeper2": "exec sleep 60",
+		"stubborn": `trap "" TERM; echo trapped; while true; do sleep 1; done`,
+		"finished": "true",
+	} {
+		if output, err := exec.Command(bgxPath, "fork", "--task-name", name, "--", "sh", "-c", script).CombinedOutput(); err != nil {
+			t.Fatalf("Fork of %s failed: %v, output: %s", name, err, output)
+		}
+	}
+	exec.Command(bgxPath, "wait", "--task-name", "finished").Run()
+	// Stop the stubborn task only once its trap is set.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		out, _ := exec.Command(bgxPath, "export", "--task-name", "stubborn").Output()
+		if strings.Contains(string(out), "trapped") || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	start := time.Now()
+	output, err := exec.Command(bgxPath, "stop", "--all", "--timeout", "1s").CombinedOutput()
+	if err != nil {
+		t.Fatalf("stop --all failed: %v, output: %s", err, output)
+	}
+	if elapsed := time.Since(start); elapsed > 8*time.Second {
+		t.Errorf("stop --all took %s; tasks should be stopped concurrently", elapsed)
+	}
+	for _, want := range []string{
+		"sleeper1: stopped (exit code 143)",
+		"sleeper2: stopped (exit code 143)",
+		"stubborn: killed after 1s (exit code 137)",
+	} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("stop --all output should contain %q, got:\n%s", want, output)
+		}
+	}
+	if strings.Contains(string(output), "finished") {
+		t.Errorf("An exited task should be left out, got:\n%s", output)
+	}
+	for _, name := range []string{"sleeper1", "sleeper2", "stubborn"} {
+		if got, _ := exec.Command(bgxPath, "status", "--task-name", name).Output(); !strings.Contains(string(got), "exited") {
+			t.Errorf("%s should have exited, status:\n%s", name, got)
+		}
+	}
+
+	output, err = exec.Command(bgxPath, "stop", "--task-name", "finished").CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "finished: already exited (code 0)") {
+		t.Errorf("stop of an exited task = %v: %s", err, output)
+	}
+	output, err = exec.Command(bgxPath, "stop").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "--task-name or --all is required") {
+		t.Errorf("stop without tasks should be rejected, got %v: %s", err, output)
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	setupDB(t)
+
+	start := time.Now().Add(-time.Hour)
+	seedTask(t, "abandoned",
+		Event{Type: EventTypeStart, Time: start, PID: 1, Command: []string{"sleep", "infinity"}},
+		Event{Type: EventTypeHeartbeat, Time: start.Add(HeartbeatInterval)},
+	)
+	seedTask(t, "finished",
+		Event{Type: EventTypeStart, Time: start, PID: 2, Command: []string{"true"}},
+		Event{Type: EventTypeExit, Time: start.Add(time.Second)},
+	)
+
+	output, err := exec.Command(bgxPath, "doctor").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Doctor should pass with warnings only: %v, output: %s", err, output)
+	}
+	for _, want := range []string{"[pass] directory", "[pass] database", "[pass] clock", "[warn] stale tasks", "abandoned"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("Doctor output should contain %q, got:\n%s", want, output)
+		}
+	}
+	if strings.Contains(string(output), "finished") {
+		t.Errorf("An exited task is not stale, got:\n%s", output)
+	}
+}
+
+func TestDoctorUnwritableDirectory(t *testing.T) {
+	// A regular file where the database directory should be can't be fixed
+	// by MkdirAll, so both the directory and database checks fail.
+	notADir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notADir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BGX_DB", filepath.Join(notADir, "bgx.db"))
+
+	cmd := exec.Command(bgxPath, "doctor")
+	output, err := cmd.CombinedOutput()
+	if got := exitCodeOf(t, err); got != 1 {
+		t.Errorf("Expected exit code 1, got %d, output: %s", got, output)
+	}
+	for _, want := range []string{"[fail] directory", "[fail] database"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("Doctor output should contain %q, got:\n%s", want, output)
+		}
+	}
+}
+
+func TestCommandFile(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "from_file"
+
+	cmdFile := filepath.Join(t.TempDir(), "cmd.txt")
+	if err := os.WriteFile(cmdFile, []byte("sh\n-c\necho 'from file'; exit 4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--command-file", cmdFile)
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	joinCmd := exec.Command(bgxPath, "join", "--task-name", taskName)
+	output, err := joinCmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 4 {
+		t.Errorf("Expected exit code 4, got: %v", err)
+	}
+	if !strings.Contains(string(output), "from file") {
+		t.Errorf("Expected 'from file' in output, got: %s", output)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	var command string
+	if err := db.QueryRow("SELECT command FROM events WHERE task = ? AND type = ?", taskName, EventTypeStart).Scan(&command); err != nil {
+		t.Fatalf("Failed to read start event: %v", err)
+	}
+	if want := `["sh","-c","echo 'from file'; exit 4"]`; command != want {
+		t.Errorf("Start event command = %s, want %s", command, want)
+	}
+}
+
+func TestForkExpand(t *testing.T) {
+	setupDB(t)
+	t.Setenv("BGX_TEST_GREETING", "hello")
+	t.Setenv("BGX_TEST_UNSET", "")
+	os.Unsetenv("BGX_TEST_UNSET")
+	t.Setenv(SignKeyEnv, "s3cret")
+	taskName := "expanded"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--expand", "--",
+		"echo", "$BGX_TEST_GREETING", "${BGX_TEST_GREETING}-world", "[$BGX_TEST_UNSET]", "[$"+SignKeyEnv+"]")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	output, err := exec.Command(bgxPath, "join", "--task-name", taskName).Output()
+	if err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	if want := "hello hello-world [] []\n"; string(output) != want {
+		t.Errorf("Expected %q, got %q", want, output)
+	}
+
+	status, err := exec.Command(bgxPath, "status", "--task-name", taskName).Output()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if !strings.Contains(string(status), "echo hello hello-world [] []") {
+		t.Errorf("The start event should record the expanded command, got:\n%s", status)
+	}
+
+	// Without --expand, arguments are passed through literally.
+	forkCmd = exec.Command(bgxPath, "fork", "--task-name", "literal", "--", "echo", "$BGX_TEST_GREETING")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	output, _ = exec.Command(bgxPath, "join", "--task-name", "literal").Output()
+	if string(output) != "$BGX_TEST_GREETING\n" {
+		t.Errorf("Expected the literal argument, got %q", output)
+	}
+}
+
+// TestForkEnvClear verifies --env-clear keeps bgx's environment from the
+// command, apart from PATH, HOME and --env, and is recorded in the start event.
+func TestForkEnvClear(t *testing.T) {
+	dbPath := setupDB(t)
+	t.Setenv("BGX_TEST_INHERITED", "leaked")
+	script := `echo "${BGX_TEST_INHERITED:-absent} ${GREETING:-unset} ${PATH:+path}"`
+
+	tests := []struct {
+		name  string
+		flags []string
+		want  string
+	}{
+		{"inherited", nil, "leaked unset path\n"},
+		{"env", []string{"--env", "GREETING=hi"}, "leaked hi path\n"},
+		{"env-clear", []string{"--env-clear", "--env", "GREETING=hi"}, "absent hi path\n"},
+	}
+	for _, tt := range tests {
+		args := append([]string{"exec", "--task-name", tt.name}, tt.flags...)
+		stdout, err := exec.Command(bgxPath, append(args, "--", "sh", "-c", script)...).Output()
+		if err != nil {
+			t.Fatalf("%s: exec failed: %v", tt.name, err)
+		}
+		if string(stdout) != tt.want {
+			t.Errorf("%s: command saw %q, want %q", tt.name, stdout, tt.want)
+		}
+	}
+
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var cleared bool
+	if err := db.QueryRow("SELECT env_clear FROM events WHERE task = ? AND type = ?", "env-clear", EventTypeStart).Scan(&cleared); err != nil || !cleared {
+		t.Errorf("Start event should record env_clear, got %v (%v)", cleared, err)
+	}
+
+	if output, err := exec.Command(bgxPath, "fork", "--task-name", "bad", "--env", "NOEQUALS", "--", "true").CombinedOutput(); err == nil {
+		t.Errorf("--env without = should be rejected, got: %s", output)
+	}
+}
+
+// TestForkShell covers shell mode: $SHELL by default, --shell-path, and
+// --interpreter with a --command-file script, each recorded in the start event.
+func TestForkShell(t *testing.T) {
+	dbPath := setupDB(t)
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not available")
+	}
+	t.Setenv("SHELL", sh)
+
+	script := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(script, []byte("echo first\necho $((40 + 2))\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"default_shell", []string{"--shell", "--", "echo $((1 + 2)) |", "tr 3 x"}, "x\n"},
+		{"shell_path", []string{"--shell-path", "sh", "--", "echo from-path"}, "from-path\n"},
+		{"interpreter", []string{"--interpreter", "sh -e -c", "--command-file", script}, "first\n42\n"},
+	} {
+		forkArgs := append([]string{"fork", "--task-name", tt.name}, tt.args...)
+		if output, err := exec.Command(bgxPath, forkArgs...).CombinedOutput(); err != nil {
+			t.Fatalf("%s: fork failed: %v, output: %s", tt.name, err, output)
+		}
+		output, err := exec.Command(bgxPath, "join", "--task-name", tt.name).Output()
+		if err != nil {
+			t.Fatalf("%s: join failed: %v", tt.name, err)
+		}
+		if string(output) != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, output)
+		}
+	}
+
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	for _, tt := range []struct{ task, interpreter string }{
+		{"default_shell", sh + " -c"},
+		{"shell_path", "sh -c"},
+		{"interpreter", "sh -e -c"},
+	} {
+		var interpreter string
+		if err := db.QueryRow("SELECT interpreter FROM events WHERE task = ? AND type = ?", tt.task, EventTypeStart).Scan(&interpreter); err != nil {
+			t.Fatalf("Failed to read start event: %v", err)
+		}
+		if interpreter != tt.interpreter {
+			t.Errorf("%s: start event interpreter = %q, want %q", tt.task, interpreter, tt.interpreter)
+		}
+	}
+}
+
+func TestForkShellMissingInterpreter(t *testing.T) {
+	setupDB(t)
+
+	output, err := exec.Command(bgxPath, "fork", "--task-name", "x", "--shell-path", "/nonexistent/zsh", "--", "true").CombinedOutput()
+	if err == nil {
+		t.Error("Fork should fail when the interpreter doesn't exist")
+	}
+	if !strings.Contains(string(output), `interpreter "/nonexistent/zsh" not found`) {
+		t.Errorf("Expected a clear error, got: %s", output)
+	}
+	if strings.Contains(string(output), "Started task") {
+		t.Errorf("The task should not have been started, got: %s", output)
+	}
+}
+
+func TestCommandFileWithPositionalCommand(t *testing.T) {
+	setupDB(t)
+
+	cmdFile := filepath.Join(t.TempDir(), "cmd.txt")
+	if err := os.WriteFile(cmdFile, []byte("true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", "both", "--command-file", cmdFile, "--", "echo", "hi")
+	output, err := forkCmd.CombinedOutput()
+	if err == nil {
+		t.Error("Fork should reject --command-file together with a command")
+	}
+	if !strings.Contains(string(output), "cannot be combined") {
+		t.Errorf("Error should explain the conflict, got: %s", output)
+	}
+}
+
+// exitCodeOf returns the exit code carried by a finished command's error.
+func exitCodeOf(t *testing.T, err error) int {
+	t.Helper()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("Command failed to run: %v", err)
+	}
+	return 0
+}
+
+// TestJoinSuccessCodes verifies --success-codes and --invert remap join's
+// exit status without altering the recorded exit code.
+func TestJoinSuccessCodes(t *testing.T) {
+	setupDB(t)
+
+	tests := []struct {
+		name     string
+		taskCode int
+		flags    []string
+		want     int
+	}{
+		{"default: only 0 succeeds", 1, nil, 1},
+		{"default: 0 succeeds", 0, nil, 0},
+		{"single code", 1, []string{"--success-codes", "0,1"}, 0},
+		{"code outside the set passes through", 2, []string{"--success-codes", "0,1"}, 2},
+		{"range", 3, []string{"--success-codes", "2-4"}, 0},
+		{"outside range", 5, []string{"--success-codes", "2-4"}, 5},
+		{"invert: 0 fails", 0, []string{"--invert"}, 1},
+		{"invert: non-zero succeeds", 2, []string{"--invert"}, 0},
+		{"invert with codes", 1, []string{"--success-codes", "0,1", "--invert"}, 1},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskName := fmt.Sprintf("codes_%d", i)
+			execCmd := exec.Command(bgxPath, "exec", "--task-name", taskName, "--", "sh", "-c", fmt.Sprintf("exit %d", tt.taskCode))
+			if got := exitCodeOf(t, execCmd.Run()); got != tt.taskCode {
+				t.Fatalf("Exec should exit with the task's own code %d, got %d", tt.taskCode, got)
+			}
+
+			args := append([]string{"join", "--task-name", taskName}, tt.flags...)
+			if got := exitCodeOf(t, exec.Command(bgxPath, args...).Run()); got != tt.want {
+				t.Errorf("join %v: exit code = %d, want %d", tt.flags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJoinInvalidSuccessCodes(t *testing.T) {
+	setupDB(t)
+
+	for _, spec := range []string{"", "a", "0,", "4-2", "1-x"} {
+		output, err := exec.Command(bgxPath, "join", "--task-name", "x", "--success-codes", spec).CombinedOutput()
+		if err == nil {
+			t.Errorf("--success-codes %q should be rejected", spec)
+		}
+		if !strings.Contains(string(output), "--success-codes") {
+			t.Errorf("--success-codes %q: error should name the flag, got: %s", spec, output)
+		}
+	}
+}
+
+// TestJoinPrintExit verifies --print-exit writes the recorded exit code to the
+// TestLogSchemaVersion verifies fork records the log schema version, and
+// that join and verify warn about, but still read, a log recorded by a newer
+// bgx.
+func TestLogSchemaVersion(t *testing.T) {
+	dbPath := setupDB(t)
+	if err := exec.Command(bgxPath, "exec", "--task-name", "current", "--", "true").Run(); err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var v int
+	if err := db.QueryRow("SELECT v FROM events WHERE task = ? AND type = ?", "current", EventTypeStart).Scan(&v); err != nil || v != LogSchemaVersion {
+		t.Errorf("Start event v = %d, %v; want %d", v, err, LogSchemaVersion)
+	}
+
+	now := time.Now()
+	seedTask(t, "future",
+		Event{Type: EventTypeStart, Time: now, V: LogSchemaVersion + 1, PID: 1, Command: []string{"true"}},
+		Event{Type: EventTypeStdout, Time: now, Data: "hi\n"},
+		Event{Type: EventTypeExit, Time: now, Code: 3},
+	)
+	join := exec.Command(bgxPath, "join", "--task-name", "future")
+	var stdout, stderr strings.Builder
+	join.Stdout, join.Stderr = &stdout, &stderr
+	if got := exitCodeOf(t, join.Run()); got != 3 || stdout.String() != "hi\n" {
+		t.Errorf("Join of a future log = %q, exit %d; want its output and code 3", stdout.String(), got)
+	}
+	if want := fmt.Sprintf("recorded by a newer bgx (log schema v%d", LogSchemaVersion+1); !strings.Contains(stderr.String(), want) {
+		t.Errorf("Join should warn about the newer schema, got stderr %q", stderr.String())
+	}
+	output, err := exec.Command(bgxPath, "verify", "--task-name", "future").CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "recorded by a newer bgx") {
+		t.Errorf("Verify of a future log = %v, %s; want a warning and success", err, output)
+	}
+
+	join = exec.Command(bgxPath, "join", "--task-name", "current")
+	if output, err := join.CombinedOutput(); err != nil || strings.Contains(string(output), "warning") {
+		t.Errorf("Join of a current log = %v, %q; want no warning", err, output)
+	}
+}
+
+// TestJoinGrep verifies --grep and --grep-v replay only the matching output
+// lines, line by line within an event, while still exiting with the task's
+// code.
+func TestJoinGrep(t *testing.T) {
+	setupDB(t)
+	now := time.Now()
+	seedTask(t, "chatty",
+		Event{Type: EventTypeStart, Time: now, PID: 1, Command: []string{"make"}},
+		Event{Type: EventTypeStdout, Time: now, Data: "compiling a\n"},
+		Event{Type: EventTypeStderr, Time: now, Data: "error: a failed\n"},
+		Event{Type: EventTypeStdout, Time: now, Data: "compiling b\nerror: b failed\ncompiling c\n"},
+		Event{Type: EventTypeHeartbeat, Time: now},
+		Event{Type: EventTypeExit, Time: now, Code: 2},
+	)
+	for _, tc := range []struct {
+		args           []string
+		stdout, stderr string
+	}{
+		{[]string{"--grep", "^error"}, "error: b failed\n", "error: a failed\n"},
+		{[]string{"--grep-v", "^error"}, "compiling a\ncompiling b\ncompiling c\n", ""},
+		{[]string{"--grep", "failed", "--grep-v", "a "}, "error: b failed\n", ""},
+		{[]string{"--grep", "nothing matches this"}, "", ""},
+	} {
+		cmd := exec.Command(bgxPath, append([]string{"join", "--task-name", "chatty"}, tc.args...)...)
+		var stdout, stderr strings.Builder
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if got := exitCodeOf(t, cmd.Run()); got != 2 || stdout.String() != tc.stdout || stderr.String() != tc.stderr {
+			t.Errorf("join %q = %q, %q, exit %d; want %q, %q, exit 2", tc.args, stdout.String(), stderr.String(), got, tc.stdout, tc.stderr)
+		}
+	}
+
+	output, err := exec.Command(bgxPath, "join", "--task-name", "chatty", "--grep", "(").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), `invalid --grep "("`) {
+		t.Errorf("An invalid --grep should fail, got %v: %s", err, output)
+	}
+}
+
+// TestJoinShowHeartbeats verifies --show-heartbeats prints a line to stderr
+// for each heartbeat of a task that goes quiet, leaving stdout and the exit
+// code alone, and that it is refused with structured output.
+func TestJoinShowHeartbeats(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping heartbeat-interval test in short mode")
+	}
+	setupDB(t)
+	taskName := "quiet"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "sh", "-c", "echo begin; sleep 6; echo end; exit 3")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+	join := exec.Command(bgxPath, "join", "--task-name", taskName, "--show-heartbeats")
+	var stdout, stderr strings.Builder
+	join.Stdout, join.Stderr = &stdout, &stderr
+	if got := exitCodeOf(t, join.Run()); got != 3 {
+		t.Errorf("Expected exit code 3, got %d", got)
+	}
+	if stdout.String() != "begin\nend\n" {
+		t.Errorf("Stdout = %q, want only the task's output", stdout.String())
+	}
+	lines := strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n")
+	if len(lines) == 0 || !regexp.MustCompile(`^\[heartbeat\] cpu=\d+\.\d\ds mem=\S+$`).MatchString(lines[0]) || strings.Contains(stderr.String(), "\r") {
+		t.Errorf("Stderr should have one plain [heartbeat] line per heartbeat, got %q", stderr.String())
+	}
+
+	output, err := exec.Command(bgxPath, "join", "--task-name", taskName, "--show-heartbeats", "--output", "json").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "--show-heartbeats only works with --output text") {
+		t.Errorf("--show-heartbeats with --output json should fail, got %v: %s", err, output)
+	}
+}
+
+// TestJoinGraphNotTerminal verifies --graph, which draws on a terminal only,
+// leaves a join whose stderr isn't one as the plain replay, or as
+// --show-heartbeats lines if that is given too, and is refused with
+// structured output.
+func TestJoinGraphNotTerminal(t *testing.T) {
+	setupDB(t)
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	seedTask(t, "busy",
+		Event{Type: EventTypeStart, Time: start, PID: 4242, Command: []string{"make"}},
+		Event{Type: EventTypeHeartbeat, Time: start.Add(5 * time.Second), CPUSeconds: 4, MemBytes: 10 << 20},
+		Event{Type: EventTypeStdout, Time: start.Add(6 * time.Second), Data: "halfway\n"},
+		Event{Type: EventTypeHeartbeat, Time: start.Add(10 * time.Second), CPUSeconds: 9, MemBytes: 20 << 20},
+		Event{Type: EventTypeStderr, Time: start.Add(11 * time.Second), Data: "warning\n"},
+		Event{Type: EventTypeExit, Time: start.Add(12 * time.Second), Code: 4})
+
+	join := func(args ...string) (string, string) {
+		t.Helper()
+		cmd := exec.Command(bgxPath, append([]string{"join", "--task-name", "busy"}, args...)...)
+		var stdout, stderr strings.Builder
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if got := exitCodeOf(t, cmd.Run()); got != 4 {
+			t.Errorf("join %q should exit with the task's code 4, got %d", args, got)
+		}
+		return stdout.String(), stderr.String()
+	}
+	plainOut, plainErr := join()
+	if graphOut, graphErr := join("--graph"); graphOut != plainOut || graphErr != plainErr {
+		t.Errorf("join --graph when not on a terminal = %q, %q; want the plain replay %q, %q", graphOut, graphErr, plainOut, plainErr)
+	}
+	heartbeatsOut, heartbeatsErr := join("--show-heartbeats")
+	if graphOut, graphErr := join("--graph", "--show-heartbeats"); graphOut != heartbeatsOut || graphErr != heartbeatsErr {
+		t.Errorf("join --graph --show-heartbeats when not on a terminal = %q, %q; want the --show-heartbeats lines %q, %q", graphOut, graphErr, heartbeatsOut, heartbeatsErr)
+	}
+
+	output, err := exec.Command(bgxPath, "join", "--task-name", "busy", "--graph", "--output", "json").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "--graph only works with --output text") {
+		t.Errorf("--graph with --output json should fail, got %v: %s", err, output)
+	}
+}
+
+// TestJoinOutputFiles verifies --stdout-file and --stderr-file split the
+// replayed streams into files, that - keeps a stream on the terminal, and
+// that the exit code is unaffected.
+func TestJoinOutputFiles(t *testing.T) {
+	setupDB(t)
+	if got := exitCodeOf(t, exec.Command(bgxPath, "exec", "--task-name", "split", "--", "sh", "-c", "echo out1; echo err1 >&2; echo out2; exit 4").Run()); got != 4 {
+		t.Fatalf("Exec should exit 4, got %d", got)
+	}
+	dir := t.TempDir()
+	outPath, errPath := filepath.Join(dir, "out.log"), filepath.Join(dir, "err.log")
+	if err := os.WriteFile(outPath, []byte("stale content to truncate\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	readFile := func(path string) string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	join := func(args ...string) (string, string, int) {
+		t.Helper()
+		cmd := exec.Command(bgxPath, append([]string{"join", "--task-name", "split"}, args...)...)
+		var stdout, stderr strings.Builder
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		code := exitCodeOf(t, cmd.Run())
+		return stdout.String(), stderr.String(), code
+	}
+
+	stdout, stderr, code := join("--stdout-file", outPath, "--stderr-file", errPath)
+	if stdout != "" || stderr != "" || code != 4 {
+		t.Errorf("Join to files = %q, %q, exit %d; want nothing on the terminal and exit 4", stdout, stderr, code)
+	}
+	if got := readFile(outPath); got != "out1\nout2\n" {
+		t.Errorf("stdout file = %q, want the task's stdout", got)
+	}
+	if got := readFile(errPath); got != "err1\n" {
+		t.Errorf("stderr file = %q, want the task's stderr", got)
+	}
+
+	stdout, stderr, code = join("--stdout-file", "-", "--stderr-file", errPath)
+	if stdout != "out1\nout2\n" || stderr != "" || code != 4 {
+		t.Errorf("Join with --stdout-file - = %q, %q, exit %d; want stdout on the terminal", stdout, stderr, code)
+	}
+
+	// The two streams are recorded independently, so only the order within
+	// each is fixed.
+	both := filepath.Join(dir, "both.log")
+	join("--stdout-file", both, "--stderr-file", both)
+	got := readFile(both)
+	if lines := strings.Fields(got); len(lines) != 3 || !strings.Contains(got, "err1\n") || !strings.Contains(strings.ReplaceAll(got, "err1\n", ""), "out1\nout2\n") {
+		t.Errorf("Shared file = %q, want both streams", got)
+	}
+
+	if _, stderr, code = join("--stdout-file", outPath, "--output", "json"); code != 1 || !strings.Contains(stderr, "only work with --output text") {
+		t.Errorf("--stdout-file with --output json = %d, %q; want an error", code, stderr)
+	}
+}
+
+// chosen descriptor after the output, even when --success-codes maps it to 0.
+func TestJoinPrintExit(t *testing.T) {
+	setupDB(t)
+	execCmd := exec.Command(bgxPath, "exec", "--task-name", "printed", "--", "sh", "-c", "echo out; exit 1")
+	if got := exitCodeOf(t, execCmd.Run()); got != 1 {
+		t.Fatalf("Exec should exit 1, got %d", got)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	joinCmd := exec.Command(bgxPath, "join", "--task-name", "printed", "--success-codes", "0,1", "--print-exit", "3")
+	joinCmd.ExtraFiles = []*os.File{w}
+	stdout, err := joinCmd.Output()
+	w.Close()
+	if err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+	if string(stdout) != "out\n" {
+		t.Errorf("stdout = %q, want only the replayed output", stdout)
+	}
+	printed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(printed) != "exit=1\n" {
+		t.Errorf("fd 3 = %q, want exit=1", printed)
+	}
+
+	// On fd 1 the line follows the replayed output.
+	stdout, err = exec.Command(bgxPath, "join", "--task-name", "printed", "--print-exit", "1").Output()
+	if got := exitCodeOf(t, err); got != 1 {
+		t.Errorf("Join should still exit with the task's code, got %d", got)
+	}
+	if string(stdout) != "out\nexit=1\n" {
+		t.Errorf("stdout = %q, want output then exit=1", stdout)
+	}
+}
+
+// TestJoinOutputFormats verifies --output writes one record per event, with
+// the chosen --fields, and keeps the task's exit code.
+func TestJoinOutputFormats(t *testing.T) {
+	setupDB(t)
+	execCmd := exec.Command(bgxPath, "exec", "--task-name", "records", "--", "sh", "-c", "echo 'a, b'; exit 2")
+	if got := exitCodeOf(t, execCmd.Run()); got != 2 {
+		t.Fatalf("Exec should exit 2, got %d", got)
+	}
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"csv", "type,data,code\nstart,,\nstdout,\"a, b\n\",\nexit,,2\n"},
+		{"json", `{"type":"start"}` + "\n" + `{"type":"stdout","data":"a, b\n"}` + "\n" + `{"type":"exit","code":2}` + "\n"},
+		{"logfmt", "type=start\ntype=stdout data=\"a, b\\n\"\ntype=exit code=2\n"},
+	}
+	for _, tt := range tests {
+		stdout, err := exec.Command(bgxPath, "join", "--task-name", "records", "--output", tt.format, "--fields", "type,data,code").Output()
+		if got := exitCodeOf(t, err); got != 2 {
+			t.Errorf("--output %s: exit code = %d, want 2", tt.format, got)
+		}
+		if string(stdout) != tt.want {
+			t.Errorf("--output %s:\ngot  %q\nwant %q", tt.format, stdout, tt.want)
+		}
+	}
+
+	if output, err := exec.Command(bgxPath, "join", "--task-name", "records", "--fields", "type").CombinedOutput(); err == nil {
+		t.Errorf("--fields without a structured --output should be rejected, got: %s", output)
+	}
+}
+
+// TestJoinInputFile verifies join --input-file replays a log saved as NDJSON,
+// as a file sink writes it, without touching BGX_DB: every task in it, or
+// those named, with the exit code of the exit event. A log that ends before
+// the exit event, and a file that is missing or isn't NDJSON, fail clearly.
+func TestJoinInputFile(t *testing.T) {
+	dbPath := setupDB(t)
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	saved := write("saved.ndjson", `{"task":"build","type":"start","time":"2026-01-02T03:04:05Z","v":1,"pid":4242,"command":["make"]}
+{"task":"lint","type":"start","time":"2026-01-02T03:04:05.1Z","v":1,"pid":4243,"command":["make","lint"]}
+{"task":"build","type":"stdout","time":"2026-01-02T03:04:06Z","data":"compiling\n"}
+{"task":"lint","type":"heartbeat","time":"2026-01-02T03:04:07Z","cpu_seconds":0.5,"mem_bytes":1024}
+{"task":"build","type":"stderr","time":"2026-01-02T03:04:07Z","data":"warning: unused\n"}
+{"task":"lint","type":"stdout","time":"2026-01-02T03:04:08Z","data":"clean\n"}
+{"task":"lint","type":"exit","time":"2026-01-02T03:04:09Z","code":0,"exit_reason":"exited normally"}
+
+{"task":"build","type":"exit","time":"2026-01-02T03:04:10Z","code":2,"exit_reason":"exited with code 2"}`)
+
+	join := func(args ...string) (string, string, int) {
+		t.Helper()
+		cmd := exec.Command(bgxPath, append([]string{"join"}, args...)...)
+		var stdout, stderr strings.Builder
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		code := exitCodeOf(t, cmd.Run())
+		return stdout.String(), stderr.String(), code
+	}
+	stdout, stderr, code := join("--input-file", saved, "--task-name", "build")
+	if stdout != "compiling\n" || stderr != "warning: unused\n" || code != 2 {
+		t.Errorf("join --input-file --task-name build = %q, %q, code %d; want its output and code 2", stdout, stderr, code)
+	}
+	stdout, _, code = join("--input-file", saved, "--group")
+	if want := "::group::build\ncompiling\n::endgroup::\n::group::lint\nclean\n::endgroup::\n"; stdout != want || code != 2 {
+		t.Errorf("join --input-file with every task = %q, code %d; want %q, code 2", stdout, code, want)
+	}
+	if _, stderr, code := join("--input-file", saved, "--task-name", "test"); code != 1 || !strings.Contains(stderr, `task "test" not found in --input-file`) {
+		t.Errorf("join --input-file of a task not in it = code %d, %q; want it not found", code, stderr)
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Errorf("Replaying a file should leave BGX_DB alone, but it was created: %v", err)
+	}
+
+	// join --output json writes the same form; without its task field, the
+	// task is named after the file.
+	exported := write("exported.ndjson", `{"time":"2026-01-02T03:04:05Z","type":"start"}
+{"time":"2026-01-02T03:04:06Z","type":"stdout","data":"hi\n"}
+{"time":"2026-01-02T03:04:07Z","type":"exit","code":0}
+`)
+	if stdout, _, code := join("--input-file", exported, "--output", "json", "--fields", "task,type,code"); code != 0 ||
+		stdout != `{"task":"exported","type":"start"}`+"\n"+`{"task":"exported","type":"stdout"}`+"\n"+`{"task":"exported","type":"exit","code":0}`+"\n" {
+		t.Errorf("join --input-file of an export = %q, code %d", stdout, code)
+	}
+
+	start := time.Now()
+	cut := write("cut.ndjson", `{"task":"build","type":"start","time":"2026-01-02T03:04:05Z","pid":4242,"command":["make"]}
+{"task":"build","type":"stdout","time":"2026-01-02T03:04:06Z","data":"compiling\n"}
+`)
+	stdout, stderr, code = join("--input-file", cut)
+	if stdout != "compiling\n" || code != 1 || !strings.Contains(stderr, `ends before task "build" exited`) || time.Since(start) > 5*time.Second {
+		t.Errorf("join --input-file of a log cut short = %q, %q, code %d after %v; want its output, then an error at once", stdout, stderr, code, time.Since(start))
+	}
+
+	for path, want := range map[string]string{
+		filepath.Join(dir, "missing.ndjson"):                    "failed to read --input-file: open ",
+		write("bad.ndjson", "{\"type\":\"start\"}\nnot json\n"): "bad.ndjson, line 2: invalid character",
+		write("untyped.ndjson", `{"data":"x"}`):                 "untyped.ndjson, line 1: no event type",
+		write("empty.ndjson", ""):                               "has no events",
+	} {
+		if _, stderr, code := join("--input-file", path); code != 1 || !strings.Contains(stderr, want) {
+			t.Errorf("join --input-file %s = code %d, %q; want an error containing %q", filepath.Base(path), code, stderr, want)
+		}
+	}
+	if _, stderr, code := join("--input-file", saved, "--checkpoint", filepath.Join(dir, "cp")); code != 1 || !strings.Contains(stderr, "can't be used with --checkpoint") {
+		t.Errorf("join --input-file --checkpoint = code %d, %q; want it refused", code, stderr)
+	}
+}
+
+// TestJoinCheckpoint verifies --checkpoint resumes after what an earlier join
+// replayed, and starts over when the database has been reset since.
+func TestJoinCheckpoint(t *testing.T) {
+	setupDB(t)
+	checkpointFile := filepath.Join(t.TempDir(), "join.checkpoint")
+	run := func(script string) {
+		t.Helper()
+		execCmd := exec.Command(bgxPath, "exec", "--task-name", "long", "--", "sh", "-c", script)
+		if got := exitCodeOf(t, execCmd.Run()); got != 3 {
+			t.Fatalf("Exec should exit 3, got %d", got)
+		}
+	}
+	join := func() string {
+		t.Helper()
+		stdout, err := exec.Command(bgxPath, "join", "--task-name", "long", "--checkpoint", checkpointFile).Output()
+		if got := exitCodeOf(t, err); got != 3 {
+			t.Errorf("Join should exit with the task's code 3, got %d", got)
+		}
+		return string(stdout)
+	}
+
+	run("echo one; echo two; exit 3")
+	if got := join(); got != "one\ntwo\n" {
+		t.Errorf("First join = %q, want the full output", got)
+	}
+	if got := join(); got != "" {
+		t.Errorf("Resumed join = %q, want nothing new", got)
+	}
+
+	// A fresh database reuses ids, but not the checkpointed event's time.
+	setupDB(t)
+	run("echo three; echo four; exit 3")
+	if got := join(); got != "three\nfour\n" {
+		t.Errorf("Join after a reset = %q, want the full output", got)
+	}
+}
+
+// TestJoinCheckpointLinger verifies --linger doesn't checkpoint the events
+// it reads past the exit, which would leave the next join with no exit to
+// find.
+func TestJoinCheckpointLinger(t *testing.T) {
+	setupDB(t)
+	checkpointFile := filepath.Join(t.TempDir(), "join.checkpoint")
+	now := time.Now()
+	seedTask(t, "t",
+		Event{Type: EventTypeStart, Time: now, PID: 1, Command: []string{"true"}},
+		Event{Type: EventTypeStdout, Time: now, Data: "done\n"},
+		Event{Type: EventTypeExit, Time: now, Code: 4},
+		Event{Type: EventTypeAccess, Time: now, Data: "wait"},
+	)
+
+	for _, want := range []string{"done\n", ""} {
+		joinCmd := exec.Command(bgxPath, "join", "--task-name", "t", "--checkpoint", checkpointFile,
+			"--linger", "300ms", "--heartbeat-timeout", "1s")
+		var stdout, stderr strings.Builder
+		joinCmd.Stdout, joinCmd.Stderr = &stdout, &stderr
+		if got := exitCodeOf(t, joinCmd.Run()); got != 4 {
+			t.Errorf("Join should exit with the task's code 4, got %d: %s", got, stderr.String())
+		}
+		if stdout.String() != want {
+			t.Errorf("Join = %q, want %q", stdout.String(), want)
+		}
+	}
+}
+
+// TestJoinWarmup verifies --warmup keeps join waiting for a task that records
+// nothing at first, where the heartbeat timeout alone would give up.
+func TestJoinWarmup(t *testing.T) {
+	setupDB(t)
+	seedTask(t, "slow") // registered, but no start event yet
+
+	output, err := exec.Command(bgxPath, "join", "--task-name", "slow", "--heartbeat-timeout", "500ms").CombinedOutput()
+	if err == nil || !strings.Contains(string(output), "heartbeat timeout") {
+		t.Fatalf("Join without --warmup should time out, got err=%v output: %s", err, output)
+	}
+
+	joinCmd := exec.Command(bgxPath, "join", "--task-name", "slow", "--heartbeat-timeout", "500ms", "--warmup", "3s")
+	var joinOutput strings.Builder
+	joinCmd.Stdout, joinCmd.Stderr = &joinOutput, &joinOutput
+	if err := joinCmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The task starts well after the heartbeat timeout, within the warmup.
+	time.Sleep(1500 * time.Millisecond)
+	db, err := openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, e := range []Event{
+		{Type: EventTypeStart, Time: time.Now(), PID: 1, Command: []string{"true"}},
+		{Type: EventTypeStdout, Time: time.Now(), Data: "ready\n"},
+		{Type: EventTypeExit, Time: time.Now(), Code: 5},
+	} {
+		if err := insertEvent(db, "slow", e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := exitCodeOf(t, joinCmd.Wait()); got != 5 {
+		t.Errorf("Join with --warmup should exit with the task's code 5, got %d (output: %s)", got, joinOutput.String())
+	}
+	if !strings.Contains(joinOutput.String(), "ready") {
+		t.Errorf("Join should replay the output, got: %s", joinOutput.String())
+	}
+}
+
+// TestJoinAudit verifies --audit records who joined or waited on a task,
+// without disturbing the task's status or its replay.
+func TestJoinAudit(t *testing.T) {
+	dbPath := setupDB(t)
+	t.Setenv("USER", "alice")
+	if got := exitCodeOf(t, exec.Command(bgxPath, "exec", "--task-name", "audited", "--", "echo", "hi").Run()); got != 0 {
+		t.Fatalf("Exec should succeed, got %d", got)
+	}
+	before, err := exec.Command(bgxPath, "status", "--task-name", "audited").Output()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+
+	stdout, err := exec.Command(bgxPath, "join", "--task-name", "audited", "--audit").Output()
+	if err != nil || string(stdout) != "hi\n" {
+		t.Errorf("Join --audit = %q, %v; want the task's output", stdout, err)
+	}
+	if err := exec.Command(bgxPath, "wait", "--task-name", "audited", "--audit").Run(); err != nil {
+		t.Errorf("Wait --audit failed: %v", err)
+	}
+
+	var accesses []string
+	for _, e := range readEvents(t, dbPath, "audited") {
+		if e.Type == EventTypeAccess {
+			accesses = append(accesses, e.Data)
+		}
+	}
+	if fmt.Sprint(accesses) != "[join by alice wait by alice]" {
+		t.Errorf("access events = %q, want join and wait by alice", accesses)
+	}
+
+	after, err := exec.Command(bgxPath, "status", "--task-name", "audited").Output()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("Access events should not change the status:\nbefore:\n%s\nafter:\n%s", before, after)
+	}
+}
+
+// TestJoinHost verifies join --host runs join on the host through $BGX_SSH,
+// passing its output and exit code through, and says so when ssh fails or
+// bgx is not installed there. The fake ssh runs the remote command locally.
+func TestJoinHost(t *testing.T) {
+	setupDB(t)
+	if got := exitCodeOf(t, exec.Command(bgxPath, "exec", "--task-name", "remote", "--", "sh", "-c", "printf out; echo err >&2; exit 3").Run()); got != 3 {
+		t.Fatalf("Exec should exit 3, got %d", got)
+	}
+	bin, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	join := func(script string, args ...string) (string, string, int) {
+		t.Helper()
+		ssh := filepath.Join(dir, "ssh")
+		if err := os.WriteFile(ssh, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(bgxPath, append([]string{"join", "--host", "box"}, args...)...)
+		cmd.Env = append(os.Environ(), "BGX_SSH="+ssh)
+		var stdout, stderr strings.Builder
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		code := exitCodeOf(t, cmd.Run())
+		return stdout.String(), stderr.String(), code
+	}
+	// Like ssh, run the arguments after the host through a shell.
+	remote := `shift; PATH="` + bin + `:$PATH" exec sh -c "$*"`
+
+	stdout, stderr, code := join(remote, "--task-name", "remote")
+	if stdout != "out" || stderr != "err\n" || code != 3 {
+		t.Errorf("join --host = %q, %q, %d; want the task's output and code 3", stdout, stderr, code)
+	}
+	stdout, _, code = join(remote, "--task-name", "remote", "--success-codes", "3")
+	if stdout != "out" || code != 0 {
+		t.Errorf("join --host --success-codes 3 = %q, %d; want the output and code 0", stdout, code)
+	}
+	_, stderr, code = join(remote, "--task-name", "missing")
+	if code != 1 || !strings.Contains(stderr, `task "missing" not found`) {
+		t.Errorf("Remote join of a missing task = %d, %q; want 1 and the remote error", code, stderr)
+	}
+
+	// A PATH with a shell but no bgx.
+	noBgx := t.TempDir()
+	if err := os.Symlink("/bin/sh", filepath.Join(noBgx, "sh")); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, code = join(`shift; PATH=`+noBgx+` exec sh -c "$*"`, "--task-name", "remote")
+	if code != 1 || !strings.Contains(stderr, `bgx is not installed on "box"`) {
+		t.Errorf("join --host without a remote bgx = %d, %q; want the not-installed error", code, stderr)
+	}
+	_, stderr, code = join(`echo "ssh: connect to host box port 22: Connection refused" >&2; exit 255`, "--task-name", "remote")
+	if code != 1 || !strings.Contains(stderr, "Connection refused") || !strings.Contains(stderr, `to "box" failed`) {
+		t.Errorf("join --host with ssh failing = %d, %q; want ssh's error and a failure message", code, stderr)
+	}
+
+	if err := exec.Command(bgxPath, "join", "--host", "box", "--task-name", "remote", "--print-exit", "1").Run(); err == nil {
+		t.Error("join --host should reject --print-exit")
+	}
+}
+
+// TestForkInPipeline verifies fork's daemon holds none of fork's stdio: a
+// pipeline reading fork's output sees EOF once fork returns, not once the
+// task is done.
+func TestForkInPipeline(t *testing.T) {
+	setupDB(t)
+	start := time.Now()
+	pipeline := exec.Command("sh", "-c", `"$0" fork --task-name piped -- sleep 10 2>&1 | cat`, bgxPath)
+	output, err := pipeline.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Pipeline failed: %v, output: %s", err, output)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("The pipeline took %v; the daemon kept it open", elapsed)
+	}
+	if !strings.Contains(string(output), "Started task 'piped'") {
+		t.Errorf("Expected fork's message through the pipe, got: %s", output)
+	}
+	exec.Command(bgxPath, "kill", "--task-name", "piped").Run()
+}
+
+// TestForkResolvesOwnExecutable verifies the daemon is re-executed from the
+// running binary's real path, not from argv[0]: here argv[0] names nothing that
+// exists, and the binary lives in a directory that isn't the working directory.
+func TestForkResolvesOwnExecutable(t *testing.T) {
+	setupDB(t)
+	taskName := "moved_binary"
+
+	data, err := os.ReadFile(bgxPath)
+	if err != nil {
+		t.Fatalf("Failed to read bgx binary: %v", err)
+	}
+	copyPath := filepath.Join(t.TempDir(), "bgx-copy")
+	if err := os.WriteFile(copyPath, data, 0755); err != nil {
+		t.Fatalf("Failed to copy bgx binary: %v", err)
+	}
+
+	forkCmd := &exec.Cmd{
+		Path: copyPath,
+		Args: []string{"bgx-not-on-path", "fork", "--task-name", taskName, "--", "echo", "relocated"},
+		Dir:  t.TempDir(),
+	}
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	output, err := exec.Command(bgxPath, "join", "--task-name", taskName).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Join failed: %v, output: %s", err, output)
+	}
+	if !strings.Contains(string(output), "relocated") {
+		t.Errorf("Expected 'relocated' in output, got: %s", output)
+	}
+}
+
+// TestBgxVersion verifies bgx version names the build, with the Go version,
+// and that a task's start event, and so status --json, records the version
+// and commit that ran it.
+func TestBgxVersion(t *testing.T) {
+	dbPath := setupDB(t)
+	output, err := exec.Command(bgxPath, "--version").Output()
+	if err != nil {
+		t.Fatalf("bgx --version failed: %v", err)
+	}
+	m := regexp.MustCompile(`^bgx (\S+) \(commit (\S+), built \S+, go\S+ \w+/\w+\)\n$`).FindStringSubmatch(string(output))
+	if m == nil {
+		t.Fatalf("bgx --version = %q, want the version, commit, date and Go version", output)
+	}
+	want := m[1] + " (commit " + m[2] + ")"
+
+	if err := exec.Command(bgxPath, "exec", "--task-name", "versioned", "--", "true").Run(); err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var got string
+	if err := db.QueryRow("SELECT bgx_version FROM events WHERE task = ? AND type = ?", "versioned", EventTypeStart).Scan(&got); err != nil || got != want {
+		t.Errorf("Start event bgx_version = %q, %v; want %q", got, err, want)
+	}
+	status, err := exec.Command(bgxPath, "status", "--task-name", "versioned", "--json").Output()
+	if err != nil || !strings.Contains(string(status), fmt.Sprintf(`"bgx_version":%q`, want)) {
+		t.Errorf("status --json should give the bgx version %q, got %v: %s", want, err, status)
+	}
+}
+
+// TestDaemonVersionMismatch verifies a daemon that isn't the build its parent
+// expected records a startup failure instead of running the command.
+func TestDaemonVersionMismatch(t *testing.T) {
+	setupDB(t)
+	taskName := "mismatch"
+	seedTask(t, taskName) // registered by a (simulated) parent fork
+
+	daemon := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "echo", "should-not-run")
+	daemon.Env = append(os.Environ(), "BGX_DAEMON_MODE=1", "BGX_DAEMON_VERSION=0.0.0-other (commit elsewhere)")
+	if err := daemon.Run(); err == nil {
+		t.Error("Daemon with a mismatched version should fail")
+	}
+
+	output, err := exec.Command(bgxPath, "join", "--task-name", taskName).CombinedOutput()
+	if got := exitCodeOf(t, err); got != 127 {
+		t.Errorf("Expected exit code 127 for the startup failure, got %d", got)
+	}
+	if !strings.Contains(string(output), "replaced") || strings.Contains(string(output), "should-not-run") {
+		t.Errorf("Expected a version-mismatch error and no command output, got: %s", output)
+	}
+}
+
+// TestNamespacedTaskNames verifies names containing '/' (and even "..") are
+// ordinary keys: tasks live in the database, not in files named after them, so
+// there is no path to traverse and namespaced names need no special handling.
+func TestNamespacedTaskNames(t *testing.T) {
+	setupDB(t)
+
+	for _, taskName := range []string{"project-a/build", "project-b/build", "../escape"} {
+		forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "echo", "in "+taskName)
+		if output, err := forkCmd.CombinedOutput(); err != nil {
+			t.Fatalf("Fork %s failed: %v, output: %s", taskName, err, output)
+		}
+	}
+	for _, taskName := range []string{"project-a/build", "project-b/build", "../escape"} {
+		output, err := exec.Command(bgxPath, "join", "--task-name", taskName).CombinedOutput()
+		if err != nil {
+			t.Fatalf("Join %s failed: %v, output: %s", taskName, err, output)
+		}
+		if !strings.Contains(string(output), "in "+taskName) {
+			t.Errorf("Join %s: expected its own output, got: %s", taskName, output)
+		}
+	}
+}
+
+// TestJoinColor verifies --color: auto leaves piped output free of escape
+// codes, always colors stderr (and only stderr), never disables it.
+func TestJoinColor(t *testing.T) {
+	setupDB(t)
+	taskName := "colored"
+
+	execCmd := exec.Command(bgxPath, "exec", "--task-name", taskName, "--", "sh", "-c", "echo plain; echo oops >&2")
+	if err := execCmd.Run(); err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+
+	join := func(flags ...string) (stdout, stderr string) {
+		t.Helper()
+		joinCmd := exec.Command(bgxPath, append([]string{"join", "--task-name", taskName}, flags...)...)
+		var out, errOut strings.Builder
+		joinCmd.Stdout, joinCmd.Stderr = &out, &errOut
+		if err := joinCmd.Run(); err != nil {
+			t.Fatalf("Join %v failed: %v", flags, err)
+		}
+		return out.String(), errOut.String()
+	}
+
+	for _, flags := range [][]string{nil, {"--color", "auto"}, {"--color", "never"}, {"--color", "never", "--timestamps"}} {
+		stdout, stderr := join(flags...)
+		if strings.Contains(stdout+stderr, "\x1b[") {
+			t.Errorf("join %v: escape codes leaked into non-terminal output: %q / %q", flags, stdout, stderr)
+		}
+	}
+
+	stdout, stderr := join("--color", "always")
+	if stdout != "plain\n" {
+		t.Errorf("stdout should stay uncolored, got %q", stdout)
+	}
+	if want := "\x1b[31moops\x1b[0m\n"; stderr != want {
+		t.Errorf("stderr = %q, want %q", stderr, want)
+	}
+}
+
+// TestJoinReplaySpeed verifies --replay-speed spaces replayed events by their
+// recorded gaps divided by the speed.
+func TestJoinReplaySpeed(t *testing.T) {
+	setupDB(t)
+	taskName := "paced"
+	t0 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	seedTask(t, taskName,
+		Event{Type: EventTypeStart, Time: t0},
+		Event{Type: EventTypeStdout, Time: t0, Data: "first\n"},
+		Event{Type: EventTypeHeartbeat, Time: t0.Add(1 * time.Second)},
+		Event{Type: EventTypeStdout, Time: t0.Add(2 * time.Second), Data: "second\n"},
+		Event{Type: EventTypeExit, Time: t0.Add(3 * time.Second)},
+	)
+
+	for _, tt := range []struct {
+		flags    []string
+		min, max time.Duration
+	}{
+		{nil, 0, 2 * time.Second}, // instant
+		{[]string{"--replay-speed", "2"}, 1400 * time.Millisecond, 3 * time.Second}, // 3s / 2
+		{[]string{"--replay-speed", "30"}, 0, 1 * time.Second},                      // 3s / 30
+	} {
+		start := time.Now()
+		output, err := exec.Command(bgxPath, append([]string{"join", "--task-name", taskName}, tt.flags...)...).CombinedOutput()
+		elapsed := time.Since(start)
+		if err != nil {
+			t.Fatalf("Join %v failed: %v, output: %s", tt.flags, err, output)
+		}
+		if string(output) != "first\nsecond\n" {
+			t.Errorf("Join %v: unexpected output %q", tt.flags, output)
+		}
+		if elapsed < tt.min || elapsed > tt.max {
+			t.Errorf("Join %v took %v, want between %v and %v", tt.flags, elapsed, tt.min, tt.max)
+		}
+	}
+}
+
+// TestForkLogTypes verifies --log-types drops unlisted event types while
+// keeping start and exit, so join still reports the exit code.
+func TestForkLogTypes(t *testing.T) {
+	dbPath := setupDB(t)
+	taskName := "filtered"
+
+	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--log-types", "stderr", "--", "sh", "-c", "echo dropped; echo kept >&2; exit 5")
+	if output, err := forkCmd.CombinedOutput(); err != nil {
+		t.Fatalf("Fork failed: %v, output: %s", err, output)
+	}
+
+	joinCmd := exec.Command(bgxPath, "join", "--task-name", taskName)
+	var stdout, stderr strings.Builder
+	joinCmd.Stdout, joinCmd.Stderr = &stdout, &stderr
+	if got := exitCodeOf(t, joinCmd.Run()); got != 5 {
+		t.Errorf("Expected exit code 5, got %d", got)
+	}
+	if stdout.String() != "" {
+		t.Errorf("stdout events should not be recorded, got: %q", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "kept") {
+		t.Errorf("Expected 'kept' on stderr, got: %q", stderr.String())
+	}
+
+	var types []string
+	for _, e := range readEvents(t, dbPath, taskName) {
+		types = append(types, e.Type)
+	}
+	if got, want := strings.Join(types, ","), "start,stderr,exit"; got != want {
+		t.Errorf("Recorded event types = %s, want %s", got, want)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	var logTypes string
+	var noHeartbeat bool
+	if err := db.QueryRow("SELECT log_types, no_heartbeat FROM events WHERE task = ? AND type = ?", taskName, EventTypeStart).Scan(&logTypes, &noHeartbeat); err != nil {
+		t.Fatalf("Failed to read start event: %v", err)
+	}
+	if logTypes != "stderr" || !noHeartbeat {
+		t.Errorf("Start event should record log_types=stderr and no heartbeats, got %q, %v", logTypes, noHeartbeat)
+	}
+}
+
+func TestForkInvalidLogTypes(t *testing.T) {
+	setupDB(t)
+
+	output, err := exec.Command(bgxPath, "fork", "--task-name", "x", "--log-types", "stdout,bogus", "--", "true").CombinedOutput()
+	if err == nil {
+		t.Error("Fork should reject an unknown event type")
+	}
+	if !strings.Contains(string(output), `"bogus"`) {
+		t.Errorf("Error should name the bad type, got: %s", output)
+	}
+}
+
 func TestDaemonModeNotLeaked(t *testing.T) {
 	setupDB(t)
 	taskName := "env_leak"
 
 	forkCmd := exec.Command(bgxPath, "fork", "--task-name", taskName, "--", "sh", "-c",
-		`echo "mode=[$BGX_DAEMON_MODE]"`)
+		`echo "mode=[$BGX_DAEMON_MODE] version=[$BGX_DAEMON_VERSION]"`)
 	if err := forkCmd.Run(); err != nil {
 		t.Fatalf("Fork failed: %v", err)
 	}
@@ -639,8 +4559,8 @@ func TestDaemonModeNotLeaked(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Join failed: %v", err)
 	}
-	if !strings.Contains(string(output), "mode=[]") {
-		t.Errorf("BGX_DAEMON_MODE should not leak into the task, got: %s", output)
+	if !strings.Contains(string(output), "mode=[] version=[]") {
+		t.Errorf("BGX_DAEMON_MODE/BGX_DAEMON_VERSION should not leak into the task, got: %s", output)
 	}
 }
 
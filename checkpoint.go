@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// checkpoint remembers, across `join --checkpoint FILE` runs, the last event
+// of each task that join has replayed, so the next run resumes after it. The
+// event's id is join's read cursor; its time is kept to recognize the same
+// event again.
+//
+// A nil checkpoint does nothing, so streamTask can always call it.
+type checkpoint struct {
+	path string
+
+	mu    sync.Mutex // tasks joined concurrently share the file
+	tasks map[string]checkpointEntry
+}
+
+// checkpointEntry is one task's position in the checkpoint file.
+type checkpointEntry struct {
+	ID   int64  `json:"id"`
+	Time string `json:"time"`
+}
+
+// loadCheckpoint reads the checkpoint file at path. A file that doesn't exist
+// yet is an empty checkpoint: every task starts from the beginning.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	cp := &checkpoint{path: path, tasks: map[string]checkpointEntry{}}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --checkpoint: %w", err)
+	}
+	if err := json.Unmarshal(b, &cp.tasks); err != nil {
+		return nil, fmt.Errorf("invalid --checkpoint file %s: %w", path, err)
+	}
+	return cp, nil
+}
+
+// resumeID returns the id to resume reading the task after: the checkpointed
+// event's id, or 0 (the beginning) if there is none. If the database no longer
+// has that event with the same time, it was reset or replaced since the
+// checkpoint was saved, and the task is replayed from the beginning too.
+func (cp *checkpoint) resumeID(db *sql.DB, task string) (int64, error) {
+	if cp == nil {
+		return 0, nil
+	}
+	cp.mu.Lock()
+	entry, ok := cp.tasks[task]
+	cp.mu.Unlock()
+	if !ok {
+		return 0, nil
+	}
+	stored, found, err := storedEventTime(db, task, entry.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check --checkpoint for %q: %w", task, err)
+	}
+	if !found || stored != entry.Time {
+		return 0, nil
+	}
+	return entry.ID, nil
+}
+
+// save records e as the last event replayed for the task and rewrites the
+// file; a zero e (nothing new replayed) leaves it as it is. The file is
+// replaced atomically, so a join that is interrupted mid-write leaves the
+// previous checkpoint intact.
+func (cp *checkpoint) save(task string, e eventRow) error {
+	if cp == nil || e.ID == 0 {
+		return nil
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.tasks[task] = checkpointEntry{ID: e.ID, Time: e.Time}
+	b, err := json.MarshalIndent(cp.tasks, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(cp.path, append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write --checkpoint: %w", err)
+	}
+	return nil
+}
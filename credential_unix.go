@@ -0,0 +1,86 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// credential resolves --user and --group to the identity the command runs
+// as, or nil without either. A user gives its uid and, unless --group says
+// otherwise, its primary group; a group alone keeps bgx's uid. Names are
+// looked up first, so a numeric name still resolves by name, and plain
+// numbers work without an entry in the user database.
+func (cfg forkConfig) credential() (*syscall.Credential, error) {
+	if cfg.user == "" && cfg.group == "" {
+		return nil, nil
+	}
+	if euid := os.Geteuid(); euid != 0 {
+		return nil, fmt.Errorf("--user and --group need bgx to run as root (it runs as uid %d)", euid)
+	}
+	uid, gid := os.Getuid(), -1
+	if cfg.user != "" {
+		u, err := user.Lookup(cfg.user)
+		if err != nil && isID(cfg.user) {
+			u, err = user.LookupId(cfg.user)
+		}
+		switch {
+		case err == nil:
+			uid, _ = strconv.Atoi(u.Uid)
+			gid, _ = strconv.Atoi(u.Gid)
+		case isID(cfg.user):
+			uid, _ = strconv.Atoi(cfg.user)
+		default:
+			return nil, fmt.Errorf("--user %q: %w", cfg.user, err)
+		}
+	}
+	if cfg.group != "" {
+		g, err := user.LookupGroup(cfg.group)
+		switch {
+		case err == nil:
+			gid, _ = strconv.Atoi(g.Gid)
+		case isID(cfg.group):
+			gid, _ = strconv.Atoi(cfg.group)
+		default:
+			return nil, fmt.Errorf("--group %q: %w", cfg.group, err)
+		}
+	}
+	if gid < 0 {
+		return nil, fmt.Errorf("--user %s has no entry in the user database to take a group from; pass --group too", cfg.user)
+	}
+	// With no Groups, the command also loses bgx's supplementary groups.
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// isID reports whether s is a plain non-negative number, such as a uid.
+func isID(s string) bool {
+	n, err := strconv.ParseUint(s, 10, 32)
+	return err == nil && strconv.FormatUint(n, 10) == s
+}
+
+// checkCredential fails if --user and --group can't be honored, so that the
+// parent reports it before claiming the task name.
+func (cfg forkConfig) checkCredential() error {
+	_, err := cfg.credential()
+	return err
+}
+
+// runAs sets up cmd to run with the --user and --group identity, if any, and
+// returns the uid and gid it will run as for the start event.
+func (cfg forkConfig) runAs(cmd *exec.Cmd) (uid, gid *int, err error) {
+	cred, err := cfg.credential()
+	if err != nil {
+		return nil, nil, err
+	}
+	u, g := os.Getuid(), os.Getgid()
+	if cred != nil {
+		u, g = int(cred.Uid), int(cred.Gid)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	return &u, &g, nil
+}
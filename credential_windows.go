@@ -0,0 +1,26 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// errNoCredential is returned for --user and --group, which would need
+// Windows' own logon APIs rather than a uid and gid.
+var errNoCredential = errors.New("--user and --group are not supported on Windows")
+
+// checkCredential fails if --user or --group was given.
+func (cfg forkConfig) checkCredential() error {
+	if cfg.user != "" || cfg.group != "" {
+		return errNoCredential
+	}
+	return nil
+}
+
+// runAs leaves cmd to run as bgx does. Windows has no uid or gid to record,
+// so both are nil.
+func (cfg forkConfig) runAs(cmd *exec.Cmd) (uid, gid *int, err error) {
+	return nil, nil, cfg.checkCredential()
+}
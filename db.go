@@ -8,6 +8,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -33,6 +36,40 @@ CREATE TABLE IF NOT EXISTS events (
 CREATE INDEX IF NOT EXISTS idx_events_task_id ON events(task, id);
 `
 
+// addedColumns lists the events columns introduced after the original schema.
+// openDB adds any that the database lacks, so a database created by an older
+// bgx keeps working. Defaults must describe what older rows meant.
+var addedColumns = []struct{ name, definition string }{
+	{"no_heartbeat", "INTEGER NOT NULL DEFAULT 0"},
+	{"log_types", "TEXT NOT NULL DEFAULT ''"},
+	{"hmac", "TEXT NOT NULL DEFAULT ''"},
+	{"inherit_fds", "TEXT NOT NULL DEFAULT ''"},
+	{"peak_mem_bytes", "INTEGER NOT NULL DEFAULT 0"},
+	{"interpreter", "TEXT NOT NULL DEFAULT ''"},
+	{"read_bytes", "INTEGER NOT NULL DEFAULT 0"},
+	{"write_bytes", "INTEGER NOT NULL DEFAULT 0"},
+	{"env_clear", "INTEGER NOT NULL DEFAULT 0"},
+	{"stdout_bytes", "INTEGER NOT NULL DEFAULT 0"},
+	{"stderr_bytes", "INTEGER NOT NULL DEFAULT 0"},
+	{"stdout_lines", "INTEGER NOT NULL DEFAULT 0"},
+	{"stderr_lines", "INTEGER NOT NULL DEFAULT 0"},
+	{"fd", "INTEGER NOT NULL DEFAULT 0"},
+	{"v", "INTEGER NOT NULL DEFAULT 0"},
+	{"mem_metric", "TEXT NOT NULL DEFAULT ''"},
+	{"uid", "INTEGER"}, // NULL: not recorded
+	{"gid", "INTEGER"},
+	{"interval_seconds", "REAL NOT NULL DEFAULT 0"},
+	{"exit_reason", "TEXT NOT NULL DEFAULT ''"},
+	{"exit_signal", "TEXT NOT NULL DEFAULT ''"},
+	{"no_proc_stats", "INTEGER NOT NULL DEFAULT 0"},
+	{"user_seconds", "REAL NOT NULL DEFAULT 0"},
+	{"system_seconds", "REAL NOT NULL DEFAULT 0"},
+	{"max_rss_bytes", "INTEGER NOT NULL DEFAULT 0"},
+	{"heartbeat_touch", "INTEGER NOT NULL DEFAULT 0"},
+	{"bgx_version", "TEXT NOT NULL DEFAULT ''"},
+	{"signed", "INTEGER NOT NULL DEFAULT 0"},
+}
+
 // getDBPath returns the path to the shared BGX database.
 //
 // Precedence:
@@ -56,7 +93,19 @@ func getDBPath() string {
 // exists. WAL mode plus a busy timeout lets independent `fork` daemons and
 // `join` readers share one file concurrently. A single connection avoids
 // self-contention on WAL's single-writer lock within a process.
+//
+// Commits use synchronous=NORMAL: in WAL mode they survive a crash of the
+// process but not necessarily a power loss. Writers that need the final state
+// to be durable call setSynchronous before their last write, as the recorder
+// does for the exit event.
 func openDB() (*sql.DB, error) {
+	return openDBSync(false)
+}
+
+// openDBSync is openDB with an explicit durability mode. When full is set, as
+// for fork --sync, every commit is fsynced (synchronous=FULL), at a
+// noticeable per-event cost; see BenchmarkInsertEvent.
+func openDBSync(full bool) (*sql.DB, error) {
 	path := getDBPath()
 	if dir := filepath.Dir(path); dir != "" {
 		if err := os.MkdirAll(dir, 0755); err != nil {
@@ -67,20 +116,92 @@ func openDB() (*sql.DB, error) {
 	// Percent-encode the path so that a BGX_DB containing '?', '#', or spaces
 	// still forms a valid file: URI rather than being parsed as query/fragment.
 	escaped := (&url.URL{Path: path}).EscapedPath()
-	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", escaped)
+	synchronous := "NORMAL"
+	if full {
+		synchronous = "FULL"
+	}
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=synchronous(%s)", escaped, synchronous)
 	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
+	return initDB(db)
+}
+
+// openMemoryDB opens an empty database held in memory, for `join
+// --input-file` to load a saved log into. It lasts as long as its one
+// connection, which is kept open until the database is closed.
+func openMemoryDB() (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	return initDB(db)
+}
+
+// initDB limits db to a single connection and creates or upgrades the
+// schema, closing db if that fails.
+func initDB(db *sql.DB) (*sql.DB, error) {
 	db.SetMaxOpenConns(1)
 
 	if _, err := db.Exec(schema); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
+	if err := addMissingColumns(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to upgrade schema: %w", err)
+	}
 	return db, nil
 }
 
+// addMissingColumns brings an existing events table up to date with
+// addedColumns. Two processes may race to add the same column; the loser's
+// "duplicate column" error is harmless and ignored.
+func addMissingColumns(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('events')")
+	if err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range addedColumns {
+		if have[c.name] {
+			continue
+		}
+		_, err := db.Exec(fmt.Sprintf("ALTER TABLE events ADD COLUMN %s %s", c.name, c.definition))
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
+	}
+	return nil
+}
+
+// setSynchronous switches the connection to synchronous=FULL, so that the
+// next commit (and with it every earlier WAL frame) is fsynced, or back to
+// NORMAL. It relies on openDB's single connection: the pragma sticks to the
+// connection later writes use.
+func setSynchronous(db *sql.DB, full bool) error {
+	mode := "NORMAL"
+	if full {
+		mode = "FULL"
+	}
+	_, err := db.Exec("PRAGMA synchronous=" + mode)
+	return err
+}
+
 // ErrTaskExists is returned by registerTask when the task name is already
 // claimed. Callers wrap it with caller-appropriate guidance.
 var ErrTaskExists = errors.New("task already exists")
@@ -106,6 +227,38 @@ func registerTask(db *sql.DB, name string) error {
 	return nil
 }
 
+// reclaimTask takes over the name of a task that has exited, for
+// --overwrite-if-exited: its events are deleted and the name is registered
+// afresh. It returns ErrTaskExists if the task has no exit event, because it
+// is still running or starting. Checking and deleting in one statement keeps
+// it race-free: of two concurrent reclaims, the second finds no exit event.
+func reclaimTask(db *sql.DB, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to reclaim task: %w", err)
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(
+		`DELETE FROM events WHERE task = ? AND EXISTS (SELECT 1 FROM events WHERE task = ? AND type = ?)`,
+		name, name, EventTypeExit,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to reclaim task: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to reclaim task: %w", err)
+	} else if n == 0 {
+		return ErrTaskExists
+	}
+	if _, err := tx.Exec("UPDATE tasks SET created_at = ? WHERE name = ?", time.Now().Format(time.RFC3339Nano), name); err != nil {
+		return fmt.Errorf("failed to reclaim task: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to reclaim task: %w", err)
+	}
+	return nil
+}
+
 // unregisterTask releases a task name. It is best-effort, used to roll back a
 // registration when the daemon fails to spawn.
 func unregisterTask(db *sql.DB, name string) {
@@ -121,41 +274,200 @@ func taskExists(db *sql.DB, name string) (bool, error) {
 	return n > 0, nil
 }
 
-// insertEvent appends one event row for the given task.
-func insertEvent(db *sql.DB, task string, e Event) error {
+// listTasks returns the names of all registered tasks, oldest first.
+func listTasks(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM tasks ORDER BY created_at, name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// storedEvent is an event as it is stored: one value per events column, with
+// the time and command already encoded as text. The JSON encoding of the
+// columns it tags is the canonical form --sign authenticates; omitempty keeps
+// that form unchanged for older rows when a column is added with a zero
+// default.
+type storedEvent struct {
+	ID            int64   `json:"-"`
+	Task          string  `json:"task"`
+	Type          string  `json:"type"`
+	Time          string  `json:"time"`
+	Data          string  `json:"data,omitempty"`
+	PID           int     `json:"pid,omitempty"`
+	Command       string  `json:"command,omitempty"`
+	Code          int     `json:"code,omitempty"`
+	CPUSeconds    float64 `json:"cpu_seconds,omitempty"`
+	MemBytes      int64   `json:"mem_bytes,omitempty"`
+	NoHeartbeat   bool    `json:"no_heartbeat,omitempty"`
+	LogTypes      string  `json:"log_types,omitempty"`
+	InheritFDs    string  `json:"inherit_fds,omitempty"` // comma-separated
+	PeakMem       int64   `json:"peak_mem_bytes,omitempty"`
+	Interpreter   string  `json:"interpreter,omitempty"`
+	ReadBytes     int64   `json:"read_bytes,omitempty"`
+	WriteBytes    int64   `json:"write_bytes,omitempty"`
+	EnvClear      bool    `json:"env_clear,omitempty"`
+	StdoutBytes   int64   `json:"stdout_bytes,omitempty"`
+	StderrBytes   int64   `json:"stderr_bytes,omitempty"`
+	StdoutLines   int64   `json:"stdout_lines,omitempty"`
+	StderrLines   int64   `json:"stderr_lines,omitempty"`
+	FD            int     `json:"fd,omitempty"`
+	V             int     `json:"v,omitempty"`
+	MemMetric     string  `json:"mem_metric,omitempty"`
+	UID           *int    `json:"uid,omitempty"`
+	GID           *int    `json:"gid,omitempty"`
+	Interval      float64 `json:"interval_seconds,omitempty"`
+	ExitReason    string  `json:"exit_reason,omitempty"`
+	ExitSignal    string  `json:"exit_signal,omitempty"`
+	NoProcStats   bool    `json:"no_proc_stats,omitempty"`
+	UserSeconds   float64 `json:"user_seconds,omitempty"`
+	SystemSeconds float64 `json:"system_seconds,omitempty"`
+	MaxRSSBytes   int64   `json:"max_rss_bytes,omitempty"`
+	Touch         bool    `json:"heartbeat_touch,omitempty"`
+	BgxVersion    string  `json:"bgx_version,omitempty"`
+	Signed        bool    `json:"signed,omitempty"`
+	HMAC          string  `json:"-"`
+}
+
+// toStored encodes an event for the given task as insertEvent stores it.
+func toStored(task string, e Event) (storedEvent, error) {
 	var command string
 	if len(e.Command) > 0 {
 		b, err := json.Marshal(e.Command)
 		if err != nil {
-			return err
+			return storedEvent{}, err
 		}
 		command = string(b)
 	}
-	_, err := db.Exec(
-		`INSERT INTO events(task, type, time, data, pid, command, code, cpu_seconds, mem_bytes)
-		 VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		task, e.Type, e.Time.Format(time.RFC3339Nano), e.Data,
-		e.PID, command, e.Code, e.CPUSeconds, e.MemBytes,
+	fds := make([]string, len(e.InheritFDs))
+	for i, fd := range e.InheritFDs {
+		fds[i] = strconv.Itoa(fd)
+	}
+	return storedEvent{
+		Task:          task,
+		Type:          e.Type,
+		Time:          e.Time.Format(time.RFC3339Nano),
+		Data:          e.Data,
+		PID:           e.PID,
+		Command:       command,
+		Code:          e.Code,
+		CPUSeconds:    e.CPUSeconds,
+		MemBytes:      e.MemBytes,
+		NoHeartbeat:   e.NoHeartbeat,
+		LogTypes:      e.LogTypes,
+		InheritFDs:    strings.Join(fds, ","),
+		PeakMem:       e.PeakMemBytes,
+		Interpreter:   e.Interpreter,
+		ReadBytes:     e.ReadBytes,
+		WriteBytes:    e.WriteBytes,
+		EnvClear:      e.EnvClear,
+		StdoutBytes:   e.StdoutBytes,
+		StderrBytes:   e.StderrBytes,
+		StdoutLines:   e.StdoutLines,
+		StderrLines:   e.StderrLines,
+		FD:            e.FD,
+		V:             e.V,
+		MemMetric:     e.MemMetric,
+		UID:           e.UID,
+		GID:           e.GID,
+		Interval:      e.IntervalSeconds,
+		ExitReason:    e.ExitReason,
+		ExitSignal:    e.ExitSignal,
+		NoProcStats:   e.NoProcStats,
+		UserSeconds:   e.UserSeconds,
+		SystemSeconds: e.SystemSeconds,
+		MaxRSSBytes:   e.MaxRSSBytes,
+		Touch:         e.HeartbeatTouch,
+		BgxVersion:    e.BgxVersion,
+		Signed:        e.Signed,
+		HMAC:          e.HMAC,
+	}, nil
+}
+
+// insertEvent appends one event row for the given task.
+func insertEvent(db *sql.DB, task string, e Event) error {
+	s, err := toStored(task, e)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		`INSERT INTO events(task, type, time, data, pid, command, code, cpu_seconds, mem_bytes, no_heartbeat, log_types, inherit_fds, peak_mem_bytes, interpreter, read_bytes, write_bytes, env_clear, stdout_bytes, stderr_bytes, stdout_lines, stderr_lines, fd, v, mem_metric, uid, gid, interval_seconds, exit_reason, exit_signal, no_proc_stats, user_seconds, system_seconds, max_rss_bytes, heartbeat_touch, bgx_version, signed, hmac)
+		 VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.Task, s.Type, s.Time, s.Data,
+		s.PID, s.Command, s.Code, s.CPUSeconds, s.MemBytes, s.NoHeartbeat, s.LogTypes, s.InheritFDs, s.PeakMem, s.Interpreter, s.ReadBytes, s.WriteBytes, s.EnvClear,
+		s.StdoutBytes, s.StderrBytes, s.StdoutLines, s.StderrLines, s.FD, s.V, s.MemMetric, s.UID, s.GID, s.Interval, s.ExitReason, s.ExitSignal, s.NoProcStats, s.UserSeconds, s.SystemSeconds, s.MaxRSSBytes, s.Touch, s.BgxVersion, s.Signed, s.HMAC,
 	)
 	return err
 }
 
+// readStoredEvents returns every column of a task's events, in insertion
+// order, for `bgx verify`.
+func readStoredEvents(db *sql.DB, task string) ([]storedEvent, error) {
+	rows, err := db.Query(
+		`SELECT id, task, type, time, data, pid, command, code, cpu_seconds, mem_bytes, no_heartbeat, log_types, inherit_fds, peak_mem_bytes, interpreter, read_bytes, write_bytes, env_clear, stdout_bytes, stderr_bytes, stdout_lines, stderr_lines, fd, v, mem_metric, uid, gid, interval_seconds, exit_reason, exit_signal, no_proc_stats, user_seconds, system_seconds, max_rss_bytes, heartbeat_touch, bgx_version, signed, hmac
+		 FROM events WHERE task = ? ORDER BY id`,
+		task,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []storedEvent
+	for rows.Next() {
+		var s storedEvent
+		if err := rows.Scan(&s.ID, &s.Task, &s.Type, &s.Time, &s.Data, &s.PID, &s.Command, &s.Code,
+			&s.CPUSeconds, &s.MemBytes, &s.NoHeartbeat, &s.LogTypes, &s.InheritFDs, &s.PeakMem, &s.Interpreter, &s.ReadBytes, &s.WriteBytes, &s.EnvClear,
+			&s.StdoutBytes, &s.StderrBytes, &s.StdoutLines, &s.StderrLines, &s.FD, &s.V, &s.MemMetric, &s.UID, &s.GID, &s.Interval, &s.ExitReason, &s.ExitSignal, &s.NoProcStats, &s.UserSeconds, &s.SystemSeconds, &s.MaxRSSBytes, &s.Touch, &s.BgxVersion, &s.Signed, &s.HMAC); err != nil {
+			return nil, err
+		}
+		events = append(events, s)
+	}
+	return events, rows.Err()
+}
+
 // eventRow is an event read back from the database. Only the fields consumed by
 // `join` are decoded.
 type eventRow struct {
-	ID   int64
-	Type string
-	Time string
-	Data string
-	Code int
+	ID          int64
+	Type        string
+	Time        string
+	Data        string
+	DataBytes   int64 // length of the stored data, even when Data was withheld
+	FD          int
+	Code        int
+	NoHeartbeat bool
+	V           int
+	MemMetric   string
+	CPUSeconds  float64
+	MemBytes    int64
+	Interval    float64 // heartbeat interval_seconds
+	ExitReason  string
+	ExitSignal  string
+
+	HeartbeatTouch bool // the start event of a task forked with --heartbeat-touch
 }
 
 // readEventsAfter returns all events for a task with id greater than afterID,
-// in insertion order. The monotonic id column acts as the read cursor.
-func readEventsAfter(db *sql.DB, task string, afterID int64) ([]eventRow, error) {
+// in insertion order. The monotonic id column acts as the read cursor. Data
+// longer than maxDataBytes (if positive) is left in the database: the row comes
+// back with an empty Data and its real size in DataBytes.
+func readEventsAfter(db *sql.DB, task string, afterID int64, maxDataBytes int) ([]eventRow, error) {
 	rows, err := db.Query(
-		"SELECT id, type, time, data, code FROM events WHERE task = ? AND id > ? ORDER BY id",
-		task, afterID,
+		`SELECT id, type, time,
+		        CASE WHEN ? > 0 AND length(CAST(data AS BLOB)) > ? THEN '' ELSE data END,
+		        length(CAST(data AS BLOB)), fd, code, no_heartbeat, v, mem_metric, cpu_seconds, mem_bytes, interval_seconds, exit_reason, exit_signal, heartbeat_touch
+		 FROM events WHERE task = ? AND id > ? ORDER BY id`,
+		maxDataBytes, maxDataBytes, task, afterID,
 	)
 	if err != nil {
 		return nil, err
@@ -165,10 +477,266 @@ func readEventsAfter(db *sql.DB, task string, afterID int64) ([]eventRow, error)
 	var events []eventRow
 	for rows.Next() {
 		var e eventRow
-		if err := rows.Scan(&e.ID, &e.Type, &e.Time, &e.Data, &e.Code); err != nil {
+		if err := rows.Scan(&e.ID, &e.Type, &e.Time, &e.Data, &e.DataBytes, &e.FD, &e.Code, &e.NoHeartbeat, &e.V, &e.MemMetric, &e.CPUSeconds, &e.MemBytes, &e.Interval, &e.ExitReason, &e.ExitSignal, &e.HeartbeatTouch); err != nil {
 			return nil, err
 		}
 		events = append(events, e)
 	}
 	return events, rows.Err()
 }
+
+// outputLine is one line of a task's stdout or stderr, without its newline.
+type outputLine struct {
+	Stream string `json:"stream"` // EventTypeStdout or EventTypeStderr
+	Data   string `json:"data"`
+}
+
+// readRecentOutput returns the last n lines a task wrote to stdout and
+// stderr, oldest first, reading its events backwards from the end of the log
+// only as far as it needs. An event holding several lines (--coalesce-window)
+// contributes each; one holding part of a longer line counts as a line.
+func readRecentOutput(db *sql.DB, task string, n int) ([]outputLine, error) {
+	rows, err := db.Query(
+		`SELECT type, data FROM events WHERE task = ? AND type IN (?, ?) ORDER BY id DESC`,
+		task, EventTypeStdout, EventTypeStderr,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []outputLine // newest first
+	for len(lines) < n && rows.Next() {
+		var stream, data string
+		if err := rows.Scan(&stream, &data); err != nil {
+			return nil, err
+		}
+		parts := strings.Split(strings.TrimSuffix(data, "\n"), "\n")
+		for i := len(parts) - 1; i >= 0 && len(lines) < n; i-- {
+			lines = append(lines, outputLine{Stream: stream, Data: parts[i]})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.Reverse(lines)
+	return lines, nil
+}
+
+// firstEventTime returns the time of the earliest recorded event among the
+// given tasks, or the zero time if none has any events yet. Ordering by id
+// rather than by the time text keeps it exact regardless of formatting.
+func firstEventTime(db *sql.DB, taskNames []string) (time.Time, error) {
+	query := "SELECT time FROM events WHERE task IN (?" + strings.Repeat(", ?", len(taskNames)-1) + ") ORDER BY id LIMIT 1"
+	args := make([]any, len(taskNames))
+	for i, name := range taskNames {
+		args[i] = name
+	}
+	var stored string
+	switch err := db.QueryRow(query, args...).Scan(&stored); {
+	case err == sql.ErrNoRows:
+		return time.Time{}, nil
+	case err != nil:
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, stored)
+}
+
+// storedEventTime returns the stored time of the given task's event with the
+// given id, or false if the task has no such event.
+func storedEventTime(db *sql.DB, task string, id int64) (string, bool, error) {
+	var stored string
+	switch err := db.QueryRow("SELECT time FROM events WHERE task = ? AND id = ?", task, id).Scan(&stored); {
+	case err == sql.ErrNoRows:
+		return "", false, nil
+	case err != nil:
+		return "", false, err
+	}
+	return stored, true, nil
+}
+
+// latestEventTime returns the time of the most recently recorded event in
+// the database, or the zero time if there are none.
+func latestEventTime(db *sql.DB) (time.Time, error) {
+	var stored string
+	switch err := db.QueryRow("SELECT time FROM events ORDER BY id DESC LIMIT 1").Scan(&stored); {
+	case err == sql.ErrNoRows:
+		return time.Time{}, nil
+	case err != nil:
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, stored)
+}
+
+// taskSummary condenses a task's recorded events into what `status` reports.
+type taskSummary struct {
+	Name      string
+	Started   bool // a start event was recorded
+	PID       int
+	Command   []string
+	StartTime time.Time
+
+	BgxVersion string // the build that ran the task ("": one that didn't record it)
+
+	// NoHeartbeat is set if nothing shows the task is alive while it runs,
+	// as when it was forked with --no-heartbeat. A --heartbeat-touch task
+	// records no heartbeats either, but HeartbeatTouch is set instead: its
+	// heartbeat file's mtime counts towards LastEventTime.
+	NoHeartbeat    bool
+	HeartbeatTouch bool
+
+	Exited   bool
+	ExitCode int
+
+	// Paused is set if the task's latest pause or resume event is a pause,
+	// and it hasn't exited since.
+	Paused bool
+
+	// Output is what the command wrote, per stream, from the exit event;
+	// zero until it has exited (or if recorded by an older bgx).
+	StdoutBytes, StderrBytes int64
+	StdoutLines, StderrLines int64
+
+	// ExitReason and ExitSignal say how it ended, from the exit event;
+	// empty if recorded by an older bgx.
+	ExitReason, ExitSignal string
+
+	// CPUSeconds is the total from the exit event, or for a running task the
+	// latest heartbeat's. MemBytes is the latest heartbeat's resident memory
+	// (zero once exited), and PeakMemBytes the highest memory sampled so far.
+	CPUSeconds   float64
+	MemBytes     int64
+	PeakMemBytes int64
+
+	// UserSeconds and SystemSeconds split the exit event's CPU time, and
+	// MaxRSSBytes is the highest resident memory the kernel saw, which
+	// PeakMemBytes then reports (unless memory is measured as PSS). All are
+	// zero until the task has exited, or if recorded by an older bgx.
+	UserSeconds, SystemSeconds float64
+	MaxRSSBytes                int64
+
+	// MemMetric is what the memory figures measure, from the start event:
+	// MemMetricPSS with --mem-metric pss, or "" for RSS.
+	MemMetric string
+
+	// NoProcStats is set, from the start event, if the task was forked with
+	// --no-proc-stats: the CPU and memory figures were never sampled.
+	NoProcStats bool
+
+	// HeartbeatInterval is the longest the next heartbeat may take, as the
+	// latest one announced with --heartbeat-adaptive; zero otherwise.
+	HeartbeatInterval time.Duration
+
+	// ReadBytes and WriteBytes are the latest --io-stats totals, from the
+	// exit event or the latest heartbeat; zero without --io-stats.
+	ReadBytes  int64
+	WriteBytes int64
+
+	// LastEventTime is the time of the most recent event: the exit event for a
+	// finished task, otherwise typically its latest heartbeat (or the
+	// latest touch of its heartbeat file, with --heartbeat-touch).
+	LastEventTime time.Time
+}
+
+// Duration is the task's run time as recorded: from its start event to its
+// exit event or, if it hasn't exited, to its latest event. It never consults
+// the current clock, so a task whose daemon died reports how long it was
+// observed running rather than a figure that keeps growing.
+func (s taskSummary) Duration() time.Duration {
+	if !s.Started {
+		return 0
+	}
+	return s.LastEventTime.Sub(s.StartTime)
+}
+
+// hasEventType reports whether the named task has an event of the given type.
+func hasEventType(db *sql.DB, name, eventType string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM events WHERE task = ? AND type = ?)", name, eventType).Scan(&exists)
+	return exists, err
+}
+
+// readTaskSummary summarizes the named task from its start, exit, and latest
+// events.
+func readTaskSummary(db *sql.DB, name string) (taskSummary, error) {
+	s := taskSummary{Name: name}
+
+	var startTime, command string
+	err := db.QueryRow(
+		"SELECT time, pid, command, no_heartbeat, mem_metric, no_proc_stats, heartbeat_touch, bgx_version FROM events WHERE task = ? AND type = ? ORDER BY id LIMIT 1",
+		name, EventTypeStart,
+	).Scan(&startTime, &s.PID, &command, &s.NoHeartbeat, &s.MemMetric, &s.NoProcStats, &s.HeartbeatTouch, &s.BgxVersion)
+	switch {
+	case err == sql.ErrNoRows:
+		return s, nil // registered, but the daemon hasn't started the command yet
+	case err != nil:
+		return s, err
+	}
+	s.Started = true
+	s.StartTime, _ = time.Parse(time.RFC3339Nano, startTime)
+	s.NoHeartbeat = s.NoHeartbeat && !s.HeartbeatTouch
+	if command != "" {
+		_ = json.Unmarshal([]byte(command), &s.Command)
+	}
+
+	err = db.QueryRow(
+		"SELECT code, stdout_bytes, stderr_bytes, stdout_lines, stderr_lines, exit_reason, exit_signal, user_seconds, system_seconds, max_rss_bytes FROM events WHERE task = ? AND type = ? ORDER BY id DESC LIMIT 1",
+		name, EventTypeExit,
+	).Scan(&s.ExitCode, &s.StdoutBytes, &s.StderrBytes, &s.StdoutLines, &s.StderrLines, &s.ExitReason, &s.ExitSignal, &s.UserSeconds, &s.SystemSeconds, &s.MaxRSSBytes)
+	switch {
+	case err == nil:
+		s.Exited = true
+	case err != sql.ErrNoRows:
+		return s, err
+	}
+
+	if !s.Exited {
+		var latest string
+		err = db.QueryRow(
+			"SELECT type FROM events WHERE task = ? AND type IN (?, ?) ORDER BY id DESC LIMIT 1",
+			name, EventTypePause, EventTypeResume,
+		).Scan(&latest)
+		if err != nil && err != sql.ErrNoRows {
+			return s, err
+		}
+		s.Paused = latest == EventTypePause
+	}
+
+	// Like the queries above, this walks the (task, id) index backwards from
+	// the newest event, so it stays cheap however long the task has run.
+	var interval float64
+	err = db.QueryRow(
+		"SELECT cpu_seconds, mem_bytes, read_bytes, write_bytes, interval_seconds FROM events WHERE task = ? AND type IN (?, ?) ORDER BY id DESC LIMIT 1",
+		name, EventTypeHeartbeat, EventTypeExit,
+	).Scan(&s.CPUSeconds, &s.MemBytes, &s.ReadBytes, &s.WriteBytes, &interval)
+	if err != nil && err != sql.ErrNoRows {
+		return s, err
+	}
+	s.HeartbeatInterval = time.Duration(interval * float64(time.Second))
+	// The exit event's peak covers every heartbeat, but a task still running
+	// (or one recorded by an older bgx) only has the heartbeats themselves.
+	if err := db.QueryRow(
+		"SELECT COALESCE(MAX(MAX(mem_bytes, peak_mem_bytes)), 0) FROM events WHERE task = ?", name,
+	).Scan(&s.PeakMemBytes); err != nil {
+		return s, err
+	}
+	// The kernel's figure is exact, where heartbeats sample every few seconds
+	// and can miss a spike.
+	if s.MaxRSSBytes > 0 && s.MemMetric != MemMetricPSS {
+		s.PeakMemBytes = s.MaxRSSBytes
+	}
+
+	// Access events are written by whoever ran a command with --audit, not by
+	// the task's daemon, so they say nothing about whether it is alive.
+	var lastTime string
+	if err := db.QueryRow(
+		"SELECT time FROM events WHERE task = ? AND type != ? ORDER BY id DESC LIMIT 1", name, EventTypeAccess,
+	).Scan(&lastTime); err != nil {
+		return s, err
+	}
+	s.LastEventTime, _ = time.Parse(time.RFC3339Nano, lastTime)
+	if s.HeartbeatTouch && !s.Exited {
+		s.LastEventTime = latest(s.LastEventTime, heartbeatFileTime(name))
+	}
+	return s, nil
+}
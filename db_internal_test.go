@@ -1,9 +1,11 @@
 package main
 
 import (
+	"database/sql"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestGetDBPath(t *testing.T) {
@@ -37,3 +39,111 @@ func TestGetDBPath(t *testing.T) {
 		}
 	})
 }
+
+func TestOpenDBSynchronous(t *testing.T) {
+	t.Setenv("BGX_DB", filepath.Join(t.TempDir(), "bgx.db"))
+
+	// synchronous values as reported by SQLite: 1 = NORMAL, 2 = FULL.
+	for _, tt := range []struct {
+		full bool
+		want int
+	}{
+		{false, 1},
+		{true, 2},
+	} {
+		db, err := openDBSync(tt.full)
+		if err != nil {
+			t.Fatalf("openDBSync(%v): %v", tt.full, err)
+		}
+		var got int
+		if err := db.QueryRow("PRAGMA synchronous").Scan(&got); err != nil {
+			t.Fatalf("PRAGMA synchronous: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("openDBSync(%v): synchronous = %d, want %d", tt.full, got, tt.want)
+		}
+
+		// setSynchronous upgrades the (single) connection for the final write.
+		if err := setSynchronous(db, true); err != nil {
+			t.Fatalf("setSynchronous: %v", err)
+		}
+		if err := db.QueryRow("PRAGMA synchronous").Scan(&got); err != nil {
+			t.Fatalf("PRAGMA synchronous: %v", err)
+		}
+		if got != 2 {
+			t.Errorf("after setSynchronous: synchronous = %d, want 2", got)
+		}
+		db.Close()
+	}
+}
+
+// TestOpenDBUpgradesOldSchema verifies a database created before a column was
+// added is upgraded in place, with existing rows taking the column default.
+func TestOpenDBUpgradesOldSchema(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "bgx.db")
+	t.Setenv("BGX_DB", dbPath)
+
+	old, err := sql.Open("sqlite", "file:"+dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec("INSERT INTO events(task, type, time) VALUES('old', 'start', '')"); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	db, err := openDB()
+	if err != nil {
+		t.Fatalf("openDB on an old database: %v", err)
+	}
+	defer db.Close()
+
+	events, err := readEventsAfter(db, "old", 0, MaxEventBytes)
+	if err != nil {
+		t.Fatalf("readEventsAfter: %v", err)
+	}
+	if len(events) != 1 || events[0].NoHeartbeat {
+		t.Errorf("Expected the old start event with heartbeats on, got: %+v", events)
+	}
+
+	// Opening again is a no-op rather than a duplicate-column error.
+	again, err := openDB()
+	if err != nil {
+		t.Fatalf("second openDB: %v", err)
+	}
+	again.Close()
+}
+
+// BenchmarkInsertEvent measures the per-event cost of the default mode against
+// --sync, which fsyncs every event, and --sync-every, which fsyncs some.
+func BenchmarkInsertEvent(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		cfg  forkConfig
+	}{
+		{"default", forkConfig{}},
+		{"sync", forkConfig{sync: true}},
+		{"sync-every-10", forkConfig{syncEvery: 10}},
+		{"sync-every-100", forkConfig{syncEvery: 100}},
+		{"sync-every-1000", forkConfig{syncEvery: 1000}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.Setenv("BGX_DB", filepath.Join(b.TempDir(), "bgx.db"))
+			db, err := openDBSync(bm.cfg.sync)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			rec := newRecorder(db, "bench", bm.cfg)
+
+			e := Event{Type: EventTypeStdout, Time: time.Now(), Data: "a line of output\n"}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rec.write(e)
+			}
+		})
+	}
+}
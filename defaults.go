@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Environment variables that set defaults for flags, to save passing them
+// every time. Each applies only where its flag isn't given, so a flag on the
+// command line (or in a fork --file definition) always wins.
+const (
+	// TimeoutEnv is the default for join's and wait's --timeout. stop's
+	// --timeout, which is how long to wait before killing, has a default
+	// of its own (StopTimeout).
+	TimeoutEnv = "BGX_TIMEOUT"
+
+	// HeartbeatTimeoutEnv is the default for join's --heartbeat-timeout.
+	HeartbeatTimeoutEnv = "BGX_HEARTBEAT_TIMEOUT"
+
+	// NoHeartbeatEnv, set to 1 or true, is the default for fork's and
+	// exec's --no-heartbeat. --heartbeat-adaptive and --heartbeat-touch,
+	// which choose how heartbeats are recorded instead, override it.
+	NoHeartbeatEnv = "BGX_NO_HEARTBEAT"
+)
+
+// envDuration returns the positive duration the environment variable name
+// holds, or 0 if it is unset or empty.
+func envDuration(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s=%q: must be a positive duration such as 30s or 5m", name, value)
+	}
+	return d, nil
+}
+
+// envBool returns whether the environment variable name is set to a true
+// value, such as 1 or true; unset or empty is false.
+func envBool(name string) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s=%q: must be 1 or 0 (or true or false)", name, value)
+	}
+	return b, nil
+}
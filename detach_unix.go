@@ -2,7 +2,10 @@
 
 package main
 
-import "syscall"
+import (
+	"os/exec"
+	"syscall"
+)
 
 // daemonSysProcAttr returns the attributes used to detach the background daemon
 // from the launching process. Setsid starts a new session so the daemon
@@ -10,3 +13,14 @@ import "syscall"
 func daemonSysProcAttr() *syscall.SysProcAttr {
 	return &syscall.SysProcAttr{Setsid: true}
 }
+
+// ownProcessGroup makes a forked task's command the leader of a process group
+// of its own, apart from the daemon's, so that kill and stop can signal it
+// together with the processes it starts. exec leaves its command in the
+// terminal's foreground group, where Ctrl-C reaches it.
+func ownProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
@@ -2,7 +2,10 @@
 
 package main
 
-import "syscall"
+import (
+	"os/exec"
+	"syscall"
+)
 
 // Process creation flags (from the Windows API). DETACHED_PROCESS runs the
 // daemon without a console, and CREATE_NEW_PROCESS_GROUP puts it in its own
@@ -18,3 +21,6 @@ const (
 func daemonSysProcAttr() *syscall.SysProcAttr {
 	return &syscall.SysProcAttr{CreationFlags: detachedProcess | createNewProcessGroup}
 }
+
+// ownProcessGroup does nothing: signalGroup can't signal a group on Windows.
+func ownProcessGroup(cmd *exec.Cmd) {}
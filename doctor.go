@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ClockSkewTolerance is how far in the future the newest recorded event may
+// be before doctor suspects the clock has been set back.
+const ClockSkewTolerance = time.Minute
+
+// Check outcomes reported by doctor, in increasing order of severity.
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// checkResult is one line of the doctor report.
+type checkResult struct {
+	status string // checkPass, checkWarn, or checkFail
+	name   string
+	detail string
+}
+
+// runDoctor checks the environment bgx depends on and prints a report with
+// one line per check. It returns exit code 1 if any check failed; warnings
+// alone don't affect the exit code.
+func runDoctor(args []string) (int, error) {
+	if len(args) > 0 {
+		return 1, fmt.Errorf("unexpected argument %q\nUsage: bgx doctor", args[0])
+	}
+
+	results := []checkResult{checkDBDirectory(), checkProcessStats()}
+
+	db, err := openDB()
+	if err != nil {
+		results = append(results, checkResult{checkFail, "database", err.Error()})
+	} else {
+		defer db.Close()
+		results = append(results,
+			checkResult{checkPass, "database", getDBPath()},
+			checkClock(db, time.Now()),
+			checkStaleTasks(db, time.Now()),
+			checkDaemonLogs(db),
+		)
+	}
+
+	exitCode := 0
+	for _, r := range results {
+		fmt.Printf("[%s] %-14s%s\n", r.status, r.name, r.detail)
+		if r.status == checkFail {
+			exitCode = 1
+		}
+	}
+	return exitCode, nil
+}
+
+// checkDBDirectory verifies that the database's directory exists (or can be
+// created) and that bgx can create files in it, which SQLite needs for the
+// WAL and shared-memory files as well as the database itself.
+func checkDBDirectory() checkResult {
+	dir := filepath.Dir(getDBPath())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return checkResult{checkFail, "directory", fmt.Sprintf("cannot create %s: %v", dir, err)}
+	}
+	f, err := os.CreateTemp(dir, ".bgx-doctor-*")
+	if err != nil {
+		return checkResult{checkFail, "directory", fmt.Sprintf("%s is not writable: %v", dir, err)}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return checkResult{checkPass, "directory", dir + " is writable"}
+}
+
+// checkProcessStats samples this process through the same helper heartbeats
+// use. Platforms without /proc report nothing, which is expected there but
+// worth knowing before wondering why cpu_seconds and mem_bytes stay at zero.
+func checkProcessStats() checkResult {
+	if _, mem, _ := getProcessStats(os.Getpid()); mem > 0 {
+		return checkResult{checkPass, "process stats", "CPU and memory are recorded in heartbeats"}
+	}
+	return checkResult{checkWarn, "process stats", "unavailable on this platform; heartbeats will carry no CPU or memory figures"}
+}
+
+// checkClock compares the newest recorded event with the current time. An
+// event from the future means the clock was set back since it was recorded,
+// which throws off durations and join's stall detection.
+func checkClock(db *sql.DB, now time.Time) checkResult {
+	latest, err := latestEventTime(db)
+	if err != nil {
+		return checkResult{checkFail, "clock", fmt.Sprintf("failed to read events: %v", err)}
+	}
+	if ahead := latest.Sub(now); ahead > ClockSkewTolerance {
+		return checkResult{checkWarn, "clock", fmt.Sprintf("newest event is %s in the future; was the clock set back?", ahead.Round(time.Second))}
+	}
+	return checkResult{checkPass, "clock", now.Format(time.RFC3339)}
+}
+
+// checkStaleTasks lists tasks that never exited but whose daemon has gone
+// quiet, as `status` would report them. Their names stay claimed until the
+// database is reset.
+func checkStaleTasks(db *sql.DB, now time.Time) checkResult {
+	names, err := listTasks(db)
+	if err != nil {
+		return checkResult{checkFail, "stale tasks", fmt.Sprintf("failed to list tasks: %v", err)}
+	}
+	var stale []string
+	for _, name := range names {
+		s, err := readTaskSummary(db, name)
+		if err != nil {
+			return checkResult{checkFail, "stale tasks", fmt.Sprintf("failed to read task %q: %v", name, err)}
+		}
+		if state := s.state(now); strings.HasPrefix(state, "stalled") {
+			stale = append(stale, fmt.Sprintf("%s (%s)", name, state))
+		}
+	}
+	if len(stale) > 0 {
+		return checkResult{checkWarn, "stale tasks", strings.Join(stale, ", ")}
+	}
+	return checkResult{checkPass, "stale tasks", fmt.Sprintf("none among %d task(s)", len(names))}
+}
+
+// checkDaemonLogs lists tasks whose daemon wrote to its log, which it only
+// does when something went wrong outside the command itself.
+func checkDaemonLogs(db *sql.DB) checkResult {
+	names, err := listTasks(db)
+	if err != nil {
+		return checkResult{checkFail, "daemon logs", fmt.Sprintf("failed to list tasks: %v", err)}
+	}
+	var reported []string
+	for _, name := range names {
+		if readDaemonLog(name) != "" {
+			reported = append(reported, name)
+		}
+	}
+	if len(reported) > 0 {
+		return checkResult{checkWarn, "daemon logs", fmt.Sprintf("daemon problems for %s; see bgx status", strings.Join(reported, ", "))}
+	}
+	return checkResult{checkPass, "daemon logs", "no daemon reported problems"}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Output formats for `join --output`. In text mode (the default) join replays
+// the task's output as the task wrote it; the others write one record per
+// event instead, all on stdout.
+const (
+	outputText   = "text"
+	outputJSON   = "json"
+	outputCSV    = "csv"
+	outputLogfmt = "logfmt"
+)
+
+// eventFields lists the fields --fields can choose from.
+var eventFields = []string{"task", "id", "time", "type", "fd", "data", "code", "exit_reason"}
+
+// defaultEventFields are the fields written when --fields isn't given, in
+// this order.
+var defaultEventFields = []string{"task", "time", "type", "data", "code"}
+
+// parseFields parses a comma-separated --fields list. The order given is the
+// order fields are written in.
+func parseFields(spec string) ([]string, error) {
+	var fields []string
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		known := false
+		for _, name := range eventFields {
+			known = known || f == name
+		}
+		if !known {
+			return nil, fmt.Errorf("invalid field %q in --fields %q: must be one of %s", f, spec, strings.Join(eventFields, ", "))
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// eventEncoder renders events of one task for a structured --output format.
+type eventEncoder struct {
+	format string
+	fields []string
+}
+
+// fieldValue returns one field of the event as text, and whether the event
+// has it at all: data is empty for lifecycle events, fd exists only on fd
+// events, and code and exit_reason only on the exit event (exit_reason not
+// on one recorded by an older bgx). Missing fields are left out of JSON and
+// logfmt records and written as empty CSV cells, so a CSV row always has
+// every column.
+func fieldValue(field, task string, e eventRow) (string, bool) {
+	switch field {
+	case "task":
+		return task, true
+	case "id":
+		return strconv.FormatInt(e.ID, 10), true
+	case "time":
+		return e.Time, true
+	case "type":
+		return e.Type, true
+	case "fd":
+		return strconv.Itoa(e.FD), e.Type == EventTypeFD
+	case "data":
+		return e.Data, e.Data != ""
+	case "code":
+		return strconv.Itoa(e.Code), e.Type == EventTypeExit
+	case "exit_reason":
+		return e.ExitReason, e.ExitReason != ""
+	}
+	return "", false
+}
+
+// header returns the line written before any record: the column names for
+// CSV, nothing for the other formats.
+func (enc eventEncoder) header() string {
+	if enc.format != outputCSV {
+		return ""
+	}
+	return csvLine(enc.fields)
+}
+
+// encode renders one event as a single line, newline included. Newlines in
+// the data are escaped (JSON, logfmt) or quoted (CSV), so a record never
+// spans more than one line except inside a quoted CSV cell.
+func (enc eventEncoder) encode(task string, e eventRow) string {
+	var b strings.Builder
+	switch enc.format {
+	case outputCSV:
+		values := make([]string, len(enc.fields))
+		for i, f := range enc.fields {
+			if v, ok := fieldValue(f, task, e); ok {
+				values[i] = v
+			}
+		}
+		return csvLine(values)
+	case outputJSON:
+		b.WriteString("{")
+		for _, f := range enc.fields {
+			v, ok := fieldValue(f, task, e)
+			if !ok {
+				continue
+			}
+			if b.Len() > 1 {
+				b.WriteString(",")
+			}
+			key, _ := json.Marshal(f)
+			b.Write(key)
+			b.WriteString(":")
+			if f == "id" || f == "code" {
+				b.WriteString(v)
+			} else {
+				quoted, _ := json.Marshal(v)
+				b.Write(quoted)
+			}
+		}
+		b.WriteString("}\n")
+	case outputLogfmt:
+		for _, f := range enc.fields {
+			v, ok := fieldValue(f, task, e)
+			if !ok {
+				continue
+			}
+			if b.Len() > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(f + "=" + logfmtValue(v))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// csvLine renders one CSV record, quoting values that contain commas, quotes
+// or newlines as RFC 4180 requires.
+func csvLine(values []string) string {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	w.Write(values)
+	w.Flush()
+	return b.String()
+}
+
+// logfmtValue renders a logfmt value: bare if it is a plain word, otherwise
+// double-quoted with Go escapes, so spaces, quotes, '=' and control characters
+// such as a line's trailing newline survive a round trip.
+func logfmtValue(v string) string {
+	if v == "" {
+		return `""`
+	}
+	for _, r := range v {
+		if r <= ' ' || r == '=' || r == '"' || r == '\\' || r == 0x7f {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// awkward is output data that each format has to escape or quote.
+const awkward = "a, \"b\" =c\\d\n"
+
+func TestEncodeCSV(t *testing.T) {
+	enc := eventEncoder{format: outputCSV, fields: []string{"type", "data", "code"}}
+	input := enc.header() +
+		enc.encode("t", eventRow{Type: EventTypeStdout, Data: awkward}) +
+		enc.encode("t", eventRow{Type: EventTypeExit, Code: 3})
+
+	records, err := csv.NewReader(strings.NewReader(input)).ReadAll()
+	if err != nil {
+		t.Fatalf("output is not valid CSV: %v\n%s", err, input)
+	}
+	want := [][]string{{"type", "data", "code"}, {"stdout", awkward, ""}, {"exit", "", "3"}}
+	if len(records) != len(want) {
+		t.Fatalf("got %d records, want %d: %q", len(records), len(want), records)
+	}
+	for i := range want {
+		if strings.Join(records[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("record %d = %q, want %q", i, records[i], want[i])
+		}
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	enc := eventEncoder{format: outputJSON, fields: []string{"task", "id", "type", "data", "code"}}
+	line := enc.encode("t", eventRow{ID: 7, Type: EventTypeStdout, Data: awkward})
+	if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "\n") {
+		t.Fatalf("record should be exactly one line, got %q", line)
+	}
+	var got map[string]any
+	if err := json.Unmarshal([]byte(line), &got); err != nil {
+		t.Fatalf("output is not valid JSON: %v\n%s", err, line)
+	}
+	if got["task"] != "t" || got["id"] != 7.0 || got["type"] != "stdout" || got["data"] != awkward {
+		t.Errorf("got %v", got)
+	}
+	if _, ok := got["code"]; ok {
+		t.Errorf("code should only be present on exit events, got %v", got)
+	}
+
+	// Keys keep the --fields order.
+	enc.fields = []string{"code", "type"}
+	if line := enc.encode("t", eventRow{Type: EventTypeExit}); line != `{"code":0,"type":"exit"}`+"\n" {
+		t.Errorf("got %q", line)
+	}
+}
+
+func TestEncodeLogfmt(t *testing.T) {
+	enc := eventEncoder{format: outputLogfmt, fields: []string{"type", "data", "code"}}
+	if line := enc.encode("t", eventRow{Type: EventTypeExit, Code: 2}); line != "type=exit code=2\n" {
+		t.Errorf("exit record = %q", line)
+	}
+
+	line := enc.encode("t", eventRow{Type: EventTypeStdout, Data: awkward})
+	value, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "type=stdout data=")
+	if !ok {
+		t.Fatalf("unexpected record %q", line)
+	}
+	if data, err := strconv.Unquote(value); err != nil || data != awkward {
+		t.Errorf("data value %s should unquote to %q, got %q (%v)", value, awkward, data, err)
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	fields, err := parseFields("data, type")
+	if err != nil || strings.Join(fields, ",") != "data,type" {
+		t.Errorf("parseFields: got %v, %v", fields, err)
+	}
+	for _, spec := range []string{"", "pid", "type,"} {
+		if _, err := parseFields(spec); err == nil {
+			t.Errorf("parseFields(%q) should fail", spec)
+		}
+	}
+}
@@ -1,9 +1,6 @@
 package main
 
-import (
-	"errors"
-	"fmt"
-)
+import "fmt"
 
 // runExec runs a command in the foreground, mirroring its stdout/stderr to the
 // terminal while also recording the full lifecycle (start, output, heartbeats,
@@ -15,12 +12,26 @@ import (
 // the whole database uploaded as a CI artifact for analysis.
 func runExec(args []string) (int, error) {
 	// exec takes the same arguments as fork: --task-name NAME -- COMMAND...
-	taskName, command, err := parseForkArgs(args)
+	taskName, command, cfg, err := parseForkArgs(args)
 	if err != nil {
 		return 1, err
 	}
+	if cfg.detachLogLevel != "" {
+		return 1, fmt.Errorf("--detach-log-level only applies to fork: exec runs the command in the foreground")
+	}
+
+	files, err := cfg.inheritedFiles(false)
+	if err != nil {
+		return 1, err
+	}
+	if err := cfg.checkCommand(command); err != nil {
+		return 1, err
+	}
+	if err := cfg.checkCredential(); err != nil {
+		return 1, err
+	}
 
-	db, err := openDB()
+	db, err := openDBSync(cfg.sync)
 	if err != nil {
 		return 1, err
 	}
@@ -28,12 +39,11 @@ func runExec(args []string) (int, error) {
 
 	// Claim the task name up front, exactly like fork, so a name collision is
 	// reported instead of silently appending to another task's log.
-	if err := registerTask(db, taskName); err != nil {
-		if errors.Is(err, ErrTaskExists) {
-			return 1, fmt.Errorf("task %q already exists (BGX_DB=%s)\nUse a different --task-name or remove the database.", taskName, getDBPath())
-		}
+	if err := claimTask(db, taskName, cfg); err != nil {
 		return 1, err
 	}
 
-	return executeProcess(db, taskName, command, true)
+	rec := newRecorder(db, taskName, cfg)
+	defer rec.close()
+	return executeProcess(rec, command, cfg, files, true)
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Transcript formats for `export --format`.
+const (
+	exportText = "txt"
+	exportHTML = "html"
+)
+
+// exportConfig holds the options for `bgx export`.
+type exportConfig struct {
+	format string // exportText (default) or exportHTML
+	merge  bool   // interleave stdout and stderr as recorded, not one after the other
+}
+
+// parseExportArgs parses `export` arguments of the form:
+//
+//	--task-name NAME [--format txt|html] [--merge]
+func parseExportArgs(args []string) (taskName string, cfg exportConfig, err error) {
+	cfg.format = exportText
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--task-name":
+			if i+1 >= len(args) {
+				return "", cfg, fmt.Errorf("--task-name requires an argument")
+			}
+			taskName = args[i+1]
+			i++
+		case "--format":
+			if i+1 >= len(args) {
+				return "", cfg, fmt.Errorf("--format requires an argument")
+			}
+			if args[i+1] != exportText && args[i+1] != exportHTML {
+				return "", cfg, fmt.Errorf("invalid --format %q: want txt or html", args[i+1])
+			}
+			cfg.format = args[i+1]
+			i++
+		case "--merge":
+			cfg.merge = true
+		default:
+			return "", cfg, fmt.Errorf("unexpected argument %q\nUsage: bgx export --task-name NAME [--format txt|html] [--merge]", args[i])
+		}
+	}
+	if taskName == "" {
+		return "", cfg, fmt.Errorf("--task-name is required")
+	}
+	return taskName, cfg, nil
+}
+
+// transcriptSection is one block of a transcript's output: a stream, or with
+// --merge both. Each chunk is an event's data, in recorded order.
+type transcriptSection struct {
+	Title  string
+	Chunks []transcriptChunk
+}
+
+type transcriptChunk struct {
+	Stderr bool
+	Data   string
+}
+
+// runExport writes a task's recorded output to stdout as a transcript that
+// stands on its own: a header with the command, its start and end times and
+// exit code, then stdout and stderr (or, with --merge, both interleaved in
+// the order they were recorded). The txt format has escape sequences
+// removed; the html format is a single page with their colors kept. It only
+// reads the log, so it works on a task that is still running, as far as it
+// has got.
+func runExport(args []string) error {
+	taskName, cfg, err := parseExportArgs(args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	exists, err := taskExists(db, taskName)
+	if err != nil {
+		return fmt.Errorf("failed to look up task: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("task %q not found (BGX_DB=%s)", taskName, getDBPath())
+	}
+	s, err := readTaskSummary(db, taskName)
+	if err != nil {
+		return fmt.Errorf("failed to read task %q: %w", taskName, err)
+	}
+	events, err := readEventsAfter(db, taskName, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to read events for %q: %w", taskName, err)
+	}
+
+	var sections []transcriptSection
+	if cfg.merge {
+		sections = []transcriptSection{{Title: "output"}}
+	} else {
+		sections = []transcriptSection{{Title: "stdout"}, {Title: "stderr"}}
+	}
+	for _, e := range events {
+		if e.Type != EventTypeStdout && e.Type != EventTypeStderr {
+			continue
+		}
+		stderr := e.Type == EventTypeStderr
+		section := &sections[0]
+		if stderr && !cfg.merge {
+			section = &sections[1]
+		}
+		section.Chunks = append(section.Chunks, transcriptChunk{Stderr: stderr, Data: e.Data})
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	if cfg.format == exportHTML {
+		err = writeHTMLTranscript(w, s, sections, time.Now())
+	} else {
+		writeTextTranscript(w, s, sections, time.Now())
+	}
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// transcriptHeader lists a transcript's header fields, as label and value.
+func transcriptHeader(s taskSummary, now time.Time) [][2]string {
+	header := [][2]string{{"Task", s.Name}}
+	if !s.Started {
+		return append(header, [2]string{"State", s.state(now)})
+	}
+	header = append(header,
+		[2]string{"Command", strings.Join(s.Command, " ")},
+		[2]string{"Started", s.StartTime.Local().Format(time.RFC3339)})
+	if s.Exited {
+		header = append(header,
+			[2]string{"Ended", s.LastEventTime.Local().Format(time.RFC3339)},
+			[2]string{"Exit code", fmt.Sprint(s.ExitCode)})
+	} else {
+		header = append(header, [2]string{"State", s.state(now)})
+	}
+	return append(header, [2]string{"Duration", s.Duration().Round(time.Millisecond).String()})
+}
+
+// writeTextTranscript writes the txt format: the header, then each section
+// with output under a "--- stdout ---" style line.
+func writeTextTranscript(w io.Writer, s taskSummary, sections []transcriptSection, now time.Time) {
+	for _, field := range transcriptHeader(s, now) {
+		fmt.Fprintf(w, "%-11s%s\n", field[0]+":", field[1])
+	}
+	var stdout, stderr ansiStripper
+	empty := true
+	for _, section := range sections {
+		if len(section.Chunks) == 0 {
+			continue
+		}
+		empty = false
+		fmt.Fprintf(w, "\n--- %s ---\n", section.Title)
+		var last string
+		for _, c := range section.Chunks {
+			stripper := &stdout
+			if c.Stderr {
+				stripper = &stderr
+			}
+			if text := stripper.strip(c.Data); text != "" {
+				io.WriteString(w, text)
+				last = text
+			}
+		}
+		if !strings.HasSuffix(last, "\n") {
+			io.WriteString(w, "\n")
+		}
+	}
+	if empty {
+		io.WriteString(w, "\n(no output)\n")
+	}
+}
+
+// htmlTranscript is the page that writeHTMLTranscript renders. Each
+// section's output is already converted, escaped, from the recorded data.
+var htmlTranscript = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Name}} - bgx transcript</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; color: #222; }
+th { text-align: left; padding-right: 1em; font-weight: normal; color: #666; }
+td { font-family: ui-monospace, monospace; }
+pre { background: #1e1e1e; color: #e5e5e5; padding: 1em; overflow-x: auto; }
+.stderr { color: #f14c4c; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<table>
+{{range .Header}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}</table>
+{{range .Sections}}<h2>{{.Title}}</h2>
+<pre>{{.Output}}</pre>
+{{else}}<p>No output.</p>
+{{end}}</body>
+</html>
+`))
+
+// writeHTMLTranscript writes the html format: a self-contained page with the
+// header as a table and each section with output as a preformatted block,
+// its ANSI colors turned into styles and stderr in red.
+func writeHTMLTranscript(w io.Writer, s taskSummary, sections []transcriptSection, now time.Time) error {
+	type htmlSection struct {
+		Title  string
+		Output template.HTML
+	}
+	var stdout, stderr ansiHTML
+	var rendered []htmlSection
+	for _, section := range sections {
+		if len(section.Chunks) == 0 {
+			continue
+		}
+		var b strings.Builder
+		for _, c := range section.Chunks {
+			if c.Stderr {
+				b.WriteString(`<span class="stderr">` + stderr.convert(c.Data) + `</span>`)
+			} else {
+				b.WriteString(stdout.convert(c.Data))
+			}
+		}
+		rendered = append(rendered, htmlSection{section.Title, template.HTML(b.String())})
+	}
+	return htmlTranscript.Execute(w, struct {
+		Name     string
+		Header   [][2]string
+		Sections []htmlSection
+	}{s.Name, transcriptHeader(s, now), rendered})
+}
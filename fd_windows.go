@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import "syscall"
+
+// writeFD writes p to an inherited handle, like join's --print-exit,
+// without wrapping it in an *os.File whose finalizer would close it.
+func writeFD(fd int, p []byte) error {
+	for len(p) > 0 {
+		n, err := syscall.Write(syscall.Handle(fd), p)
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
@@ -2,52 +2,707 @@ package main
 
 import (
 	"bufio"
+	"cmp"
 	"database/sql"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// ReadyTimeout is how long fork --wait-file waits for the file by default,
+// and ReadyPollInterval how often the daemon looks for it.
+const (
+	ReadyTimeout      = 30 * time.Second
+	ReadyPollInterval = 100 * time.Millisecond
+)
+
+// detachLogLevels are the levels of fork's --detach-log-level, quietest
+// first: how much fork itself says on stderr while it starts the daemon. At
+// info, the default, it reports that the task started (and, with
+// --wait-file, that it is ready); debug adds how the daemon was run; error
+// leaves only errors, and silent not even those, for scripts that go by the
+// exit status alone. None of them changes what the task records.
+var detachLogLevels = []string{"silent", "error", "info", "debug"}
+
+// maxCaptureFD bounds --capture-fd: every descriptor from 3 up to a captured
+// one is set up in the command, closed if not otherwise used.
+const maxCaptureFD = 255
+
+// Memory metrics for --mem-metric. RSS counts every resident page a process
+// maps, shared ones in full; PSS (Linux only) divides each shared page among
+// the processes mapping it, so it is closer to what a process actually costs.
+const (
+	MemMetricRSS = "rss"
+	MemMetricPSS = "pss"
+)
+
+// forkConfig holds the recording options shared by `fork` and `exec`.
+type forkConfig struct {
+	sync        bool     // fsync every event, not just the final exit event
+	syncEvery   int      // fsync every this many events instead (0: only the exit event)
+	sinks       []string // also stream events as NDJSON to these tcp://, unix:// or file:// URLs
+	noHeartbeat bool     // don't emit heartbeat events
+	ioStats     bool     // sample /proc/<pid>/io storage I/O in heartbeats
+	memMetric   string   // what heartbeats sample as memory: MemMetricPSS, or "" for RSS
+	noProcStats bool     // don't sample CPU or memory: heartbeats only mark liveness
+
+	heartbeatAdaptive bool // space heartbeats out while the command is quiet
+
+	// heartbeatTouch marks liveness by touching the task's heartbeat file at
+	// each heartbeat instead of recording a heartbeat event.
+	heartbeatTouch bool
+
+	sign bool // chain an HMAC (keyed by BGX_SIGN_KEY) through every event
+
+	// shell runs the command as a script: a shell (shellPath, else $SHELL,
+	// else sh) with -c, or the given interpreter's words, then the script.
+	shell       bool
+	shellPath   string
+	interpreter string
+
+	maxEvents int // kill the command after this many stdout/stderr events (0: no limit)
+
+	maxTotalBytes int // stop recording output, but not the command, past this many bytes (0: no limit)
+
+	idleTimeout time.Duration // kill the command after this long without output (0: never)
+
+	coalesceWindow time.Duration // batch a stream's records written within this long into one event (0: don't)
+
+	// waitFile is a file whose appearance means the command is ready, as
+	// recorded by a ready event; fork waits up to waitTimeout for it. The
+	// timeout is fork's own, so it is not passed on to the daemon.
+	waitFile    string
+	waitTimeout time.Duration
+
+	// detachLogLevel, one of detachLogLevels ("": info), is how much fork
+	// prints while starting the daemon. It is fork's own, so it is not
+	// passed on to the daemon either.
+	detachLogLevel string
+
+	maxEventBytes int // split output lines into events of at most this many bytes (0: MaxEventBytes)
+
+	delimiter string // the byte that ends a record of output ("": newline)
+
+	stripANSI bool // remove ANSI escape sequences from output before recording it
+
+	// inheritFDs lists descriptors, as numbered in the process that ran
+	// `fork`, to pass on to the command; it receives them from fd 3 up.
+	inheritFDs []int
+
+	// captureFDs lists descriptors of the command, 3 or more, whose output
+	// is recorded as fd events alongside stdout and stderr.
+	captureFDs []int
+
+	// logTypes lists the output and heartbeat event types to persist (nil:
+	// all of them). Lifecycle events such as start and exit are always
+	// persisted; join can't work without them.
+	logTypes []string
+
+	// env holds --env KEY=VALUE assignments for the command, in order; they
+	// win over inherited variables. With envClear, the command inherits
+	// nothing but PATH and HOME besides them.
+	env      []string
+	envClear bool
+
+	// user and group, as given to --user and --group (a name or a number),
+	// are who the command runs as; bgx must be root to switch. Empty: bgx's
+	// own identity.
+	user, group string
+
+	// overwriteIfExited lets the task name be reused if the task using it
+	// has exited. The name is claimed before the daemon starts, so this is
+	// not passed on to it.
+	overwriteIfExited bool
+
+	// commandFile and expand are resolved into the command by parseForkArgs,
+	// so they are not passed on to the daemon.
+	commandFile string
+	expand      bool // expand $VAR and ${VAR} in the command's arguments
+}
+
+// logs reports whether fork prints messages of the given --detach-log-level.
+func (cfg forkConfig) logs(level string) bool {
+	return slices.Index(detachLogLevels, level) <= slices.Index(detachLogLevels, cmp.Or(cfg.detachLogLevel, "info"))
+}
+
+// records reports whether events of the given type are persisted.
+func (cfg forkConfig) records(eventType string) bool {
+	switch {
+	case cfg.logTypes == nil:
+		return true
+	case eventType != EventTypeStdout && eventType != EventTypeStderr && eventType != EventTypeHeartbeat && eventType != EventTypeError:
+		return true
+	}
+	for _, t := range cfg.logTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// heartbeats reports whether heartbeat events will be recorded at all, either
+// of which flags may rule out.
+func (cfg forkConfig) heartbeats() bool {
+	return !cfg.noHeartbeat && cfg.records(EventTypeHeartbeat)
+}
+
+// parseLogTypes parses a comma-separated --log-types list of event types.
+func parseLogTypes(spec string) ([]string, error) {
+	types := []string{}
+	for _, t := range strings.Split(spec, ",") {
+		switch t = strings.TrimSpace(t); t {
+		case EventTypeStart, EventTypeStdout, EventTypeStderr, EventTypeHeartbeat, EventTypeError, EventTypeExit:
+			types = append(types, t)
+		default:
+			return nil, fmt.Errorf("invalid event type %q in --log-types %q", t, spec)
+		}
+	}
+	return types, nil
+}
+
+// minEventBytes is the smallest --max-event-bytes fork accepts: bufio's
+// minimum buffer size, which it would silently round smaller values up to.
+const minEventBytes = 16
+
+// eventBytes is the most output data one event may carry.
+func (cfg forkConfig) eventBytes() int {
+	if cfg.maxEventBytes == 0 {
+		return MaxEventBytes
+	}
+	return cfg.maxEventBytes
+}
+
+// recordDelimiter is the byte output is split into events after.
+func (cfg forkConfig) recordDelimiter() byte {
+	if cfg.delimiter == "" {
+		return '\n'
+	}
+	return cfg.delimiter[0]
+}
+
+// parseDelimiter parses a --delimiter value: a single byte taken literally,
+// \0 for NUL, or a Go escape for one byte such as \n, \t or \x1e.
+func parseDelimiter(spec string) (string, error) {
+	if len(spec) == 1 {
+		return spec, nil
+	}
+	if spec == `\0` {
+		return "\x00", nil
+	}
+	if d, err := strconv.Unquote(`"` + spec + `"`); err == nil && len(d) == 1 {
+		return d, nil
+	}
+	return "", fmt.Errorf("invalid --delimiter %q: must be a single byte, \\0, or an escape such as \\n or \\x1e", spec)
+}
+
+// interpreterArgs returns the words that precede the script in shell mode, or
+// nil when the command runs directly. --interpreter is split on whitespace,
+// with no quoting; a shell path is used as is.
+func (cfg forkConfig) interpreterArgs() []string {
+	switch {
+	case cfg.interpreter != "":
+		return strings.Fields(cfg.interpreter)
+	case cfg.shellPath != "":
+		return []string{cfg.shellPath, "-c"}
+	case cfg.shell:
+		if sh := os.Getenv("SHELL"); sh != "" {
+			return []string{sh, "-c"}
+		}
+		return []string{"sh", "-c"}
+	}
+	return nil
+}
+
+// commandLine returns the argv to execute for command: command itself, or in
+// shell mode the interpreter followed by command joined into one script.
+func (cfg forkConfig) commandLine(command []string) []string {
+	interp := cfg.interpreterArgs()
+	if interp == nil {
+		return command
+	}
+	return append(interp, strings.Join(command, " "))
+}
+
+// checkCommand fails if the command can't be found, so that fork and exec
+// report it before claiming the task name rather than recording a task that
+// only fails to start. It resolves the name the way the command is started:
+// against bgx's own PATH, even under --env or --env-clear. In shell mode the
+// shell resolves the command, so only the interpreter is checked, by
+// parseForkArgs.
+func (cfg forkConfig) checkCommand(command []string) error {
+	if cfg.interpreterArgs() != nil {
+		return nil
+	}
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return fmt.Errorf("command not found: %w", err)
+	}
+	return nil
+}
+
+// inheritedFiles returns the --inherit-fd descriptors as files, checking that
+// each is open. In the daemon they are no longer at their original numbers:
+// the parent hands them over as ExtraFiles, which start at fd 3.
+func (cfg forkConfig) inheritedFiles(daemon bool) ([]*os.File, error) {
+	files := make([]*os.File, len(cfg.inheritFDs))
+	for i, fd := range cfg.inheritFDs {
+		n := fd
+		if daemon {
+			n = 3 + i
+		}
+		files[i] = os.NewFile(uintptr(n), fmt.Sprintf("fd %d", fd))
+		if _, err := files[i].Stat(); err != nil {
+			return nil, fmt.Errorf("--inherit-fd %d is not an open file descriptor: %w", fd, err)
+		}
+	}
+	return files, nil
+}
+
+// args renders cfg back into command-line flags, so the parent can hand the
+// same options to the daemon it spawns.
+func (cfg forkConfig) args() []string {
+	var args []string
+	if cfg.sync {
+		args = append(args, "--sync")
+	}
+	if cfg.syncEvery != 0 {
+		args = append(args, "--sync-every", strconv.Itoa(cfg.syncEvery))
+	}
+	for _, spec := range cfg.sinks {
+		args = append(args, "--sink", spec)
+	}
+	if cfg.noHeartbeat {
+		args = append(args, "--no-heartbeat")
+	}
+	if cfg.heartbeatAdaptive {
+		args = append(args, "--heartbeat-adaptive")
+	}
+	if cfg.heartbeatTouch {
+		args = append(args, "--heartbeat-touch")
+	}
+	if cfg.ioStats {
+		args = append(args, "--io-stats")
+	}
+	if cfg.noProcStats {
+		args = append(args, "--no-proc-stats")
+	}
+	if cfg.memMetric != "" {
+		args = append(args, "--mem-metric", cfg.memMetric)
+	}
+	if cfg.stripANSI {
+		args = append(args, "--strip-ansi")
+	}
+	if cfg.user != "" {
+		args = append(args, "--user", cfg.user)
+	}
+	if cfg.group != "" {
+		args = append(args, "--group", cfg.group)
+	}
+	if cfg.logTypes != nil {
+		args = append(args, "--log-types", strings.Join(cfg.logTypes, ","))
+	}
+	if cfg.sign {
+		args = append(args, "--sign")
+	}
+	for _, fd := range cfg.inheritFDs {
+		args = append(args, "--inherit-fd", strconv.Itoa(fd))
+	}
+	for _, fd := range cfg.captureFDs {
+		args = append(args, "--capture-fd", strconv.Itoa(fd))
+	}
+	if cfg.maxEventBytes != 0 {
+		args = append(args, "--max-event-bytes", strconv.Itoa(cfg.maxEventBytes))
+	}
+	if cfg.delimiter != "" {
+		// Escaped so that a NUL survives as an argument.
+		quoted := strconv.QuoteToASCII(cfg.delimiter)
+		args = append(args, "--delimiter", quoted[1:len(quoted)-1])
+	}
+	if cfg.maxEvents != 0 {
+		args = append(args, "--max-events", strconv.Itoa(cfg.maxEvents))
+	}
+	if cfg.maxTotalBytes != 0 {
+		args = append(args, "--max-total-bytes", strconv.Itoa(cfg.maxTotalBytes))
+	}
+	if cfg.envClear {
+		args = append(args, "--env-clear")
+	}
+	for _, kv := range cfg.env {
+		args = append(args, "--env", kv)
+	}
+	if cfg.idleTimeout != 0 {
+		args = append(args, "--idle-timeout", cfg.idleTimeout.String())
+	}
+	if cfg.coalesceWindow != 0 {
+		args = append(args, "--coalesce-window", cfg.coalesceWindow.String())
+	}
+	if cfg.waitFile != "" {
+		args = append(args, "--wait-file", cfg.waitFile)
+	}
+	if cfg.shellPath != "" {
+		args = append(args, "--shell-path", cfg.shellPath)
+	} else if cfg.interpreter != "" {
+		args = append(args, "--interpreter", cfg.interpreter)
+	} else if cfg.shell {
+		args = append(args, "--shell")
+	}
+	return args
+}
+
 // parseForkArgs parses `fork` arguments of the form:
 //
-//	--task-name NAME -- COMMAND [ARGS...]
-func parseForkArgs(args []string) (taskName string, command []string, err error) {
+//	--task-name NAME [--sync | --sync-every N] [--sink URL] [--no-heartbeat] -- COMMAND [ARGS...]
+//	--task-name NAME [...] --command-file FILE
+//	--file TASK.json [...] [-- COMMAND [ARGS...]]
+//
+// With --command-file, the command and its arguments are read from FILE, one
+// per line, instead of following `--`. With --file, a task definition
+// supplies defaults for the rest (see expandTaskFile).
+func parseForkArgs(args []string) (taskName string, command []string, cfg forkConfig, err error) {
+	if args, err = expandTaskFile(args); err != nil {
+		return "", nil, cfg, err
+	}
+	heartbeatSet := false // --heartbeat or --no-heartbeat given: no default from the environment
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
 		case "--task-name":
 			if i+1 >= len(args) {
-				return "", nil, fmt.Errorf("--task-name requires an argument")
+				return "", nil, cfg, fmt.Errorf("--task-name requires an argument")
 			}
 			taskName = args[i+1]
 			i++
+		case "--sync":
+			cfg.sync = true
+		case "--sync-every":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--sync-every requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n <= 0 {
+				return "", nil, cfg, fmt.Errorf("invalid --sync-every %q: must be a positive number", args[i+1])
+			}
+			cfg.syncEvery = n
+			i++
+		case "--sink":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--sink requires an argument")
+			}
+			if _, _, err := parseSinkURL(args[i+1]); err != nil {
+				return "", nil, cfg, err
+			}
+			cfg.sinks = append(cfg.sinks, args[i+1])
+			i++
+		case "--no-heartbeat", "--heartbeat":
+			// The last one given wins, so that the command line can
+			// override a --file definition either way.
+			cfg.noHeartbeat = args[i] == "--no-heartbeat"
+			heartbeatSet = true
+		case "--heartbeat-adaptive":
+			cfg.heartbeatAdaptive = true
+		case "--heartbeat-touch":
+			cfg.heartbeatTouch = true
+		case "--io-stats":
+			cfg.ioStats = true
+		case "--no-proc-stats":
+			cfg.noProcStats = true
+		case "--strip-ansi":
+			cfg.stripANSI = true
+		case "--user", "--group":
+			if i+1 >= len(args) || args[i+1] == "" {
+				return "", nil, cfg, fmt.Errorf("%s requires an argument", args[i])
+			}
+			if args[i] == "--user" {
+				cfg.user = args[i+1]
+			} else {
+				cfg.group = args[i+1]
+			}
+			i++
+		case "--mem-metric":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--mem-metric requires an argument")
+			}
+			switch args[i+1] {
+			case MemMetricRSS:
+				cfg.memMetric = ""
+			case MemMetricPSS:
+				cfg.memMetric = MemMetricPSS
+			default:
+				return "", nil, cfg, fmt.Errorf("invalid --mem-metric %q: want rss or pss", args[i+1])
+			}
+			i++
+		case "--sign":
+			cfg.sign = true
+		case "--expand":
+			cfg.expand = true
+		case "--shell":
+			cfg.shell = true
+		case "--shell-path", "--interpreter":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("%s requires an argument", args[i])
+			}
+			if args[i] == "--shell-path" {
+				cfg.shellPath = args[i+1]
+			} else if cfg.interpreter = args[i+1]; strings.TrimSpace(cfg.interpreter) == "" {
+				return "", nil, cfg, fmt.Errorf("--interpreter requires a program, such as \"python3 -c\"")
+			}
+			cfg.shell = true
+			i++
+		case "--delimiter":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--delimiter requires an argument")
+			}
+			d, err := parseDelimiter(args[i+1])
+			if err != nil {
+				return "", nil, cfg, err
+			}
+			cfg.delimiter = d
+			i++
+		case "--env":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--env requires an argument")
+			}
+			if key, _, ok := strings.Cut(args[i+1], "="); !ok || key == "" {
+				return "", nil, cfg, fmt.Errorf("invalid --env %q: must be KEY=VALUE", args[i+1])
+			}
+			cfg.env = append(cfg.env, args[i+1])
+			i++
+		case "--env-clear":
+			cfg.envClear = true
+		case "--max-events":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--max-events requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n <= 0 {
+				return "", nil, cfg, fmt.Errorf("invalid --max-events %q: must be a positive number", args[i+1])
+			}
+			cfg.maxEvents = n
+			i++
+		case "--max-total-bytes":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--max-total-bytes requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n <= 0 {
+				return "", nil, cfg, fmt.Errorf("invalid --max-total-bytes %q: must be a positive number", args[i+1])
+			}
+			cfg.maxTotalBytes = n
+			i++
+		case "--idle-timeout":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--idle-timeout requires an argument")
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d <= 0 {
+				return "", nil, cfg, fmt.Errorf("invalid --idle-timeout %q: must be a duration such as 30s or 5m", args[i+1])
+			}
+			cfg.idleTimeout = d
+			i++
+		case "--coalesce-window":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--coalesce-window requires an argument")
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d <= 0 {
+				return "", nil, cfg, fmt.Errorf("invalid --coalesce-window %q: must be a duration such as 50ms or 1s", args[i+1])
+			}
+			cfg.coalesceWindow = d
+			i++
+		case "--overwrite-if-exited":
+			cfg.overwriteIfExited = true
+		case "--wait-file":
+			if i+1 >= len(args) || args[i+1] == "" {
+				return "", nil, cfg, fmt.Errorf("--wait-file requires an argument")
+			}
+			cfg.waitFile = args[i+1]
+			i++
+		case "--wait-timeout":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--wait-timeout requires an argument")
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d <= 0 {
+				return "", nil, cfg, fmt.Errorf("invalid --wait-timeout %q: must be a duration such as 30s or 5m", args[i+1])
+			}
+			cfg.waitTimeout = d
+			i++
+		case "--detach-log-level":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--detach-log-level requires an argument")
+			}
+			if !slices.Contains(detachLogLevels, args[i+1]) {
+				return "", nil, cfg, fmt.Errorf("invalid --detach-log-level %q: want %s", args[i+1], strings.Join(detachLogLevels, ", "))
+			}
+			cfg.detachLogLevel = args[i+1]
+			i++
+		case "--max-event-bytes":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--max-event-bytes requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < minEventBytes {
+				return "", nil, cfg, fmt.Errorf("invalid --max-event-bytes %q: must be a byte count of at least %d", args[i+1], minEventBytes)
+			}
+			cfg.maxEventBytes = n
+			i++
+		case "--inherit-fd":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--inherit-fd requires an argument")
+			}
+			fd, err := strconv.Atoi(args[i+1])
+			if err != nil || fd < 3 {
+				return "", nil, cfg, fmt.Errorf("invalid --inherit-fd %q: must be a descriptor number of 3 or more (0-2 are stdio)", args[i+1])
+			}
+			cfg.inheritFDs = append(cfg.inheritFDs, fd)
+			i++
+		case "--capture-fd":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--capture-fd requires an argument")
+			}
+			fd, err := strconv.Atoi(args[i+1])
+			if err != nil || fd < 3 || fd > maxCaptureFD {
+				return "", nil, cfg, fmt.Errorf("invalid --capture-fd %q: must be a descriptor number from 3 to %d (1 and 2 are always captured)", args[i+1], maxCaptureFD)
+			}
+			if slices.Contains(cfg.captureFDs, fd) {
+				return "", nil, cfg, fmt.Errorf("--capture-fd %d given twice", fd)
+			}
+			cfg.captureFDs = append(cfg.captureFDs, fd)
+			i++
+		case "--log-types":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--log-types requires an argument")
+			}
+			if cfg.logTypes, err = parseLogTypes(args[i+1]); err != nil {
+				return "", nil, cfg, err
+			}
+			i++
+		case "--command-file":
+			if i+1 >= len(args) {
+				return "", nil, cfg, fmt.Errorf("--command-file requires an argument")
+			}
+			cfg.commandFile = args[i+1]
+			i++
 		case "--":
 			command = args[i+1:]
 			i = len(args)
 		default:
-			return "", nil, fmt.Errorf("unexpected argument %q\nUsage: bgx fork --task-name NAME -- COMMAND [ARGS...]", args[i])
+			return "", nil, cfg, fmt.Errorf("unexpected argument %q\nUsage: bgx fork --task-name NAME [options] -- COMMAND [ARGS...]\nRun 'bgx' with no arguments for the list of options.", args[i])
 		}
 	}
 	if taskName == "" {
-		return "", nil, fmt.Errorf("--task-name is required")
+		return "", nil, cfg, fmt.Errorf("--task-name is required")
+	}
+	// The daemon is handed the parent's options as flags, after this
+	// default was applied (or overridden with --heartbeat, which isn't
+	// passed on), so it mustn't apply it again.
+	if !heartbeatSet && !cfg.heartbeatAdaptive && !cfg.heartbeatTouch && os.Getenv("BGX_DAEMON_MODE") != "1" {
+		if cfg.noHeartbeat, err = envBool(NoHeartbeatEnv); err != nil {
+			return "", nil, cfg, err
+		}
+	}
+	if cfg.shellPath != "" && cfg.interpreter != "" {
+		return "", nil, cfg, fmt.Errorf("--shell-path and --interpreter cannot be combined")
+	}
+	if cfg.sync && cfg.syncEvery != 0 {
+		return "", nil, cfg, fmt.Errorf("--sync-every cannot be combined with --sync, which already fsyncs every event")
+	}
+	if cfg.heartbeatTouch && (cfg.noHeartbeat || cfg.heartbeatAdaptive) {
+		// Adaptive heartbeats announce their interval in the events.
+		return "", nil, cfg, fmt.Errorf("--heartbeat-touch cannot be combined with --no-heartbeat or --heartbeat-adaptive")
+	}
+	if cfg.noProcStats && (cfg.ioStats || cfg.memMetric != "") {
+		return "", nil, cfg, fmt.Errorf("--no-proc-stats cannot be combined with --io-stats or --mem-metric pss")
+	}
+	if cfg.waitTimeout != 0 && cfg.waitFile == "" {
+		return "", nil, cfg, fmt.Errorf("--wait-timeout requires --wait-file")
+	}
+	for _, fd := range cfg.captureFDs {
+		if fd < 3+len(cfg.inheritFDs) {
+			return "", nil, cfg, fmt.Errorf("--capture-fd %d is taken by --inherit-fd: the command receives the %d inherited descriptors from fd 3 up", fd, len(cfg.inheritFDs))
+		}
+	}
+	if cfg.commandFile != "" {
+		if len(command) > 0 {
+			return "", nil, cfg, fmt.Errorf("--command-file cannot be combined with a command after --")
+		}
+		if cfg.shell {
+			// In shell mode the file is the script itself, verbatim.
+			data, err := os.ReadFile(cfg.commandFile)
+			if err != nil {
+				return "", nil, cfg, fmt.Errorf("failed to read command file: %w", err)
+			}
+			command = []string{string(data)}
+		} else if command, err = readCommandFile(cfg.commandFile); err != nil {
+			return "", nil, cfg, err
+		}
 	}
 	if len(command) == 0 {
-		return "", nil, fmt.Errorf("no command specified")
+		return "", nil, cfg, fmt.Errorf("no command specified")
+	}
+	if interp := cfg.interpreterArgs(); interp != nil {
+		if _, err := exec.LookPath(interp[0]); err != nil {
+			return "", nil, cfg, fmt.Errorf("interpreter %q not found: %w", interp[0], err)
+		}
+	}
+	if cfg.expand {
+		command = expandArgs(command, cfg.childEnviron())
+	}
+	if cfg.sign && os.Getenv(SignKeyEnv) == "" {
+		return "", nil, cfg, fmt.Errorf("--sign requires %s to be set to the signing key", SignKeyEnv)
+	}
+	return taskName, command, cfg, nil
+}
+
+// readCommandFile reads a --command-file: the command and each of its
+// arguments on a line of their own. Blank lines are skipped, so the file may
+// end with a newline (or be spaced out) without adding empty arguments.
+func readCommandFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command file: %w", err)
+	}
+	var command []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line != "" {
+			command = append(command, line)
+		}
 	}
-	return taskName, command, nil
+	return command, nil
 }
 
+// errSilenced is what runFork returns in place of an error that
+// --detach-log-level silent keeps quiet: fork still exits 1, without a word.
+var errSilenced = errors.New("error not shown (--detach-log-level silent)")
+
 func runFork(args []string) error {
-	taskName, command, err := parseForkArgs(args)
+	taskName, command, cfg, err := parseForkArgs(args)
 	if err != nil {
-		return err
+		return err // a malformed command line is always reported
+	}
+	if err = startFork(taskName, command, cfg); err != nil && !cfg.logs("error") {
+		return errSilenced
 	}
+	return err
+}
 
-	db, err := openDB()
+// startFork runs the daemon for a task, or in the daemon, the command.
+func startFork(taskName string, command []string, cfg forkConfig) error {
+	db, err := openDBSync(cfg.sync)
 	if err != nil {
 		return err
 	}
@@ -55,106 +710,597 @@ func runFork(args []string) error {
 
 	// Daemon mode: we are the detached child; actually run the command.
 	if os.Getenv("BGX_DAEMON_MODE") == "1" {
-		_, err := executeProcess(db, taskName, command, false)
+		rec := newRecorder(db, taskName, cfg)
+		defer rec.close()
+		// The parent names the build it expects; if the binary on disk was
+		// replaced in between, fail visibly rather than run a different bgx.
+		if want := os.Getenv("BGX_DAEMON_VERSION"); want != "" && want != buildID() {
+			_, err := recordStartupFailure(rec, fmt.Errorf("daemon is bgx %s but fork was bgx %s; was the binary replaced?", buildID(), want))
+			return err
+		}
+		files, err := cfg.inheritedFiles(true)
+		if err != nil {
+			_, err := recordStartupFailure(rec, err)
+			return err
+		}
+		if _, err = executeProcess(rec, command, cfg, files, false); err == nil {
+			removeIfEmpty(daemonLogPath(taskName)) // nothing went wrong, nothing to keep
+		}
+		return err
+	}
+
+	// Re-exec this very binary as the daemon. os.Args[0] may be a bare name
+	// resolved via PATH, or relative to a directory that no longer applies,
+	// so resolve the executable before claiming the name.
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to resolve the bgx executable for the daemon: %w", err)
+	}
+	files, err := cfg.inheritedFiles(false)
+	if err != nil {
+		return err
+	}
+	if err := cfg.checkCommand(command); err != nil {
+		return err
+	}
+	if err := cfg.checkCredential(); err != nil {
 		return err
 	}
 
 	// Parent mode: atomically claim the task name, then spawn the daemon.
-	if err := registerTask(db, taskName); err != nil {
-		if errors.Is(err, ErrTaskExists) {
-			return fmt.Errorf("task %q already exists (BGX_DB=%s)\nUse a different --task-name or remove the database.", taskName, getDBPath())
-		}
+	if err := claimTask(db, taskName, cfg); err != nil {
 		return err
 	}
 
-	env := append(os.Environ(), "BGX_DAEMON_MODE=1")
-	daemonArgs := []string{"fork", "--task-name", taskName, "--"}
+	daemonEnv := []string{"BGX_DAEMON_MODE=1", "BGX_DAEMON_VERSION=" + buildID()}
+	env := append(os.Environ(), daemonEnv...)
+	daemonArgs := append([]string{"fork", "--task-name", taskName}, cfg.args()...)
+	daemonArgs = append(daemonArgs, "--")
 	daemonArgs = append(daemonArgs, command...)
 
-	cmd := exec.Command(os.Args[0], daemonArgs...)
+	// Once detached, the daemon's own errors (as opposed to the command's
+	// output) would go nowhere; keep them in the task's daemon log instead.
+	// The name was just claimed, so any earlier log is from a reset database.
+	daemonLog, err := createDaemonLog(taskName)
+	if err != nil {
+		unregisterTask(db, taskName)
+		return err
+	}
+	defer daemonLog.Close()
+
+	// None of fork's own stdio is passed on: the daemon's stdin is left nil,
+	// which os/exec connects to the null device, and its stdout and stderr go
+	// to the daemon log. Holding on to, say, the write end of a pipe that fork
+	// was run in would keep the reader waiting until the task is done
+	// (TestForkInPipeline).
+	cmd := exec.Command(self, daemonArgs...)
 	cmd.Env = env
+	cmd.Stdout, cmd.Stderr = daemonLog, daemonLog
 	cmd.SysProcAttr = daemonSysProcAttr() // detach so the daemon outlives this step
+	cmd.ExtraFiles = files                // --inherit-fd; the daemon sees them from fd 3
 
 	if err := cmd.Start(); err != nil {
 		unregisterTask(db, taskName) // release the name; nothing ran
 		return fmt.Errorf("failed to start daemon: %w", err)
 	}
+	if cfg.logs("debug") {
+		fmt.Fprintf(os.Stderr, "bgx: daemon: %s\n", quoteArgs(append([]string{self}, daemonArgs...)))
+		fmt.Fprintf(os.Stderr, "bgx: daemon environment: fork's, plus %s\n", quoteArgs(daemonEnv))
+		fmt.Fprintf(os.Stderr, "bgx: daemon log: %s\n", daemonLog.Name())
+		fmt.Fprintf(os.Stderr, "bgx: daemon pid: %d\n", cmd.Process.Pid)
+	}
 	cmd.Process.Release()
 
-	fmt.Fprintf(os.Stderr, "Started task '%s' (BGX_DB: %s)\n", taskName, getDBPath())
-	fmt.Fprintf(os.Stderr, "To monitor: bgx join --task-name %s\n", taskName)
+	if cfg.logs("info") {
+		fmt.Fprintf(os.Stderr, "Started task '%s' (BGX_DB: %s)\n", taskName, getDBPath())
+		fmt.Fprintf(os.Stderr, "To monitor: bgx join --task-name %s\n", taskName)
+	}
+	if cfg.waitFile != "" {
+		return waitForReady(db, taskName, cfg)
+	}
+	return nil
+}
+
+// quoteArgs joins args with spaces for display, quoting those a POSIX shell
+// would not take as a single word as they are.
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = arg
+		if arg == "" || strings.ContainsFunc(arg, func(r rune) bool {
+			return !strings.ContainsRune("_-./=:,+@%", r) && (r > unicode.MaxASCII || !unicode.IsLetter(r) && !unicode.IsDigit(r))
+		}) {
+			quoted[i] = shellQuote(arg)
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// waitForReady polls a task's events until its ready event, for fork
+// --wait-file. A task that exits first, or isn't ready within --wait-timeout,
+// is an error; in the latter case it is left running.
+func waitForReady(db *sql.DB, taskName string, cfg forkConfig) error {
+	path, timeout := cfg.waitFile, cmp.Or(cfg.waitTimeout, ReadyTimeout)
+	deadline := time.Now().Add(timeout)
+	var lastID int64
+	for {
+		events, err := readEventsAfter(db, taskName, lastID, MaxEventBytes) // output is ignored
+		if err != nil {
+			return fmt.Errorf("failed to read events for %q: %w", taskName, err)
+		}
+		for _, e := range events {
+			lastID = e.ID
+			switch e.Type {
+			case EventTypeReady:
+				if cfg.logs("info") {
+					fmt.Fprintf(os.Stderr, "Task '%s' is ready (%s appeared)\n", taskName, path)
+				}
+				return nil
+			case EventTypeExit:
+				return fmt.Errorf("task %q exited with code %d before %s appeared", taskName, e.Code, path)
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("task %q is still running, but %s did not appear within %v", taskName, path, timeout)
+		}
+		time.Sleep(JoinPollInterval)
+	}
+}
+
+// claimTask registers taskName for a new run, as fork and exec do before
+// starting anything, or with --overwrite-if-exited takes the name over from
+// a task that has exited. The errors say what to do about a name in use.
+func claimTask(db *sql.DB, taskName string, cfg forkConfig) error {
+	err := registerTask(db, taskName)
+	if !errors.Is(err, ErrTaskExists) {
+		return err
+	}
+	if !cfg.overwriteIfExited {
+		return fmt.Errorf("task %q already exists (BGX_DB=%s)\nUse a different --task-name, --overwrite-if-exited, or remove the database.", taskName, getDBPath())
+	}
+	if err := reclaimTask(db, taskName); errors.Is(err, ErrTaskExists) {
+		return fmt.Errorf("task %q already exists and hasn't exited (BGX_DB=%s)\n--overwrite-if-exited only replaces a task that has finished.", taskName, getDBPath())
+	} else if err != nil {
+		return err
+	}
 	return nil
 }
 
-// executeProcess launches the command and records its lifecycle as events,
-// returning the command's exit code. When mirror is true, stdout and stderr are
-// also written live to the terminal (used by `bgx exec`, which runs in the
-// foreground); otherwise output is only persisted (used by the `fork` daemon).
-func executeProcess(db *sql.DB, taskName string, command []string, mirror bool) (int, error) {
+// daemonLogPath is where a task's daemon writes its own diagnostics: a file
+// per task in a directory beside the database. The name is escaped so that
+// namespaced names like project/build stay one file.
+func daemonLogPath(taskName string) string {
+	return filepath.Join(getDBPath()+"-daemon", url.PathEscape(taskName)+".log")
+}
+
+// heartbeatFilePath is the file a --heartbeat-touch task's daemon touches at
+// each heartbeat, beside its daemon log.
+func heartbeatFilePath(taskName string) string {
+	return filepath.Join(getDBPath()+"-daemon", url.PathEscape(taskName)+".heartbeat")
+}
+
+// touchHeartbeatFile sets a task's heartbeat file's mtime to now, creating it
+// (and its directory, which exec has no daemon log to create) if need be.
+func touchHeartbeatFile(taskName string) error {
+	path := heartbeatFilePath(taskName)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// heartbeatFileTime returns when a task's heartbeat file was last touched,
+// or the zero time if it doesn't exist (yet, or any more).
+func heartbeatFileTime(taskName string) time.Time {
+	fi, err := os.Stat(heartbeatFilePath(taskName))
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// createDaemonLog creates (or empties) a task's daemon log.
+func createDaemonLog(taskName string) (*os.File, error) {
+	path := daemonLogPath(taskName)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create daemon log directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create daemon log: %w", err)
+	}
+	return f, nil
+}
+
+// readDaemonLog returns the contents of a task's daemon log, or "" if it is
+// empty or missing, as it is for a task whose daemon ran without trouble.
+func readDaemonLog(taskName string) string {
+	data, _ := os.ReadFile(daemonLogPath(taskName))
+	return string(data)
+}
+
+// removeIfEmpty deletes the file at path if it has no content.
+func removeIfEmpty(path string) {
+	if fi, err := os.Stat(path); err == nil && fi.Size() == 0 {
+		os.Remove(path)
+	}
+}
+
+// runeCut returns the length of the longest prefix of data, of at most max
+// bytes, that doesn't end part way through a UTF-8 sequence: 0 if data is
+// only the start of one. Data that isn't UTF-8 to begin with is cut at max.
+// (max is at least minEventBytes, so a prefix of max bytes always holds a
+// whole character.)
+func runeCut(data []byte, max int) int {
+	n := min(len(data), max)
+	for i := n - 1; i >= 0 && i >= n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:n]) {
+				return i
+			}
+			return n
+		}
+	}
+	return n
+}
+
+// executeProcess launches the command (through its interpreter, in shell
+// mode) and records its lifecycle as events, returning the command's exit
+// code. When mirror is true, stdout and stderr are also written live to the
+// terminal (used by `bgx exec`, which runs in the foreground); otherwise
+// output is only persisted (used by the `fork` daemon). The command receives
+// extraFiles (from --inherit-fd) as fd 3 onwards, and the write end of a pipe
+// at each --capture-fd.
+func executeProcess(rec *recorder, command []string, cfg forkConfig, extraFiles []*os.File, mirror bool) (int, error) {
+	command = cfg.commandLine(command)
 	cmd := exec.Command(command[0], command[1:]...)
-	// Don't leak bgx's internal daemon flag into the task; otherwise a nested
-	// `bgx fork` inside the task would think it is a daemon and not detach.
-	cmd.Env = environWithout("BGX_DAEMON_MODE")
+	cmd.Env = cfg.childEnviron()
+	cmd.ExtraFiles = slices.Clone(extraFiles)
+	uid, gid, err := cfg.runAs(cmd)
+	if err != nil {
+		return recordStartupFailure(rec, err)
+	}
+	if !mirror {
+		ownProcessGroup(cmd)
+	}
+
+	var captures []capturedFD
+	for _, fd := range cfg.captureFDs {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return recordStartupFailure(rec, fmt.Errorf("failed to create pipe for --capture-fd %d: %w", fd, err))
+		}
+		captures = append(captures, capturedFD{fd: fd, pipe: r, w: w})
+		// A nil entry leaves that descriptor closed in the command.
+		for len(cmd.ExtraFiles) <= fd-3 {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, nil)
+		}
+		cmd.ExtraFiles[fd-3] = w
+	}
 
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return recordStartupFailure(db, taskName, fmt.Errorf("failed to create stdout pipe: %w", err))
+		return recordStartupFailure(rec, fmt.Errorf("failed to create stdout pipe: %w", err))
 	}
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
-		return recordStartupFailure(db, taskName, fmt.Errorf("failed to create stderr pipe: %w", err))
+		return recordStartupFailure(rec, fmt.Errorf("failed to create stderr pipe: %w", err))
 	}
 
-	if err := cmd.Start(); err != nil {
-		return recordStartupFailure(db, taskName, fmt.Errorf("failed to start command: %w", err))
+	err = cmd.Start()
+	// The command has its own copies now; don't keep, say, a listening socket
+	// open in bgx after the command closes it, and let the --capture-fd
+	// readers see EOF once the command closes its ends.
+	for _, f := range extraFiles {
+		f.Close()
+	}
+	for _, c := range captures {
+		c.w.Close()
+	}
+	if err != nil {
+		return recordStartupFailure(rec, fmt.Errorf("failed to start command: %w", err))
 	}
 
 	pid := cmd.Process.Pid
-	writeEvent(db, taskName, Event{
-		Type:    EventTypeStart,
-		Time:    time.Now(),
-		PID:     pid,
-		Command: command,
+	// Where the kernel doesn't provide PSS (it needs /proc/<pid>/smaps_rollup,
+	// Linux 4.14 and later), heartbeats report RSS and the start event says so.
+	if cfg.memMetric == MemMetricPSS {
+		if _, ok := getProcessPSS(pid); !ok {
+			fmt.Fprintf(os.Stderr, "bgx: PSS is unavailable for pid %d; reporting RSS\n", pid)
+			cfg.memMetric = ""
+		}
+	}
+	rec.write(Event{
+		Type:           EventTypeStart,
+		V:              LogSchemaVersion,
+		BgxVersion:     buildID(),
+		PID:            pid,
+		Command:        command,
+		NoHeartbeat:    !cfg.heartbeats() || cfg.heartbeatTouch,
+		HeartbeatTouch: cfg.heartbeatTouch,
+		LogTypes:       strings.Join(cfg.logTypes, ","),
+		InheritFDs:     cfg.inheritFDs,
+		Interpreter:    strings.Join(cfg.interpreterArgs(), " "),
+		EnvClear:       cfg.envClear,
+		MemMetric:      cfg.memMetric,
+		NoProcStats:    cfg.noProcStats,
+		Signed:         cfg.sign,
+		UID:            uid,
+		GID:            gid,
 	})
 
-	return runProcess(db, taskName, cmd, stdoutPipe, stderrPipe, pid, mirror)
+	return runProcess(rec, cmd, stdoutPipe, stderrPipe, captures, pid, cfg, mirror)
+}
+
+// adaptiveHeartbeat decides which of the samples taken every
+// HeartbeatInterval become heartbeat events for --heartbeat-adaptive. While
+// the command is quiet (no output, under 1% of a CPU, memory within 1%) the
+// gap between heartbeats doubles up to HeartbeatMaxInterval; any activity
+// records a heartbeat at once and returns to HeartbeatInterval.
+type adaptiveHeartbeat struct {
+	interval time.Duration // the longest the next heartbeat may take
+	lastBeat time.Time     // when the last heartbeat (or the start) was
+	cpu      float64       // the CPU time and memory sampled then
+	mem      int64
+}
+
+// due reports whether a sample taken at now should be recorded, given
+// whether the command wrote output since the last heartbeat, and if so
+// moves on the interval the heartbeat announces.
+func (a *adaptiveHeartbeat) due(now time.Time, cpu float64, mem int64, output bool) bool {
+	elapsed := now.Sub(a.lastBeat)
+	quiet := !output &&
+		cpu-a.cpu < 0.01*elapsed.Seconds() &&
+		max(mem-a.mem, a.mem-mem) <= a.mem/100
+	switch {
+	case !quiet:
+		a.interval = HeartbeatInterval
+	case elapsed >= a.interval-HeartbeatInterval/2: // ticks run a little early or late
+		a.interval = min(2*a.interval, HeartbeatMaxInterval)
+	default:
+		return false
+	}
+	a.lastBeat, a.cpu, a.mem = now, cpu, mem
+	return true
+}
+
+// jitter returns d moved early or late by up to HeartbeatJitter of itself,
+// uniformly, with random numbers in [0, 1) from random. Without it, tasks
+// started together, as in a CI fan-out, would sample /proc in lockstep for
+// as long as they run; spread out this way, they drift apart while keeping
+// d as the average gap.
+func jitter(d time.Duration, random func() float64) time.Duration {
+	return time.Duration(float64(d) * (1 + HeartbeatJitter*(2*random()-1)))
+}
+
+// procSampler takes the CPU and memory samples heartbeats carry. A failure
+// to read them is recorded as an error event when it starts, not at every
+// heartbeat, except that a process already gone is no failure: the last
+// sample can race with the process being reaped.
+type procSampler struct {
+	rec       *recorder
+	pid       int
+	memMetric string
+	failing   bool // the previous sample failed
+}
+
+func (p *procSampler) sample() (cpuTime float64, memBytes int64) {
+	cpuTime, memBytes, err := getProcessStats(p.pid)
+	switch {
+	case err == nil || errors.Is(err, fs.ErrNotExist):
+		p.failing = false
+	case !p.failing:
+		p.failing = true
+		p.rec.reportError(fmt.Errorf("%w (heartbeats record 0 for what can't be read)", err))
+	}
+	if p.memMetric == MemMetricPSS {
+		if pss, ok := getProcessPSS(p.pid); ok {
+			memBytes = pss
+		}
+	}
+	return cpuTime, memBytes
+}
+
+// capturedFD is a --capture-fd pipe: the command writes to w as its
+// descriptor fd, and bgx reads pipe.
+type capturedFD struct {
+	fd   int
+	pipe *os.File
+	w    *os.File
+}
+
+// coalescer batches a stream's output for --coalesce-window: data added
+// within window of the first unrecorded piece is recorded as one event, or
+// sooner if the batch would grow past max bytes. Pieces are whole records (or
+// the parts of an over-long one), so a batch never splits a line.
+type coalescer struct {
+	window time.Duration
+	max    int
+	record func(data string)
+
+	mu    sync.Mutex
+	buf   strings.Builder
+	timer *time.Timer // pending flush of buf; nil while buf is empty
+}
+
+func (c *coalescer) add(data string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.buf.Len() > 0 && c.buf.Len()+len(data) > c.max {
+		c.flushLocked()
+	}
+	c.buf.WriteString(data)
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.window, c.flush)
+	}
+}
+
+// flush records whatever is batched. A pending timer that fires afterwards
+// finds nothing (or the next batch, early) and records no empty event.
+func (c *coalescer) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+}
+
+func (c *coalescer) flushLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.buf.Len() > 0 {
+		c.record(c.buf.String())
+		c.buf.Reset()
+	}
 }
 
 // recordStartupFailure writes a stderr + exit event so that a `join` waiting on
 // this task fails fast with a clear message instead of hitting a heartbeat
 // timeout. Exit code 127 mirrors the shell's "command not found".
-func recordStartupFailure(db *sql.DB, taskName string, cause error) (int, error) {
-	writeEvent(db, taskName, Event{
+func recordStartupFailure(rec *recorder, cause error) (int, error) {
+	rec.write(Event{
 		Type: EventTypeStderr,
-		Time: time.Now(),
 		Data: fmt.Sprintf("bgx: %v\n", cause),
 	})
-	writeEvent(db, taskName, Event{
-		Type: EventTypeExit,
-		Time: time.Now(),
-		Code: 127,
+	rec.writeExit(Event{
+		Type:       EventTypeExit,
+		Code:       127,
+		ExitReason: "failed to start",
 	})
 	return 127, cause
 }
 
-func runProcess(db *sql.DB, taskName string, cmd *exec.Cmd, stdoutPipe, stderrPipe io.ReadCloser, pid int, mirror bool) (int, error) {
-	streamOutput := func(pipe io.ReadCloser, eventType string, tee io.Writer) {
-		br := bufio.NewReader(pipe)
+func runProcess(rec *recorder, cmd *exec.Cmd, stdoutPipe, stderrPipe io.ReadCloser, captures []capturedFD, pid int, cfg forkConfig, mirror bool) (int, error) {
+	// A task that reaches --max-events or --idle-timeout is killed outright:
+	// it is presumably stuck, so there is no point asking it to clean up.
+	// Whatever it wrote before dying is already in the pipes, and the readers
+	// drain it as for any exit, so its last lines are recorded. But a child
+	// process it left behind may hold the pipes open indefinitely; after
+	// KillDrainWindow they are closed regardless, so the exit event still
+	// gets written.
+	var stopOnce sync.Once
+	var stopped atomic.Bool // the daemon killed the command itself
+	stop := func() {
+		stopOnce.Do(func() {
+			stopped.Store(true)
+			cmd.Process.Kill()
+			time.AfterFunc(KillDrainWindow, func() {
+				stdoutPipe.Close()
+				stderrPipe.Close()
+				for _, c := range captures {
+					c.pipe.Close()
+				}
+			})
+		})
+	}
+	rec.onLimit(stop)
+
+	// The OOM killer sends SIGKILL, so an exit by it looks like any other kill
+	// but for the memory cgroup's count of OOM kills, which goes up. Counting
+	// from now, it is blamed for a SIGKILL only if it killed something in the
+	// cgroup meanwhile, and bgx didn't send one itself; where there's no count
+	// to read, it never is. The cgroup is often shared (a user's session, a
+	// service), so this is a heuristic: the OOM kill may have been of another
+	// process in it, and the task's SIGKILL from something else.
+	oomPath := oomKillsPath(pid)
+	oomKills, _ := readOOMKills(oomPath)
+
+	// lastOutput is when the command last wrote anything, for --idle-timeout;
+	// starting the clock at launch makes a command that never prints idle too.
+	var lastOutput atomic.Int64
+	lastOutput.Store(time.Now().UnixNano())
+
+	// streamOutput records a pipe's output and counts what the command wrote
+	// to it, including anything past --max-events that isn't recorded.
+	streamOutput := func(pipe io.ReadCloser, eventType string, fd int, tee io.Writer, bytes, lines *int64) {
+		// The reader's buffer bounds an event's size: a line (or record,
+		// with --delimiter) that doesn't fit is recorded as several
+		// consecutive events, which join replays back to back, so the output
+		// is reproduced byte for byte.
+		br := bufio.NewReaderSize(pipe, cfg.eventBytes())
+		delim := cfg.recordDelimiter()
+		partial := false // part of a line has been read, but not its end
+		// With --strip-ansi, only the recorded data is cleaned: the counts
+		// and exec's mirror get the output as written.
+		var ansi *ansiStripper
+		if cfg.stripANSI {
+			ansi = &ansiStripper{}
+		}
+		record := func(data string) {
+			rec.write(Event{Type: eventType, Data: data, FD: fd})
+		}
+		// An event that doesn't end its record may not end part way through
+		// a UTF-8 sequence either, or each half of the character would be
+		// stored as invalid UTF-8; the sequence's first bytes are carried
+		// into the next event instead.
+		var carry []byte
+		// With --coalesce-window, whole records are batched before they are
+		// recorded; the last batch is recorded before the reader returns.
+		if cfg.coalesceWindow > 0 {
+			c := &coalescer{window: cfg.coalesceWindow, max: cfg.eventBytes(), record: record}
+			defer c.flush()
+			record = c.add
+		}
+		recordPart := func(data []byte) {
+			line := string(data)
+			if ansi != nil {
+				line = ansi.strip(line)
+			}
+			if line != "" {
+				record(line)
+			}
+		}
 		for {
-			// ReadString has no line-length limit, so arbitrarily long
-			// output lines are preserved intact.
-			line, err := br.ReadString('\n')
-			if len(line) > 0 {
+			chunk, err := br.ReadSlice(delim)
+			if err == bufio.ErrBufferFull {
+				err = nil
+			}
+			if len(chunk) > 0 {
+				*bytes += int64(len(chunk))
+				partial = chunk[len(chunk)-1] != delim
+				if !partial {
+					*lines++
+				}
+				lastOutput.Store(time.Now().UnixNano())
 				if tee != nil {
-					io.WriteString(tee, line)
+					tee.Write(chunk)
 				}
-				writeEvent(db, taskName, Event{
-					Type: eventType,
-					Time: time.Now(),
-					Data: line,
-				})
+				data := append(carry, chunk...)
+				carry = nil
+				for len(data) > cfg.eventBytes() {
+					n := runeCut(data, cfg.eventBytes())
+					recordPart(data[:n])
+					data = data[n:]
+				}
+				if partial && err == nil {
+					n := runeCut(data, len(data))
+					data, carry = data[:n], data[n:]
+				}
+				recordPart(data)
 			}
 			if err != nil {
+				if len(carry) > 0 {
+					recordPart(carry) // the output ended mid-character
+				}
+				if partial {
+					*lines++
+				}
+				// A pipe closed after a kill (see stop) is no surprise.
+				if err != io.EOF && !errors.Is(err, os.ErrClosed) {
+					stream := eventType
+					if eventType == EventTypeFD {
+						stream = fmt.Sprintf("fd %d", fd)
+					}
+					rec.reportError(fmt.Errorf("failed to read the command's %s: %w", stream, err))
+				}
 				return
 			}
 		}
@@ -167,79 +1313,266 @@ func runProcess(db *sql.DB, taskName string, cmd *exec.Cmd, stdoutPipe, stderrPi
 
 	// Read both pipes to EOF before calling cmd.Wait: Wait closes the pipes,
 	// so calling it while reads are in flight would truncate output.
+	// Each reader alone updates its stream's counters; they are read once
+	// both are done.
 	var readers sync.WaitGroup
-	readers.Add(2)
-	go func() { defer readers.Done(); streamOutput(stdoutPipe, EventTypeStdout, stdoutTee) }()
-	go func() { defer readers.Done(); streamOutput(stderrPipe, EventTypeStderr, stderrTee) }()
+	var stdoutBytes, stderrBytes, stdoutLines, stderrLines int64
+	readers.Add(2 + len(captures))
+	go func() {
+		defer readers.Done()
+		streamOutput(stdoutPipe, EventTypeStdout, 0, stdoutTee, &stdoutBytes, &stdoutLines)
+	}()
+	go func() {
+		defer readers.Done()
+		streamOutput(stderrPipe, EventTypeStderr, 0, stderrTee, &stderrBytes, &stderrLines)
+	}()
+	for _, c := range captures {
+		go func() {
+			defer readers.Done()
+			defer c.pipe.Close()
+			var bytes, lines int64 // not part of the exit event's counts
+			streamOutput(c.pipe, EventTypeFD, c.fd, nil, &bytes, &lines)
+		}()
+	}
 
-	// Emit heartbeats until the process is reaped (see close(done) below).
+	// Emit heartbeats until the process is reaped (see close(done) below),
+	// unless --no-heartbeat or --log-types asked for none. The heartbeat
+	// goroutine alone tracks peakMem and the latest --io-stats sample; they are
+	// read once that goroutine is done. With --heartbeat-touch, each
+	// heartbeat touches the heartbeat file instead: the exit event still
+	// carries the peak and the totals, but nothing in between is recorded.
 	done := make(chan struct{})
+	var peakMem, readBytes, writeBytes int64
 	var heartbeat sync.WaitGroup
-	heartbeat.Add(1)
-	go func() {
-		defer heartbeat.Done()
-		ticker := time.NewTicker(HeartbeatInterval)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				cpuTime, memBytes := getProcessStats(pid)
-				writeEvent(db, taskName, Event{
-					Type:       EventTypeHeartbeat,
-					Time:       time.Now(),
-					CPUSeconds: cpuTime,
-					MemBytes:   memBytes,
-				})
-			case <-done:
-				return
+	if cfg.heartbeats() || cfg.heartbeatTouch {
+		heartbeat.Add(1)
+		go func() {
+			defer heartbeat.Done()
+			timer := time.NewTimer(jitter(HeartbeatInterval, rand.Float64))
+			defer timer.Stop()
+			sample := (&procSampler{rec: rec, pid: pid, memMetric: cfg.memMetric}).sample
+			if cfg.noProcStats {
+				sample = func() (float64, int64) { return 0, 0 }
 			}
-		}
-	}()
+			// Only the first failure to touch is reported; the rest would
+			// say the same.
+			touchFailed := false
+			touch := func() {
+				if err := touchHeartbeatFile(rec.task); err != nil && !touchFailed {
+					touchFailed = true
+					rec.reportError(fmt.Errorf("failed to touch heartbeat file: %w", err))
+				}
+			}
+			if cfg.heartbeatTouch {
+				touch()
+			}
+			var adaptive *adaptiveHeartbeat
+			if cfg.heartbeatAdaptive {
+				cpuTime, memBytes := sample()
+				adaptive = &adaptiveHeartbeat{interval: HeartbeatInterval, lastBeat: time.Now(), cpu: cpuTime, mem: memBytes}
+			}
+			for {
+				select {
+				case now := <-timer.C:
+					timer.Reset(jitter(HeartbeatInterval, rand.Float64))
+					cpuTime, memBytes := sample()
+					peakMem = max(peakMem, memBytes)
+					var interval time.Duration
+					if adaptive != nil {
+						output := lastOutput.Load() > adaptive.lastBeat.UnixNano()
+						if !adaptive.due(now, cpuTime, memBytes, output) {
+							continue
+						}
+						interval = adaptive.interval
+					}
+					if cfg.ioStats {
+						readBytes, writeBytes = getProcessIO(pid)
+					}
+					if cfg.heartbeatTouch {
+						touch()
+						continue
+					}
+					rec.write(Event{
+						Type:            EventTypeHeartbeat,
+						CPUSeconds:      cpuTime,
+						MemBytes:        memBytes,
+						ReadBytes:       readBytes,
+						WriteBytes:      writeBytes,
+						IntervalSeconds: interval.Seconds(),
+					})
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	// With --idle-timeout, a watchdog kills the command once it has gone that
+	// long without writing to stdout or stderr, even if heartbeats show it
+	// alive: it is presumably hung, for example on a dead network peer. It
+	// stops with the heartbeats, so it never writes after the exit event.
+	var watchdog sync.WaitGroup
+	if cfg.idleTimeout > 0 {
+		watchdog.Add(1)
+		go func() {
+			defer watchdog.Done()
+			timer := time.NewTimer(cfg.idleTimeout)
+			defer timer.Stop()
+			for {
+				select {
+				case <-timer.C:
+					quiet := time.Since(time.Unix(0, lastOutput.Load()))
+					if quiet < cfg.idleTimeout {
+						timer.Reset(cfg.idleTimeout - quiet)
+						continue
+					}
+					rec.write(Event{
+						Type: EventTypeIdleTimeout,
+						Data: fmt.Sprintf("task stopped after no output for %s (--idle-timeout)", quiet.Round(time.Millisecond)),
+					})
+					stop()
+					return
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	// With --wait-file, the file is looked for until it appears or the
+	// command exits; it counts as ready however it came to exist, so a file
+	// left over from an earlier run should be removed first.
+	if cfg.waitFile != "" {
+		watchdog.Add(1)
+		go func() {
+			defer watchdog.Done()
+			ticker := time.NewTicker(ReadyPollInterval)
+			defer ticker.Stop()
+			for {
+				if _, err := os.Stat(cfg.waitFile); err == nil {
+					rec.write(Event{Type: EventTypeReady, Data: cfg.waitFile})
+					return
+				}
+				select {
+				case <-ticker.C:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
 
 	// Drain both pipes (readers hit EOF when the process closes its output),
 	// then reap the process. Heartbeats keep flowing until cmd.Wait returns,
 	// so a task that closes stdout/stderr but keeps running is still reported
 	// alive rather than tripping join's heartbeat timeout.
+	//
+	// Both waits must finish before the exit event is written: once they have,
+	// no goroutine is left to call rec.write, so the exit event is strictly
+	// the task's last event and join can stop at it (TestNoOutputAfterExit).
 	readers.Wait()
 	err := cmd.Wait()
 	close(done)
 	heartbeat.Wait()
+	watchdog.Wait()
 
-	exitCode := 0
-	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			exitCode = exitError.ExitCode()
-		} else {
-			exitCode = 1
+	exitCode, exitReason, exitSignal := 1, "", ""
+	if _, ok := err.(*exec.ExitError); err == nil || ok {
+		exitCode, exitReason, exitSignal = exitStatus(cmd.ProcessState)
+	}
+	if n, ok := readOOMKills(oomPath); ok && n > oomKills && exitSignal == "SIGKILL" && !stopped.Load() {
+		// bgx kill, stop and wait --on-timeout kill record a kill event.
+		if killed, err := hasEventType(rec.db, rec.task, EventTypeKill); err == nil && !killed {
+			exitReason = "oom-killed (SIGKILL)"
 		}
 	}
 
-	writeEvent(db, taskName, Event{
-		Type: EventTypeExit,
-		Time: time.Now(),
-		Code: exitCode,
+	// The exit event carries the totals: CPU time and peak resident memory
+	// as the kernel accounted them when the process was reaped, the highest
+	// memory any heartbeat saw, the I/O counts as last sampled
+	// (/proc/<pid>/io is gone by now), and how much the command wrote to each
+	// stream.
+	var userSeconds, systemSeconds float64
+	var maxRSSBytes int64
+	if cmd.ProcessState != nil {
+		userSeconds = cmd.ProcessState.UserTime().Seconds()
+		systemSeconds = cmd.ProcessState.SystemTime().Seconds()
+		maxRSSBytes = maxRSS(cmd.ProcessState)
+	}
+	rec.writeExit(Event{
+		Type:          EventTypeExit,
+		Code:          exitCode,
+		ExitReason:    exitReason,
+		ExitSignal:    exitSignal,
+		CPUSeconds:    userSeconds + systemSeconds,
+		UserSeconds:   userSeconds,
+		SystemSeconds: systemSeconds,
+		MaxRSSBytes:   maxRSSBytes,
+		PeakMemBytes:  peakMem,
+		ReadBytes:     readBytes,
+		WriteBytes:    writeBytes,
+		StdoutBytes:   stdoutBytes,
+		StderrBytes:   stderrBytes,
+		StdoutLines:   stdoutLines,
+		StderrLines:   stderrLines,
 	})
+	if cfg.heartbeatTouch {
+		// The exit event is what says the task is over now.
+		os.Remove(heartbeatFilePath(rec.task))
+	}
 	return exitCode, nil
 }
 
+// childEnviron returns the environment the command runs with: bgx's own, or
+// with --env-clear only its PATH and HOME, followed by the --env assignments
+// (which exec.Cmd lets win over an earlier value for the same key). It leaves
+// out bgx's internal daemon flags, since otherwise a nested `bgx fork` inside
+// the task would think it is a daemon and not detach, and the --sign key,
+// since the task must not be able to forge its own log.
+func (cfg forkConfig) childEnviron() []string {
+	var env []string
+	if cfg.envClear {
+		for _, key := range []string{"PATH", "HOME"} {
+			if v, ok := os.LookupEnv(key); ok {
+				env = append(env, key+"="+v)
+			}
+		}
+	} else {
+		env = environWithout("BGX_DAEMON_MODE", "BGX_DAEMON_VERSION", SignKeyEnv)
+	}
+	return append(env, cfg.env...)
+}
+
+// expandArgs applies os.ExpandEnv's rules to each argument, but looks
+// variables up in env rather than bgx's own environment, so an argument can
+// refer to exactly what the command itself would see.
+func expandArgs(args []string, env []string) []string {
+	vars := make(map[string]string, len(env))
+	for _, kv := range env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			vars[k] = v
+		}
+	}
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = os.Expand(arg, func(name string) string { return vars[name] })
+	}
+	return expanded
+}
+
 // environWithout returns a copy of the current environment with any assignment
-// of the given key removed.
-func environWithout(key string) []string {
-	prefix := key + "="
+// of the given keys removed.
+func environWithout(keys ...string) []string {
 	env := os.Environ()
 	out := make([]string, 0, len(env))
+outer:
 	for _, kv := range env {
-		if !strings.HasPrefix(kv, prefix) {
-			out = append(out, kv)
+		for _, key := range keys {
+			if strings.HasPrefix(kv, key+"=") {
+				continue outer
+			}
 		}
+		out = append(out, kv)
 	}
 	return out
 }
-
-// writeEvent records an event, reporting (rather than silently dropping)
-// failures. A single database connection serializes concurrent writers.
-func writeEvent(db *sql.DB, taskName string, e Event) {
-	if err := insertEvent(db, taskName, e); err != nil {
-		fmt.Fprintf(os.Stderr, "bgx: failed to record %s event: %v\n", e.Type, err)
-	}
-}
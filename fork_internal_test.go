@@ -0,0 +1,292 @@
+package main
+
+import (
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDelimiterForwarding verifies every --delimiter value survives being
+// passed on to the daemon, which parses its arguments again.
+func TestDelimiterForwarding(t *testing.T) {
+	for spec, want := range map[string]string{
+		`\n`:   "\n",
+		`\0`:   "\x00",
+		`\x1e`: "\x1e",
+		`,`:    ",",
+		`"`:    `"`,
+		`\`:    `\`,
+		`\\`:   `\`,
+	} {
+		d, err := parseDelimiter(spec)
+		if err != nil || d != want {
+			t.Errorf("parseDelimiter(%q) = %q, %v; want %q", spec, d, err, want)
+			continue
+		}
+		args := forkConfig{delimiter: d}.args()
+		_, _, cfg, err := parseForkArgs(append(args, "--task-name", "t", "--", "true"))
+		if err != nil || cfg.delimiter != want {
+			t.Errorf("%q forwarded as %q: got %q, %v", spec, args, cfg.delimiter, err)
+		}
+	}
+	for _, spec := range []string{"", "ab", `\x`, `é`} {
+		if _, err := parseDelimiter(spec); err == nil {
+			t.Errorf("parseDelimiter(%q) should fail", spec)
+		}
+	}
+}
+
+// TestForkArgOrder verifies fork's flags are recognized in any order before
+// --, however many come after --task-name, and that everything after -- is
+// the command, even tokens that look like fork's own flags. A token before --
+// that isn't a flag fork knows is an error rather than the command's start.
+func TestForkArgOrder(t *testing.T) {
+	groups := [][]string{
+		{"--task-name", "x"},
+		{"--sync-every", "10"},
+		{"--no-heartbeat"},
+		{"--env", "A=1"},
+	}
+	command := []string{"echo", "--task-name", "y", "--sync", "--"}
+	var permute func(done [][]string, rest [][]string)
+	permute = func(done [][]string, rest [][]string) {
+		if len(rest) == 0 {
+			args := append(slices.Concat(done...), "--")
+			args = append(args, command...)
+			taskName, got, cfg, err := parseForkArgs(args)
+			if err != nil || taskName != "x" || !slices.Equal(got, command) ||
+				cfg.syncEvery != 10 || !cfg.noHeartbeat || !slices.Equal(cfg.env, []string{"A=1"}) || cfg.sync {
+				t.Errorf("parseForkArgs(%q) = %q, %q, %+v, %v", args, taskName, got, cfg, err)
+			}
+			return
+		}
+		for i := range rest {
+			permute(append(slices.Clone(done), rest[i]), slices.Concat(rest[:i], rest[i+1:]))
+		}
+	}
+	permute(nil, groups)
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--task-name", "x", "--cwd", "/tmp", "--", "true"}, `unexpected argument "--cwd"`},
+		{[]string{"--task-name", "x", "echo", "hi"}, `unexpected argument "echo"`},
+		{[]string{"--no-heartbeat", "--", "true"}, "--task-name is required"},
+		{[]string{"--task-name", "x", "--"}, "no command specified"},
+		{[]string{"--task-name", "x", "--sync-every"}, "--sync-every requires an argument"},
+	} {
+		if _, _, _, err := parseForkArgs(tt.args); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseForkArgs(%q) = %v, want an error containing %q", tt.args, err, tt.want)
+		}
+	}
+}
+
+// TestAdaptiveHeartbeat verifies a quiet command's heartbeats space out,
+// doubling up to the cap, and that output, CPU use or a change in memory
+// records one at once and returns to the base interval.
+func TestAdaptiveHeartbeat(t *testing.T) {
+	start := time.Unix(0, 0)
+	a := &adaptiveHeartbeat{interval: HeartbeatInterval, lastBeat: start, mem: 1 << 20}
+	var beats []time.Duration // the interval announced at each heartbeat
+	tick := func(n int, cpu float64, mem int64, output bool) {
+		if a.due(start.Add(time.Duration(n)*HeartbeatInterval), cpu, mem, output) {
+			beats = append(beats, a.interval)
+		}
+	}
+	for n := 1; n <= 7; n++ {
+		tick(n, 0, 1<<20, false)
+	}
+	if want := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second}; !slices.Equal(beats, want) {
+		t.Errorf("Quiet heartbeats announced %v, want %v (at ticks 1, 3 and 7)", beats, want)
+	}
+
+	for _, activity := range []struct {
+		name   string
+		cpu    float64
+		mem    int64
+		output bool
+	}{
+		{"output", 0, 1 << 20, true},
+		{"CPU", 1, 1 << 20, false},
+		{"memory", 0, 2 << 20, false},
+	} {
+		a.interval, beats = HeartbeatMaxInterval, nil
+		tick(8, activity.cpu, activity.mem, activity.output)
+		if len(beats) != 1 || beats[0] != HeartbeatInterval {
+			t.Errorf("After %s, heartbeats = %v, want one announcing %v", activity.name, beats, HeartbeatInterval)
+		}
+		a.cpu, a.mem = 0, 1<<20
+	}
+
+	a.interval = HeartbeatMaxInterval
+	a.lastBeat = start
+	if !a.due(start.Add(HeartbeatMaxInterval), 0, 1<<20, false) || a.interval != HeartbeatMaxInterval {
+		t.Errorf("Interval after the cap = %v, want it to stay at %v", a.interval, HeartbeatMaxInterval)
+	}
+}
+
+// TestCoalescer verifies batched output is recorded whole and in order, with
+// no batch past max bytes unless a single piece is, and nothing left behind
+// by the final flush.
+func TestCoalescer(t *testing.T) {
+	var events []string
+	c := &coalescer{window: time.Hour, max: 10, record: func(data string) { events = append(events, data) }}
+	for _, piece := range []string{"abc\n", "def\n", "ghi\n", "a long line\n", "x\n"} {
+		c.add(piece)
+	}
+	c.flush()
+	c.flush()
+	want := []string{"abc\ndef\n", "ghi\n", "a long line\n", "x\n"}
+	if !slices.Equal(events, want) {
+		t.Errorf("Recorded %q, want %q", events, want)
+	}
+
+	events = nil
+	c = &coalescer{window: 10 * time.Millisecond, max: 100, record: func(data string) { events = append(events, data) }}
+	c.add("one\n")
+	c.add("two\n")
+	time.Sleep(200 * time.Millisecond)
+	c.mu.Lock()
+	got := slices.Clone(events)
+	c.mu.Unlock()
+	if want := []string{"one\ntwo\n"}; !slices.Equal(got, want) {
+		t.Errorf("After the window, recorded %q, want %q", got, want)
+	}
+}
+
+// TestTaskFile verifies a --file definition stands in for flags and the
+// command, that flags on the command line win, that unknown keys are rejected
+// rather than ignored, and that a YAML or TOML file is refused.
+func TestTaskFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "task.json")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{
+		"task_name": "web",
+		"command": ["python3", "-m", "http.server"],
+		"env": {"PORT": "8000", "DEBUG": "1"},
+		"sinks": ["tcp://localhost:9000"],
+		"max_events": 100,
+		"idle_timeout": "5m"
+	}`)
+
+	taskName, command, cfg, err := parseForkArgs([]string{"--file", path, "--max-events", "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taskName != "web" || !slices.Equal(command, []string{"python3", "-m", "http.server"}) {
+		t.Errorf("Task %q running %q, want web running the file's command", taskName, command)
+	}
+	if !slices.Equal(cfg.env, []string{"DEBUG=1", "PORT=8000"}) || len(cfg.sinks) != 1 || cfg.idleTimeout != 5*time.Minute {
+		t.Errorf("Config %+v doesn't match the file", cfg)
+	}
+	if cfg.maxEvents != 7 {
+		t.Errorf("--max-events = %d, want the command line's 7", cfg.maxEvents)
+	}
+
+	// A repeatable flag on the command line replaces the file's list.
+	_, _, cfg, err = parseForkArgs([]string{"--file", path, "--env", "PORT=9000", "--sink", "unix:///run/c.sock"})
+	if err != nil || !slices.Equal(cfg.env, []string{"PORT=9000"}) || !slices.Equal(cfg.sinks, []string{"unix:///run/c.sock"}) {
+		t.Errorf("--env and --sink = %q, %q, %v; want the command line's alone", cfg.env, cfg.sinks, err)
+	}
+
+	_, command, _, err = parseForkArgs([]string{"--file", path, "--", "echo", "hi"})
+	if err != nil || !slices.Equal(command, []string{"echo", "hi"}) {
+		t.Errorf("Command after -- = %q, %v; want it to replace the file's", command, err)
+	}
+
+	for content, want := range map[string]string{
+		`{"task_name": "web", "cwd": "/srv"}`:   `unknown field "cwd"`,
+		`{"idle_timeout": "soon"}`:              `invalid --idle-timeout "soon"`,
+		`{"max_events": "many"}`:                `cannot unmarshal string`,
+		`{"max_event_bytes": 0}`:                "max_event_bytes 0: must be a byte count of at least 16",
+		`{"task_name": "a"} {"task_name": "b"}`: "more than one JSON value",
+	} {
+		write(content)
+		if _, _, _, err := parseForkArgs([]string{"--file", path}); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Task file %s: error %v, want one mentioning %q", content, err, want)
+		}
+	}
+
+	for name, want := range map[string]string{"task.yaml": "not YAML", "task.yml": "not YML", "task.toml": "not TOML"} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte("task_name: web\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, _, _, err := parseForkArgs([]string{"--file", path})
+		if err == nil || !strings.Contains(err.Error(), "only JSON task definitions are supported, "+want) {
+			t.Errorf("Task file %s: error %v, want it refused as not JSON", name, err)
+		}
+	}
+}
+
+// TestHeartbeatJitter verifies jittered heartbeat gaps stay within
+// HeartbeatJitter of the interval and average out to it, and that tasks
+// started at the same moment, each with its own random numbers, don't
+// heartbeat in step.
+func TestHeartbeatJitter(t *testing.T) {
+	lo := time.Duration(float64(HeartbeatInterval) * (1 - HeartbeatJitter))
+	hi := time.Duration(float64(HeartbeatInterval) * (1 + HeartbeatJitter))
+	for r, want := range map[float64]time.Duration{0: lo, 0.5: HeartbeatInterval} {
+		if got := jitter(HeartbeatInterval, func() float64 { return r }); got != want {
+			t.Errorf("jitter with random number %v = %v, want %v", r, got, want)
+		}
+	}
+
+	const tasks, beats = 5, 200
+	var total time.Duration
+	tenth := make(map[time.Duration]bool) // when each task's 10th heartbeat is
+	for seed := range uint64(tasks) {
+		random := rand.New(rand.NewPCG(seed, seed)).Float64
+		var at time.Duration
+		for n := 1; n <= beats; n++ {
+			gap := jitter(HeartbeatInterval, random)
+			if gap < lo || gap >= hi {
+				t.Fatalf("Gap %v outside [%v, %v)", gap, lo, hi)
+			}
+			at += gap
+			if n == 10 {
+				tenth[at] = true
+			}
+		}
+		total += at
+	}
+	if mean := total / (tasks * beats); mean < HeartbeatInterval*99/100 || mean > HeartbeatInterval*101/100 {
+		t.Errorf("Mean gap %v, want about %v", mean, HeartbeatInterval)
+	}
+	if len(tenth) != tasks {
+		t.Errorf("Tasks' 10th heartbeats at %v, want %d different times", tenth, tasks)
+	}
+}
+
+// TestRuneCut verifies output is cut into events only between UTF-8
+// sequences, and at the limit regardless where the data isn't UTF-8.
+func TestRuneCut(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		max  int
+		want int
+	}{
+		{"abcdef", 4, 4},
+		{"abcdef", 10, 6},
+		{"ab\u00e9", 3, 2},       // é is 2 bytes: not split
+		{"ab\u00e9", 4, 4},       // complete
+		{"a\u20ac", 3, 1},        // € is 3 bytes
+		{"a\u20acb", 4, 4},       // complete
+		{"a\U0001F600", 4, 1},    // 😀 is 4 bytes
+		{"\u20ac", 2, 0},         // only the start of a character
+		{"ab\xff\xff\xff", 4, 4}, // not UTF-8
+	} {
+		if got := runeCut([]byte(tc.data), tc.max); got != tc.want {
+			t.Errorf("runeCut(%q, %d) = %d, want %d", tc.data, tc.max, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// GraphWidth is how many heartbeats `join --graph` keeps, and so how
+	// many characters wide each of its sparklines grows: 30 heartbeats
+	// span two and a half minutes at the default interval.
+	GraphWidth = 30
+
+	// GraphRedrawInterval is the least time between two redraws of the
+	// graph. A task's history replays its heartbeats all at once; each is
+	// added to the graph, but it is redrawn only this often.
+	GraphRedrawInterval = 100 * time.Millisecond
+)
+
+// sparkBlocks are the heights a sparkline is drawn with, lowest first.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// resourceGraph is the rolling window of heartbeat samples `join --graph`
+// draws: CPU use between consecutive heartbeats, as a share of one core, and
+// memory at each, oldest first.
+type resourceGraph struct {
+	cpu, mem []float64
+
+	prevCPU  float64   // cpu_seconds of the previous heartbeat
+	prevTime time.Time // and when it was recorded (zero: no heartbeat yet)
+
+	drawn time.Time // when the graph was last drawn
+	stale bool      // a sample was added since
+}
+
+// add records a heartbeat's sample. CPU use needs the heartbeat before it,
+// so the first one only records memory; the CPU sparkline starts with the
+// second.
+func (g *resourceGraph) add(e eventRow) {
+	t, err := time.Parse(time.RFC3339Nano, e.Time)
+	if err != nil {
+		return
+	}
+	if !g.prevTime.IsZero() && t.After(g.prevTime) {
+		g.cpu = appendWindow(g.cpu, max(0, e.CPUSeconds-g.prevCPU)/t.Sub(g.prevTime).Seconds())
+	}
+	g.prevCPU, g.prevTime = e.CPUSeconds, t
+	g.mem = appendWindow(g.mem, float64(e.MemBytes))
+	g.stale = true
+}
+
+// due reports whether to redraw the graph now: if a sample was added since
+// it was last drawn, and GraphRedrawInterval has passed or force is set (at
+// the end of a batch of events, so the latest sample isn't left undrawn). If
+// so, it counts the graph as drawn now.
+func (g *resourceGraph) due(now time.Time, force bool) bool {
+	if !g.stale || !force && now.Sub(g.drawn) < GraphRedrawInterval {
+		return false
+	}
+	g.drawn, g.stale = now, false
+	return true
+}
+
+// render draws the graph as one line, such as
+// "[graph] cpu ▁▃▇█▅ 85% mem ▂▃▄▅▅ 45.0MiB", after the prefix as
+// formatHeartbeat has it; the memory label is pss for a task forked with
+// --mem-metric pss. Each sparkline is scaled to the highest sample in it.
+func (g *resourceGraph) render(prefix, memMetric string, color bool) string {
+	mem := "mem"
+	if memMetric == MemMetricPSS {
+		mem = "pss"
+	}
+	cpu := "-"
+	if len(g.cpu) > 0 {
+		cpu = fmt.Sprintf("%.0f%%", g.cpu[len(g.cpu)-1]*100)
+	}
+	var memBytes int64
+	if len(g.mem) > 0 {
+		memBytes = int64(g.mem[len(g.mem)-1])
+	}
+	fields := []string{prefix + "[graph]", "cpu", sparkline(g.cpu), cpu, mem, sparkline(g.mem), strings.ReplaceAll(formatBytes(memBytes), " ", "")}
+	line := strings.Join(slices.DeleteFunc(fields, func(f string) bool { return f == "" }), " ")
+	if color {
+		return ansiDim + line + ansiReset
+	}
+	return line
+}
+
+// appendWindow appends v to window, dropping the oldest value once there
+// are more than GraphWidth.
+func appendWindow(window []float64, v float64) []float64 {
+	window = append(window, v)
+	if len(window) > GraphWidth {
+		window = window[len(window)-GraphWidth:]
+	}
+	return window
+}
+
+// sparkline draws values as a row of block characters, each as tall as its
+// value relative to the largest; values all 0 draw as the lowest block.
+func sparkline(values []float64) string {
+	peak := 0.0
+	for _, v := range values {
+		peak = max(peak, v)
+	}
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if peak > 0 {
+			i = min(int(v/peak*float64(len(sparkBlocks)-1)+0.5), len(sparkBlocks)-1)
+		}
+		b.WriteRune(sparkBlocks[i])
+	}
+	return b.String()
+}
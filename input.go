@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadInputFile reads a saved log for `join --input-file` into a database
+// of its own, held in memory, and returns it with the names of the tasks in
+// the file, in the order they first appear. The log is NDJSON, one event
+// per line, as a --sink writes it or join --output json prints it: the
+// event's fields, plus the task it belongs to. An event without a task (a
+// join --output json with --fields leaving it out) is taken to be of a task
+// named after the file, such as "saved" for saved.ndjson.
+func loadInputFile(path string) (*sql.DB, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read --input-file: %w", err)
+	}
+	defer f.Close()
+
+	db, err := openMemoryDB()
+	if err != nil {
+		return nil, nil, err
+	}
+	fallback := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	var taskNames []string
+	// Lines are read whole, however long: an event's data, escaped, may be
+	// several times MaxEventBytes.
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			db.Close()
+			return nil, nil, fmt.Errorf("failed to read --input-file: %w", err)
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var e sinkEvent
+			if jsonErr := json.Unmarshal(line, &e); jsonErr != nil || e.Type == "" {
+				db.Close()
+				if jsonErr == nil {
+					jsonErr = errors.New("no event type")
+				}
+				return nil, nil, fmt.Errorf("invalid --input-file %s, line %d: %s", path, n, strings.TrimPrefix(jsonErr.Error(), "json: "))
+			}
+			if e.Task == "" {
+				e.Task = fallback
+			}
+			if regErr := registerTask(db, e.Task); regErr == nil {
+				taskNames = append(taskNames, e.Task)
+			} else if !errors.Is(regErr, ErrTaskExists) {
+				db.Close()
+				return nil, nil, regErr
+			}
+			if insertErr := insertEvent(db, e.Task, e.Event); insertErr != nil {
+				db.Close()
+				return nil, nil, fmt.Errorf("failed to load --input-file: %w", insertErr)
+			}
+		}
+		if err != nil { // io.EOF, after a last line without a newline
+			return db, taskNames, nil
+		}
+	}
+}
@@ -2,30 +2,320 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
+
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 // joinConfig holds the output options for a join.
 type joinConfig struct {
 	group      bool // wrap each task's output in a GitHub Actions ::group:: block
 	timestamps bool // prefix each line with the event's recorded time
+
+	tagLines bool   // prefix each line with its event's id and stream, as "12:O:"
+	tagSep   string // what separates a tag's fields (--tag-format; "": ":")
+
+	successCodes codeSet // exit codes that count as success (nil: only 0)
+	invert       bool    // treat success codes as failure and vice versa
+
+	color string // "auto" (default), "always", or "never"
+
+	replaySpeed float64 // replay at the recorded pace divided by this (0: as fast as possible)
+
+	maxEventBytes int // refuse events with more data than this (0: no limit)
+
+	linger time.Duration // keep reading this long after the exit event
+
+	timeout time.Duration // give up on a task still running after this long (0: never)
+
+	// A task that records no event for heartbeatTimeout (0: HeartbeatTimeout)
+	// is given up on, but not before warmup has passed since join attached.
+	heartbeatTimeout time.Duration
+	warmup           time.Duration
+
+	printExit  int    // after replay, write exit=<code> lines to this fd (0: don't)
+	summary    bool   // after replay, print each task's exit code and output size
+	resultFile string // after replay, write each task's outcome here as JSON (empty: don't)
+
+	fds []int // also replay output captured from these descriptors, to stderr
+
+	showHeartbeats bool // show each heartbeat's CPU and memory sample on stderr
+	graph          bool // draw CPU and memory sparklines from heartbeats, on a terminal
+
+	// grep and grepV, when set, replay only output lines that match grep and
+	// don't match grepV.
+	grep, grepV *regexp.Regexp
+
+	// stdoutFile and stderrFile are where --stdout-file and --stderr-file
+	// send the replayed streams ("" or "-": the terminal). runJoin opens them
+	// as stdout and stderr; nil means bgx's own.
+	stdoutFile, stderrFile string
+	stdout, stderr         *os.File
+
+	checkpoint string // file to resume from and save progress to (empty: none)
+
+	inputFile string // replay this saved NDJSON log instead of BGX_DB's tasks (empty: don't)
+
+	audit bool // record an access event in each task's log
+
+	output string   // outputText (default), outputJSON, outputCSV or outputLogfmt
+	fields []string // fields of each structured record (nil: defaultEventFields)
+
+	host       string   // join the task on this host over ssh (empty: locally)
+	remoteArgs []string // the join arguments, less --host, for the remote bgx
+}
+
+// filterLines returns the lines of an output event's data that --grep and
+// --grep-v keep, each with its newline, or "" if none are. A pattern is
+// matched against a line without its newline. An event normally holds one
+// line, but one recorded with --delimiter, or split for being too long, may
+// hold several or part of one; each part is matched on its own.
+func (cfg joinConfig) filterLines(data string) string {
+	if cfg.grep == nil && cfg.grepV == nil {
+		return data
+	}
+	var kept strings.Builder
+	for _, line := range strings.SplitAfter(data, "\n") {
+		text := strings.TrimSuffix(line, "\n")
+		if line == "" ||
+			cfg.grep != nil && !cfg.grep.MatchString(text) ||
+			cfg.grepV != nil && cfg.grepV.MatchString(text) {
+			continue
+		}
+		kept.WriteString(line)
+	}
+	return kept.String()
+}
+
+// replayStdout and replayStderr return where replayed stdout and stderr go.
+// bgx's own messages, such as why a task stopped, stay on its stderr.
+func (cfg joinConfig) replayStdout() *os.File {
+	if cfg.stdout != nil {
+		return cfg.stdout
+	}
+	return os.Stdout
+}
+
+func (cfg joinConfig) replayStderr() *os.File {
+	if cfg.stderr != nil {
+		return cfg.stderr
+	}
+	return os.Stderr
+}
+
+// openOutputFiles creates (or truncates) the --stdout-file and --stderr-file
+// files, returning a function that closes them. Naming one file for both
+// streams writes them to it in the order joined, as for 2>&1.
+func (cfg *joinConfig) openOutputFiles() (func(), error) {
+	var opened []*os.File
+	closeAll := func() {
+		for _, f := range opened {
+			f.Close()
+		}
+	}
+	open := func(path string) (*os.File, error) {
+		if path == "" || path == "-" {
+			return nil, nil
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to create output file: %w", err)
+		}
+		opened = append(opened, f)
+		return f, nil
+	}
+	var err error
+	if cfg.stdout, err = open(cfg.stdoutFile); err != nil {
+		return nil, err
+	}
+	if cfg.stderrFile == cfg.stdoutFile {
+		cfg.stderr = cfg.stdout
+	} else if cfg.stderr, err = open(cfg.stderrFile); err != nil {
+		return nil, err
+	}
+	return closeAll, nil
+}
+
+// encoder returns the encoder for a structured --output format, or false in
+// text mode.
+func (cfg joinConfig) encoder() (eventEncoder, bool) {
+	if cfg.output == "" || cfg.output == outputText {
+		return eventEncoder{}, false
+	}
+	fields := cfg.fields
+	if fields == nil {
+		fields = defaultEventFields
+	}
+	return eventEncoder{format: cfg.output, fields: fields}, true
+}
+
+// pacer spaces out replayed events according to their recorded times, for
+// --replay-speed. The first event it sees (or a preset origin) is replayed
+// immediately, and every later event at its recorded offset from that origin
+// divided by speed. Events that are already due, such as those of a task still
+// running, are never delayed further.
+type pacer struct {
+	speed float64
+
+	mu     sync.Mutex
+	origin time.Time // recorded time that replays at start
+	start  time.Time // wall-clock time replay began
+}
+
+// newPacer returns a pacer for cfg, or nil when replay isn't paced.
+func newPacer(cfg joinConfig) *pacer {
+	if cfg.replaySpeed == 0 {
+		return nil
+	}
+	return &pacer{speed: cfg.replaySpeed}
+}
+
+// wait sleeps until the event recorded at the stored time is due.
+func (p *pacer) wait(stored string) {
+	if p == nil {
+		return
+	}
+	recorded, err := time.Parse(time.RFC3339Nano, stored)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	if p.origin.IsZero() {
+		p.origin, p.start = recorded, time.Now()
+	}
+	due := p.start.Add(time.Duration(float64(recorded.Sub(p.origin)) / p.speed))
+	p.mu.Unlock()
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// ANSI escape sequences used by --color and --show-heartbeats.
+const (
+	ansiRed       = "\x1b[31m"
+	ansiDim       = "\x1b[2m"
+	ansiClearLine = "\x1b[K" // erase from the cursor to the end of the line
+	ansiReset     = "\x1b[0m"
+)
+
+// colorFor reports whether lines written to f should be colored. In auto mode
+// that is only when f is a terminal and NO_COLOR (https://no-color.org) is
+// unset, so piped or redirected output keeps the task's raw bytes.
+func (cfg joinConfig) colorFor(f *os.File) bool {
+	switch cfg.color {
+	case "always":
+		return true
+	case "never":
+		return false
+	default:
+		return os.Getenv("NO_COLOR") == "" && isTerminal(f)
+	}
+}
+
+// isTerminal reports whether f is attached to a terminal (a character device).
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// codeRange is an inclusive range of exit codes; a single code has lo == hi.
+type codeRange struct{ lo, hi int }
+
+// codeSet is a set of exit codes, as given to --success-codes.
+type codeSet []codeRange
+
+// parseCodeSet parses a comma-separated list of exit codes and inclusive
+// ranges, such as "0,1" or "0-2,127".
+func parseCodeSet(spec string) (codeSet, error) {
+	var set codeSet
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exit code %q in --success-codes %q", part, spec)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(hi); err != nil || to < from {
+				return nil, fmt.Errorf("invalid exit code range %q in --success-codes %q", part, spec)
+			}
+		}
+		set = append(set, codeRange{from, to})
+	}
+	return set, nil
+}
+
+// contains reports whether code is in the set.
+func (set codeSet) contains(code int) bool {
+	for _, r := range set {
+		if r.lo <= code && code <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// exitStatus maps a task's recorded exit code to join's own exit status: 0 if
+// the code counts as success, otherwise the code itself (or 1 for a code of 0
+// that --invert made a failure). It never changes what was recorded.
+func (cfg joinConfig) exitStatus(code int) int {
+	success := code == 0
+	if cfg.successCodes != nil {
+		success = cfg.successCodes.contains(code)
+	}
+	if cfg.invert {
+		success = !success
+	}
+	switch {
+	case success:
+		return 0
+	case code == 0:
+		return 1
+	default:
+		return code
+	}
 }
 
 // parseJoinArgs parses `join` arguments of the form:
 //
 //	--task-name NAME [--task-name NAME ...] [--group] [--timestamps]
+//	[--success-codes CODES] [--invert] [--color auto|always|never]
+//	[--replay-speed N] [--max-event-bytes N] [--linger DURATION]
+//	[--print-exit FD] [--output text|json|csv|logfmt] [--fields FIELDS]
+//	[--checkpoint FILE] [--audit] [--heartbeat-timeout DURATION]
+//	[--warmup DURATION] [--host HOST] [--summary] [--fd N ...]
+//	[--stdout-file PATH] [--stderr-file PATH] [--grep REGEX] [--grep-v REGEX]
+//	[--show-heartbeats] [--timeout DURATION] [--tag-lines [--tag-format SEP]]
 //
 // Repeating --task-name joins several tasks at once.
 func parseJoinArgs(args []string) ([]string, joinConfig, error) {
 	var taskNames []string
-	var cfg joinConfig
+	cfg := joinConfig{maxEventBytes: MaxEventBytes}
+	given := map[string]bool{} // flags given, which the environment's defaults don't override
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
+		case "--host":
+			if i+1 >= len(args) || args[i+1] == "" {
+				return nil, cfg, fmt.Errorf("--host requires an argument")
+			}
+			if cfg.host != "" {
+				return nil, cfg, fmt.Errorf("--host can only be given once")
+			}
+			cfg.host = args[i+1]
+			cfg.remoteArgs = append(append([]string{}, args[:i]...), args[i+2:]...)
+			i++
 		case "--task-name":
 			if i+1 >= len(args) {
 				return nil, cfg, fmt.Errorf("--task-name requires an argument")
@@ -36,13 +326,267 @@ func parseJoinArgs(args []string) ([]string, joinConfig, error) {
 			cfg.group = true
 		case "--timestamps":
 			cfg.timestamps = true
+		case "--tag-lines":
+			cfg.tagLines = true
+		case "--tag-format":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--tag-format requires an argument")
+			}
+			if sep := args[i+1]; sep == "" || strings.ContainsAny(sep, "0123456789OE\n") {
+				return nil, cfg, fmt.Errorf("invalid --tag-format %q: the separator must be non-empty, without digits, O, E or newlines", sep)
+			}
+			cfg.tagSep = args[i+1]
+			i++
+		case "--success-codes":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--success-codes requires an argument")
+			}
+			set, err := parseCodeSet(args[i+1])
+			if err != nil {
+				return nil, cfg, err
+			}
+			cfg.successCodes = set
+			i++
+		case "--invert":
+			cfg.invert = true
+		case "--summary":
+			cfg.summary = true
+		case "--show-heartbeats":
+			cfg.showHeartbeats = true
+		case "--graph":
+			cfg.graph = true
+		case "--grep", "--grep-v":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("%s requires an argument", args[i])
+			}
+			re, err := regexp.Compile(args[i+1])
+			if err != nil {
+				return nil, cfg, fmt.Errorf("invalid %s %q: %w", args[i], args[i+1], err)
+			}
+			if args[i] == "--grep" {
+				cfg.grep = re
+			} else {
+				cfg.grepV = re
+			}
+			i++
+		case "--stdout-file", "--stderr-file":
+			if i+1 >= len(args) || args[i+1] == "" {
+				return nil, cfg, fmt.Errorf("%s requires an argument", args[i])
+			}
+			if args[i] == "--stdout-file" {
+				cfg.stdoutFile = args[i+1]
+			} else {
+				cfg.stderrFile = args[i+1]
+			}
+			i++
+		case "--fd":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--fd requires an argument")
+			}
+			fd, err := strconv.Atoi(args[i+1])
+			if err != nil || fd < 3 {
+				return nil, cfg, fmt.Errorf("invalid --fd %q: must be a descriptor number the task was forked with --capture-fd, 3 or more", args[i+1])
+			}
+			cfg.fds = append(cfg.fds, fd)
+			i++
+		case "--color":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--color requires an argument")
+			}
+			switch args[i+1] {
+			case "auto", "always", "never":
+				cfg.color = args[i+1]
+			default:
+				return nil, cfg, fmt.Errorf("invalid --color %q: must be auto, always, or never", args[i+1])
+			}
+			i++
+		case "--replay-speed":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--replay-speed requires an argument")
+			}
+			speed, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil || speed <= 0 {
+				return nil, cfg, fmt.Errorf("invalid --replay-speed %q: must be a positive number", args[i+1])
+			}
+			cfg.replaySpeed = speed
+			i++
+		case "--linger":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--linger requires an argument")
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d < 0 {
+				return nil, cfg, fmt.Errorf("invalid --linger %q: must be a duration such as 500ms or 2s", args[i+1])
+			}
+			cfg.linger = d
+			i++
+		case "--timeout":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--timeout requires an argument")
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d < 0 {
+				return nil, cfg, fmt.Errorf("invalid --timeout %q: must be a duration such as 30s or 5m, or 0 for none", args[i+1])
+			}
+			cfg.timeout = d
+			given[args[i]] = true
+			i++
+		case "--audit":
+			cfg.audit = true
+		case "--checkpoint":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--checkpoint requires an argument")
+			}
+			cfg.checkpoint = args[i+1]
+			i++
+		case "--output":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--output requires an argument")
+			}
+			switch args[i+1] {
+			case outputText, outputJSON, outputCSV, outputLogfmt:
+				cfg.output = args[i+1]
+			default:
+				return nil, cfg, fmt.Errorf("invalid --output %q: must be text, json, csv, or logfmt", args[i+1])
+			}
+			i++
+		case "--fields":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--fields requires an argument")
+			}
+			fields, err := parseFields(args[i+1])
+			if err != nil {
+				return nil, cfg, err
+			}
+			cfg.fields = fields
+			i++
+		case "--print-exit":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--print-exit requires an argument")
+			}
+			fd, err := strconv.Atoi(args[i+1])
+			if err != nil || fd < 1 {
+				return nil, cfg, fmt.Errorf("invalid --print-exit %q: must be a file descriptor number, such as 1 or 3", args[i+1])
+			}
+			cfg.printExit = fd
+			i++
+		case "--input-file":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--input-file requires an argument")
+			}
+			cfg.inputFile = args[i+1]
+			i++
+		case "--result-file":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--result-file requires an argument")
+			}
+			cfg.resultFile = args[i+1]
+			i++
+		case "--heartbeat-timeout", "--warmup":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("%s requires an argument", args[i])
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d <= 0 {
+				return nil, cfg, fmt.Errorf("invalid %s %q: must be a positive duration such as 30s or 2m", args[i], args[i+1])
+			}
+			if args[i] == "--warmup" {
+				cfg.warmup = d
+			} else {
+				cfg.heartbeatTimeout = d
+			}
+			given[args[i]] = true
+			i++
+		case "--max-event-bytes":
+			if i+1 >= len(args) {
+				return nil, cfg, fmt.Errorf("--max-event-bytes requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return nil, cfg, fmt.Errorf("invalid --max-event-bytes %q: must be a byte count, or 0 for no limit", args[i+1])
+			}
+			cfg.maxEventBytes = n
+			i++
 		default:
-			return nil, cfg, fmt.Errorf("unexpected argument %q\nUsage: bgx join --task-name NAME [--task-name NAME ...] [--group] [--timestamps]", args[i])
+			return nil, cfg, fmt.Errorf("unexpected argument %q\nUsage: bgx join --task-name NAME [--task-name NAME ...] [options]\nRun 'bgx' with no arguments for the list of options.", args[i])
+		}
+	}
+	// Defaults from the environment, for the flags not given. A remote join
+	// doesn't see this environment, so it is passed them as flags.
+	for _, d := range []struct {
+		env, flag string
+		value     *time.Duration
+	}{
+		{TimeoutEnv, "--timeout", &cfg.timeout},
+		{HeartbeatTimeoutEnv, "--heartbeat-timeout", &cfg.heartbeatTimeout},
+	} {
+		if given[d.flag] {
+			continue
+		}
+		v, err := envDuration(d.env)
+		if err != nil {
+			return nil, cfg, err
+		}
+		if *d.value = v; v != 0 && cfg.host != "" {
+			cfg.remoteArgs = append(cfg.remoteArgs, d.flag, v.String())
 		}
 	}
-	if len(taskNames) == 0 {
+	if len(taskNames) == 0 && cfg.inputFile == "" {
 		return nil, cfg, fmt.Errorf("--task-name is required")
 	}
+	if cfg.inputFile != "" {
+		// The file's tasks are loaded into a database of join's own, which
+		// is gone once it is done; the remote bgx has no such file.
+		switch {
+		case cfg.host != "":
+			return nil, cfg, fmt.Errorf("--input-file can't be used with --host")
+		case cfg.checkpoint != "":
+			return nil, cfg, fmt.Errorf("--input-file can't be used with --checkpoint")
+		case cfg.audit:
+			return nil, cfg, fmt.Errorf("--input-file can't be used with --audit")
+		}
+	}
+	_, structured := cfg.encoder()
+	if cfg.fields != nil && !structured {
+		return nil, cfg, fmt.Errorf("--fields requires --output json, csv, or logfmt")
+	}
+	if cfg.group && structured {
+		// ::group:: lines would be mixed into the records.
+		return nil, cfg, fmt.Errorf("--group only works with --output text")
+	}
+	if cfg.host != "" && cfg.printExit != 0 {
+		// The file descriptor would be the remote bgx's, not ours.
+		return nil, cfg, fmt.Errorf("--print-exit can't be used with --host")
+	}
+	if cfg.host != "" && cfg.resultFile != "" {
+		// The file would be written on the remote host.
+		return nil, cfg, fmt.Errorf("--result-file can't be used with --host")
+	}
+	toFile := func(path string) bool { return path != "" && path != "-" }
+	if toFile(cfg.stdoutFile) || toFile(cfg.stderrFile) {
+		switch {
+		case structured:
+			return nil, cfg, fmt.Errorf("--stdout-file and --stderr-file only work with --output text")
+		case cfg.host != "":
+			// The files would be created on the remote host.
+			return nil, cfg, fmt.Errorf("--stdout-file and --stderr-file can't be used with --host")
+		}
+	}
+	if structured && (cfg.grep != nil || cfg.grepV != nil) {
+		return nil, cfg, fmt.Errorf("--grep and --grep-v only work with --output text")
+	}
+	if cfg.tagSep != "" && !cfg.tagLines {
+		return nil, cfg, fmt.Errorf("--tag-format requires --tag-lines")
+	}
+	if structured && cfg.tagLines {
+		return nil, cfg, fmt.Errorf("--tag-lines only works with --output text")
+	}
+	if structured && cfg.showHeartbeats {
+		return nil, cfg, fmt.Errorf("--show-heartbeats only works with --output text")
+	}
+	if structured && cfg.graph {
+		return nil, cfg, fmt.Errorf("--graph only works with --output text")
+	}
 	return taskNames, cfg, nil
 }
 
@@ -51,39 +595,95 @@ func runJoin(args []string) (int, error) {
 	if err != nil {
 		return 1, err
 	}
+	if cfg.host != "" {
+		remoteArgs := cfg.remoteArgs
+		if cfg.color == "" && cfg.colorFor(os.Stdout) && cfg.colorFor(os.Stderr) {
+			// The remote bgx writes to a pipe, so it would never color on
+			// its own; decide for it here, where the terminal is.
+			remoteArgs = append(remoteArgs, "--color", "always")
+		}
+		return joinRemote(cfg.host, remoteArgs)
+	}
 
-	db, err := openDB()
-	if err != nil {
+	var db *sql.DB
+	if cfg.inputFile != "" {
+		var inFile []string
+		if db, inFile, err = loadInputFile(cfg.inputFile); err != nil {
+			return 1, err
+		}
+		if len(taskNames) == 0 {
+			if len(inFile) == 0 {
+				db.Close()
+				return 1, fmt.Errorf("--input-file %s has no events", cfg.inputFile)
+			}
+			taskNames = inFile
+		}
+	} else if db, err = openDB(); err != nil {
 		return 1, err
 	}
 	defer db.Close()
 
 	for _, name := range taskNames {
 		exists, err := taskExists(db, name)
-		if err != nil {
+		switch {
+		case err != nil:
 			return 1, fmt.Errorf("failed to look up task: %w", err)
-		}
-		if !exists {
+		case !exists && cfg.inputFile != "":
+			return 1, fmt.Errorf("task %q not found in --input-file %s", name, cfg.inputFile)
+		case !exists:
 			return 1, fmt.Errorf("task %q not found (BGX_DB=%s)", name, getDBPath())
 		}
 	}
+	if cfg.audit {
+		for _, name := range taskNames {
+			if err := recordAccess(db, name, "join"); err != nil {
+				return 1, err
+			}
+		}
+	}
+
+	closeFiles, err := cfg.openOutputFiles()
+	if err != nil {
+		return 1, err
+	}
+	defer closeFiles()
+
+	var cp *checkpoint
+	if cfg.checkpoint != "" {
+		if cp, err = loadCheckpoint(cfg.checkpoint); err != nil {
+			return 1, err
+		}
+	}
+
+	if enc, ok := cfg.encoder(); ok {
+		fmt.Print(enc.header())
+	}
 
 	// --group must keep each task's lines contiguous, so it drains tasks
 	// sequentially. Otherwise multiple tasks stream concurrently, each line
 	// tagged with its task name; a single task streams unprefixed.
 	if cfg.group {
-		return joinGrouped(db, taskNames, cfg)
+		return joinGrouped(db, taskNames, cfg, cp)
 	}
 	var printMu sync.Mutex
+	pace := newPacer(cfg)
+	if pace != nil {
+		// Concurrent tasks share one timeline, anchored at the earliest event
+		// among them, so their relative timing is replayed too.
+		if first, err := firstEventTime(db, taskNames); err == nil && !first.IsZero() {
+			pace.origin, pace.start = first, time.Now()
+		}
+	}
 	if len(taskNames) == 1 {
-		return streamTask(db, taskNames[0], "", cfg, &printMu)
+		code, err := streamTask(db, taskNames[0], "", cfg, &printMu, pace, cp)
+		return aggregate(db, taskNames, []int{code}, []error{err}, cfg)
 	}
-	return joinConcurrent(db, taskNames, cfg, &printMu)
+	return joinConcurrent(db, taskNames, cfg, &printMu, pace, cp)
 }
 
 // joinConcurrent streams every task at once, each line prefixed with [task],
 // returning the first failing task's exit code (non-zero if any failed).
-func joinConcurrent(db *sql.DB, taskNames []string, cfg joinConfig, printMu *sync.Mutex) (int, error) {
+func joinConcurrent(db *sql.DB, taskNames []string, cfg joinConfig, printMu *sync.Mutex, pace *pacer, cp *checkpoint) (int, error) {
 	codes := make([]int, len(taskNames))
 	errs := make([]error, len(taskNames))
 
@@ -92,103 +692,540 @@ func joinConcurrent(db *sql.DB, taskNames []string, cfg joinConfig, printMu *syn
 		wg.Add(1)
 		go func(i int, name string) {
 			defer wg.Done()
-			codes[i], errs[i] = streamTask(db, name, fmt.Sprintf("[%s] ", name), cfg, printMu)
+			codes[i], errs[i] = streamTask(db, name, fmt.Sprintf("[%s] ", name), cfg, printMu, pace, cp)
 		}(i, name)
 	}
 	wg.Wait()
 
-	return aggregate(taskNames, codes, errs)
+	return aggregate(db, taskNames, codes, errs, cfg)
 }
 
 // joinGrouped drains tasks one at a time, wrapping each in a GitHub Actions
 // collapsible ::group:: block. It waits for every task and returns the first
-// failing task's exit code (non-zero if any failed).
-func joinGrouped(db *sql.DB, taskNames []string, cfg joinConfig) (int, error) {
+// failing task's exit code (non-zero if any failed). Since groups are replayed
+// one after another, --replay-speed paces each on its own timeline.
+func joinGrouped(db *sql.DB, taskNames []string, cfg joinConfig, cp *checkpoint) (int, error) {
 	codes := make([]int, len(taskNames))
 	errs := make([]error, len(taskNames))
 
 	var printMu sync.Mutex
 	for i, name := range taskNames {
 		fmt.Printf("::group::%s\n", name)
-		codes[i], errs[i] = streamTask(db, name, "", cfg, &printMu)
+		codes[i], errs[i] = streamTask(db, name, "", cfg, &printMu, newPacer(cfg), cp)
 		fmt.Println("::endgroup::")
 	}
 
-	return aggregate(taskNames, codes, errs)
+	return aggregate(db, taskNames, codes, errs, cfg)
+}
+
+// report runs once replay is over, with each task's exit code and whether
+// join gave up on it still running (--timeout): it prints the --summary and
+// writes the --result-file and the --print-exit lines.
+func (cfg joinConfig) report(db *sql.DB, taskNames []string, codes []int, running []bool) error {
+	if cfg.summary {
+		if err := printSummaries(db, taskNames, running); err != nil {
+			return err
+		}
+	}
+	if cfg.resultFile != "" {
+		if err := writeResultFile(cfg.resultFile, db, taskNames, running); err != nil {
+			return err
+		}
+	}
+	return cfg.printExits(taskNames, codes)
+}
+
+// printSummaries writes each task's exit code, run time, and how much it
+// wrote to each stream to stderr: for one task as a line such as
+// "bgx: build exited with code 0 after 1.2s: stdout 12 lines (3.4 KiB), stderr empty",
+// and for several as a table with a row per task, in argument order.
+func printSummaries(db *sql.DB, taskNames []string, running []bool) error {
+	summaries := make([]taskSummary, len(taskNames))
+	for i, name := range taskNames {
+		s, err := readTaskSummary(db, name)
+		if err != nil {
+			return fmt.Errorf("failed to read task %q: %w", name, err)
+		}
+		summaries[i] = s
+	}
+	if len(taskNames) == 1 {
+		s := summaries[0]
+		if running[0] {
+			fmt.Fprintf(os.Stderr, "bgx: %s was still running after %s\n", s.Name, s.Duration().Round(time.Millisecond))
+		} else {
+			fmt.Fprintf(os.Stderr, "bgx: %s exited with code %d after %s: %s\n",
+				s.Name, s.ExitCode, s.Duration().Round(time.Millisecond), formatOutput(s))
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tEXIT\tDURATION\tOUTPUT")
+	for i, s := range summaries {
+		if running[i] {
+			fmt.Fprintf(w, "%s\t-\t%s\tstill running\n", s.Name, s.Duration().Round(time.Millisecond))
+		} else {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", s.Name, s.ExitCode, s.Duration().Round(time.Millisecond), formatOutput(s))
+		}
+	}
+	return w.Flush()
+}
+
+// printExits writes each task's recorded exit code to the --print-exit
+// descriptor once replay is over: exit=<code> for a single task, and
+// task=<name> exit=<code> per task (in argument order) for several.
+func (cfg joinConfig) printExits(taskNames []string, codes []int) error {
+	if cfg.printExit == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for i, name := range taskNames {
+		if len(taskNames) > 1 {
+			fmt.Fprintf(&b, "task=%s ", name)
+		}
+		fmt.Fprintf(&b, "exit=%d\n", codes[i])
+	}
+	if err := writeFD(cfg.printExit, []byte(b.String())); err != nil {
+		return fmt.Errorf("failed to write --print-exit to fd %d: %w", cfg.printExit, err)
+	}
+	return nil
 }
 
 // aggregate reduces per-task results to a single exit code: the first read
-// error fails the join, otherwise the first non-zero exit code (in argument
-// order), otherwise success.
-func aggregate(taskNames []string, codes []int, errs []error) (int, error) {
+// error fails the join, otherwise the first failing task's exit status (in
+// argument order, after --success-codes/--invert, and WaitTimeoutExitCode
+// for a task given up on by --timeout), otherwise success.
+func aggregate(db *sql.DB, taskNames []string, codes []int, errs []error, cfg joinConfig) (int, error) {
+	running := make([]bool, len(taskNames))
 	for i := range taskNames {
-		if errs[i] != nil {
+		switch {
+		case errors.Is(errs[i], errStillRunning):
+			running[i] = true
+		case errs[i] != nil:
 			return 1, errs[i]
 		}
 	}
 	for i := range taskNames {
-		if codes[i] != 0 {
-			return codes[i], nil
+		if running[i] {
+			fmt.Fprintf(os.Stderr, "bgx: %v\n", errs[i])
+		}
+	}
+	if err := cfg.report(db, taskNames, codes, running); err != nil {
+		return 1, err
+	}
+	for i := range taskNames {
+		if running[i] {
+			return WaitTimeoutExitCode, nil
+		}
+		if code := cfg.exitStatus(codes[i]); code != 0 {
+			return code, nil
 		}
 	}
 	return 0, nil
 }
 
+// errStillRunning is wrapped by the error streamTask returns for a task that
+// hadn't exited within join's --timeout.
+var errStillRunning = errors.New("still running")
+
 // streamTask replays and tails one task's output to stdout/stderr and returns
 // its exit code. Each line is written under printMu (so concurrently-joined
 // tasks never interleave mid-line), prefixed with prefix and, when
 // cfg.timestamps is set, the event's recorded time. It polls the database,
 // advancing a monotonic id cursor, until it sees the exit event or the task
-// stops emitting events for HeartbeatTimeout.
+// stops emitting events for HeartbeatTimeout (cfg.heartbeatTimeout, stretched
+// when a --heartbeat-adaptive heartbeat announced a longer wait), counted
+// from no earlier than the end of cfg.warmup. A task forked with
+// --no-heartbeat can be silent indefinitely, so once its start event says so,
+// only the exit event ends the join. One forked with --heartbeat-touch
+// records no heartbeats, but each touch of its heartbeat file counts as an
+// event. With cfg.timeout, a task that hasn't exited that long after
+// streamTask began following it is given up on too, with an error wrapping
+// errStillRunning.
 //
 // Because it reads persisted events rather than a live process, joining a task
-// that finished long ago replays its full history and exit code.
-func streamTask(db *sql.DB, taskName, prefix string, cfg joinConfig, printMu *sync.Mutex) (int, error) {
-	var lastID int64
+// that finished long ago replays its full history and exit code. A non-nil
+// pace holds each output and exit event back until it is due (--replay-speed).
+// An event over cfg.maxEventBytes is never loaded; it fails the join instead.
+// With a structured --output, every event but heartbeats is written to stdout
+// as a record instead of replaying the output.
+//
+// A non-nil cp resumes the task after its checkpointed event and checkpoints
+// each batch read. The exit event itself is never checkpointed, so resuming a
+// finished task replays just its exit and returns its code again.
+//
+// With cfg.inputFile, db holds a saved log that never grows, so a task that
+// runs out of events before its exit event fails at once.
+//
+// The daemon writes the exit event last, so stopping there loses nothing it
+// recorded. cfg.linger keeps reading past it anyway, for events other writers
+// might add after the fact.
+func streamTask(db *sql.DB, taskName, prefix string, cfg joinConfig, printMu *sync.Mutex, pace *pacer, cp *checkpoint) (int, error) {
+	lastID, err := cp.resumeID(db, taskName)
+	if err != nil {
+		return 1, err
+	}
 	lastEventTime := time.Now()
+	deadline := lastEventTime.Add(cfg.timeout)
+	heartbeats := true
+	touched := false     // --heartbeat-touch: the heartbeat file counts as an event
+	var memMetric string // what the heartbeats' memory samples measure
+	// announced is how long the latest heartbeat said the next may take
+	// (--heartbeat-adaptive), which stretches the timeout.
+	var announced time.Duration
+	timeout := cfg.heartbeatTimeout
+	if timeout == 0 {
+		timeout = HeartbeatTimeout
+	}
+	// A task slow to start, or joined while its daemon is still launching it,
+	// gets the full timeout once the warmup is over.
+	warmupEnd := lastEventTime.Add(cfg.warmup)
+	if lastID > 0 {
+		// The start event, which says whether to expect heartbeats, may be
+		// behind the checkpoint.
+		s, err := readTaskSummary(db, taskName)
+		if err != nil {
+			return 1, fmt.Errorf("failed to read task %q: %w", taskName, err)
+		}
+		heartbeats, touched = !s.NoHeartbeat, s.HeartbeatTouch
+		memMetric = s.MemMetric
+		announced = s.HeartbeatInterval
+	}
+	stdout, stderr := cfg.replayStdout(), cfg.replayStderr()
+	colorStdout, colorStderr := cfg.colorFor(stdout), cfg.colorFor(stderr)
+	enc, structured := cfg.encoder()
+	status := cfg.heartbeatStatus(prefix)
+	defer status.clear()
+
+	// With --linger, the exit event doesn't end the join right away:
+	// exitCode is held until lingerUntil while any later output is replayed.
+	exited := false
+	var exitCode int
+	var lingerUntil time.Time
 
 	for {
-		events, err := readEventsAfter(db, taskName, lastID)
-		if err != nil {
+		var events []eventRow
+		if err := retryTransient(func() (err error) {
+			events, err = readEventsAfter(db, taskName, lastID, cfg.maxEventBytes)
+			return err
+		}, ReadRetryDelay); err != nil {
 			return 1, fmt.Errorf("failed to read events for %q: %w", taskName, err)
 		}
 
+		var replayed eventRow // the batch's last event before any exit, to checkpoint
 		for _, e := range events {
 			lastID = e.ID
+			if e.Type != EventTypeExit && !exited { // not what --linger reads past it
+				replayed = e
+			}
+			if cfg.maxEventBytes > 0 && e.DataBytes > int64(cfg.maxEventBytes) {
+				return 1, fmt.Errorf("event %d of task %q has %d bytes of data, more than --max-event-bytes %d (bgx never records events that large by default; pass --max-event-bytes 0 to read it anyway)",
+					e.ID, taskName, e.DataBytes, cfg.maxEventBytes)
+			}
+			if structured && e.Type != EventTypeHeartbeat {
+				pace.wait(e.Time)
+				record := enc.encode(taskName, e)
+				printMu.Lock()
+				fmt.Print(record)
+				printMu.Unlock()
+			}
+
 			var w io.Writer
+			var color bool
 			switch e.Type {
+			case EventTypeStart:
+				heartbeats, touched = !e.NoHeartbeat || e.HeartbeatTouch, e.HeartbeatTouch
+				memMetric = e.MemMetric
+				if warning := newerSchemaWarning(taskName, e.V); warning != "" {
+					printMu.Lock()
+					status.clear()
+					fmt.Fprintln(os.Stderr, warning)
+					printMu.Unlock()
+				}
+				continue
 			case EventTypeStdout:
-				w = os.Stdout
+				w, color = stdout, colorStdout
 			case EventTypeStderr:
-				w = os.Stderr
+				w, color = stderr, colorStderr
+			case EventTypeFD:
+				// Captured descriptors have no counterpart in join, so their
+				// output goes to stderr, each line labeled with its
+				// descriptor.
+				if structured || !slices.Contains(cfg.fds, e.FD) {
+					continue
+				}
+				if e.Data = cfg.filterLines(e.Data); e.Data == "" {
+					continue
+				}
+				pace.wait(e.Time)
+				line := formatLine(e, fmt.Sprintf("%s[fd %d] ", prefix, e.FD), cfg, colorStderr)
+				printMu.Lock()
+				status.clear()
+				fmt.Fprint(stderr, line)
+				printMu.Unlock()
+				continue
+			case EventTypeLimitExceeded, EventTypeIdleTimeout, EventTypeTruncated, EventTypeError:
+				// Say why the output stops short, or what the daemon ran
+				// into along the way; the task's exit code is unaffected.
+				if structured {
+					continue
+				}
+				printMu.Lock()
+				status.clear()
+				fmt.Fprintf(os.Stderr, "%sbgx: %s\n", prefix, e.Data)
+				printMu.Unlock()
+				continue
 			case EventTypeExit:
-				return e.Code, nil
+				pace.wait(e.Time)
+				if e.ExitSignal != "" && !structured {
+					// An exit code such as 139 says little on its own.
+					printMu.Lock()
+					status.clear()
+					fmt.Fprintf(os.Stderr, "%sbgx: task ended: %s, exit code %d\n", prefix, e.ExitReason, e.Code)
+					printMu.Unlock()
+				}
+				if cfg.linger == 0 {
+					return e.Code, cp.save(taskName, replayed)
+				}
+				exited, exitCode, lingerUntil = true, e.Code, time.Now().Add(cfg.linger)
+				continue
+			case EventTypeHeartbeat:
+				announced = time.Duration(e.Interval * float64(time.Second))
+				if structured || status == nil {
+					continue
+				}
+				pace.wait(e.Time)
+				line := formatHeartbeat(e, prefix, memMetric, cfg, cfg.colorFor(os.Stderr))
+				if g := status.graph; g != nil {
+					if g.add(e); !g.due(time.Now(), false) {
+						continue
+					}
+					line = g.render(prefix, memMetric, cfg.colorFor(os.Stderr))
+				}
+				printMu.Lock()
+				status.show(line)
+				printMu.Unlock()
+				continue
 			default:
 				continue
 			}
 
-			var b strings.Builder
-			if cfg.timestamps {
-				b.WriteString(formatTimestamp(e.Time))
+			if structured {
+				continue
 			}
-			b.WriteString(prefix)
-			b.WriteString(e.Data)
+			if e.Data = cfg.filterLines(e.Data); e.Data == "" {
+				continue
+			}
+			pace.wait(e.Time)
+			line := formatLine(e, prefix, cfg, color)
+			printMu.Lock()
+			status.clear()
+			fmt.Fprint(w, line)
+			printMu.Unlock()
+		}
 
+		if status != nil && status.graph != nil && status.graph.due(time.Now(), true) {
 			printMu.Lock()
-			fmt.Fprint(w, b.String())
+			status.show(status.graph.render(prefix, memMetric, cfg.colorFor(os.Stderr)))
 			printMu.Unlock()
 		}
+		if err := cp.save(taskName, replayed); err != nil {
+			return 1, err
+		}
 
-		if len(events) > 0 {
+		if touched {
+			lastEventTime = latest(lastEventTime, heartbeatFileTime(taskName))
+		}
+		switch {
+		case exited:
+			if time.Now().After(lingerUntil) {
+				return exitCode, nil
+			}
+		case cfg.timeout > 0 && time.Now().After(deadline):
+			return WaitTimeoutExitCode, fmt.Errorf("gave up on task %q, %w after --timeout %v", taskName, errStillRunning, cfg.timeout)
+		case cfg.inputFile != "" && len(events) == 0:
+			// A saved log never grows, so there is nothing to wait for.
+			return 1, fmt.Errorf("--input-file %s ends before task %q exited", cfg.inputFile, taskName)
+		case len(events) > 0:
 			lastEventTime = time.Now()
-		} else if time.Since(lastEventTime) > HeartbeatTimeout {
-			return 1, fmt.Errorf("heartbeat timeout: no events from task %q for %v", taskName, HeartbeatTimeout)
+		case heartbeats && time.Since(latest(lastEventTime, warmupEnd)) > stallTimeout(timeout, announced):
+			return 1, fmt.Errorf("heartbeat timeout: no events from task %q for %v", taskName, stallTimeout(timeout, announced))
 		}
 
 		time.Sleep(JoinPollInterval)
 	}
 }
 
+// A read of the database that fails with a transient error is retried up to
+// ReadRetries times, the wait doubling from ReadRetryDelay, before join gives
+// up on the task.
+const (
+	ReadRetries    = 4
+	ReadRetryDelay = 100 * time.Millisecond
+)
+
+// retryTransient calls read until it succeeds, fails with an error that
+// isn't transient, or has been retried ReadRetries times, sleeping delay
+// before the first retry and twice as long before each after it. It returns
+// read's last error.
+func retryTransient(read func() error, delay time.Duration) error {
+	err := read()
+	for retry := 0; retry < ReadRetries && isTransient(err); retry++ {
+		time.Sleep(delay)
+		delay *= 2
+		err = read()
+	}
+	return err
+}
+
+// isTransient reports whether err is an SQLite error that may well not
+// happen again: the database staying locked past the busy timeout, say by a
+// long checkpoint, or an I/O error, as an overlay or a loaded disk can
+// produce. Others, such as a corrupt or unreadable database, are permanent.
+func isTransient(err error) bool {
+	var coded interface{ Code() int } // *sqlite.Error
+	if !errors.As(err, &coded) {
+		return false
+	}
+	switch coded.Code() & 0xff { // the primary result code
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_IOERR, sqlite3.SQLITE_PROTOCOL:
+		return true
+	}
+	return false
+}
+
+// latest returns the later of two times.
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// formatLine renders one stdout/stderr event for output: the optional tag
+// and timestamp, the task prefix, then the data. An event holding several
+// lines (with fork --coalesce-window) has each labelled. With color, the
+// timestamp and prefix are dimmed and stderr data is red; escape sequences
+// close before the line's newline so a color never bleeds into the next line.
+// The tag is never colored, so that it stays easy to parse.
+func formatLine(e eventRow, prefix string, cfg joinConfig, color bool) string {
+	var b strings.Builder
+	label := prefix
+	if cfg.timestamps {
+		label = formatTimestamp(e.Time) + prefix
+	}
+	if color && label != "" {
+		label = ansiDim + label + ansiReset
+	}
+	label = cfg.lineTag(e) + label
+
+	for line := range strings.SplitAfterSeq(e.Data, "\n") {
+		if line == "" {
+			continue
+		}
+		b.WriteString(label)
+		if color && e.Type == EventTypeStderr {
+			body, newline := strings.CutSuffix(line, "\n")
+			b.WriteString(ansiRed + body + ansiReset)
+			if newline {
+				b.WriteString("\n")
+			}
+		} else {
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+// lineTag returns the --tag-lines tag for a line of e: the event's id, then
+// its stream (O for stdout, E for stderr, or the descriptor's number for an
+// fd event), each followed by the separator, such as "12:O:". Ids increase
+// in the order events were recorded, across tasks too, but aren't
+// consecutive. Without --tag-lines it is "".
+func (cfg joinConfig) lineTag(e eventRow) string {
+	if !cfg.tagLines {
+		return ""
+	}
+	sep := cfg.tagSep
+	if sep == "" {
+		sep = ":"
+	}
+	stream := "O"
+	switch e.Type {
+	case EventTypeStderr:
+		stream = "E"
+	case EventTypeFD:
+		stream = strconv.Itoa(e.FD)
+	}
+	return strconv.FormatInt(e.ID, 10) + sep + stream + sep
+}
+
+// formatHeartbeat renders a heartbeat for --show-heartbeats, such as
+// "[heartbeat] cpu=1.20s mem=45.0MiB" (pss= instead of mem= for a task forked
+// with --mem-metric pss), after the timestamp and prefix as formatLine has
+// them. It has no newline; heartbeatStatus decides how the line ends.
+func formatHeartbeat(e eventRow, prefix, memMetric string, cfg joinConfig, color bool) string {
+	mem := "mem"
+	if memMetric == MemMetricPSS {
+		mem = "pss"
+	}
+	label := prefix
+	if cfg.timestamps {
+		label = formatTimestamp(e.Time) + prefix
+	}
+	line := fmt.Sprintf("%s[heartbeat] cpu=%.2fs %s=%s", label, e.CPUSeconds, mem, strings.ReplaceAll(formatBytes(e.MemBytes), " ", ""))
+	if color {
+		return ansiDim + line + ansiReset
+	}
+	return line
+}
+
+// heartbeatStatus writes --show-heartbeats lines to stderr. Joining a single
+// task with stderr on a terminal, each heartbeat overwrites the last one in
+// place and the line is cleared before anything else is printed; otherwise
+// (several tasks, or stderr redirected) every heartbeat gets a line of its
+// own. With --graph, the in-place line is a resourceGraph instead. A nil
+// heartbeatStatus, without either flag, shows nothing.
+type heartbeatStatus struct {
+	inPlace bool
+	shown   bool           // an in-place line is on screen, with the cursor at its end
+	graph   *resourceGraph // --graph, in place
+}
+
+// heartbeatStatus returns the status line for a task joined with prefix, or
+// nil without --show-heartbeats or --graph. The graph is only ever drawn in
+// place; where it can't be, --graph falls back on --show-heartbeats if that
+// was given too, and otherwise on the plain replay.
+func (cfg joinConfig) heartbeatStatus(prefix string) *heartbeatStatus {
+	inPlace := prefix == "" && isTerminal(os.Stderr)
+	switch {
+	case cfg.graph && inPlace:
+		return &heartbeatStatus{inPlace: true, graph: &resourceGraph{}}
+	case cfg.showHeartbeats:
+		return &heartbeatStatus{inPlace: inPlace}
+	}
+	return nil
+}
+
+// show prints line as the current heartbeat. Callers hold printMu.
+func (h *heartbeatStatus) show(line string) {
+	if !h.inPlace {
+		fmt.Fprintln(os.Stderr, line)
+		return
+	}
+	fmt.Fprint(os.Stderr, "\r"+line+ansiClearLine)
+	h.shown = true
+}
+
+// clear erases an in-place heartbeat line, if one is showing, so that the
+// next output starts on a clean line. Callers hold printMu.
+func (h *heartbeatStatus) clear() {
+	if h == nil || !h.shown {
+		return
+	}
+	fmt.Fprint(os.Stderr, "\r"+ansiClearLine)
+	h.shown = false
+}
+
 // formatTimestamp renders a stored RFC3339 event time as "HH:MM:SS.mmm ".
 // If the stored value can't be parsed, it returns an empty string.
 func formatTimestamp(stored string) string {
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// finishedTask records a task that has already exited with the given code.
+func finishedTask(tb testing.TB, code int) *sql.DB {
+	tb.Helper()
+	tb.Setenv("BGX_DB", filepath.Join(tb.TempDir(), "bgx.db"))
+	db, err := openDB()
+	if err != nil {
+		tb.Fatalf("openDB: %v", err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	for _, e := range []Event{
+		{Type: EventTypeStart, Time: time.Now(), PID: 1, Command: []string{"true"}},
+		{Type: EventTypeHeartbeat, Time: time.Now()},
+		{Type: EventTypeExit, Time: time.Now(), Code: code},
+	} {
+		if err := insertEvent(db, "done", e); err != nil {
+			tb.Fatalf("insertEvent: %v", err)
+		}
+	}
+	return db
+}
+
+// TestStreamFinishedTask verifies that joining a task whose log already ends
+// with its exit event returns as soon as that event is read, without sleeping
+// for another poll.
+func TestStreamFinishedTask(t *testing.T) {
+	db := finishedTask(t, 3)
+	var printMu sync.Mutex
+
+	start := time.Now()
+	code, err := streamTask(db, "done", "", joinConfig{}, &printMu, nil, nil)
+	elapsed := time.Since(start)
+	if err != nil || code != 3 {
+		t.Fatalf("streamTask = %d, %v; want 3, nil", code, err)
+	}
+	if elapsed >= JoinPollInterval/2 {
+		t.Errorf("streamTask took %s, want well under the %s poll interval", elapsed, JoinPollInterval)
+	}
+}
+
+// BenchmarkStreamFinishedTask measures a join of a task that has already
+// exited: one read of its events, with no polling.
+func BenchmarkStreamFinishedTask(b *testing.B) {
+	db := finishedTask(b, 0)
+	var printMu sync.Mutex
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := streamTask(db, "done", "", joinConfig{}, &printMu, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// transientErr stands in for an *sqlite.Error with the given result code.
+type transientErr int
+
+func (e transientErr) Error() string { return fmt.Sprintf("sqlite error %d", int(e)) }
+func (e transientErr) Code() int     { return int(e) }
+
+// TestRetryTransient verifies a read failing with a transient error is
+// retried until it succeeds, but only so many times, and that one failing
+// for good isn't retried at all.
+func TestRetryTransient(t *testing.T) {
+	failing := func(errs ...error) (func() error, *int) {
+		calls := 0
+		return func() error {
+			calls++
+			if calls <= len(errs) {
+				return errs[calls-1]
+			}
+			return nil
+		}, &calls
+	}
+	busy, ioErr := transientErr(5), transientErr(10|2<<8) // SQLITE_BUSY, SQLITE_IOERR_READ
+
+	read, calls := failing(busy, ioErr)
+	if err := retryTransient(read, time.Millisecond); err != nil || *calls != 3 {
+		t.Errorf("After two transient errors: %v in %d calls, want success on the 3rd", err, *calls)
+	}
+
+	read, calls = failing(fmt.Errorf("wrapped: %w", busy), transientErr(11)) // then SQLITE_CORRUPT
+	if err := retryTransient(read, time.Millisecond); err != transientErr(11) || *calls != 2 {
+		t.Errorf("After a permanent error: %v in %d calls, want it returned from the 2nd", err, *calls)
+	}
+
+	var always []error
+	for range ReadRetries + 5 {
+		always = append(always, busy)
+	}
+	read, calls = failing(always...)
+	if err := retryTransient(read, time.Millisecond); err != busy || *calls != ReadRetries+1 {
+		t.Errorf("When always busy: %v in %d calls, want the error after %d", err, *calls, ReadRetries+1)
+	}
+}
+
+// TestIsTransientSQLite verifies isTransient recognizes a real *sqlite.Error:
+// a write lock another connection holds past the busy timeout.
+func TestIsTransientSQLite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bgx.db")
+	open := func() *sql.DB {
+		db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(0)&_pragma=journal_mode(WAL)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	holder, other := open(), open()
+	if _, err := holder.Exec("BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := other.Exec("BEGIN IMMEDIATE")
+	if err == nil || !isTransient(err) {
+		t.Errorf("A locked database: %v, want a transient error", err)
+	}
+	if _, err := other.Exec("SELECT * FROM no_such_table"); err == nil || isTransient(err) {
+		t.Errorf("A missing table: %v, want a permanent error", err)
+	}
+}
+
+// TestResourceGraph verifies join --graph's sparklines: CPU use between
+// heartbeats and memory at each, scaled to the window's peak, keeping the
+// last GraphWidth samples, and redrawn at most every GraphRedrawInterval
+// unless forced.
+func TestResourceGraph(t *testing.T) {
+	if got := sparkline([]float64{0, 1, 2, 3, 4, 5, 6, 7}); got != "▁▂▃▄▅▆▇█" {
+		t.Errorf("sparkline of 0-7 = %q, want every height in turn", got)
+	}
+	if got := sparkline([]float64{0, 0}); got != "▁▁" {
+		t.Errorf("sparkline of zeros = %q, want the lowest blocks", got)
+	}
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	heartbeat := func(i int, cpu float64, mem int64) eventRow {
+		return eventRow{Type: EventTypeHeartbeat, Time: start.Add(time.Duration(i) * 5 * time.Second).Format(time.RFC3339Nano), CPUSeconds: cpu, MemBytes: mem}
+	}
+	var g resourceGraph
+	if got, want := g.render("", "", false), "[graph] cpu - mem unknown"; got != want {
+		t.Errorf("render with no samples = %q, want %q", got, want)
+	}
+	g.add(heartbeat(0, 1, 10<<20))
+	g.add(heartbeat(1, 6, 20<<20))   // a whole core for 5s
+	g.add(heartbeat(2, 8.5, 40<<20)) // half a core
+	if got, want := g.render("[busy] ", "", false), "[busy] [graph] cpu █▅ 50% mem ▃▅█ 40.0MiB"; got != want {
+		t.Errorf("render = %q, want %q", got, want)
+	}
+	if got, want := g.render("", MemMetricPSS, true), ansiDim+"[graph] cpu █▅ 50% pss ▃▅█ 40.0MiB"+ansiReset; got != want {
+		t.Errorf("render of PSS in color = %q, want %q", got, want)
+	}
+
+	for i := 3; i < GraphWidth+10; i++ {
+		g.add(heartbeat(i, 8.5, 40<<20))
+	}
+	if len(g.cpu) != GraphWidth || len(g.mem) != GraphWidth {
+		t.Errorf("After %d heartbeats the window has %d CPU and %d memory samples, want %d each", GraphWidth+10, len(g.cpu), len(g.mem), GraphWidth)
+	}
+
+	now := time.Now()
+	if !g.due(now, false) {
+		t.Error("A graph with new samples should be due")
+	}
+	g.add(heartbeat(GraphWidth+10, 9, 40<<20))
+	if g.due(now.Add(GraphRedrawInterval/2), false) {
+		t.Error("A graph drawn within GraphRedrawInterval shouldn't be due")
+	}
+	if !g.due(now.Add(GraphRedrawInterval/2), true) {
+		t.Error("A forced redraw with a new sample should be due")
+	}
+	if g.due(now.Add(2*GraphRedrawInterval), true) {
+		t.Error("A graph with no new samples shouldn't be due, even forced")
+	}
+}
+
+// TestJoinEnvDefaults verifies BGX_TIMEOUT and BGX_HEARTBEAT_TIMEOUT set
+// join's defaults, that its flags override them, and that a remote join is
+// passed the defaults it can't see.
+func TestJoinEnvDefaults(t *testing.T) {
+	t.Setenv(TimeoutEnv, "10m")
+	t.Setenv(HeartbeatTimeoutEnv, "2m")
+	_, cfg, err := parseJoinArgs([]string{"--task-name", "t"})
+	if err != nil || cfg.timeout != 10*time.Minute || cfg.heartbeatTimeout != 2*time.Minute {
+		t.Errorf("parseJoinArgs = timeout %v, heartbeat timeout %v, %v; want the environment's 10m and 2m", cfg.timeout, cfg.heartbeatTimeout, err)
+	}
+	_, cfg, err = parseJoinArgs([]string{"--task-name", "t", "--heartbeat-timeout", "45s"})
+	if err != nil || cfg.timeout != 10*time.Minute || cfg.heartbeatTimeout != 45*time.Second {
+		t.Errorf("parseJoinArgs with --heartbeat-timeout 45s = %v, %v, %v; want 10m and the flag's 45s", cfg.timeout, cfg.heartbeatTimeout, err)
+	}
+	_, cfg, err = parseJoinArgs([]string{"--task-name", "t", "--timeout", "0"})
+	if err != nil || cfg.timeout != 0 {
+		t.Errorf("parseJoinArgs with --timeout 0 = %v, %v; want no timeout", cfg.timeout, err)
+	}
+	_, cfg, err = parseJoinArgs([]string{"--host", "box", "--task-name", "t", "--timeout", "1m"})
+	if want := []string{"--task-name", "t", "--timeout", "1m", "--heartbeat-timeout", "2m0s"}; err != nil || !slices.Equal(cfg.remoteArgs, want) {
+		t.Errorf("remote join args = %q, %v; want %q", cfg.remoteArgs, err, want)
+	}
+
+	t.Setenv(HeartbeatTimeoutEnv, "-5s")
+	if _, _, err := parseJoinArgs([]string{"--task-name", "t"}); err == nil || !strings.Contains(err.Error(), "invalid BGX_HEARTBEAT_TIMEOUT") {
+		t.Errorf("parseJoinArgs with BGX_HEARTBEAT_TIMEOUT=-5s = %v, want an error naming it", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// killConfig holds the options for a kill.
+type killConfig struct {
+	signal os.Signal // what to send (default terminateSignal)
+	audit  bool      // record an access event in the task's log
+}
+
+// parseKillArgs parses `kill` arguments of the form:
+//
+//	--task-name NAME [--signal SIGNAL] [--audit]
+func parseKillArgs(args []string) (string, killConfig, error) {
+	var taskName string
+	cfg := killConfig{signal: terminateSignal}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--task-name":
+			if i+1 >= len(args) {
+				return "", cfg, fmt.Errorf("--task-name requires an argument")
+			}
+			taskName = args[i+1]
+			i++
+		case "--signal":
+			if i+1 >= len(args) {
+				return "", cfg, fmt.Errorf("--signal requires an argument")
+			}
+			sig, err := parseSignal(args[i+1])
+			if err != nil {
+				return "", cfg, err
+			}
+			cfg.signal = sig
+			i++
+		case "--audit":
+			cfg.audit = true
+		default:
+			return "", cfg, fmt.Errorf("unexpected argument %q\nUsage: bgx kill --task-name NAME [--signal SIGNAL] [--audit]", args[i])
+		}
+	}
+	if taskName == "" {
+		return "", cfg, fmt.Errorf("--task-name is required")
+	}
+	return taskName, cfg, nil
+}
+
+// parseSignal resolves a --signal value: a number, or a name from
+// signalNames with or without its SIG prefix, in any case ("15", "TERM",
+// "SIGTERM", "sigterm"). Numbers are passed on as they are, since what they
+// mean differs between platforms; names are looked up for this one.
+func parseSignal(spec string) (os.Signal, error) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid --signal %q: must be a positive signal number or a name such as TERM", spec)
+		}
+		return syscall.Signal(n), nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(spec), "SIG")
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	return nil, fmt.Errorf("unknown --signal %q: must be a signal number or one of %s", spec, strings.Join(signalNameOrder, ", "))
+}
+
+// runKill sends a signal to a running task's process and records a kill event
+// saying so. It returns once the signal is sent; `bgx wait` or `join` then
+// reports how the task exited.
+func runKill(args []string) error {
+	taskName, cfg, err := parseKillArgs(args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	exists, err := taskExists(db, taskName)
+	if err != nil {
+		return fmt.Errorf("failed to look up task: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("task %q not found (BGX_DB=%s)", taskName, getDBPath())
+	}
+	if cfg.audit {
+		if err := recordAccess(db, taskName, "kill"); err != nil {
+			return err
+		}
+	}
+
+	s, err := readTaskSummary(db, taskName)
+	if err != nil {
+		return fmt.Errorf("failed to read task %q: %w", taskName, err)
+	}
+	switch {
+	case !s.Started:
+		return fmt.Errorf("task %q has no process yet; nothing to kill", taskName)
+	case s.Exited:
+		return fmt.Errorf("task %q has already exited (code %d)", taskName, s.ExitCode)
+	}
+	if err := s.checkNotStalled(time.Now()); err != nil {
+		return fmt.Errorf("task %q: %w", taskName, err)
+	}
+	return signalTask(db, taskName, s.PID, cfg.signal, "bgx kill")
+}
@@ -3,15 +3,56 @@ package main
 import (
 	"fmt"
 	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
 )
 
-// Build information, set via -ldflags at release time by GoReleaser.
+// Build information, set via -ldflags at release time by GoReleaser. Where
+// they weren't set, buildInfo falls back on what Go embedded in the binary.
 var (
 	version = "dev"
 	commit  = "none"
 	date    = "unknown"
 )
 
+// buildInfo returns this build's version, commit and date. Those not set by
+// -ldflags come from the build info Go embeds: the module version for `go
+// install github.com/dtinth/bgx@v1.2.3`, and the revision (with "-dirty" for
+// uncommitted changes) and commit time for a build in a git checkout.
+func buildInfo() (v, c, d string) {
+	v, c, d = version, commit, date
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v, c, d
+	}
+	if v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v = strings.TrimPrefix(info.Main.Version, "v")
+	}
+	settings := map[string]string{}
+	for _, s := range info.Settings {
+		settings[s.Key] = s.Value
+	}
+	if rev := settings["vcs.revision"]; c == "none" && rev != "" {
+		c = rev
+		if settings["vcs.modified"] == "true" {
+			c += "-dirty"
+		}
+	}
+	if t := settings["vcs.time"]; d == "unknown" && t != "" {
+		d = t
+	}
+	return v, c, d
+}
+
+// buildID identifies this build of bgx, so a daemon can check that it is the
+// same binary as the `fork` that spawned it. Start events record it too, so
+// a task's log says which build ran it.
+func buildID() string {
+	v, c, _ := buildInfo()
+	return v + " (commit " + c + ")"
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		printUsage()
@@ -23,7 +64,9 @@ func main() {
 	switch command {
 	case "fork":
 		if err := runFork(os.Args[2:]); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			if err != errSilenced {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
 			os.Exit(1)
 		}
 	case "exec":
@@ -39,8 +82,65 @@ func main() {
 			os.Exit(1)
 		}
 		os.Exit(exitCode)
+	case "wait":
+		exitCode, err := runWait(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(exitCode)
+	case "alive":
+		exitCode, err := runAlive(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		os.Exit(exitCode)
+	case "stop":
+		exitCode, err := runStop(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		os.Exit(exitCode)
+	case "kill":
+		if err := runKill(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "pause", "resume":
+		if err := runPause(os.Args[2:], command == "resume"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "status":
+		if err := runStatus(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "export":
+		if err := runExport(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "top":
+		if err := runTop(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "verify":
+		exitCode, err := runVerify(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		os.Exit(exitCode)
+	case "doctor":
+		exitCode, err := runDoctor(os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		os.Exit(exitCode)
 	case "version", "--version", "-v":
-		fmt.Printf("bgx %s (commit %s, built %s)\n", version, commit, date)
+		v, c, d := buildInfo()
+		fmt.Printf("bgx %s (commit %s, built %s, %s %s/%s)\n", v, c, d, runtime.Version(), runtime.GOOS, runtime.GOARCH)
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
 		printUsage()
@@ -52,10 +152,24 @@ func printUsage() {
 	fmt.Fprintf(os.Stderr, `bgx - Background task executor with structured logging
 
 Usage:
-  bgx fork --task-name NAME -- COMMAND [ARGS...]
-  bgx exec --task-name NAME -- COMMAND [ARGS...]
-  bgx join --task-name NAME [--task-name NAME ...] [--group] [--timestamps]
-  bgx version
+  bgx fork --task-name NAME [options] -- COMMAND [ARGS...]
+  bgx exec --task-name NAME [options] -- COMMAND [ARGS...]
+  bgx fork --task-name NAME [options] --command-file FILE
+  bgx fork --file TASK.json [options] [-- COMMAND [ARGS...]]
+  bgx join --task-name NAME [--task-name NAME ...] [options]
+  bgx join --input-file PATH [--task-name NAME ...] [options]
+  bgx wait --task-name NAME [--timeout DURATION [--on-timeout return|kill]] [--audit] [--result-file PATH]
+  bgx kill --task-name NAME [--signal SIGNAL] [--audit]
+  bgx stop --task-name NAME [--task-name NAME ...] | --all [--timeout DURATION] [--audit]
+  bgx pause --task-name NAME [--audit]
+  bgx resume --task-name NAME [--audit]
+  bgx alive --task-name NAME [--within DURATION]
+  bgx status --task-name NAME [--json] [--peek N]
+  bgx export --task-name NAME [--format txt|html] [--merge]
+  bgx top [--watch] [--sort name|start|cpu|mem|status] [--reverse]
+  bgx verify --task-name NAME
+  bgx doctor
+  bgx version | --version
 
 Commands:
   fork    Run COMMAND in the background and record it; returns immediately.
@@ -63,11 +177,213 @@ Commands:
           recording it; exits with the command's exit code.
   join    Replay a task's recorded output and exit with its exit code,
           waiting for the task to finish if it is still running.
+  wait    Wait for a task to exit, without replaying its output, and exit
+          with its exit code. With --timeout, give up after DURATION (e.g.
+          30s, 5m; 0 for never) with exit code 124, first terminating the task if
+          --on-timeout kill is given. --audit records who waited, and
+          --result-file writes the outcome, as for join.
+  kill    Send a running task's process SIGNAL (default TERM; on Windows it
+          is terminated), as a number or name such as 9, KILL, or SIGKILL,
+          and record a kill event. --audit records who killed it.
+  stop    Shut tasks down (every task that hasn't exited, with --all) and
+          wait for them: TERM, then KILL once --timeout (default 10s) has
+          passed. Prints how each ended; exits 1 if any couldn't be stopped.
+  pause   Stop a running task's process (SIGSTOP) and record a pause event;
+          status shows it as paused until resume. Not on Windows.
+  resume  Continue a paused task's process (SIGCONT), recording a resume
+          event.
+  alive   Exit 0 if a task is running and recorded an event (such as a
+          heartbeat) within DURATION (default 15s), or 1 if it has exited
+          or gone quiet; for health checks.
+  status  Show a task's state, command, and recorded start/end and duration;
+          --json prints it as a JSON object. --peek N adds the last N lines
+          of output.
+  export  Write a task's output to stdout as a transcript with a header
+          (command, start and end time, exit code): plain text, or with
+          --format html a self-contained page keeping ANSI colors. stdout
+          and stderr come one after the other, or interleaved with --merge.
+  top     Show the latest CPU and memory of every task that hasn't exited,
+          with totals; --watch refreshes every heartbeat interval. Newest
+          first, or --sort by name, cpu, mem (highest first) or status;
+          --reverse flips the order.
+  verify  Check the HMAC chain of a task forked with --sign and report the
+          first altered, inserted, or missing event.
+  doctor  Check the database location, process stats, clock, and for stale
+          tasks; exits non-zero if anything is broken.
+  version Print the bgx version, commit, build date and Go version (also
+          --version). Each task's start event records the version that ran
+          it, as bgx_version.
+
+Fork/exec options:
+  --command-file FILE
+                 Read the command and its arguments from FILE, one per line,
+                 instead of after --. With --shell, FILE is the script itself.
+  --file TASK.json
+                 Read the task name, command and options from a JSON task
+                 definition (YAML and TOML aren't supported); flags given
+                 here override it (see the README).
+  --shell        Run the command as a script: its arguments, joined with spaces,
+                 are passed to $SHELL -c (or sh -c if SHELL is unset).
+  --shell-path PATH
+                 Use this shell for --shell instead of $SHELL (implies --shell).
+  --interpreter "PROG ARGS"
+                 Run the script with PROG ARGS instead of a shell, e.g.
+                 "python3 -c" (implies --shell; split on spaces, no quoting).
+  --env KEY=VALUE
+                 Set an environment variable for the command; repeatable.
+  --env-clear    Don't pass bgx's environment on: the command gets only PATH,
+                 HOME and the --env assignments.
+  --user USER, --group GROUP
+                 Run the command as this user and group (names or numbers;
+                 --user alone uses the user's primary group). Needs bgx to
+                 run as root; not supported on Windows.
+  --expand       Expand $VAR and ${VAR} in the command's arguments (as Go's
+                 os.ExpandEnv does; there is no shell). Unset variables
+                 expand to nothing.
+  --overwrite-if-exited
+                 If the task name is taken by a task that has exited, delete
+                 that task's log and reuse the name; a running task is never
+                 replaced.
+  --sync         Fsync every recorded event, not just the final exit event
+                 (slower; see "Durability" in the README).
+  --sync-every N Fsync every Nth event instead, so that a power loss loses at
+                 most the last N.
+  --sink URL     Also stream events as NDJSON to a collector at tcp://HOST:PORT
+                 or unix:///PATH, or append them to file:///PATH; repeatable.
+                 The database stays the complete record.
+  --heartbeat    Record heartbeats (the default), overriding BGX_NO_HEARTBEAT
+                 or a --file definition's no_heartbeat.
+  --no-heartbeat Don't record heartbeats (no CPU/memory samples). join then
+                 waits for the exit event however long the task is silent.
+  --heartbeat-adaptive
+                 While the command is quiet (no output, no CPU use, steady
+                 memory), double the gap between heartbeats up to 5m; any
+                 activity returns to every 5s. join and status allow for it.
+  --heartbeat-touch
+                 Touch a heartbeat file beside the database instead of
+                 recording heartbeat events; join and status count a touch as
+                 an event. The exit event still has the CPU and memory totals.
+  --io-stats     Also record the command's storage I/O (read_bytes and
+                 write_bytes from /proc/PID/io, Linux only) in heartbeats.
+  --no-proc-stats
+                 Don't sample CPU and memory from /proc: heartbeats only mark
+                 the task alive, for where those reads fail or are unwanted.
+  --mem-metric rss|pss
+                 Sample memory as RSS (default) or, on Linux, as PSS from
+                 /proc/PID/smaps_rollup, which splits shared pages among the
+                 processes mapping them. Falls back to RSS if unavailable.
+  --sign         Chain an HMAC-SHA256, keyed by $BGX_SIGN_KEY, through every
+                 event so that 'bgx verify' can detect tampering.
+  --max-event-bytes N
+                 Record output lines longer than N bytes (default 1048576) as
+                 several events; join replays them back to back.
+  --delimiter D  End each recorded event at byte D instead of a newline: \0
+                 for NUL-delimited output, or any single byte or escape.
+  --coalesce-window DURATION
+                 Record the lines a stream writes within DURATION of each other
+                 as one event instead of one event per line.
+  --strip-ansi   Remove ANSI escape sequences (colors, cursor movement,
+                 titles) from the output before recording it.
+  --max-events N Kill the command once it has written N stdout/stderr events,
+                 recording a limit-exceeded event that join reports.
+  --max-total-bytes N
+                 Stop recording output once N bytes of stdout/stderr have
+                 been recorded, with a truncated event that join reports; the
+                 command keeps running.
+  --idle-timeout DURATION
+                 Kill the command if it writes no stdout/stderr for DURATION,
+                 recording an idle-timeout event that join reports.
+  --wait-file PATH
+                 Record a ready event once PATH exists; fork waits for it and
+                 fails if the task exits first or PATH doesn't appear in time.
+  --wait-timeout DURATION
+                 How long fork --wait-file waits (default 30s).
+  --detach-log-level silent|error|info|debug
+                 How much fork itself prints on stderr (default info): debug
+                 adds the daemon's command line, environment and pid; error
+                 prints only errors, and silent nothing at all. fork only.
+  --inherit-fd N Pass open descriptor N (3 or more) on to the command; repeatable.
+                 The command receives them in order as fd 3, 4, and so on.
+  --capture-fd N Also record what the command writes to its descriptor N (3 or
+                 more) as fd events; repeatable. join --fd N replays them.
+  --log-types TYPES
+                 Persist only these event types (comma-separated: stdout,
+                 stderr, heartbeat, error). start and exit are always recorded.
 
 Join options:
   --group        Wrap each task's output in a GitHub Actions ::group:: block
                  (drains tasks sequentially so each group stays contiguous).
   --timestamps   Prefix each output line with the event's recorded time.
+  --tag-lines    Prefix each output line with its event's id and stream, as
+                 "12:O:" (O stdout, E stderr, or the --fd number).
+  --tag-format SEP
+                 Separate the --tag-lines fields with SEP instead of ":".
+  --success-codes CODES
+                 Exit 0 if a task's exit code is in CODES (e.g. 0,1 or 0-2),
+                 instead of only for 0. Other codes pass through unchanged.
+  --invert       Flip success and failure (a task exiting 0 fails the join).
+  --color WHEN   Color stderr red and dim timestamps/prefixes: auto (default;
+                 only on a terminal, unless NO_COLOR is set), always, never.
+  --replay-speed N
+                 Replay at the recorded pace, N times faster (1 = real time).
+  --linger DURATION
+                 Keep replaying output recorded up to DURATION after the exit
+                 event, before exiting with the task's code.
+  --heartbeat-timeout DURATION
+                 Give up on a task with no events for DURATION (default 30s).
+  --warmup DURATION
+                 Don't give up on a task in the first DURATION after attaching,
+                 for tasks slow to start; the timeout then runs in full.
+  --max-event-bytes N
+                 Fail rather than load an event with more than N bytes of data
+                 (default 1048576; 0 for no limit).
+  --audit        Record an access event ("join by USER") in each task's log,
+                 for an audit trail of who looked at or acted on it.
+  --checkpoint FILE
+                 Resume after the events an earlier join with this FILE
+                 replayed, and save progress to it as events are read.
+  --input-file PATH
+                 Replay a log saved as NDJSON (by --sink file:// or --output
+                 json) instead of BGX_DB's tasks; --task-name is optional, and
+                 picks tasks from the file.
+  --output FORMAT
+                 text (default) replays the output; json, csv and logfmt write
+                 one record per event (heartbeats aside) to stdout instead.
+  --fields FIELDS
+                 Fields of each record, in order (comma-separated from task, id,
+                 time, type, fd, data, code, exit_reason; default
+                 task,time,type,data,code).
+  --print-exit FD
+                 After replay, write exit=<code> to descriptor FD (with several
+                 tasks, one "task=NAME exit=<code>" line each).
+  --timeout DURATION
+                 Give up on a task that hasn't exited DURATION after join
+                 began following it, counting it as failed with code 124
+                 (0: no timeout, overriding BGX_TIMEOUT).
+  --summary      After replay, print each task's exit code, duration, and
+                 output size (lines and bytes per stream) to stderr, as a
+                 table when joining several tasks.
+  --result-file PATH
+                 After replay, write each task's outcome to PATH as JSON: its
+                 status --json object plus "timed_out" (an array of them when
+                 joining several tasks). The file is replaced atomically.
+  --grep REGEX, --grep-v REGEX
+                 Replay only output lines matching (or, with --grep-v, not
+                 matching) the Go regular expression; the exit code is kept.
+  --show-heartbeats
+                 Print each heartbeat's CPU and memory sample to stderr, as
+                 "[heartbeat] cpu=1.20s mem=45.0MiB" (updated in place on a
+                 terminal when joining one task).
+  --graph        Joining one task with stderr on a terminal, draw sparklines
+                 of its CPU use and memory over the last 30 heartbeats below
+                 the output, updated in place; elsewhere ignored.
+  --stdout-file PATH, --stderr-file PATH
+                 Write the replayed stdout or stderr to PATH (created or
+                 truncated) instead of the terminal; - means the terminal.
+  --fd N         Also replay output captured with fork --capture-fd N, to
+                 stderr with each line labeled [fd N]; repeatable.
+  --host HOST    Join the task on HOST instead, by running bgx join there over
+                 ssh; bgx must be installed on HOST.
 
 Example:
   bgx fork --task-name build -- make build
@@ -80,6 +396,15 @@ Joining several tasks waits for all of them and fails if any did.
 
 Environment:
   BGX_DB    Path to the shared database (default: <tmpdir>/bgx.db)
+  BGX_SIGN_KEY
+            Secret for --sign and verify (never passed on to the task)
+  BGX_SSH   Command join --host connects with (default: ssh)
+  BGX_TIMEOUT, BGX_HEARTBEAT_TIMEOUT
+            Defaults for join's --timeout and --heartbeat-timeout (and wait's
+            --timeout) where the flag isn't given, as durations such as 10m
+  BGX_NO_HEARTBEAT
+            1 to fork and exec with --no-heartbeat by default, unless
+            --heartbeat, --heartbeat-adaptive or --heartbeat-touch is given
 
 Configuration:
   Heartbeat interval: 5s
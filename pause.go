@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// pauseConfig holds the options for a pause or resume.
+type pauseConfig struct {
+	audit bool // record an access event in the task's log
+}
+
+// parsePauseArgs parses `pause` and `resume` arguments of the form:
+//
+//	--task-name NAME [--audit]
+func parsePauseArgs(command string, args []string) (string, pauseConfig, error) {
+	var taskName string
+	var cfg pauseConfig
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--task-name":
+			if i+1 >= len(args) {
+				return "", cfg, fmt.Errorf("--task-name requires an argument")
+			}
+			taskName = args[i+1]
+			i++
+		case "--audit":
+			cfg.audit = true
+		default:
+			return "", cfg, fmt.Errorf("unexpected argument %q\nUsage: bgx %s --task-name NAME [--audit]", args[i], command)
+		}
+	}
+	if taskName == "" {
+		return "", cfg, fmt.Errorf("--task-name is required")
+	}
+	return taskName, cfg, nil
+}
+
+// runPause stops a running task's process with pauseSignal, or with resume
+// continues it with resumeSignal, recording a pause or resume event; status
+// reports the task as paused in between. Pausing a task that is already
+// paused, or resuming one that isn't, is an error, as is either for a task
+// that has exited.
+func runPause(args []string, resume bool) error {
+	command, eventType, sig := "pause", EventTypePause, pauseSignal
+	if resume {
+		command, eventType, sig = "resume", EventTypeResume, resumeSignal
+	}
+	taskName, cfg, err := parsePauseArgs(command, args)
+	if err != nil {
+		return err
+	}
+	if sig == nil {
+		return errNoPause
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	exists, err := taskExists(db, taskName)
+	if err != nil {
+		return fmt.Errorf("failed to look up task: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("task %q not found (BGX_DB=%s)", taskName, getDBPath())
+	}
+	if cfg.audit {
+		if err := recordAccess(db, taskName, command); err != nil {
+			return err
+		}
+	}
+
+	s, err := readTaskSummary(db, taskName)
+	if err != nil {
+		return fmt.Errorf("failed to read task %q: %w", taskName, err)
+	}
+	switch {
+	case !s.Started:
+		return fmt.Errorf("task %q has no process yet; nothing to %s", taskName, command)
+	case s.Exited:
+		return fmt.Errorf("task %q has already exited (code %d)", taskName, s.ExitCode)
+	}
+	if err := s.checkNotStalled(time.Now()); err != nil {
+		return fmt.Errorf("task %q: %w", taskName, err)
+	}
+	switch {
+	case s.Paused && !resume:
+		return fmt.Errorf("task %q is already paused", taskName)
+	case !s.Paused && resume:
+		return fmt.Errorf("task %q isn't paused", taskName)
+	}
+	if err := pauseTask(db, taskName, s.PID, eventType, sig); err != nil {
+		return err
+	}
+	if resume {
+		fmt.Printf("Task '%s' resumed\n", taskName)
+	} else {
+		fmt.Printf("Task '%s' paused; to continue it: bgx resume --task-name %s\n", taskName, taskName)
+	}
+	return nil
+}
+
+// pauseTask records a pause or resume event, then sends the task's process
+// group sig, so that a child the command started is paused too. As with
+// signalTask, the event comes first so that it precedes an exit
+// event; a task that has exited is never reported as paused.
+func pauseTask(db *sql.DB, taskName string, pid int, eventType string, sig os.Signal) error {
+	if err := insertEvent(db, taskName, Event{
+		Type: eventType,
+		Time: time.Now(),
+		Data: fmt.Sprintf("bgx %s (signal: %v)", eventType, sig),
+	}); err != nil {
+		return fmt.Errorf("failed to record %s event: %w", eventType, err)
+	}
+	if err := signalGroup(pid, sig); err != nil {
+		return fmt.Errorf("failed to signal process %d: %w", pid, err)
+	}
+	return nil
+}
+
+// errNoPause is returned by pause and resume where there are no job-control
+// signals to send.
+var errNoPause = errors.New("pause and resume are not supported on Windows")
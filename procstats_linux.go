@@ -3,39 +3,171 @@
 package main
 
 import (
+	"cmp"
+	"encoding/binary"
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 )
 
+// defaultClockTicks is the CLK_TCK that Linux reports on nearly every
+// configuration, used where the real value can't be read.
+const defaultClockTicks = 100
+
+// atClockTicks is the auxiliary vector entry (AT_CLKTCK) through which the
+// kernel tells every process the tick rate of the CPU times in /proc.
+const atClockTicks = 17
+
+// clockTicks returns the kernel's CLK_TCK, read once from /proc/self/auxv:
+// the value sysconf(_SC_CLK_TCK) returns in C, without needing cgo.
+var clockTicks = sync.OnceValue(func() uint64 {
+	data, err := os.ReadFile("/proc/self/auxv")
+	if err != nil {
+		return defaultClockTicks
+	}
+	if ticks, ok := parseAuxvClockTicks(data, strconv.IntSize/8); ok {
+		return ticks
+	}
+	return defaultClockTicks
+})
+
+// parseAuxvClockTicks finds AT_CLKTCK in the contents of /proc/self/auxv: a
+// list of (type, value) pairs of native words, wordSize bytes each, ending
+// with a zero type.
+func parseAuxvClockTicks(auxv []byte, wordSize int) (uint64, bool) {
+	word := func(b []byte) uint64 {
+		if wordSize == 4 {
+			return uint64(binary.NativeEndian.Uint32(b))
+		}
+		return binary.NativeEndian.Uint64(b)
+	}
+	for len(auxv) >= 2*wordSize {
+		typ, value := word(auxv), word(auxv[wordSize:])
+		auxv = auxv[2*wordSize:]
+		switch {
+		case typ == 0:
+			return 0, false
+		case typ == atClockTicks && value > 0:
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// procDir is where the process stats are read from; tests point it at a
+// directory of their own making.
+var procDir = "/proc"
+
 // getProcessStats reads CPU time and resident memory for a pid from /proc.
-// Returns zero values when the information is unavailable.
-func getProcessStats(pid int) (cpuSeconds float64, memBytes int64) {
-	if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
-		cpuSeconds, _ = parseStatCPU(string(data))
+// Whatever can't be read is zero, and err says why; it wraps fs.ErrNotExist
+// once the process is gone.
+func getProcessStats(pid int) (cpuSeconds float64, memBytes int64, err error) {
+	statPath := fmt.Sprintf("%s/%d/stat", procDir, pid)
+	data, statErr := os.ReadFile(statPath)
+	if statErr == nil {
+		var ok bool
+		if cpuSeconds, ok = parseStatCPU(string(data), clockTicks()); !ok {
+			statErr = fmt.Errorf("unexpected contents of %s: %q", statPath, data)
+		}
 	}
 
-	statmData, err := os.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	statmPath := fmt.Sprintf("%s/%d/statm", procDir, pid)
+	statmData, err := os.ReadFile(statmPath)
 	if err != nil {
-		return cpuSeconds, 0
+		return cpuSeconds, 0, cmp.Or(statErr, err)
 	}
+	unexpected := fmt.Errorf("unexpected contents of %s: %q", statmPath, statmData)
 	statmFields := strings.Fields(string(statmData))
 	if len(statmFields) < 2 {
-		return cpuSeconds, 0
+		return cpuSeconds, 0, cmp.Or(statErr, unexpected)
+	}
+	resident, err := strconv.ParseUint(statmFields[1], 10, 64)
+	if err != nil {
+		return cpuSeconds, 0, cmp.Or(statErr, unexpected)
 	}
-	resident, _ := strconv.ParseUint(statmFields[1], 10, 64)
 	memBytes = int64(resident) * int64(syscall.Getpagesize())
-	return cpuSeconds, memBytes
+	return cpuSeconds, memBytes, statErr
+}
+
+// getProcessPSS reads a pid's proportional set size from
+// /proc/<pid>/smaps_rollup for --mem-metric pss. ok is false where that file
+// can't be read: on kernels before 4.14, or without ptrace access to the pid.
+func getProcessPSS(pid int) (pssBytes int64, ok bool) {
+	data, err := os.ReadFile(fmt.Sprintf("%s/%d/smaps_rollup", procDir, pid))
+	if err != nil {
+		return 0, false
+	}
+	return parseSmapsPSS(string(data))
+}
+
+// parseSmapsPSS extracts the "Pss:" total, in kB, from the contents of
+// /proc/<pid>/smaps_rollup, returning it in bytes. Only that exact field
+// counts; the kernel also reports breakdowns such as Pss_Anon.
+func parseSmapsPSS(smaps string) (int64, bool) {
+	for _, line := range strings.Split(smaps, "\n") {
+		value, ok := strings.CutPrefix(line, "Pss:")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) != 2 || fields[1] != "kB" {
+			return 0, false
+		}
+		kb, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return kb * 1024, true
+	}
+	return 0, false
+}
+
+// getProcessIO reads the bytes a pid has caused to be read from and written to
+// storage, from /proc/<pid>/io. That file is only readable with ptrace access
+// to the process, so where bgx lacks it (or the kernel lacks I/O accounting)
+// both counts are zero.
+func getProcessIO(pid int) (readBytes, writeBytes int64) {
+	data, err := os.ReadFile(fmt.Sprintf("%s/%d/io", procDir, pid))
+	if err != nil {
+		return 0, 0
+	}
+	return parseProcIO(string(data))
+}
+
+// parseProcIO extracts read_bytes and write_bytes from the contents of
+// /proc/<pid>/io, a list of "name: value" lines. Missing or malformed values
+// are zero.
+func parseProcIO(io string) (readBytes, writeBytes int64) {
+	for _, line := range strings.Split(io, "\n") {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch name {
+		case "read_bytes":
+			readBytes = n
+		case "write_bytes":
+			writeBytes = n
+		}
+	}
+	return readBytes, writeBytes
 }
 
 // parseStatCPU extracts cumulative CPU seconds (utime + stime) from the
-// contents of /proc/<pid>/stat. The comm field (field 2) is wrapped in
+// contents of /proc/<pid>/stat, which counts them in ticks of the given
+// rate. The comm field (field 2) is wrapped in
 // parentheses and may itself contain spaces or parentheses, so we split on the
 // last ')' rather than on whitespace. Counting from the state field that
 // follows comm, utime and stime are at indices 11 and 12.
-func parseStatCPU(stat string) (float64, bool) {
+func parseStatCPU(stat string, ticks uint64) (float64, bool) {
 	rparen := strings.LastIndexByte(stat, ')')
 	if rparen < 0 || rparen+2 >= len(stat) {
 		return 0, false
@@ -49,6 +181,70 @@ func parseStatCPU(stat string) (float64, bool) {
 	if err1 != nil || err2 != nil {
 		return 0, false
 	}
-	const clockTicks = 100 // typical CLK_TCK on Linux
-	return float64(utime+stime) / clockTicks, true
+	return float64(utime+stime) / float64(ticks), true
+}
+
+// cgroupDir is where cgroup filesystems are mounted; tests point it at a
+// fake tree.
+var cgroupDir = "/sys/fs/cgroup"
+
+// oomKillsPath returns the file that counts OOM kills in pid's memory cgroup:
+// memory.events under cgroup v2, or memory.oom_control under v1's memory
+// controller (the oom_kill line needs Linux 4.13). It is "" where neither can
+// be found, such as in a container that doesn't mount the cgroup filesystem.
+func oomKillsPath(pid int) string {
+	data, err := os.ReadFile(fmt.Sprintf("%s/%d/cgroup", procDir, pid))
+	if err != nil {
+		return ""
+	}
+	for _, candidate := range oomKillsCandidates(string(data)) {
+		if _, ok := readOOMKills(candidate); ok {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// oomKillsCandidates lists where the OOM kill count may be, given the
+// contents of /proc/<pid>/cgroup: lines of "ID:CONTROLLERS:PATH", where v2's
+// unified hierarchy has ID 0 and no controllers. v2 is mounted at cgroupDir,
+// or at cgroupDir/unified beside v1's controllers.
+func oomKillsCandidates(cgroup string) []string {
+	var paths []string
+	for _, line := range strings.Split(cgroup, "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		switch path := parts[2]; {
+		case parts[0] == "0" && parts[1] == "":
+			paths = append(paths, cgroupDir+path+"/memory.events", cgroupDir+"/unified"+path+"/memory.events")
+		case slices.Contains(strings.Split(parts[1], ","), "memory"):
+			paths = append(paths, cgroupDir+"/memory"+path+"/memory.oom_control")
+		}
+	}
+	return paths
+}
+
+// readOOMKills returns the oom_kill count in a memory.events or
+// memory.oom_control file, and whether there was one.
+func readOOMKills(path string) (int64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	return parseOOMKills(string(data))
+}
+
+// parseOOMKills extracts the oom_kill count from lines of "name value".
+func parseOOMKills(events string) (int64, bool) {
+	for _, line := range strings.Split(events, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "oom_kill" {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		return n, err == nil
+	}
+	return 0, false
 }
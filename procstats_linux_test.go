@@ -2,7 +2,13 @@
 
 package main
 
-import "testing"
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
 
 func TestParseStatCPU(t *testing.T) {
 	// Fields after comm: state ppid pgrp session tty_nr tpgid flags minflt
@@ -53,7 +59,7 @@ func TestParseStatCPU(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, ok := parseStatCPU(tt.stat)
+			got, ok := parseStatCPU(tt.stat, 100)
 			if ok != tt.ok {
 				t.Fatalf("ok = %v, want %v", ok, tt.ok)
 			}
@@ -63,3 +69,206 @@ func TestParseStatCPU(t *testing.T) {
 		})
 	}
 }
+
+// TestParseStatCPUTickRate verifies CPU ticks are converted at the kernel's
+// rate rather than an assumed 100 per second.
+func TestParseStatCPUTickRate(t *testing.T) {
+	stat := "4242 (bash) S 1 2 3 4 5 6 7 8 9 10 600 150 0 0"
+	for ticks, want := range map[uint64]float64{100: 7.5, 250: 3.0, 1000: 0.75} {
+		if got, ok := parseStatCPU(stat, ticks); !ok || got != want {
+			t.Errorf("parseStatCPU at %d ticks/s = %v, %v; want %v", ticks, got, ok, want)
+		}
+	}
+}
+
+// TestParseAuxvClockTicks verifies AT_CLKTCK is found among the auxiliary
+// vector's entries in both word sizes, and that a vector without it (or one
+// cut short) reports nothing.
+func TestParseAuxvClockTicks(t *testing.T) {
+	auxv := func(wordSize int, pairs ...uint64) []byte {
+		var b []byte
+		for _, v := range pairs {
+			if wordSize == 4 {
+				b = binary.NativeEndian.AppendUint32(b, uint32(v))
+			} else {
+				b = binary.NativeEndian.AppendUint64(b, v)
+			}
+		}
+		return b
+	}
+	for _, wordSize := range []int{4, 8} {
+		data := auxv(wordSize, 6, 4096, atClockTicks, 250, 0, 0)
+		if got, ok := parseAuxvClockTicks(data, wordSize); !ok || got != 250 {
+			t.Errorf("%d-byte words: got %d, %v; want 250", wordSize, got, ok)
+		}
+		for _, data := range [][]byte{
+			auxv(wordSize, 6, 4096, 0, 0, atClockTicks, 250),
+			auxv(wordSize, 6, 4096, atClockTicks)[:3*wordSize],
+			nil,
+		} {
+			if got, ok := parseAuxvClockTicks(data, wordSize); ok {
+				t.Errorf("%d-byte words: %x gave %d, want nothing", wordSize, data, got)
+			}
+		}
+	}
+	if ticks := clockTicks(); ticks == 0 || ticks != clockTicks() {
+		t.Errorf("clockTicks() = %d, want the same nonzero rate on every call", ticks)
+	}
+}
+
+func TestParseProcIO(t *testing.T) {
+	io := "rchar: 4096\nwchar: 8192\nsyscr: 3\nsyscw: 2\nread_bytes: 512\nwrite_bytes: 1048576\ncancelled_write_bytes: 0\n"
+	if r, w := parseProcIO(io); r != 512 || w != 1048576 {
+		t.Errorf("parseProcIO = %d, %d, want 512, 1048576", r, w)
+	}
+	if r, w := parseProcIO("garbage\nwrite_bytes: x\n"); r != 0 || w != 0 {
+		t.Errorf("parseProcIO on garbage = %d, %d, want 0, 0", r, w)
+	}
+}
+
+func TestParseSmapsPSS(t *testing.T) {
+	rollup := "55d0c7a4e000-7ffd2b3f1000 ---p 00000000 00:00 0                          [rollup]\n" +
+		"Rss:                5120 kB\nPss:                2048 kB\nPss_Anon:           1024 kB\nPss_File:           1024 kB\n"
+	if pss, ok := parseSmapsPSS(rollup); !ok || pss != 2048*1024 {
+		t.Errorf("parseSmapsPSS = %d, %v, want %d, true", pss, ok, 2048*1024)
+	}
+	for _, bad := range []string{"", "Rss: 5120 kB\n", "Pss_Anon: 1024 kB\n", "Pss: x kB\n", "Pss: 2048\n"} {
+		if pss, ok := parseSmapsPSS(bad); ok {
+			t.Errorf("parseSmapsPSS(%q) = %d, true; want not ok", bad, pss)
+		}
+	}
+}
+
+// TestGetProcessPSS verifies PSS is read for a live process where the kernel
+// provides smaps_rollup, and that it doesn't exceed the process's RSS.
+func TestGetProcessPSS(t *testing.T) {
+	if _, err := os.Stat("/proc/self/smaps_rollup"); err != nil {
+		t.Skipf("smaps_rollup unavailable: %v", err)
+	}
+	pss, ok := getProcessPSS(os.Getpid())
+	if !ok || pss <= 0 {
+		t.Fatalf("getProcessPSS = %d, %v; want a positive size", pss, ok)
+	}
+	if _, rss, _ := getProcessStats(os.Getpid()); pss > rss {
+		t.Errorf("PSS %d should not exceed RSS %d", pss, rss)
+	}
+}
+
+// TestProcSamplerError verifies a stats read failure is recorded as an error
+// event when it starts, once per streak, while a process that is gone is not
+// treated as a failure.
+func TestProcSamplerError(t *testing.T) {
+	t.Setenv("BGX_DB", filepath.Join(t.TempDir(), "bgx.db"))
+	db, err := openDB()
+	if err != nil {
+		t.Fatalf("openDB: %v", err)
+	}
+	defer db.Close()
+
+	dir := t.TempDir()
+	defer func(saved string) { procDir = saved }(procDir)
+	procDir = dir
+	pidDir := filepath.Join(dir, "42")
+	writeStats := func(stat string) {
+		t.Helper()
+		if err := os.MkdirAll(pidDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(pidDir, "stat"), []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(pidDir, "statm"), []byte("100 25 0 0 0 0 0\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	good := "42 (sleep) S 1 2 3 4 5 6 7 8 9 10 200 100 0 0"
+
+	p := &procSampler{rec: newRecorder(db, "proc", forkConfig{}), pid: 42}
+	writeStats("garbage")
+	if _, mem := p.sample(); mem != 25*int64(os.Getpagesize()) {
+		t.Errorf("Memory = %d, want the statm figure despite the bad stat", mem)
+	}
+	p.sample()
+	writeStats(good)
+	if cpu, _ := p.sample(); cpu != 3 {
+		t.Errorf("CPU = %v after recovery, want 3", cpu)
+	}
+	writeStats("garbage")
+	p.sample()
+	os.RemoveAll(pidDir) // the process is gone
+	p.sample()
+	p.sample()
+
+	events, err := readEventsAfter(db, "proc", 0, 0)
+	if err != nil {
+		t.Fatalf("readEventsAfter: %v", err)
+	}
+	var problems []string
+	for _, e := range events {
+		if e.Type == EventTypeError {
+			problems = append(problems, e.Data)
+		}
+	}
+	if len(problems) != 2 {
+		t.Fatalf("Recorded %d error events, want one per failing streak: %q", len(problems), problems)
+	}
+	for _, msg := range problems {
+		if !strings.Contains(msg, "unexpected contents of "+filepath.Join(pidDir, "stat")) {
+			t.Errorf("Error event %q should name the file that couldn't be read", msg)
+		}
+	}
+}
+
+// TestOOMKillsPath verifies the OOM kill count is found in a process's memory
+// cgroup under cgroup v2, at either mount point, and under v1, and that
+// there's no path where none of the files exist.
+func TestOOMKillsPath(t *testing.T) {
+	root := t.TempDir()
+	oldProc, oldCgroup := procDir, cgroupDir
+	procDir, cgroupDir = filepath.Join(root, "proc"), filepath.Join(root, "cgroup")
+	t.Cleanup(func() { procDir, cgroupDir = oldProc, oldCgroup })
+	write := func(path, contents string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v2 := "low 0\nhigh 0\nmax 3\noom 2\noom_kill 2\noom_group_kill 0\n"
+	v1 := "oom_kill_disable 0\nunder_oom 0\noom_kill 5\n"
+	write(filepath.Join(procDir, "1", "cgroup"), "0::/jobs/a\n")
+	write(filepath.Join(cgroupDir, "jobs", "a", "memory.events"), v2)
+	write(filepath.Join(procDir, "2", "cgroup"), "4:memory:/jobs/b\n1:name=systemd:/jobs/b\n0::/jobs/b\n")
+	write(filepath.Join(cgroupDir, "memory", "jobs", "b", "memory.oom_control"), v1)
+	write(filepath.Join(procDir, "3", "cgroup"), "0::/jobs/c\n")
+	write(filepath.Join(cgroupDir, "unified", "jobs", "c", "memory.events"), v2)
+	write(filepath.Join(procDir, "4", "cgroup"), "3:cpu,cpuacct:/jobs/d\n0::/jobs/d\n")
+
+	tests := []struct {
+		pid  int
+		path string
+		want int64
+	}{
+		{1, filepath.Join(cgroupDir, "jobs", "a", "memory.events"), 2},
+		{2, filepath.Join(cgroupDir, "memory", "jobs", "b", "memory.oom_control"), 5},
+		{3, filepath.Join(cgroupDir, "unified", "jobs", "c", "memory.events"), 2},
+		{4, "", 0},
+		{5, "", 0}, // no such process
+	}
+	for _, tt := range tests {
+		path := oomKillsPath(tt.pid)
+		if path != tt.path {
+			t.Errorf("oomKillsPath(%d) = %q, want %q", tt.pid, path, tt.path)
+			continue
+		}
+		if n, ok := readOOMKills(path); n != tt.want || ok != (tt.path != "") {
+			t.Errorf("readOOMKills(%q) = %d, %v; want %d", path, n, ok, tt.want)
+		}
+	}
+
+	if _, ok := parseOOMKills("oom 1\noom_kill lots\n"); ok {
+		t.Errorf("parseOOMKills should reject a count that isn't a number")
+	}
+}
@@ -4,7 +4,33 @@ package main
 
 // getProcessStats reports CPU time and resident memory for a pid. Resource
 // monitoring reads /proc, which only exists on Linux, so on other platforms
-// (macOS, Windows) it reports zero and heartbeats simply carry no stats.
-func getProcessStats(pid int) (cpuSeconds float64, memBytes int64) {
+// (macOS, Windows) it reports zero and heartbeats simply carry no stats. That
+// is expected, so it is not an error.
+func getProcessStats(pid int) (cpuSeconds float64, memBytes int64, err error) {
+	return 0, 0, nil
+}
+
+// getProcessIO reports a pid's storage I/O for --io-stats, which like the
+// other stats comes from /proc: on other platforms it is always zero.
+func getProcessIO(pid int) (readBytes, writeBytes int64) {
 	return 0, 0
 }
+
+// getProcessPSS reports a pid's proportional set size for --mem-metric pss.
+// It comes from /proc/<pid>/smaps_rollup, so elsewhere it is never available
+// and heartbeats fall back to RSS (which is zero here too).
+func getProcessPSS(pid int) (pssBytes int64, ok bool) {
+	return 0, false
+}
+
+// oomKillsPath returns the file that counts OOM kills in pid's memory cgroup.
+// cgroups are Linux's, so elsewhere there is none, and an OOM kill looks like
+// any other SIGKILL.
+func oomKillsPath(pid int) string {
+	return ""
+}
+
+// readOOMKills returns the oom_kill count in path; see oomKillsPath.
+func readOOMKills(path string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// recorder writes one task's events: to the shared database, which is the
+// durable record `join` reads, and to any --sink collectors.
+type recorder struct {
+	db    *sql.DB
+	task  string
+	cfg   forkConfig
+	sinks []*sink // one per --sink, in the order given
+
+	// problems holds errors yet to be recorded as error events: sink
+	// failures, which arise while an event is being inserted.
+	problems []error
+
+	signer *signer // nil unless --sign was given
+
+	outputEvents int    // stdout/stderr/fd events recorded, for --max-events
+	stop         func() // called when --max-events is reached
+
+	outputBytes int  // stdout/stderr/fd data recorded, for --max-total-bytes
+	truncated   bool // --max-total-bytes was reached: output is dropped
+
+	stored int // events stored, for --sync-every
+
+	// exited is set once the exit event is stored: it is the task's last
+	// event, which join and wait rely on, so nothing is recorded after it.
+	exited bool
+
+	// setSync switches the database's commits between fsynced and not
+	// (setSynchronous; tests replace it to count syncs).
+	setSync func(db *sql.DB, full bool) error
+
+	now  func() time.Time // the clock events are stamped with (time.Now; tests replace it)
+	last time.Time        // the previous event's time, which no later event precedes
+
+	// mu serializes writes so that every sink sees events in the same order as
+	// the database, and the HMAC chain follows that order too. (The database's
+	// single connection would serialize inserts on its own, but not the rest.)
+	mu sync.Mutex
+}
+
+// newRecorder returns a recorder for taskName configured from cfg. A sink
+// that cannot be reached yet is not an error: it is retried as events arrive,
+// and the other sinks are unaffected.
+func newRecorder(db *sql.DB, taskName string, cfg forkConfig) *recorder {
+	rec := &recorder{db: db, task: taskName, cfg: cfg, now: time.Now, setSync: setSynchronous}
+	for _, spec := range cfg.sinks {
+		s, err := newSink(spec)
+		rec.sinks = append(rec.sinks, s)
+		if err != nil {
+			rec.problems = append(rec.problems, err)
+		}
+	}
+	if cfg.sign {
+		rec.signer = &signer{key: []byte(os.Getenv(SignKeyEnv))}
+	}
+	return rec
+}
+
+// onLimit sets the action write takes when the task reaches --max-events,
+// typically killing its process. It must be set before output is written.
+func (r *recorder) onLimit(stop func()) {
+	r.mu.Lock()
+	r.stop = stop
+	r.mu.Unlock()
+}
+
+// write records an event, reporting (rather than silently dropping) failures.
+// Event types excluded by --log-types are dropped here, for the sinks as well.
+// The event's Time is assigned here rather than by the caller; see insert.
+//
+// With --max-events, write also counts output events: the one that reaches
+// the cap is followed by a limit-exceeded event and the stop action, and any
+// output still arriving before the process dies is dropped.
+//
+// With --max-total-bytes, an output event that would take the recorded
+// output past the cap is dropped instead, along with all output after it,
+// and a truncated event says so; the command is left to run.
+func (r *recorder) write(e Event) {
+	if !r.cfg.records(e.Type) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.exited {
+		return
+	}
+
+	isOutput := e.Type == EventTypeStdout || e.Type == EventTypeStderr || e.Type == EventTypeFD
+	if isOutput && r.cfg.maxTotalBytes > 0 {
+		if r.truncated {
+			return
+		}
+		if r.outputBytes+len(e.Data) > r.cfg.maxTotalBytes {
+			r.truncated = true
+			r.insert(Event{
+				Type: EventTypeTruncated,
+				Data: fmt.Sprintf("output no longer recorded after %d bytes (--max-total-bytes %d); the task kept running", r.outputBytes, r.cfg.maxTotalBytes),
+			})
+			return
+		}
+		r.outputBytes += len(e.Data)
+	}
+	if isOutput && r.cfg.maxEvents > 0 {
+		if r.outputEvents >= r.cfg.maxEvents {
+			return
+		}
+		r.outputEvents++
+	}
+	r.insert(e)
+	if isOutput && r.cfg.maxEvents > 0 && r.outputEvents == r.cfg.maxEvents {
+		r.insert(Event{
+			Type: EventTypeLimitExceeded,
+			Data: fmt.Sprintf("task stopped after reaching --max-events %d output events", r.cfg.maxEvents),
+		})
+		if r.stop != nil {
+			r.stop()
+		}
+	}
+}
+
+// insert stamps, signs (with --sign) and stores one event, then passes it to
+// the sinks. The caller holds r.mu.
+//
+// Stamping under the mutex, in the order events are stored, keeps their times
+// non-decreasing: should the wall clock step backward, an event is clamped to
+// its predecessor's time rather than appearing to happen before it. (The
+// monotonic reading is stripped first, since it is not what gets stored and
+// would hide exactly that step from the comparison.)
+func (r *recorder) insert(e Event) {
+	e.Time = r.now().Round(0)
+	if e.Time.Before(r.last) {
+		e.Time = r.last
+	}
+	r.last = e.Time
+	if e.Type == EventTypeExit {
+		r.exited = true
+	}
+
+	if r.signer != nil {
+		e.HMAC = r.signer.sign(r.task, e)
+	}
+	// With --sync-every, every Nth commit is fsynced, and with it every
+	// event before it.
+	r.stored++
+	durable := r.cfg.syncEvery > 0 && r.stored%r.cfg.syncEvery == 0 && e.Type != EventTypeExit
+	if durable {
+		if err := r.setSync(r.db, true); err != nil {
+			fmt.Fprintf(os.Stderr, "bgx: failed to enable sync for --sync-every: %v\n", err)
+		}
+	}
+	if err := insertEvent(r.db, r.task, e); err != nil {
+		fmt.Fprintf(os.Stderr, "bgx: failed to record %s event: %v\n", e.Type, err)
+	}
+	if durable {
+		if err := r.setSync(r.db, false); err != nil {
+			fmt.Fprintf(os.Stderr, "bgx: failed to disable sync after --sync-every: %v\n", err)
+		}
+	}
+	for _, s := range r.sinks {
+		r.problems = append(r.problems, s.send(r.task, e)...)
+	}
+	// A sink that fails now is in its retry delay, or already dropping
+	// events, so it starts no new outage with the error events; each
+	// outage is reported once, which bounds the recursion. Problems that
+	// --log-types leaves out, or that come up with the exit event, are
+	// left to the warning the sink printed.
+	for len(r.problems) > 0 {
+		err := r.problems[0]
+		r.problems = r.problems[1:]
+		if !r.exited && r.cfg.records(EventTypeError) {
+			r.insert(Event{Type: EventTypeError, Data: err.Error()})
+		}
+	}
+}
+
+// reportError records a problem the daemon carries on from as an error
+// event, and also prints it on stderr (the daemon log, for fork) in case it
+// can't be recorded, or isn't: with --log-types leaving error events out, or
+// after the exit event.
+func (r *recorder) reportError(err error) {
+	fmt.Fprintf(os.Stderr, "bgx: %v\n", err)
+	r.write(Event{Type: EventTypeError, Data: err.Error()})
+}
+
+// writeExit records the final exit event durably: the commit carrying it is
+// fsynced, so the task's completion status survives a crash or power loss even
+// though earlier events were written without a sync.
+func (r *recorder) writeExit(e Event) {
+	if err := r.setSync(r.db, true); err != nil {
+		fmt.Fprintf(os.Stderr, "bgx: failed to enable sync for exit event: %v\n", err)
+	}
+	r.write(e)
+}
+
+// close sends the sinks what they still have queued and releases their
+// connections.
+func (r *recorder) close() {
+	for _, s := range r.sinks {
+		s.close()
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestRecorderMonotonicTime verifies events are stamped as they are recorded
+// and never go back in time, even when the wall clock does.
+func TestRecorderMonotonicTime(t *testing.T) {
+	t.Setenv("BGX_DB", filepath.Join(t.TempDir(), "bgx.db"))
+	db, err := openDB()
+	if err != nil {
+		t.Fatalf("openDB: %v", err)
+	}
+	defer db.Close()
+
+	// The clock steps back by a second after the first event, then recovers.
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ticks := []time.Time{base, base.Add(-time.Second), base.Add(time.Millisecond)}
+	rec := newRecorder(db, "clock", forkConfig{})
+	rec.now = func() time.Time {
+		now := ticks[0]
+		ticks = ticks[1:]
+		return now
+	}
+
+	// Whatever time a caller sets is replaced by the recorder's own stamp.
+	rec.write(Event{Type: EventTypeStart, Time: base.Add(time.Hour)})
+	rec.write(Event{Type: EventTypeStdout, Data: "hello\n"})
+	rec.write(Event{Type: EventTypeExit})
+
+	events, err := readEventsAfter(db, "clock", 0, 0)
+	if err != nil {
+		t.Fatalf("readEventsAfter: %v", err)
+	}
+	want := []time.Time{base, base, base.Add(time.Millisecond)}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d", len(events), len(want))
+	}
+	for i, e := range events {
+		got, err := time.Parse(time.RFC3339Nano, e.Time)
+		if err != nil {
+			t.Fatalf("event %d: bad time %q: %v", i, e.Time, err)
+		}
+		if !got.Equal(want[i]) {
+			t.Errorf("event %d (%s): time = %s, want %s", i, e.Type, got, want[i])
+		}
+	}
+}
+
+// TestRecorderSyncEvery verifies --sync-every fsyncs the commit of every Nth
+// event, and only that one, before the exit event's own sync.
+func TestRecorderSyncEvery(t *testing.T) {
+	t.Setenv("BGX_DB", filepath.Join(t.TempDir(), "bgx.db"))
+	db, err := openDB()
+	if err != nil {
+		t.Fatalf("openDB: %v", err)
+	}
+	defer db.Close()
+
+	rec := newRecorder(db, "durable", forkConfig{syncEvery: 3})
+	var syncs []string // each switch, with the number of events stored by then
+	rec.setSync = func(db *sql.DB, full bool) error {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM events").Scan(&n); err != nil {
+			t.Errorf("counting events: %v", err)
+		}
+		syncs = append(syncs, fmt.Sprintf("full=%v after %d", full, n))
+		return nil
+	}
+	rec.write(Event{Type: EventTypeStart})
+	for range 6 {
+		rec.write(Event{Type: EventTypeStdout, Data: "line\n"})
+	}
+	rec.writeExit(Event{Type: EventTypeExit})
+
+	// Events 3 and 6 are committed with a sync; the exit event is the 8th.
+	want := []string{"full=true after 2", "full=false after 3", "full=true after 5", "full=false after 6", "full=true after 7"}
+	if !slices.Equal(syncs, want) {
+		t.Errorf("Syncs %q, want %q", syncs, want)
+	}
+}
+
+// TestRecorderErrorEvents verifies error events follow --log-types, and that
+// nothing, problems included, is recorded after the exit event.
+func TestRecorderErrorEvents(t *testing.T) {
+	t.Setenv("BGX_DB", filepath.Join(t.TempDir(), "bgx.db"))
+	db, err := openDB()
+	if err != nil {
+		t.Fatalf("openDB: %v", err)
+	}
+	defer db.Close()
+	types := func(task string) []string {
+		t.Helper()
+		events, err := readEventsAfter(db, task, 0, 0)
+		if err != nil {
+			t.Fatalf("readEventsAfter: %v", err)
+		}
+		var types []string
+		for _, e := range events {
+			types = append(types, e.Type)
+		}
+		return types
+	}
+
+	rec := newRecorder(db, "filtered", forkConfig{logTypes: []string{EventTypeStdout}})
+	rec.write(Event{Type: EventTypeStart})
+	rec.reportError(fmt.Errorf("failed to read the command's stdout"))
+	rec.write(Event{Type: EventTypeStdout, Data: "line\n"})
+	rec.writeExit(Event{Type: EventTypeExit})
+	if got, want := types("filtered"), []string{EventTypeStart, EventTypeStdout, EventTypeExit}; !slices.Equal(got, want) {
+		t.Errorf("With --log-types stdout, recorded %q, want %q", got, want)
+	}
+
+	rec = newRecorder(db, "late", forkConfig{})
+	rec.write(Event{Type: EventTypeStart})
+	rec.reportError(fmt.Errorf("failed to touch heartbeat file"))
+	rec.problems = append(rec.problems, fmt.Errorf("lost connection to sink")) // as if sending the exit event failed
+	rec.writeExit(Event{Type: EventTypeExit})
+	rec.reportError(fmt.Errorf("too late"))
+	if got, want := types("late"), []string{EventTypeStart, EventTypeError, EventTypeExit}; !slices.Equal(got, want) {
+		t.Errorf("Recorded %q, want %q: the exit event last", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SSHEnv names the environment variable that overrides the command `join
+// --host` connects with, such as "ssh -p 2222 -i ~/.ssh/ci" (split on spaces,
+// no quoting). It defaults to plain ssh.
+const SSHEnv = "BGX_SSH"
+
+// remoteExitMarker ends the remote side's stderr with the remote join's exit
+// status, so the local bgx can tell it apart from ssh's own exit status, and
+// remoteMissingMarker says bgx isn't installed there. Both are stripped from
+// the stderr passed through.
+const (
+	remoteExitMarker    = "__bgx_remote_exit="
+	remoteMissingMarker = "__bgx_remote_missing"
+)
+
+var remoteStatus = regexp.MustCompile(`(?:` + remoteExitMarker + `(\d+)|` + remoteMissingMarker + `)\n$`)
+
+// joinRemote runs `bgx join` with the given arguments on host over ssh and
+// streams its output, making the local bgx a thin proxy. It returns the
+// remote join's exit code, or an error if ssh couldn't connect or bgx isn't
+// installed on the host. The task names and the database are the remote
+// host's; BGX_DB there is whatever a non-interactive ssh session gets.
+func joinRemote(host string, args []string) (int, error) {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	script := fmt.Sprintf(
+		`if command -v bgx >/dev/null 2>&1; then bgx join %s; printf '%s%%d\n' $? >&2; else printf '%s\n' >&2; fi`,
+		strings.Join(quoted, " "), remoteExitMarker, remoteMissingMarker)
+
+	ssh := []string{"ssh"}
+	if override := strings.Fields(os.Getenv(SSHEnv)); len(override) > 0 {
+		ssh = override
+	}
+	// ssh runs its arguments through the remote user's shell, which may not
+	// be POSIX; handing the script to sh keeps its syntax well defined.
+	cmd := exec.Command(ssh[0], append(ssh[1:], host, "sh", "-c", shellQuote(script))...)
+	stderr := &markerWriter{w: os.Stderr}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	tail := stderr.tail()
+
+	m := remoteStatus.FindSubmatch(tail)
+	if m == nil {
+		os.Stderr.Write(tail)
+		if err != nil {
+			return 1, fmt.Errorf("%s to %q failed: %w", ssh[0], host, err)
+		}
+		return 1, fmt.Errorf("%s to %q ended without the remote join's exit status", ssh[0], host)
+	}
+	os.Stderr.Write(tail[:len(tail)-len(m[0])])
+	if m[1] == nil {
+		return 1, fmt.Errorf("bgx is not installed on %q (or not on the PATH of a non-interactive ssh session there)", host)
+	}
+	code, _ := strconv.Atoi(string(m[1]))
+	return code, nil
+}
+
+// shellQuote quotes s as a single word for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// markerWriter passes stderr through to w as it arrives, except for a
+// trailing part that could be the start of a status marker, which it holds
+// back until more output shows otherwise. After the remote side exits, tail
+// returns what is still held: the marker, if it was printed.
+type markerWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (m *markerWriter) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	ready := len(m.buf) - pendingMarker(m.buf)
+	if ready > 0 {
+		if _, err := m.w.Write(m.buf[:ready]); err != nil {
+			return 0, err
+		}
+		m.buf = append(m.buf[:0], m.buf[ready:]...)
+	}
+	return len(p), nil
+}
+
+// tail returns the bytes held back.
+func (m *markerWriter) tail() []byte {
+	return m.buf
+}
+
+// pendingMarker returns the length of the longest suffix of b that a status
+// marker could begin with, complete markers included.
+func pendingMarker(b []byte) int {
+	const longest = len(remoteExitMarker) + 20 + 1 // marker, exit status digits, newline
+	for start := max(0, len(b)-longest); start < len(b); start++ {
+		if couldBeMarker(string(b[start:])) {
+			return len(b) - start
+		}
+	}
+	return 0
+}
+
+// couldBeMarker reports whether s is a prefix of a status marker line.
+func couldBeMarker(s string) bool {
+	if strings.HasPrefix(remoteMissingMarker+"\n", s) {
+		return true
+	}
+	if len(s) <= len(remoteExitMarker) {
+		return strings.HasPrefix(remoteExitMarker, s)
+	}
+	rest, ok := strings.CutPrefix(s, remoteExitMarker)
+	if !ok {
+		return false
+	}
+	rest = strings.TrimSuffix(rest, "\n")
+	return strings.Trim(rest, "0123456789") == "" && !strings.Contains(rest, "\n")
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestMarkerWriter verifies stderr passes through as it arrives, even when
+// it looks like the start of a marker for a while, and only a trailing
+// status marker is held back, however the writes split it.
+func TestMarkerWriter(t *testing.T) {
+	const stderr = "err\n__bgx_x\n__bgx_remote_exit=\n__bgx_remote_missing!"
+	for _, tail := range []string{remoteExitMarker + "42\n", remoteMissingMarker + "\n", ""} {
+		var out strings.Builder
+		m := &markerWriter{w: &out}
+		for _, c := range []byte(stderr + tail) {
+			m.Write([]byte{c})
+		}
+		if out.String() != stderr || string(m.tail()) != tail {
+			t.Errorf("passed %q and held %q, want %q and %q", out.String(), m.tail(), stderr, tail)
+		}
+	}
+
+	var out strings.Builder
+	m := &markerWriter{w: &out}
+	m.Write([]byte("progress\n"))
+	if out.String() != "progress\n" {
+		t.Errorf("a complete line should pass straight through, got %q", out.String())
+	}
+}
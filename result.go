@@ -0,0 +1,65 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// taskResultJSON is what `join --result-file` and `wait --result-file` write
+// for a task: its `status --json` object, and whether --timeout gave up on
+// it. The start time tells one run of a task from another under the same
+// name (such as after fork --overwrite-if-exited).
+type taskResultJSON struct {
+	taskStatusJSON
+	TimedOut bool `json:"timed_out"`
+}
+
+// writeResultFile writes the outcome of each task to path once join or wait
+// is done with them: for one task as an object, and for several as an array
+// of them in argument order. timedOut says which tasks --timeout gave up on.
+func writeResultFile(path string, db *sql.DB, taskNames []string, timedOut []bool) error {
+	now := time.Now()
+	results := make([]taskResultJSON, len(taskNames))
+	for i, name := range taskNames {
+		s, err := readTaskSummary(db, name)
+		if err != nil {
+			return fmt.Errorf("failed to read task %q: %w", name, err)
+		}
+		results[i] = taskResultJSON{s.statusJSON(now), timedOut[i]}
+	}
+	var v any = results
+	if len(results) == 1 {
+		v = results[0]
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write --result-file: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data by writing a temporary
+// file beside it and renaming it into place, so that a reader never sees it
+// half-written, and an interrupted write leaves the previous file intact.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".bgx-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// maxRSS returns 0: Windows reports no peak memory for a reaped process.
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
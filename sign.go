@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// SignKeyEnv names the environment variable holding the secret that --sign
+// and `bgx verify` key their HMACs with. It is never passed on to the task.
+const SignKeyEnv = "BGX_SIGN_KEY"
+
+// eventMAC computes an event's chained HMAC: HMAC-SHA256 over the previous
+// event's HMAC (empty for the first event) and the event's canonical JSON
+// encoding, hex-encoded. Chaining means that deleting or reordering events
+// breaks verification of the event after the gap, not just of the event
+// itself.
+func eventMAC(key []byte, prev string, s storedEvent) string {
+	canonical, _ := json.Marshal(s) // storedEvent only has plain fields
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(prev))
+	mac.Write([]byte{'\n'})
+	mac.Write(canonical)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signer extends one task's HMAC chain as its events are recorded. It is not
+// safe for concurrent use; the recorder calls it under its lock, so the chain
+// follows insertion order.
+type signer struct {
+	key  []byte
+	prev string
+}
+
+// sign returns the HMAC for e, the next event of task, and advances the chain.
+func (sg *signer) sign(task string, e Event) string {
+	s, err := toStored(task, e)
+	if err != nil {
+		return "" // insertEvent fails the same way, so nothing is stored
+	}
+	sg.prev = eventMAC(sg.key, sg.prev, s)
+	return sg.prev
+}
+
+// parseVerifyArgs parses `verify` arguments of the form:
+//
+//	--task-name NAME
+func parseVerifyArgs(args []string) (string, error) {
+	var taskName string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--task-name":
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("--task-name requires an argument")
+			}
+			taskName = args[i+1]
+			i++
+		default:
+			return "", fmt.Errorf("unexpected argument %q\nUsage: bgx verify --task-name NAME", args[i])
+		}
+	}
+	if taskName == "" {
+		return "", fmt.Errorf("--task-name is required")
+	}
+	return taskName, nil
+}
+
+// runVerify recomputes the HMAC chain of a task forked with --sign and
+// reports the first event that doesn't match, exiting 1 if there is one. A
+// task that wasn't signed has nothing to verify and passes.
+func runVerify(args []string) (int, error) {
+	taskName, err := parseVerifyArgs(args)
+	if err != nil {
+		return 1, err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return 1, err
+	}
+	defer db.Close()
+
+	exists, err := taskExists(db, taskName)
+	if err != nil {
+		return 1, fmt.Errorf("failed to look up task: %w", err)
+	}
+	if !exists {
+		return 1, fmt.Errorf("task %q not found (BGX_DB=%s)", taskName, getDBPath())
+	}
+
+	events, err := readStoredEvents(db, taskName)
+	if err != nil {
+		return 1, fmt.Errorf("failed to read events for %q: %w", taskName, err)
+	}
+	signed, startedSigned := false, false
+	for _, e := range events {
+		signed = signed || e.HMAC != ""
+		if e.Type == EventTypeStart {
+			startedSigned = startedSigned || e.Signed
+			if warning := newerSchemaWarning(taskName, e.V); warning != "" {
+				fmt.Fprintln(os.Stderr, warning)
+			}
+		}
+	}
+	if !signed && startedSigned {
+		// Stripping every HMAC must not pass for a task that never signed.
+		fmt.Printf("Task %q was forked with --sign, but none of its events are signed: they were stripped after the fact.\n", taskName)
+		return 1, nil
+	}
+	if !signed {
+		fmt.Printf("Task %q is not signed; nothing to verify.\n", taskName)
+		return 0, nil
+	}
+
+	key := os.Getenv(SignKeyEnv)
+	if key == "" {
+		return 1, fmt.Errorf("%s must be set to the key the task was signed with", SignKeyEnv)
+	}
+
+	var prev, lastType string
+	verified := 0
+	for _, e := range events {
+		if e.HMAC == "" {
+			// Other bgx processes (such as `wait --on-timeout kill`, pause
+			// and resume, or any command with --audit) may add events
+			// without the key; anything else unsigned was inserted.
+			switch e.Type {
+			case EventTypeKill, EventTypePause, EventTypeResume, EventTypeAccess:
+				continue
+			}
+			fmt.Printf("Event %d (%s) is not signed: it was inserted after the fact.\n", e.ID, e.Type)
+			return 1, nil
+		}
+		if !hmac.Equal([]byte(e.HMAC), []byte(eventMAC([]byte(key), prev, e))) {
+			fmt.Printf("Event %d (%s) failed verification: it was altered, an event before it is missing or out of order, or %s is not the signing key.\n", e.ID, e.Type, SignKeyEnv)
+			return 1, nil
+		}
+		prev, lastType = e.HMAC, e.Type
+		verified++
+	}
+
+	fmt.Printf("Verified %d signed events for task %q.\n", verified, taskName)
+	if lastType != EventTypeExit {
+		fmt.Println("Note: no exit event yet; the task is still running, or events after the last one were removed.")
+	}
+	return 0, nil
+}
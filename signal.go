@@ -0,0 +1,42 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// exitStatus returns the exit code a reaped command is recorded with and
+// its exit_reason, such as "exited normally", "exited with code 2" or
+// "segfault (SIGSEGV)", along with the signal's name if one killed it. Such
+// a process has no exit code of its own; like a shell, bgx reports 128 plus
+// the signal number, so SIGKILL gives 137.
+func exitStatus(state *os.ProcessState) (code int, reason, signal string) {
+	if code, reason, signal, ok := signalExit(state); ok {
+		return code, reason, signal
+	}
+	code = state.ExitCode()
+	if code == 0 {
+		return 0, "exited normally", ""
+	}
+	return code, fmt.Sprintf("exited with code %d", code), ""
+}
+
+// signalTask sends sig to a task's process (the pid from its start event),
+// and for a forked task to the processes it started too (see signalGroup),
+// and records a kill event saying why. The event is written first so that
+// it precedes the exit event the daemon records once the process dies.
+func signalTask(db *sql.DB, taskName string, pid int, sig os.Signal, reason string) error {
+	if err := insertEvent(db, taskName, Event{
+		Type: EventTypeKill,
+		Time: time.Now(),
+		Data: fmt.Sprintf("%s (signal: %v)", reason, sig),
+	}); err != nil {
+		return fmt.Errorf("failed to record kill event: %w", err)
+	}
+	if err := signalGroup(pid, sig); err != nil {
+		return fmt.Errorf("failed to signal process %d: %w", pid, err)
+	}
+	return nil
+}
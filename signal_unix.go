@@ -0,0 +1,101 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// terminateSignal asks a process to shut down, giving it a chance to clean up.
+var terminateSignal os.Signal = syscall.SIGTERM
+
+// pauseSignal and resumeSignal stop and continue a process, for `pause` and
+// `resume`. Unlike SIGTSTP, SIGSTOP can't be caught or ignored.
+var pauseSignal, resumeSignal os.Signal = syscall.SIGSTOP, syscall.SIGCONT
+
+// signalNames maps the names `kill --signal` accepts, without the SIG
+// prefix, to this platform's signals; signalNameOrder lists them for errors.
+var signalNames = map[string]os.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"ABRT":  syscall.SIGABRT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"PIPE":  syscall.SIGPIPE,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+var signalNameOrder = []string{"HUP", "INT", "QUIT", "ABRT", "KILL", "USR1", "USR2", "PIPE", "ALRM", "TERM", "CONT", "STOP", "TSTP", "WINCH"}
+
+// signalPhrases describes how a process died of the common fatal signals, by
+// the signal's name, for exit reasons such as "segfault (SIGSEGV)".
+var signalPhrases = map[syscall.Signal][2]string{
+	syscall.SIGHUP:  {"SIGHUP", "hung up"},
+	syscall.SIGINT:  {"SIGINT", "interrupted"},
+	syscall.SIGQUIT: {"SIGQUIT", "quit"},
+	syscall.SIGILL:  {"SIGILL", "illegal instruction"},
+	syscall.SIGTRAP: {"SIGTRAP", "trapped"},
+	syscall.SIGABRT: {"SIGABRT", "aborted"},
+	syscall.SIGBUS:  {"SIGBUS", "bus error"},
+	syscall.SIGFPE:  {"SIGFPE", "arithmetic error"},
+	syscall.SIGKILL: {"SIGKILL", "killed"},
+	syscall.SIGSEGV: {"SIGSEGV", "segfault"},
+	syscall.SIGPIPE: {"SIGPIPE", "broken pipe"},
+	syscall.SIGALRM: {"SIGALRM", "alarm"},
+	syscall.SIGTERM: {"SIGTERM", "terminated"},
+	syscall.SIGXCPU: {"SIGXCPU", "CPU time limit exceeded"},
+	syscall.SIGXFSZ: {"SIGXFSZ", "file size limit exceeded"},
+}
+
+// signalGroup sends sig to the process group pid leads, as a forked task's
+// command does (see ownProcessGroup), so that the processes it started get
+// it too: a child left holding the command's output pipes would otherwise
+// keep the daemon from recording the exit. A command run by exec shares
+// bgx's group instead, so it is signalled alone.
+func signalGroup(pid int, sig os.Signal) error {
+	if s, ok := sig.(syscall.Signal); ok {
+		if pgid, err := syscall.Getpgid(pid); err == nil && pgid == pid {
+			return syscall.Kill(-pid, s)
+		}
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(sig)
+}
+
+// signalExit reports, for a process a signal killed, its exit code and
+// reason (see exitStatus) and the signal's name.
+func signalExit(state *os.ProcessState) (code int, reason, signal string, ok bool) {
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return 0, "", "", false
+	}
+	sig := ws.Signal()
+	signal = fmt.Sprintf("signal %d", int(sig))
+	for name, s := range signalNames {
+		if s == sig {
+			signal = "SIG" + name
+		}
+	}
+	reason = fmt.Sprintf("killed by %s (%v)", signal, sig)
+	if phrase, known := signalPhrases[sig]; known {
+		signal = phrase[0]
+		reason = fmt.Sprintf("%s (%s)", phrase[1], signal)
+	}
+	if ws.CoreDump() {
+		reason = strings.TrimSuffix(reason, ")") + ", core dumped)"
+	}
+	return 128 + int(sig), reason, signal, true
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+// TestParseSignal verifies --signal accepts numbers and names, with or
+// without the SIG prefix and in any case, and rejects anything else.
+func TestParseSignal(t *testing.T) {
+	for spec, want := range map[string]syscall.Signal{
+		"15":      syscall.SIGTERM,
+		"9":       syscall.SIGKILL,
+		"TERM":    syscall.SIGTERM,
+		"SIGTERM": syscall.SIGTERM,
+		"kill":    syscall.SIGKILL,
+		"SigInt":  syscall.SIGINT,
+		"HUP":     syscall.SIGHUP,
+		"SIGUSR1": syscall.SIGUSR1,
+	} {
+		sig, err := parseSignal(spec)
+		if err != nil || sig != want {
+			t.Errorf("parseSignal(%q) = %v, %v; want %v", spec, sig, err, want)
+		}
+	}
+	for _, spec := range []string{"", "0", "-1", "TERMINATE", "SIG", "SIGFOO", "1.5"} {
+		if sig, err := parseSignal(spec); err == nil {
+			t.Errorf("parseSignal(%q) = %v, want an error", spec, sig)
+		}
+	}
+}
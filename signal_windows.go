@@ -0,0 +1,39 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// terminateSignal asks a process to shut down. Windows has no SIGTERM that
+// os.Process can deliver, so the process is terminated outright.
+var terminateSignal os.Signal = os.Kill
+
+// pauseSignal and resumeSignal are nil: Windows has no job-control signals,
+// so `pause` and `resume` aren't supported.
+var pauseSignal, resumeSignal os.Signal
+
+// signalNames maps the names `kill --signal` accepts, without the SIG
+// prefix; signalNameOrder lists them for errors. os.Process can only
+// terminate a process on Windows, so TERM and KILL both do that.
+var signalNames = map[string]os.Signal{
+	"KILL": os.Kill,
+	"TERM": os.Kill,
+}
+
+var signalNameOrder = []string{"KILL", "TERM"}
+
+// signalGroup terminates the process pid. Windows has no process groups to
+// signal, so a process the command started is left running.
+func signalGroup(pid int, sig os.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(sig)
+}
+
+// signalExit reports no signal: on Windows a process that is terminated
+// exits with the code it was given, which exitStatus reports as is.
+func signalExit(state *os.ProcessState) (code int, reason, signal string, ok bool) {
+	return 0, "", "", false
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// SinkRetryInterval is how long a sink waits after a failed connection attempt
+// before dialing again. Events sent in between reach only the database. It
+// also bounds how long a write to the collector may block.
+const SinkRetryInterval = 5 * time.Second
+
+// SinkQueueSize is how many events a sink holds for a collector that is slow
+// to take them. Past that, events reach only the database until it catches
+// up, so that a collector that stops reading never holds up the task.
+const SinkQueueSize = 1024
+
+// sinkEvent is the NDJSON form of an event sent to a sink: the event's own
+// fields plus the task it belongs to, since one collector may serve many tasks.
+type sinkEvent struct {
+	Task string `json:"task"`
+	Event
+}
+
+// MarshalJSON writes the task first, then the event as Event.MarshalJSON
+// encodes it, which the embedding would otherwise use for the whole line.
+func (s sinkEvent) MarshalJSON() ([]byte, error) {
+	event, err := json.Marshal(s.Event)
+	if err != nil {
+		return nil, err
+	}
+	task, err := json.Marshal(s.Task)
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte(`{"task":`), task...)
+	b = append(b, ',')
+	return append(b, event[1:]...), nil // event is a non-empty object: {"type":...}
+}
+
+// sink streams a task's events as NDJSON to a collector over TCP or a Unix
+// socket, or appends them to a file. The database remains the durable record:
+// if the collector is down or the connection drops, events keep being
+// recorded there and the sink reconnects on a later event, so a collector can
+// backfill any gap from the database.
+//
+// Events are written by a goroutine of the sink's own, from a queue, so that
+// dialing and writing never hold up the recorder.
+type sink struct {
+	network string // "tcp", "unix" or "file"
+	address string
+
+	queue   chan sinkEvent
+	done    chan struct{} // closed once the queue is drained
+	falling bool          // the queue was full when the last event came: it was dropped
+
+	// Used by the goroutine (and by newSink, before it starts).
+	conn      io.WriteCloser
+	enc       *json.Encoder
+	lastTried time.Time
+	warned    bool
+
+	mu   sync.Mutex
+	errs []error // outages the goroutine started, for the recorder to report
+}
+
+// parseSinkURL validates a --sink value of the form tcp://HOST:PORT,
+// unix:///PATH or file:///PATH and returns the network and address to dial
+// (for a file, "file" and its path).
+func parseSinkURL(spec string) (network, address string, err error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid --sink %q: %w", spec, err)
+	}
+	switch u.Scheme {
+	case "tcp":
+		if u.Host == "" {
+			return "", "", fmt.Errorf("invalid --sink %q: expected tcp://HOST:PORT", spec)
+		}
+		return "tcp", u.Host, nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("invalid --sink %q: expected unix:///PATH", spec)
+		}
+		return "unix", u.Path, nil
+	case "file":
+		if u.Host != "" || u.Path == "" {
+			return "", "", fmt.Errorf("invalid --sink %q: expected file:///PATH (an absolute path)", spec)
+		}
+		return "file", u.Path, nil
+	default:
+		return "", "", fmt.Errorf("invalid --sink %q: scheme must be tcp://, unix:// or file://", spec)
+	}
+}
+
+// newSink returns a sink for an already-validated --sink value and makes the
+// first connection attempt, returning its error if it fails.
+func newSink(spec string) (*sink, error) {
+	network, address, _ := parseSinkURL(spec)
+	s := &sink{network: network, address: address, queue: make(chan sinkEvent, SinkQueueSize), done: make(chan struct{})}
+	err := s.connect()
+	go s.run()
+	return s, err
+}
+
+// run writes the queued events until close.
+func (s *sink) run() {
+	defer close(s.done)
+	for e := range s.queue {
+		if err := s.write(e); err != nil {
+			s.mu.Lock()
+			s.errs = append(s.errs, err)
+			s.mu.Unlock()
+		}
+	}
+	s.closeConn()
+}
+
+// connect dials the collector, or opens the file for appending, warning
+// (once per outage) on failure. The error is returned only with the warning,
+// so only the start of an outage is reported.
+func (s *sink) connect() error {
+	s.lastTried = time.Now()
+	var conn io.WriteCloser
+	var err error
+	if s.network == "file" {
+		conn, err = os.OpenFile(s.address, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	} else {
+		conn, err = net.DialTimeout(s.network, s.address, SinkRetryInterval)
+	}
+	if err != nil {
+		return s.warn(fmt.Errorf("failed to connect to sink %s://%s: %w", s.network, s.address, err))
+	}
+	s.conn = conn
+	s.enc = json.NewEncoder(conn)
+	s.warned = false
+	return nil
+}
+
+// send queues one event for the collector without waiting for it, and
+// returns the errors of outages begun since the last call: the collector
+// falling SinkQueueSize events behind, so that this one is dropped, or those
+// write reports.
+func (s *sink) send(task string, e Event) []error {
+	s.mu.Lock()
+	errs := s.errs
+	s.errs = nil
+	s.mu.Unlock()
+	select {
+	case s.queue <- sinkEvent{Task: task, Event: e}:
+		s.falling = false
+	default:
+		if !s.falling {
+			s.falling = true
+			err := fmt.Errorf("sink %s://%s fell %d events behind; dropping events until it catches up", s.network, s.address, SinkQueueSize)
+			printSinkWarning(err)
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// write writes one event to the collector, dropping the connection on error
+// (including a write that doesn't complete within SinkRetryInterval) so the
+// next event, after SinkRetryInterval, tries to reconnect. Like connect, it
+// returns an error when it starts an outage.
+func (s *sink) write(e sinkEvent) error {
+	if s.conn == nil {
+		if time.Since(s.lastTried) < SinkRetryInterval {
+			return nil
+		}
+		if err := s.connect(); s.conn == nil {
+			return err
+		}
+	}
+	if c, ok := s.conn.(net.Conn); ok {
+		c.SetWriteDeadline(time.Now().Add(SinkRetryInterval))
+	}
+	if err := s.enc.Encode(e); err != nil {
+		s.closeConn()
+		s.lastTried = time.Now()
+		return s.warn(fmt.Errorf("lost connection to sink %s://%s: %w", s.network, s.address, err))
+	}
+	return nil
+}
+
+// warn reports a sink failure on stderr, once until the sink recovers, so an
+// unreachable collector doesn't produce a warning per event. It returns err
+// if it was reported, or nil.
+func (s *sink) warn(err error) error {
+	if s.warned {
+		return nil
+	}
+	s.warned = true
+	printSinkWarning(err)
+	return err
+}
+
+func printSinkWarning(err error) {
+	fmt.Fprintf(os.Stderr, "bgx: %v (events are still recorded in the database)\n", err)
+}
+
+// close sends the events still queued, then closes the connection. A
+// collector that has stopped reading holds it up no longer than the write
+// deadline, since the events after a failed write are dropped.
+func (s *sink) close() {
+	close(s.queue)
+	<-s.done
+}
+
+func (s *sink) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+		s.enc = nil
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusConfig holds the options for status.
+type statusConfig struct {
+	asJSON bool
+	peek   int // also show the last this many lines of output (0: none)
+}
+
+// parseStatusArgs parses `status` arguments of the form:
+//
+//	--task-name NAME [--json] [--peek N]
+func parseStatusArgs(args []string) (string, statusConfig, error) {
+	var taskName string
+	var cfg statusConfig
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--task-name":
+			if i+1 >= len(args) {
+				return "", cfg, fmt.Errorf("--task-name requires an argument")
+			}
+			taskName = args[i+1]
+			i++
+		case "--json":
+			cfg.asJSON = true
+		case "--peek":
+			if i+1 >= len(args) {
+				return "", cfg, fmt.Errorf("--peek requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n <= 0 {
+				return "", cfg, fmt.Errorf("invalid --peek %q: must be a positive number of lines", args[i+1])
+			}
+			cfg.peek = n
+			i++
+		default:
+			return "", cfg, fmt.Errorf("unexpected argument %q\nUsage: bgx status --task-name NAME [--json] [--peek N]", args[i])
+		}
+	}
+	if taskName == "" {
+		return "", cfg, fmt.Errorf("--task-name is required")
+	}
+	return taskName, cfg, nil
+}
+
+// runStatus prints a summary of one task: its state, command, and recorded
+// start/end times and duration, then with --peek its latest output. With
+// --json it prints all that as one JSON object instead.
+func runStatus(args []string) error {
+	taskName, cfg, err := parseStatusArgs(args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	exists, err := taskExists(db, taskName)
+	if err != nil {
+		return fmt.Errorf("failed to look up task: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("task %q not found (BGX_DB=%s)", taskName, getDBPath())
+	}
+
+	s, err := readTaskSummary(db, taskName)
+	if err != nil {
+		return fmt.Errorf("failed to read task %q: %w", taskName, err)
+	}
+	var recent []outputLine
+	if cfg.peek > 0 {
+		if recent, err = readRecentOutput(db, taskName, cfg.peek); err != nil {
+			return fmt.Errorf("failed to read output of %q: %w", taskName, err)
+		}
+	}
+	if cfg.asJSON {
+		j := s.statusJSON(time.Now())
+		j.RecentOutput = recent
+		b, err := json.Marshal(j)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	printField("Task:", s.Name)
+	printField("State:", s.state(time.Now()))
+	if s.Exited && s.ExitReason != "" {
+		printField("Reason:", s.ExitReason)
+	}
+	// A daemon that fails before starting the command leaves the task in
+	// "starting" forever; its log is the only record of why. It comes last,
+	// after the output --peek shows (deferred calls run in reverse order).
+	defer printDaemonLog(taskName)
+	if cfg.peek > 0 {
+		defer printRecentOutput(recent, cfg.peek)
+	}
+	if !s.Started {
+		return nil
+	}
+	// Without samples, the figures are known only once the kernel reports
+	// them at exit.
+	if s.NoProcStats && s.MaxRSSBytes == 0 {
+		printField("Peak mem:", notSampled)
+	} else {
+		printField("Peak mem:", formatBytes(s.PeakMemBytes)+s.memLabel())
+	}
+	switch {
+	case s.NoProcStats && !s.Exited:
+		printField("CPU time:", notSampled)
+	case s.UserSeconds > 0 || s.SystemSeconds > 0:
+		printField("CPU time:", fmt.Sprintf("%.2fs (user %.2fs, system %.2fs)", s.CPUSeconds, s.UserSeconds, s.SystemSeconds))
+	default:
+		printField("CPU time:", fmt.Sprintf("%.2fs", s.CPUSeconds))
+	}
+	if s.ReadBytes > 0 || s.WriteBytes > 0 {
+		printField("I/O:", formatIO(s))
+	}
+	if s.Exited {
+		printField("Output:", formatOutput(s))
+	}
+	printField("PID:", fmt.Sprint(s.PID))
+	printField("Command:", strings.Join(s.Command, " "))
+	printField("Started:", s.StartTime.Local().Format(time.RFC3339))
+	if s.Exited {
+		printField("Ended:", s.LastEventTime.Local().Format(time.RFC3339))
+	} else {
+		printField("Last seen:", s.LastEventTime.Local().Format(time.RFC3339))
+	}
+	printField("Duration:", s.Duration().Round(time.Millisecond).String())
+	return nil
+}
+
+// taskStatusJSON is the object `status --json` prints. Fields that only a
+// started or exited task has are left out until then.
+type taskStatusJSON struct {
+	Task            string     `json:"task"`
+	State           string     `json:"state"`
+	PID             int        `json:"pid,omitempty"`
+	Command         []string   `json:"command,omitempty"`
+	BgxVersion      string     `json:"bgx_version,omitempty"`
+	StartTime       *time.Time `json:"start_time,omitempty"`
+	LastEventTime   *time.Time `json:"last_event_time,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	Exited          bool       `json:"exited"`
+	ExitCode        *int       `json:"exit_code,omitempty"`
+	ExitReason      string     `json:"exit_reason,omitempty"`
+	ExitSignal      string     `json:"exit_signal,omitempty"`
+	CPUSeconds      float64    `json:"cpu_seconds"`
+	UserSeconds     float64    `json:"user_seconds,omitempty"`
+	SystemSeconds   float64    `json:"system_seconds,omitempty"`
+	MaxRSSBytes     int64      `json:"max_rss_bytes,omitempty"`
+	MemBytes        int64      `json:"mem_bytes"`
+	PeakMemBytes    int64      `json:"peak_mem_bytes"`
+	MemMetric       string     `json:"mem_metric,omitempty"`
+	NoProcStats     bool       `json:"no_proc_stats,omitempty"`
+	ReadBytes       int64      `json:"read_bytes"`
+	WriteBytes      int64      `json:"write_bytes"`
+	StdoutBytes     int64      `json:"stdout_bytes"`
+	StderrBytes     int64      `json:"stderr_bytes"`
+	StdoutLines     int64      `json:"stdout_lines"`
+	StderrLines     int64      `json:"stderr_lines"`
+
+	RecentOutput []outputLine `json:"recent_output,omitempty"` // with --peek
+}
+
+// statusJSON converts the summary for `status --json`, with its state as of
+// now.
+func (s taskSummary) statusJSON(now time.Time) taskStatusJSON {
+	j := taskStatusJSON{
+		Task:            s.Name,
+		State:           s.state(now),
+		PID:             s.PID,
+		Command:         s.Command,
+		BgxVersion:      s.BgxVersion,
+		DurationSeconds: s.Duration().Seconds(),
+		Exited:          s.Exited,
+		CPUSeconds:      s.CPUSeconds,
+		UserSeconds:     s.UserSeconds,
+		SystemSeconds:   s.SystemSeconds,
+		MaxRSSBytes:     s.MaxRSSBytes,
+		MemBytes:        s.MemBytes,
+		PeakMemBytes:    s.PeakMemBytes,
+		NoProcStats:     s.NoProcStats,
+		ReadBytes:       s.ReadBytes,
+		WriteBytes:      s.WriteBytes,
+		StdoutBytes:     s.StdoutBytes,
+		StderrBytes:     s.StderrBytes,
+		StdoutLines:     s.StdoutLines,
+		StderrLines:     s.StderrLines,
+	}
+	if s.Started {
+		j.StartTime, j.LastEventTime = &s.StartTime, &s.LastEventTime
+		j.MemMetric = s.memMetric()
+	}
+	if s.Exited {
+		j.ExitCode = &s.ExitCode
+		j.ExitReason, j.ExitSignal = s.ExitReason, s.ExitSignal
+	}
+	return j
+}
+
+// printRecentOutput shows the lines --peek read, indented and labelled with
+// their stream.
+func printRecentOutput(lines []outputLine, n int) {
+	fmt.Println()
+	if len(lines) == 0 {
+		fmt.Println("No output recorded yet.")
+		return
+	}
+	fmt.Printf("Last %d lines of output:\n", min(n, len(lines)))
+	for _, line := range lines {
+		fmt.Printf("  %s | %s\n", line.Stream, line.Data)
+	}
+}
+
+// printDaemonLog shows the task's daemon log, if the daemon wrote anything:
+// the last few lines, indented, under a pointer to the full file.
+func printDaemonLog(taskName string) {
+	log := strings.TrimRight(readDaemonLog(taskName), "\n")
+	if log == "" {
+		return
+	}
+	lines := strings.Split(log, "\n")
+	const shown = 5
+	fmt.Println()
+	fmt.Printf("The daemon reported problems (%s):\n", daemonLogPath(taskName))
+	if len(lines) > shown {
+		fmt.Printf("  ... %d earlier lines\n", len(lines)-shown)
+		lines = lines[len(lines)-shown:]
+	}
+	for _, line := range lines {
+		fmt.Println("  " + line)
+	}
+}
+
+// printField prints one aligned "Label: value" line of status output.
+func printField(label, value string) {
+	fmt.Printf("%-11s%s\n", label, value)
+}
+
+// formatIO renders --io-stats totals along with the average rate over the
+// task's recorded duration, such as "12.0 MiB read (1.2 MiB/s), 0 B written".
+func formatIO(s taskSummary) string {
+	part := func(n int64, verb string) string {
+		if n == 0 {
+			return "0 B " + verb
+		}
+		text := formatBytes(n) + " " + verb
+		if secs := s.Duration().Seconds(); secs >= 1 && float64(n) >= secs {
+			text += fmt.Sprintf(" (%s/s)", formatBytes(int64(float64(n)/secs)))
+		}
+		return text
+	}
+	return part(s.ReadBytes, "read") + ", " + part(s.WriteBytes, "written")
+}
+
+// notSampled stands in for the resource figures of a task forked with
+// --no-proc-stats.
+const notSampled = "not sampled (--no-proc-stats)"
+
+// memMetric names what the task's memory figures measure: "pss" or "rss".
+func (s taskSummary) memMetric() string {
+	if s.MemMetric == MemMetricPSS {
+		return MemMetricPSS
+	}
+	return MemMetricRSS
+}
+
+// memLabel marks memory figures that are PSS rather than the usual RSS, such
+// as " (PSS)"; it is empty for RSS.
+func (s taskSummary) memLabel() string {
+	if s.MemMetric == MemMetricPSS {
+		return " (PSS)"
+	}
+	return ""
+}
+
+// formatOutput renders how much an exited task wrote to each stream, such
+// as "stdout 12 lines (3.4 KiB), stderr empty".
+func formatOutput(s taskSummary) string {
+	part := func(name string, lines, n int64) string {
+		if n == 0 {
+			return name + " empty"
+		}
+		noun := "lines"
+		if lines == 1 {
+			noun = "line"
+		}
+		return fmt.Sprintf("%s %d %s (%s)", name, lines, noun, formatBytes(n))
+	}
+	return part("stdout", s.StdoutLines, s.StdoutBytes) + ", " + part("stderr", s.StderrLines, s.StderrBytes)
+}
+
+// formatBytes renders a byte count in binary units, such as "12.5 MiB". Zero
+// means nothing was sampled (no heartbeats, or no /proc on this platform).
+func formatBytes(n int64) string {
+	if n == 0 {
+		return "unknown"
+	}
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 4 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exp])
+}
+
+// checkNotStalled refuses to signal a stalled task: its daemon is gone, and
+// after so long (or a reboot) its pid may well belong to another process by
+// now. kill, pause, resume and stop all call it before signalling.
+func (s taskSummary) checkNotStalled(now time.Time) error {
+	if state := s.state(now); strings.HasPrefix(state, "stalled") {
+		return fmt.Errorf("%s, daemon gone; not signalled, as pid %d may belong to another process now", state, s.PID)
+	}
+	return nil
+}
+
+// state describes where the task is in its lifecycle as of now. A task that
+// hasn't exited but has gone quiet for longer than join's HeartbeatTimeout
+// (extended for a --heartbeat-adaptive task that announced a longer wait) is
+// reported as stalled: its daemon most likely died.
+func (s taskSummary) state(now time.Time) string {
+	switch {
+	case !s.Started:
+		return "starting"
+	case s.Exited:
+		return fmt.Sprintf("exited (code %d)", s.ExitCode)
+	case !s.NoHeartbeat && now.Sub(s.LastEventTime) > stallTimeout(HeartbeatTimeout, s.HeartbeatInterval):
+		return fmt.Sprintf("stalled (no events for %s)", now.Sub(s.LastEventTime).Round(time.Second))
+	case s.Paused:
+		return "paused"
+	default:
+		return "running"
+	}
+}
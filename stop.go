@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// StopTimeout is how long `stop` waits, by default, for a task to exit after
+// asking it to before killing it.
+const StopTimeout = 10 * time.Second
+
+// stopConfig holds the options for a stop.
+type stopConfig struct {
+	taskNames []string
+	all       bool          // stop every task that hasn't exited
+	timeout   time.Duration // from the terminate signal to the kill
+	audit     bool          // record an access event in each task's log
+}
+
+// parseStopArgs parses `stop` arguments of the form:
+//
+//	--task-name NAME [--task-name NAME ...] [--timeout DURATION] [--audit]
+//	--all [--timeout DURATION] [--audit]
+func parseStopArgs(args []string) (stopConfig, error) {
+	cfg := stopConfig{timeout: StopTimeout}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--task-name":
+			if i+1 >= len(args) {
+				return cfg, fmt.Errorf("--task-name requires an argument")
+			}
+			cfg.taskNames = append(cfg.taskNames, args[i+1])
+			i++
+		case "--all":
+			cfg.all = true
+		case "--timeout":
+			if i+1 >= len(args) {
+				return cfg, fmt.Errorf("--timeout requires an argument")
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d <= 0 {
+				return cfg, fmt.Errorf("invalid --timeout %q: must be a positive duration such as 30s or 5m", args[i+1])
+			}
+			cfg.timeout = d
+			i++
+		case "--audit":
+			cfg.audit = true
+		default:
+			return cfg, fmt.Errorf("unexpected argument %q\nUsage: bgx stop --task-name NAME | --all [--timeout DURATION] [--audit]", args[i])
+		}
+	}
+	switch {
+	case cfg.all && len(cfg.taskNames) > 0:
+		return cfg, fmt.Errorf("--all cannot be combined with --task-name")
+	case !cfg.all && len(cfg.taskNames) == 0:
+		return cfg, fmt.Errorf("--task-name or --all is required")
+	}
+	return cfg, nil
+}
+
+// runStop shuts tasks down, all at once: each is sent terminateSignal, and
+// if it hasn't exited within --timeout, killed. It prints one line per task
+// saying how it ended, and returns 1 if any task couldn't be stopped (or
+// named one doesn't exist). A task that has already exited, or exits on its
+// own meanwhile, is simply reported.
+func runStop(args []string) (int, error) {
+	cfg, err := parseStopArgs(args)
+	if err != nil {
+		return 1, err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return 1, err
+	}
+	defer db.Close()
+
+	names := cfg.taskNames
+	if cfg.all {
+		if names, err = listTasks(db); err != nil {
+			return 1, fmt.Errorf("failed to list tasks: %w", err)
+		}
+	}
+	for _, name := range cfg.taskNames {
+		exists, err := taskExists(db, name)
+		if err != nil {
+			return 1, fmt.Errorf("failed to look up task: %w", err)
+		}
+		if !exists {
+			return 1, fmt.Errorf("task %q not found (BGX_DB=%s)", name, getDBPath())
+		}
+	}
+
+	outcomes := make([]string, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if cfg.audit {
+				if errs[i] = recordAccess(db, name, "stop"); errs[i] != nil {
+					return
+				}
+			}
+			outcomes[i], errs[i] = stopTask(db, name, cfg.timeout, !cfg.all)
+		}()
+	}
+	wg.Wait()
+
+	code := 0
+	for i, name := range names {
+		switch {
+		case errs[i] != nil:
+			fmt.Printf("%s: not stopped: %v\n", name, errs[i])
+			code = 1
+		case outcomes[i] != "":
+			fmt.Printf("%s: %s\n", name, outcomes[i])
+		}
+	}
+	return code, nil
+}
+
+// stopTask stops one task and describes how it ended, such as "stopped (exit
+// code 143)". With --all, a task that has already exited isn't worth a line
+// of its own, and is described as "" unless named.
+func stopTask(db *sql.DB, taskName string, timeout time.Duration, named bool) (string, error) {
+	s, err := readTaskSummary(db, taskName)
+	if err != nil {
+		return "", fmt.Errorf("failed to read task: %w", err)
+	}
+	switch {
+	case !s.Started:
+		return "", errors.New("it has no process yet")
+	case s.Exited && named:
+		return fmt.Sprintf("already exited (code %d)", s.ExitCode), nil
+	case s.Exited:
+		return "", nil
+	}
+	if err := s.checkNotStalled(time.Now()); err != nil {
+		return "", err
+	}
+
+	// A signal that can't be delivered most likely means the process has
+	// just exited, and its exit event is on its way.
+	signalErr := signalTask(db, taskName, s.PID, terminateSignal, "bgx stop")
+	if signalErr == nil && s.Paused {
+		// A stopped process doesn't act on the signal until it is continued.
+		signalErr = pauseTask(db, taskName, s.PID, EventTypeResume, resumeSignal)
+	}
+	if exit, err := waitForExitWithin(db, taskName, timeout); err == nil {
+		if signalErr != nil {
+			return fmt.Sprintf("exited on its own (code %d)", exit.Code), nil
+		}
+		return fmt.Sprintf("stopped (exit code %d)", exit.Code), nil
+	} else if !errors.Is(err, context.DeadlineExceeded) {
+		return "", err
+	}
+	if signalErr != nil {
+		return "", signalErr
+	}
+
+	if err := signalTask(db, taskName, s.PID, os.Kill, fmt.Sprintf("bgx stop: still running after %v", timeout)); err != nil {
+		return "", err
+	}
+	exit, err := waitForExitWithin(db, taskName, KillGracePeriod)
+	if err != nil {
+		return "", fmt.Errorf("killed after %v, but no exit was recorded: %w", timeout, err)
+	}
+	return fmt.Sprintf("killed after %v (exit code %d)", timeout, exit.Code), nil
+}
+
+// waitForExitWithin is waitForExit, giving up after timeout.
+func waitForExitWithin(db *sql.DB, taskName string, timeout time.Duration) (eventRow, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitForExit(ctx, db, taskName)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// taskFile is a task definition for `fork --file`: the command and the
+// options fork would otherwise take as flags, as a JSON object whose keys are
+// the flags' names with underscores. Durations are strings such as "30s".
+type taskFile struct {
+	TaskName string   `json:"task_name"`
+	Command  []string `json:"command"`
+
+	Shell       bool   `json:"shell"`
+	ShellPath   string `json:"shell_path"`
+	Interpreter string `json:"interpreter"`
+	Expand      bool   `json:"expand"`
+
+	Env      map[string]string `json:"env"`
+	EnvClear bool              `json:"env_clear"`
+	User     string            `json:"user"`
+	Group    string            `json:"group"`
+
+	Sync              bool     `json:"sync"`
+	SyncEvery         int      `json:"sync_every"`
+	Sinks             []string `json:"sinks"`
+	NoHeartbeat       bool     `json:"no_heartbeat"`
+	HeartbeatAdaptive bool     `json:"heartbeat_adaptive"`
+	HeartbeatTouch    bool     `json:"heartbeat_touch"`
+	IOStats           bool     `json:"io_stats"`
+	NoProcStats       bool     `json:"no_proc_stats"`
+	MemMetric         string   `json:"mem_metric"`
+	Sign              bool     `json:"sign"`
+	LogTypes          []string `json:"log_types"`
+
+	MaxEvents      int    `json:"max_events"`
+	MaxTotalBytes  int    `json:"max_total_bytes"`
+	MaxEventBytes  *int   `json:"max_event_bytes"` // nil: unset, so that 0 is caught
+	IdleTimeout    string `json:"idle_timeout"`
+	CoalesceWindow string `json:"coalesce_window"`
+	Delimiter      string `json:"delimiter"`
+	StripANSI      bool   `json:"strip_ansi"`
+
+	InheritFDs []int `json:"inherit_fds"`
+	CaptureFDs []int `json:"capture_fds"`
+
+	WaitFile          string `json:"wait_file"`
+	WaitTimeout       string `json:"wait_timeout"`
+	DetachLogLevel    string `json:"detach_log_level"`
+	OverwriteIfExited bool   `json:"overwrite_if_exited"`
+}
+
+// args returns the flags the definition stands for, the command aside.
+func (f taskFile) args() []string {
+	var args []string
+	str := func(flag, value string) {
+		if value != "" {
+			args = append(args, flag, value)
+		}
+	}
+	flag := func(flag string, set bool) {
+		if set {
+			args = append(args, flag)
+		}
+	}
+	str("--task-name", f.TaskName)
+	flag("--shell", f.Shell)
+	str("--shell-path", f.ShellPath)
+	str("--interpreter", f.Interpreter)
+	flag("--expand", f.Expand)
+	for _, key := range slices.Sorted(maps.Keys(f.Env)) {
+		args = append(args, "--env", key+"="+f.Env[key])
+	}
+	flag("--env-clear", f.EnvClear)
+	str("--user", f.User)
+	str("--group", f.Group)
+	flag("--sync", f.Sync)
+	if f.SyncEvery != 0 {
+		args = append(args, "--sync-every", strconv.Itoa(f.SyncEvery))
+	}
+	for _, spec := range f.Sinks {
+		args = append(args, "--sink", spec)
+	}
+	flag("--no-heartbeat", f.NoHeartbeat)
+	flag("--heartbeat-adaptive", f.HeartbeatAdaptive)
+	flag("--heartbeat-touch", f.HeartbeatTouch)
+	flag("--io-stats", f.IOStats)
+	flag("--no-proc-stats", f.NoProcStats)
+	str("--mem-metric", f.MemMetric)
+	flag("--sign", f.Sign)
+	if f.LogTypes != nil {
+		args = append(args, "--log-types", strings.Join(f.LogTypes, ","))
+	}
+	if f.MaxEvents != 0 {
+		args = append(args, "--max-events", strconv.Itoa(f.MaxEvents))
+	}
+	if f.MaxTotalBytes != 0 {
+		args = append(args, "--max-total-bytes", strconv.Itoa(f.MaxTotalBytes))
+	}
+	if f.MaxEventBytes != nil {
+		args = append(args, "--max-event-bytes", strconv.Itoa(*f.MaxEventBytes))
+	}
+	str("--idle-timeout", f.IdleTimeout)
+	str("--coalesce-window", f.CoalesceWindow)
+	str("--delimiter", f.Delimiter)
+	flag("--strip-ansi", f.StripANSI)
+	for _, fd := range f.InheritFDs {
+		args = append(args, "--inherit-fd", strconv.Itoa(fd))
+	}
+	for _, fd := range f.CaptureFDs {
+		args = append(args, "--capture-fd", strconv.Itoa(fd))
+	}
+	str("--wait-file", f.WaitFile)
+	str("--wait-timeout", f.WaitTimeout)
+	str("--detach-log-level", f.DetachLogLevel)
+	flag("--overwrite-if-exited", f.OverwriteIfExited)
+	return args
+}
+
+// readTaskFile loads a --file definition, rejecting keys it doesn't know
+// (a misspelt option would otherwise be silently ignored) and values the
+// flags they stand for wouldn't accept. Definitions are JSON only: bgx has
+// no YAML or TOML parser, and a file named as one is refused up front rather
+// than failing on its first line.
+func readTaskFile(path string) (taskFile, error) {
+	var f taskFile
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml", ".toml":
+		return f, fmt.Errorf("invalid task file %s: only JSON task definitions are supported, not %s", path, strings.ToUpper(ext[1:]))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return f, fmt.Errorf("failed to read task file: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return f, fmt.Errorf("invalid task file %s: %s", path, strings.TrimPrefix(err.Error(), "json: "))
+	}
+	if dec.More() {
+		return f, fmt.Errorf("invalid task file %s: more than one JSON value", path)
+	}
+	if f.MaxEventBytes != nil && *f.MaxEventBytes < minEventBytes {
+		return f, fmt.Errorf("invalid task file %s: max_event_bytes %d: must be a byte count of at least %d", path, *f.MaxEventBytes, minEventBytes)
+	}
+	// Check the values on their own, so that an error is blamed on the file.
+	check := append(f.args(), "--task-name", "-", "--", "true")
+	if _, _, _, err := parseForkArgs(check); err != nil {
+		return f, fmt.Errorf("invalid task file %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// expandTaskFile replaces a --file PATH among fork's arguments with the flags
+// the definition stands for, placed first so that flags given on the command
+// line override them, and appends the file's command unless one is given
+// (after -- or with --command-file). A repeatable flag on the command line
+// would add to the file's list instead, so the file's is left out: the
+// command line's --env, --sink, --inherit-fd or --capture-fd list replaces
+// it.
+func expandTaskFile(args []string) ([]string, error) {
+	end := slices.Index(args, "--")
+	if end < 0 {
+		end = len(args)
+	}
+	i := slices.Index(args[:end], "--file")
+	if i < 0 {
+		return args, nil
+	}
+	if i+1 >= end {
+		return nil, fmt.Errorf("--file requires an argument")
+	}
+	if slices.Contains(args[i+2:end], "--file") {
+		return nil, fmt.Errorf("--file given twice")
+	}
+	f, err := readTaskFile(args[i+1])
+	if err != nil {
+		return nil, err
+	}
+	given := append(slices.Clone(args[:i]), args[i+2:end]...)
+	if slices.Contains(given, "--env") {
+		f.Env = nil
+	}
+	if slices.Contains(given, "--sink") {
+		f.Sinks = nil
+	}
+	if slices.Contains(given, "--inherit-fd") {
+		f.InheritFDs = nil
+	}
+	if slices.Contains(given, "--capture-fd") {
+		f.CaptureFDs = nil
+	}
+	expanded := append(f.args(), args[:i]...)
+	expanded = append(expanded, args[i+2:]...)
+	if end == len(args) && !slices.Contains(args, "--command-file") && len(f.Command) > 0 {
+		expanded = append(append(expanded, "--"), f.Command...)
+	}
+	return expanded, nil
+}
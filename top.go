@@ -0,0 +1,168 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// topConfig holds the options for top.
+type topConfig struct {
+	watch   bool
+	sort    string // "name", "start" (default), "cpu", "mem" or "status"
+	reverse bool
+}
+
+// parseTopArgs parses `top` arguments of the form:
+//
+//	[--watch] [--sort name|start|cpu|mem|status] [--reverse]
+func parseTopArgs(args []string) (topConfig, error) {
+	cfg := topConfig{sort: "start"}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--watch":
+			cfg.watch = true
+		case "--sort":
+			if i+1 >= len(args) {
+				return cfg, fmt.Errorf("--sort requires an argument")
+			}
+			switch args[i+1] {
+			case "name", "start", "cpu", "mem", "status":
+				cfg.sort = args[i+1]
+			default:
+				return cfg, fmt.Errorf("invalid --sort %q: must be name, start, cpu, mem or status", args[i+1])
+			}
+			i++
+		case "--reverse":
+			cfg.reverse = true
+		default:
+			return cfg, fmt.Errorf("unexpected argument %q\nUsage: bgx top [--watch] [--sort name|start|cpu|mem|status] [--reverse]", args[i])
+		}
+	}
+	return cfg, nil
+}
+
+// stateRank orders task states for --sort status: running tasks first, then
+// paused ones, those yet to start, and stalled ones.
+var stateRank = map[string]int{"running": 0, "paused": 1, "starting": 2, "stalled": 3}
+
+// sortTasks orders the rows of top by cfg.sort: names alphabetically, the
+// newest start first (a task that hasn't started counts as newest), the most
+// CPU time or memory first, or by state. Ties keep the order the tasks were
+// created in. --reverse flips the whole order.
+func sortTasks(summaries []taskSummary, cfg topConfig, now time.Time) {
+	var compare func(a, b taskSummary) int
+	switch cfg.sort {
+	case "name":
+		compare = func(a, b taskSummary) int { return strings.Compare(a.Name, b.Name) }
+	case "start":
+		compare = func(a, b taskSummary) int {
+			switch {
+			case !a.Started && b.Started:
+				return -1
+			case a.Started && !b.Started:
+				return 1
+			}
+			return b.StartTime.Compare(a.StartTime)
+		}
+	case "cpu":
+		compare = func(a, b taskSummary) int { return cmp.Compare(b.CPUSeconds, a.CPUSeconds) }
+	case "mem":
+		compare = func(a, b taskSummary) int { return cmp.Compare(b.MemBytes, a.MemBytes) }
+	case "status":
+		compare = func(a, b taskSummary) int {
+			return cmp.Compare(stateRank[strings.Fields(a.state(now))[0]], stateRank[strings.Fields(b.state(now))[0]])
+		}
+	}
+	slices.SortStableFunc(summaries, compare)
+	if cfg.reverse {
+		slices.Reverse(summaries)
+	}
+}
+
+// runTop prints the latest CPU and memory sample of every task that hasn't
+// exited, in --sort order, followed by their totals. With --watch it redraws
+// every HeartbeatInterval, the rate at which samples change, until
+// interrupted.
+func runTop(args []string) error {
+	cfg, err := parseTopArgs(args)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	clear := cfg.watch && isTerminal(os.Stdout)
+	for {
+		names, err := listTasks(db)
+		if err != nil {
+			return fmt.Errorf("failed to list tasks: %w", err)
+		}
+		var summaries []taskSummary
+		for _, name := range names {
+			s, err := readTaskSummary(db, name)
+			if err != nil {
+				return fmt.Errorf("failed to read task %q: %w", name, err)
+			}
+			if !s.Exited {
+				summaries = append(summaries, s)
+			}
+		}
+
+		now := time.Now()
+		sortTasks(summaries, cfg, now)
+		if clear {
+			fmt.Print("\x1b[H\x1b[2J")
+		}
+		printTop(summaries, now)
+		if !cfg.watch {
+			return nil
+		}
+		time.Sleep(HeartbeatInterval)
+		if !clear {
+			fmt.Println()
+		}
+	}
+}
+
+// printTop writes one row per task and a totals row. Only tasks that are
+// running count towards the totals: a stalled task's last sample is from a
+// process that is most likely gone.
+func printTop(summaries []taskSummary, now time.Time) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tSTATE\tPID\tCPU\tMEM")
+	var running int
+	var cpu float64
+	var mem int64
+	for _, s := range summaries {
+		state := s.state(now)
+		if !s.Started {
+			fmt.Fprintf(w, "%s\t%s\t\t\t\n", s.Name, state)
+			continue
+		}
+		if s.NoProcStats {
+			fmt.Fprintf(w, "%s\t%s\t%d\t-\t-\n", s.Name, strings.SplitN(state, " ", 2)[0], s.PID)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%.2fs\t%s\n", s.Name, strings.SplitN(state, " ", 2)[0], s.PID, s.CPUSeconds, formatBytes(s.MemBytes)+s.memLabel())
+		}
+		if state == "running" {
+			running++
+			cpu += s.CPUSeconds
+			mem += s.MemBytes
+		}
+	}
+	total := "0 B"
+	if mem > 0 {
+		total = formatBytes(mem)
+	}
+	fmt.Fprintf(w, "TOTAL\t%d running\t\t%.2fs\t%s\n", running, cpu, total)
+	w.Flush()
+}
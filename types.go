@@ -1,24 +1,92 @@
 package main
 
-import "time"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
 
 // Event is a single record in a task's log. Each event is stored as one row
-// in the SQLite `events` table.
+// in the SQLite `events` table; the JSON names (used by --sink) match the
+// column names.
 type Event struct {
-	Type string
-	Time time.Time
-	Data string
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data string    `json:"data,omitempty"`
+	FD   int       `json:"fd,omitempty"` // fd events: the command's descriptor the data was written to
 
 	// Start event fields
-	PID     int
-	Command []string
+	V              int      `json:"v,omitempty"`           // LogSchemaVersion of the bgx that recorded the task (0: 1)
+	BgxVersion     string   `json:"bgx_version,omitempty"` // buildID of the bgx that recorded the task
+	PID            int      `json:"pid,omitempty"`
+	Command        []string `json:"command,omitempty"`
+	NoHeartbeat    bool     `json:"no_heartbeat,omitempty"`    // no heartbeat events will follow
+	LogTypes       string   `json:"log_types,omitempty"`       // --log-types: comma-separated types persisted ("" = all)
+	InheritFDs     []int    `json:"inherit_fds,omitempty"`     // --inherit-fd: descriptors passed on, as numbered by the caller
+	Interpreter    string   `json:"interpreter,omitempty"`     // shell mode: the words before the script in Command
+	EnvClear       bool     `json:"env_clear,omitempty"`       // --env-clear: the command didn't inherit bgx's environment
+	MemMetric      string   `json:"mem_metric,omitempty"`      // what heartbeats' MemBytes measures: MemMetricPSS, or "" for RSS
+	NoProcStats    bool     `json:"no_proc_stats,omitempty"`   // --no-proc-stats: heartbeats carry no CPU or memory samples
+	HeartbeatTouch bool     `json:"heartbeat_touch,omitempty"` // --heartbeat-touch: liveness is the heartbeat file's mtime (NoHeartbeat is set too)
+	Signed         bool     `json:"signed,omitempty"`          // --sign: the task's events carry HMACs, so a log without them was stripped
+	UID            *int     `json:"uid,omitempty"`             // the uid and gid the command ran as (nil: not recorded, as on Windows)
+	GID            *int     `json:"gid,omitempty"`
+
+	// Exit event fields (with CPUSeconds: the total at exit). Code is only
+	// omitted from the JSON of other events; see MarshalJSON.
+	Code         int   `json:"code,omitempty"`
+	PeakMemBytes int64 `json:"peak_mem_bytes,omitempty"` // highest MemBytes across heartbeats
+
+	// Exit event fields: the kernel's accounting of the command when it was
+	// reaped (getrusage): CPU time split into user and system, and its
+	// highest resident memory (0 where not reported, as on Windows).
+	UserSeconds   float64 `json:"user_seconds,omitempty"`
+	SystemSeconds float64 `json:"system_seconds,omitempty"`
+	MaxRSSBytes   int64   `json:"max_rss_bytes,omitempty"`
+
+	// Exit event fields: how the command ended, in words ("exited normally",
+	// "segfault (SIGSEGV)"), and the signal that killed it, if any.
+	ExitReason string `json:"exit_reason,omitempty"`
+	ExitSignal string `json:"exit_signal,omitempty"`
 
-	// Exit event fields
-	Code int
+	// Exit event fields: how much the command wrote to each stream, in bytes
+	// and in lines (records, with --delimiter; a final unterminated one
+	// counts too).
+	StdoutBytes int64 `json:"stdout_bytes,omitempty"`
+	StderrBytes int64 `json:"stderr_bytes,omitempty"`
+	StdoutLines int64 `json:"stdout_lines,omitempty"`
+	StderrLines int64 `json:"stderr_lines,omitempty"`
 
 	// Heartbeat event fields
-	CPUSeconds float64
-	MemBytes   int64
+	CPUSeconds float64 `json:"cpu_seconds,omitempty"`
+	MemBytes   int64   `json:"mem_bytes,omitempty"`
+
+	// IntervalSeconds is, with --heartbeat-adaptive, the longest the next
+	// heartbeat may take; 0 means HeartbeatInterval.
+	IntervalSeconds float64 `json:"interval_seconds,omitempty"`
+
+	// --io-stats: cumulative storage I/O, on heartbeats and (as last sampled)
+	// the exit event
+	ReadBytes  int64 `json:"read_bytes,omitempty"`
+	WriteBytes int64 `json:"write_bytes,omitempty"`
+
+	// HMAC is set on every event of a task forked with --sign: a hex
+	// HMAC-SHA256 over the event, chained to the previous event's HMAC.
+	HMAC string `json:"hmac,omitempty"`
+}
+
+// MarshalJSON encodes the event with its JSON field names. An exit event
+// always includes code, even when it is 0, so that a consumer can tell a clean
+// exit from an event that has no exit code at all.
+func (e Event) MarshalJSON() ([]byte, error) {
+	type fields Event // the same fields, without this method
+	if e.Type != EventTypeExit {
+		return json.Marshal(fields(e))
+	}
+	return json.Marshal(struct {
+		fields
+		Code int `json:"code"` // shadows the embedded omitempty field
+	}{fields(e), e.Code})
 }
 
 const (
@@ -27,12 +95,95 @@ const (
 	EventTypeStderr    = "stderr"
 	EventTypeHeartbeat = "heartbeat"
 	EventTypeExit      = "exit"
+
+	// EventTypeKill records that bgx signalled the task's process, with the
+	// reason in Data. The exit event that follows records how it ended.
+	EventTypeKill = "kill"
+
+	// EventTypeAccess records, with --audit, that someone ran a bgx command
+	// against the task; Data says what and who. It can follow the exit event.
+	EventTypeAccess = "access"
+
+	// EventTypeLimitExceeded records that the daemon stopped the task for
+	// exceeding a limit such as --max-events, described in Data.
+	EventTypeLimitExceeded = "limit-exceeded"
+
+	// EventTypeTruncated records that the daemon stopped recording the task's
+	// output on reaching --max-total-bytes, described in Data. The command
+	// keeps running; its exit event still counts everything it wrote.
+	EventTypeTruncated = "truncated"
+
+	// EventTypeIdleTimeout records that the daemon stopped the task for
+	// writing no output for --idle-timeout, described in Data.
+	EventTypeIdleTimeout = "idle-timeout"
+
+	// EventTypeFD records output the command wrote to a descriptor captured
+	// with --capture-fd, whose number is in FD.
+	EventTypeFD = "fd"
+
+	// EventTypeError records a problem the daemon ran into and carried on
+	// from, such as a sink it can't reach or /proc it can't read, described
+	// in Data. The task itself is unaffected.
+	EventTypeError = "error"
+
+	// EventTypePause and EventTypeResume record that `bgx pause` stopped the
+	// task's process and `bgx resume` continued it. Data says which signal.
+	EventTypePause  = "pause"
+	EventTypeResume = "resume"
+
+	// EventTypeReady records that the file named by --wait-file, in Data,
+	// appeared: the command said it is ready, which may be well after start.
+	EventTypeReady = "ready"
 )
 
+// LogSchemaVersion is the version of the log format this bgx writes, recorded
+// in each start event's v; a log without one is version 1. It is bumped only
+// when a change means an older bgx would misread a log, not for every added
+// field, since unknown columns and JSON fields are simply ignored.
+const LogSchemaVersion = 1
+
+// newerSchemaWarning returns a warning to print if a task's start event says
+// it was recorded with a newer log schema than this bgx understands, or ""
+// if it wasn't.
+func newerSchemaWarning(taskName string, v int) string {
+	if v <= LogSchemaVersion {
+		return ""
+	}
+	return fmt.Sprintf("bgx: warning: task %q was recorded by a newer bgx (log schema v%d; this bgx understands up to v%d), so some of it may be misread; upgrade bgx to read it reliably", taskName, v, LogSchemaVersion)
+}
+
+// stallTimeout returns how long a task may go without events before it
+// counts as stalled: timeout, plus however much longer than usual its latest
+// heartbeat said the next one may take (--heartbeat-adaptive).
+func stallTimeout(timeout, announced time.Duration) time.Duration {
+	if announced > HeartbeatInterval {
+		return timeout + announced - HeartbeatInterval
+	}
+	return timeout
+}
+
+// MaxEventBytes is the default cap on one event's data. The daemon splits
+// longer output lines into several events, and join refuses to load larger
+// ones, so neither side buffers an unbounded line in memory.
+const MaxEventBytes = 1 << 20
+
 const (
 	HeartbeatInterval = 5 * time.Second
 	HeartbeatTimeout  = 30 * time.Second
 
+	// HeartbeatMaxInterval caps how far --heartbeat-adaptive spaces out the
+	// heartbeats of a quiet command.
+	HeartbeatMaxInterval = 5 * time.Minute
+
+	// HeartbeatJitter is how far, as a fraction of HeartbeatInterval, each
+	// gap between heartbeats may randomly run early or late; see jitter.
+	HeartbeatJitter = 0.1
+
 	// JoinPollInterval is how often `join` polls the database for new events.
 	JoinPollInterval = 100 * time.Millisecond
+
+	// KillDrainWindow is how long the daemon keeps reading a command's output
+	// after killing it (--max-events, --idle-timeout) before giving up on
+	// output pipes that a surviving child process still holds open.
+	KillDrainWindow = 2 * time.Second
 )
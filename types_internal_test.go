@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExitCodeZeroJSON verifies an exit event keeps its code in JSON even
+// when it is 0, while other events still leave it out.
+func TestExitCodeZeroJSON(t *testing.T) {
+	exit := Event{Type: EventTypeExit, Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b, err := json.Marshal(exit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"code":0`) {
+		t.Errorf("exit event JSON %s should include code 0", b)
+	}
+
+	var fields map[string]any
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if code, ok := fields["code"]; !ok || code != 0.0 {
+		t.Errorf("decoded code = %v (present: %v), want 0", code, ok)
+	}
+	var back Event
+	if err := json.Unmarshal(b, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Type != EventTypeExit || back.Code != 0 || !back.Time.Equal(exit.Time) {
+		t.Errorf("round trip = %+v, want %+v", back, exit)
+	}
+
+	b, err = json.Marshal(Event{Type: EventTypeStdout, Data: "hi\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `"code"`) {
+		t.Errorf("stdout event JSON %s should not include code", b)
+	}
+}
+
+// TestSinkEventJSON verifies a sink line carries the task alongside the
+// event's fields, including an exit code of 0.
+func TestSinkEventJSON(t *testing.T) {
+	b, err := json.Marshal(sinkEvent{Task: "build", Event: Event{Type: EventTypeExit}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatalf("sink line %s is not valid JSON: %v", b, err)
+	}
+	if fields["task"] != "build" || fields["type"] != EventTypeExit || fields["code"] != 0.0 {
+		t.Errorf("sink line = %s, want task, type and code 0", b)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// WaitTimeoutExitCode is what `wait` exits with when the task didn't exit
+	// in time, whether or not it was killed (as with coreutils' timeout).
+	WaitTimeoutExitCode = 124
+
+	// KillGracePeriod is how long `wait --on-timeout kill` waits for the exit
+	// event after signalling the task.
+	KillGracePeriod = 10 * time.Second
+)
+
+// waitConfig holds the options for a wait.
+type waitConfig struct {
+	timeout   time.Duration // 0: wait indefinitely
+	onTimeout string        // "return" (default) or "kill"
+	audit     bool          // record an access event in the task's log
+
+	resultFile string // write the task's outcome here as JSON (empty: don't)
+}
+
+// parseWaitArgs parses `wait` arguments of the form:
+//
+//	--task-name NAME [--timeout DURATION] [--on-timeout return|kill] [--audit] [--result-file PATH]
+func parseWaitArgs(args []string) (string, waitConfig, error) {
+	var taskName string
+	cfg := waitConfig{onTimeout: "return"}
+	onTimeoutSet, timeoutSet := false, false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--task-name":
+			if i+1 >= len(args) {
+				return "", cfg, fmt.Errorf("--task-name requires an argument")
+			}
+			taskName = args[i+1]
+			i++
+		case "--timeout":
+			if i+1 >= len(args) {
+				return "", cfg, fmt.Errorf("--timeout requires an argument")
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d < 0 {
+				return "", cfg, fmt.Errorf("invalid --timeout %q: must be a duration such as 30s or 5m, or 0 for none", args[i+1])
+			}
+			cfg.timeout = d
+			timeoutSet = true
+			i++
+		case "--on-timeout":
+			if i+1 >= len(args) {
+				return "", cfg, fmt.Errorf("--on-timeout requires an argument")
+			}
+			switch args[i+1] {
+			case "return", "kill":
+				cfg.onTimeout = args[i+1]
+			default:
+				return "", cfg, fmt.Errorf("invalid --on-timeout %q: must be return or kill", args[i+1])
+			}
+			onTimeoutSet = true
+			i++
+		case "--audit":
+			cfg.audit = true
+		case "--result-file":
+			if i+1 >= len(args) {
+				return "", cfg, fmt.Errorf("--result-file requires an argument")
+			}
+			cfg.resultFile = args[i+1]
+			i++
+		default:
+			return "", cfg, fmt.Errorf("unexpected argument %q\nUsage: bgx wait --task-name NAME [--timeout DURATION] [--on-timeout return|kill] [--audit] [--result-file PATH]", args[i])
+		}
+	}
+	if taskName == "" {
+		return "", cfg, fmt.Errorf("--task-name is required")
+	}
+	if !timeoutSet {
+		d, err := envDuration(TimeoutEnv)
+		if err != nil {
+			return "", cfg, err
+		}
+		cfg.timeout = d
+	}
+	if onTimeoutSet && cfg.timeout == 0 {
+		return "", cfg, fmt.Errorf("--on-timeout requires --timeout")
+	}
+	return taskName, cfg, nil
+}
+
+// runWait blocks until a task exits, without replaying its output, and
+// returns its exit code. With --timeout it gives up after that long, first
+// killing the task if --on-timeout kill was given, and returns
+// WaitTimeoutExitCode. Either way, --result-file then gets the outcome.
+func runWait(args []string) (int, error) {
+	taskName, cfg, err := parseWaitArgs(args)
+	if err != nil {
+		return 1, err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return 1, err
+	}
+	defer db.Close()
+
+	exists, err := taskExists(db, taskName)
+	if err != nil {
+		return 1, fmt.Errorf("failed to look up task: %w", err)
+	}
+	if !exists {
+		return 1, fmt.Errorf("task %q not found (BGX_DB=%s)", taskName, getDBPath())
+	}
+	if cfg.audit {
+		if err := recordAccess(db, taskName, "wait"); err != nil {
+			return 1, err
+		}
+	}
+
+	ctx := context.Background()
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+	}
+	exit, err := waitForExit(ctx, db, taskName)
+	code, timedOut := exit.Code, false
+	switch {
+	case err == nil:
+	case !errors.Is(err, context.DeadlineExceeded):
+		return 1, err
+	default:
+		timedOut = true
+		fmt.Fprintf(os.Stderr, "bgx: task %q did not exit within %v\n", taskName, cfg.timeout)
+		code = WaitTimeoutExitCode
+		if cfg.onTimeout == "kill" {
+			if code, err = killOnTimeout(db, taskName, cfg.timeout); err != nil {
+				return code, err
+			}
+		}
+	}
+	if cfg.resultFile != "" {
+		if err := writeResultFile(cfg.resultFile, db, []string{taskName}, []bool{timedOut}); err != nil {
+			return 1, err
+		}
+	}
+	return code, nil
+}
+
+// killOnTimeout terminates a task that outlived wait's --timeout and waits up
+// to KillGracePeriod for its exit event. If the task turns out to have exited
+// on its own in the meantime, its exit code is returned as usual.
+func killOnTimeout(db *sql.DB, taskName string, timeout time.Duration) (int, error) {
+	s, err := readTaskSummary(db, taskName)
+	if err != nil {
+		return 1, fmt.Errorf("failed to read task %q: %w", taskName, err)
+	}
+	if !s.Started {
+		fmt.Fprintf(os.Stderr, "bgx: task %q has no process yet; nothing to kill\n", taskName)
+		return WaitTimeoutExitCode, nil
+	}
+	if s.Exited {
+		return s.ExitCode, nil
+	}
+
+	signalErr := signalTask(db, taskName, s.PID, terminateSignal, fmt.Sprintf("bgx wait: timed out after %v", timeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), KillGracePeriod)
+	defer cancel()
+	exit, err := waitForExit(ctx, db, taskName)
+	switch {
+	case signalErr != nil && err == nil:
+		return exit.Code, nil // it exited just before the signal could land
+	case signalErr != nil:
+		return 1, signalErr
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "bgx: task %q was signalled but has not exited yet: %v\n", taskName, err)
+	}
+	return WaitTimeoutExitCode, nil
+}
+
+// waitForExit polls a task's events until its exit event, which it returns.
+// Like join, it gives up with an error if the task (unless it was forked
+// without heartbeats) goes quiet for HeartbeatTimeout, or longer if its
+// latest heartbeat announced a longer wait, counting touches of a
+// --heartbeat-touch task's heartbeat file as events, and it returns
+// ctx.Err() once ctx is done.
+func waitForExit(ctx context.Context, db *sql.DB, taskName string) (eventRow, error) {
+	var lastID int64
+	lastEventTime := time.Now()
+	heartbeats, touched := true, false
+	var announced time.Duration // by the latest heartbeat
+
+	for {
+		events, err := readEventsAfter(db, taskName, lastID, MaxEventBytes) // output is ignored
+		if err != nil {
+			return eventRow{}, fmt.Errorf("failed to read events for %q: %w", taskName, err)
+		}
+		for _, e := range events {
+			lastID = e.ID
+			switch e.Type {
+			case EventTypeStart:
+				heartbeats, touched = !e.NoHeartbeat || e.HeartbeatTouch, e.HeartbeatTouch
+			case EventTypeHeartbeat:
+				announced = time.Duration(e.Interval * float64(time.Second))
+			case EventTypeExit:
+				return e, nil
+			}
+		}
+
+		if touched {
+			lastEventTime = latest(lastEventTime, heartbeatFileTime(taskName))
+		}
+		if len(events) > 0 {
+			lastEventTime = time.Now()
+		} else if timeout := stallTimeout(HeartbeatTimeout, announced); heartbeats && time.Since(lastEventTime) > timeout {
+			return eventRow{}, fmt.Errorf("heartbeat timeout: no events from task %q for %v", taskName, timeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return eventRow{}, ctx.Err()
+		case <-time.After(JoinPollInterval):
+		}
+	}
+}
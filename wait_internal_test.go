@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestWaitForExit verifies waitForExit returns a task's exit event once it
+// is recorded, and gives up with the context's error on a timeout or when
+// cancelled, promptly in each case.
+func TestWaitForExit(t *testing.T) {
+	t.Setenv("BGX_DB", filepath.Join(t.TempDir(), "bgx.db"))
+	db, err := openDB()
+	if err != nil {
+		t.Fatalf("openDB: %v", err)
+	}
+	defer db.Close()
+	record := func(taskName string, e Event) {
+		t.Helper()
+		e.Time = time.Now()
+		if err := insertEvent(db, taskName, e); err != nil {
+			t.Fatalf("insertEvent: %v", err)
+		}
+	}
+	for _, taskName := range []string{"exits", "runs"} {
+		record(taskName, Event{Type: EventTypeStart, PID: 1, Command: []string{"sleep", "1"}})
+		record(taskName, Event{Type: EventTypeStdout, Data: "working\n"})
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		if err := insertEvent(db, "exits", Event{Type: EventTypeExit, Time: time.Now(), Code: 7}); err != nil {
+			t.Errorf("insertEvent: %v", err)
+		}
+	}()
+	exit, err := waitForExitWithin(db, "exits", 5*time.Second)
+	if err != nil || exit.Type != EventTypeExit || exit.Code != 7 {
+		t.Errorf("waitForExit = %+v, %v; want the exit event with code 7", exit, err)
+	}
+
+	start := time.Now()
+	_, err = waitForExitWithin(db, "runs", 300*time.Millisecond)
+	if elapsed := time.Since(start); !errors.Is(err, context.DeadlineExceeded) || elapsed > time.Second {
+		t.Errorf("waitForExit on a running task = %v after %v, want a deadline error after 300ms", err, elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start = time.Now()
+	_, err = waitForExit(ctx, db, "runs")
+	if elapsed := time.Since(start); !errors.Is(err, context.Canceled) || elapsed > time.Second {
+		t.Errorf("waitForExit after cancel = %v after %v, want context.Canceled after 200ms", err, elapsed)
+	}
+}